@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/amartorelli/nsq_exporter/pkg/collector"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	allowlistFile          = flag.String("allowlist.file", "", "Path to a YAML file listing the only topics and channels exported, applied on top of the --filter.* flags. It is re-read when it changes.")
+	allowlistCheckInterval = flag.Duration("allowlist.check-interval", 10*time.Second, "Interval at which --allowlist.file is checked for changes.")
+)
+
+// checkAllowlistFlags validates the --allowlist.* flags.
+func checkAllowlistFlags() error {
+	if *allowlistFile != "" && *allowlistCheckInterval <= 0 {
+		return fmt.Errorf("--allowlist.check-interval must be positive, got %s", *allowlistCheckInterval)
+	}
+	return nil
+}
+
+// allowlistConfig is the content of --allowlist.file.
+type allowlistConfig struct {
+	Allow []collector.AllowRule `yaml:"allow"`
+}
+
+// loadAllowlist reads the allowlist at path.
+func loadAllowlist(path string) (*collector.Allowlist, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read allowlist file: %v", err)
+	}
+	var cfg allowlistConfig
+	if err := yaml.UnmarshalStrict(b, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse allowlist file %s: %v", path, err)
+	}
+	a, err := collector.NewAllowlist(cfg.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allowlist file %s: %v", path, err)
+	}
+	return a, nil
+}
+
+// watchAllowlist applies --allowlist.file to c again whenever its
+// modification time changes, until stop is closed. Invalid versions are
+// logged and the previous one is kept.
+func watchAllowlist(logger *slog.Logger, c *collector.Collector, stop <-chan struct{}) {
+	last, _ := modTime(*allowlistFile)
+	ticker := time.NewTicker(*allowlistCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		mod, err := modTime(*allowlistFile)
+		if err != nil {
+			logger.Error("Error checking allowlist file", "err", err)
+			continue
+		}
+		if mod.Equal(last) {
+			continue
+		}
+		last = mod
+		a, err := loadAllowlist(*allowlistFile)
+		if err != nil {
+			logger.Error("Error reloading allowlist, keeping the previous one", "err", err)
+			continue
+		}
+		c.SetAllowlist(a)
+		logger.Info("Allowlist reloaded", "file", *allowlistFile)
+	}
+}
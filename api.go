@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/amartorelli/nsq_exporter/pkg/collector"
+	"github.com/amartorelli/nsq_exporter/pkg/nsqhttp"
+)
+
+// metricsAPIHandler serves the stats last fetched from every target as
+// JSON, keyed by node.
+func metricsAPIHandler(c *collector.Collector) http.Handler {
+	type node struct {
+		URL       string               `json:"url"`
+		Up        bool                 `json:"up"`
+		Error     string               `json:"error,omitempty"`
+		FetchedAt *time.Time           `json:"fetched_at,omitempty"`
+		Version   string               `json:"version,omitempty"`
+		Topics    []nsqhttp.TopicStats `json:"topics"`
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		out := make(map[string]node)
+		for _, t := range c.Targets() {
+			status := t.Status()
+			n := node{
+				URL:    t.Endpoint().URL,
+				Up:     !status.LastScrape.IsZero() && status.Err == nil,
+				Topics: []nsqhttp.TopicStats{},
+			}
+			if status.Err != nil {
+				n.Error = status.Err.Error()
+			}
+			if stats, fetchedAt := t.LastStats(); stats != nil {
+				n.FetchedAt = &fetchedAt
+				n.Version = stats.Version
+				n.Topics = stats.Topics
+			}
+			out[t.Endpoint().Node] = n
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(out)
+	})
+}
+
+// topicsAPIHandler serves the topics and channels last seen on every
+// target as JSON, with their depths and client counts summed across nodes.
+// Topics and channels are paused if they are on any node.
+func topicsAPIHandler(c *collector.Collector) http.Handler {
+	type channel struct {
+		Channel       string `json:"channel"`
+		Depth         int64  `json:"depth"`
+		InFlightCount int64  `json:"in_flight_count"`
+		ClientCount   int    `json:"client_count"`
+		Paused        bool   `json:"paused"`
+	}
+	type topic struct {
+		Topic    string     `json:"topic"`
+		Nodes    []string   `json:"nodes"`
+		Depth    int64      `json:"depth"`
+		Paused   bool       `json:"paused"`
+		Channels []*channel `json:"channels"`
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		topics := make(map[string]*topic)
+		channels := make(map[[2]string]*channel)
+		for _, t := range c.Targets() {
+			stats, _ := t.LastStats()
+			if stats == nil {
+				continue
+			}
+			for _, ts := range stats.Topics {
+				tp, ok := topics[ts.TopicName]
+				if !ok {
+					tp = &topic{Topic: ts.TopicName, Channels: []*channel{}}
+					topics[ts.TopicName] = tp
+				}
+				tp.Nodes = append(tp.Nodes, t.Endpoint().Node)
+				tp.Depth += ts.Depth + ts.BackendDepth
+				tp.Paused = tp.Paused || ts.Paused
+				for _, cs := range ts.Channels {
+					key := [2]string{ts.TopicName, cs.ChannelName}
+					ch, ok := channels[key]
+					if !ok {
+						ch = &channel{Channel: cs.ChannelName}
+						channels[key] = ch
+						tp.Channels = append(tp.Channels, ch)
+					}
+					ch.Depth += cs.Depth + cs.BackendDepth
+					ch.InFlightCount += cs.InFlightCount
+					ch.ClientCount += cs.ClientCount
+					ch.Paused = ch.Paused || cs.Paused
+				}
+			}
+		}
+
+		out := struct {
+			Topics []*topic `json:"topics"`
+		}{Topics: make([]*topic, 0, len(topics))}
+		for _, tp := range topics {
+			sort.Strings(tp.Nodes)
+			sort.Slice(tp.Channels, func(i, j int) bool { return tp.Channels[i].Channel < tp.Channels[j].Channel })
+			out.Topics = append(out.Topics, tp)
+		}
+		sort.Slice(out.Topics, func(i, j int) bool { return out.Topics[i].Topic < out.Topics[j].Topic })
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(out)
+	})
+}
+
+// targetsAPIHandler serves the targets of c as JSON, with where they come
+// from and the outcome of their last scrape.
+func targetsAPIHandler(c *collector.Collector) http.Handler {
+	type target struct {
+		Node   string `json:"node"`
+		URL    string `json:"url"`
+		Source string `json:"source"`
+		// ServedBy is the node the stats last came from, the target's or
+		// its fallback's, for targets with a fallback.
+		ServedBy string `json:"served_by,omitempty"`
+		// Cluster is the name of the cluster of the target, if any.
+		Cluster string `json:"cluster,omitempty"`
+		// Health is up or down after the first scrape, unknown before.
+		Health      string     `json:"health"`
+		LastScrape  *time.Time `json:"last_scrape,omitempty"`
+		Duration    float64    `json:"last_scrape_duration_seconds"`
+		Error       string     `json:"error,omitempty"`
+		ErrorReason string     `json:"error_reason,omitempty"`
+		CircuitOpen bool       `json:"circuit_open"`
+		Topics      int        `json:"topics"`
+		Channels    int        `json:"channels"`
+
+		ConsecutiveFailures uint64 `json:"consecutive_failures"`
+		Degraded            bool   `json:"degraded"`
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		out := struct {
+			Targets []target `json:"targets"`
+		}{Targets: []target{}}
+		for _, t := range c.Targets() {
+			status := t.Status()
+			tg := target{
+				Node:        t.Endpoint().Node,
+				URL:         t.Endpoint().URL,
+				Source:      targetSource(t),
+				Cluster:     targetCluster(t),
+				Health:      "unknown",
+				Duration:    status.Duration.Seconds(),
+				CircuitOpen: status.CircuitOpen,
+				Topics:      status.Topics,
+				Channels:    status.Channels,
+
+				ConsecutiveFailures: status.ConsecutiveFailures,
+				Degraded:            status.Degraded,
+			}
+			if served := t.ServedBy(); t.Fallback() != nil && served != nil {
+				tg.ServedBy = served.Node
+			}
+			if !status.LastScrape.IsZero() {
+				tg.LastScrape = &status.LastScrape
+				tg.Health = "up"
+			}
+			if status.Err != nil {
+				tg.Health = "down"
+				tg.Error = status.Err.Error()
+				tg.ErrorReason = nsqhttp.ErrorReason(status.Err)
+				if errors.Is(status.Err, collector.ErrCircuitOpen) {
+					tg.ErrorReason = "circuit_open"
+				}
+			}
+			out.Targets = append(out.Targets, tg)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(out)
+	})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+var (
+	webMetricsToken = secretFlag("web.metrics-token", "Bearer token required to scrape <web.path>, its clusters and the views without credentials of their own, and by the other endpoints serving the topics and channels: /api/v1/metrics, /api/v1/topics, /api/v1/history and /events.")
+	webAdminToken   = secretFlag("web.admin-token", "Bearer token required by the admin endpoints: /-/reload, /-/quit, /-/config, /status, /api/v1/targets and /debug/.")
+)
+
+// checkAuthFlags validates the tokens of the endpoints.
+func checkAuthFlags() error {
+	var errs []error
+	for _, s := range []*secret{webMetricsToken, webAdminToken} {
+		if err := s.validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// requireToken makes next answer 401 to requests lacking token as their
+// bearer token, unless token isn't set. The token is read on every
+// request, so a rotated token file is picked up.
+func requireToken(token *secret, next http.Handler) http.Handler {
+	if !token.isSet() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		want, err := token.get()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || !equal(got, want) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireViewToken protects the views of <web.path>/view/<name> without
+// credentials of their own with --web.metrics-token. Views with credentials
+// check them instead.
+func requireViewToken(next http.Handler) http.Handler {
+	protected := requireToken(webMetricsToken, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v := findView(r.PathValue("view")); v != nil && (v.BasicAuth != nil || v.BearerToken != "") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		protected.ServeHTTP(w, r)
+	})
+}
+
+// adminOnly protects an admin endpoint with --web.admin-token.
+func adminOnly(next http.Handler) http.Handler {
+	return requireToken(webAdminToken, next)
+}
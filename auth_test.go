@@ -0,0 +1,105 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/amartorelli/nsq_exporter/pkg/collector"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// setFlag sets a flag for the duration of the test.
+func setFlag(t *testing.T, name, value string) {
+	t.Helper()
+	old := flag.Lookup(name).Value.String()
+	if err := flag.Set(name, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { flag.Set(name, old) })
+}
+
+func TestMuxTokens(t *testing.T) {
+	setFlag(t, "web.metrics-token", "metrics-token")
+	setFlag(t, "web.admin-token", "admin-token")
+	setFlag(t, "web.enable-lifecycle", "true")
+	setFlag(t, "web.ui", "true")
+	initHTTPMetrics()
+	loadedConfig.Store(&Config{Views: []ViewConfig{
+		{Name: "open", Topics: []string{"*"}},
+		{Name: "team", Topics: []string{"orders"}, BearerToken: "team-token"},
+	}})
+	t.Cleanup(func() { loadedConfig.Store(nil) })
+
+	c := collector.New(collector.Options{})
+	registry := prometheus.NewRegistry()
+	reload := func() error { return nil }
+	stop := make(chan struct{})
+	defer close(stop)
+	mux, err := newMux(slog.Default(), c, registry, registry, nil, newDepthHistory(10), reload, func() {}, stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		method string
+		path   string
+		token  string
+		want   int
+	}{
+		// Health checks.
+		{"GET", "/healthz", "", http.StatusOK},
+		{"GET", "/readyz", "", http.StatusServiceUnavailable},
+
+		// Metrics.
+		{"GET", "/metrics", "", http.StatusUnauthorized},
+		{"GET", "/metrics", "wrong", http.StatusUnauthorized},
+		{"GET", "/metrics", "admin-token", http.StatusUnauthorized},
+		{"GET", "/metrics", "metrics-token", http.StatusOK},
+
+		// Views.
+		{"GET", "/metrics/view/open", "", http.StatusUnauthorized},
+		{"GET", "/metrics/view/open", "admin-token", http.StatusUnauthorized},
+		{"GET", "/metrics/view/open", "metrics-token", http.StatusOK},
+		{"GET", "/metrics/view/team", "", http.StatusUnauthorized},
+		{"GET", "/metrics/view/team", "metrics-token", http.StatusUnauthorized},
+		{"GET", "/metrics/view/team", "team-token", http.StatusOK},
+
+		// Data endpoints.
+		{"GET", "/api/v1/metrics", "", http.StatusUnauthorized},
+		{"GET", "/api/v1/metrics", "admin-token", http.StatusUnauthorized},
+		{"GET", "/api/v1/metrics", "metrics-token", http.StatusOK},
+		{"GET", "/api/v1/topics", "", http.StatusUnauthorized},
+		{"GET", "/api/v1/topics", "wrong", http.StatusUnauthorized},
+		{"GET", "/api/v1/topics", "metrics-token", http.StatusOK},
+		{"GET", "/api/v1/history", "", http.StatusUnauthorized},
+		{"GET", "/api/v1/history", "metrics-token", http.StatusOK},
+		{"GET", "/ui", "", http.StatusOK},
+
+		// Admin endpoints.
+		{"GET", "/status", "", http.StatusUnauthorized},
+		{"GET", "/status", "metrics-token", http.StatusUnauthorized},
+		{"GET", "/status", "admin-token", http.StatusOK},
+		{"GET", "/-/config", "", http.StatusUnauthorized},
+		{"GET", "/-/config", "metrics-token", http.StatusUnauthorized},
+		{"GET", "/-/config", "admin-token", http.StatusOK},
+		{"GET", "/api/v1/targets", "wrong", http.StatusUnauthorized},
+		{"GET", "/api/v1/targets", "metrics-token", http.StatusUnauthorized},
+		{"GET", "/api/v1/targets", "admin-token", http.StatusOK},
+		{"POST", "/-/reload", "", http.StatusUnauthorized},
+		{"POST", "/-/reload", "metrics-token", http.StatusUnauthorized},
+		{"POST", "/-/reload", "admin-token", http.StatusOK},
+	} {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s %s with token %q: status %d, want %d", tt.method, tt.path, tt.token, rec.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"slices"
+	"sort"
+	"sync/atomic"
+
+	"github.com/amartorelli/nsq_exporter/pkg/collector"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+const clusterLabel = "cluster"
+
+var webClusterMetrics = flag.Bool("web.cluster-metrics", false, "Also serve the metrics of every cluster of the configuration file at <web.path>/cluster/<name>, only fetching the stats of its nodes.")
+
+// checkClusterFlags validates --web.cluster-metrics.
+func checkClusterFlags() error {
+	if *webClusterMetrics && *scrapeMode == "statsd" {
+		return errors.New("--web.cluster-metrics requires nsqd to be scraped, not --scrape.mode=statsd")
+	}
+	return nil
+}
+
+// ClusterConfig names a group of nsqd nodes. The series of its targets are
+// exported with its name as the cluster label.
+type ClusterConfig struct {
+	Name    string         `yaml:"name"`
+	Targets []TargetConfig `yaml:"targets"`
+}
+
+// nodeClusters maps the node of every target of a cluster to the name of
+// the cluster, replaced on reload.
+var nodeClusters atomic.Pointer[map[string]string]
+
+// hasCluster reports whether the configuration defines the cluster name.
+func hasCluster(name string) bool {
+	cfg := loadedConfig.Load()
+	return cfg != nil && slices.ContainsFunc(cfg.Clusters, func(cl ClusterConfig) bool { return cl.Name == name })
+}
+
+// nodeCluster returns the cluster of node, if any.
+func nodeCluster(node string) string {
+	if m := nodeClusters.Load(); m != nil {
+		return (*m)[node]
+	}
+	return ""
+}
+
+// targetCluster returns the cluster t belongs to, if any.
+func targetCluster(t *collector.Target) string {
+	return nodeCluster(t.Endpoint().Node)
+}
+
+// clusterGatherer adds the cluster label to the series of a gatherer whose
+// node belongs to a cluster.
+type clusterGatherer struct {
+	prometheus.Gatherer
+}
+
+func (g clusterGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+	if m := nodeClusters.Load(); m != nil && len(*m) > 0 {
+		addNodeLabel(mfs, clusterLabel, func(node string) string { return (*m)[node] })
+	}
+	return mfs, err
+}
+
+// addNodeLabel adds the label name to the series of mfs with a node label,
+// with the value value returns for the node unless it is empty.
+func addNodeLabel(mfs []*dto.MetricFamily, name string, value func(node string) string) {
+	for _, mf := range mfs {
+		for _, metric := range mf.Metric {
+			var v string
+			for _, lp := range metric.Label {
+				if lp.GetName() == "node" {
+					v = value(lp.GetValue())
+					break
+				}
+			}
+			if v == "" {
+				continue
+			}
+			metric.Label = append(metric.Label, &dto.LabelPair{Name: proto.String(name), Value: proto.String(v)})
+			sort.Slice(metric.Label, func(i, j int) bool { return metric.Label[i].GetName() < metric.Label[j].GetName() })
+		}
+	}
+}
+
+// onlyClusterGatherer only keeps the series of a gatherer labelled with the
+// given cluster, for /metrics/cluster/<name>.
+type onlyClusterGatherer struct {
+	prometheus.Gatherer
+	cluster string
+}
+
+func (g onlyClusterGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+	kept := mfs[:0]
+	for _, mf := range mfs {
+		metrics := mf.Metric[:0]
+		for _, m := range mf.Metric {
+			for _, lp := range m.Label {
+				if lp.GetName() == clusterLabel && lp.GetValue() == g.cluster {
+					metrics = append(metrics, m)
+					break
+				}
+			}
+		}
+		if mf.Metric = metrics; len(metrics) > 0 {
+			kept = append(kept, mf)
+		}
+	}
+	return kept, err
+}
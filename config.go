@@ -0,0 +1,432 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/amartorelli/nsq_exporter/pkg/collector"
+	"github.com/amartorelli/nsq_exporter/pkg/nsqhttp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	configFile = flag.String("config.file", "", "Path to a YAML configuration file, re-read on SIGHUP and on POST /-/reload.")
+
+	filterTopicInclude   = flag.String("filter.topic-include", "", "Only scrape topics matching this regular expression.")
+	filterTopicExclude   = flag.String("filter.topic-exclude", "", "Don't scrape topics matching this regular expression.")
+	filterChannelInclude = flag.String("filter.channel-include", "", "Only scrape channels matching this regular expression.")
+	filterChannelExclude = flag.String("filter.channel-exclude", "", "Don't scrape channels matching this regular expression, e.g. '.*#ephemeral'.")
+	filterSkipEphemeral  = flag.Bool("filter.skip-ephemeral", false, "Don't scrape ephemeral topics and channels, whose names end with #ephemeral.")
+)
+
+// Config is the content of the configuration file.
+type Config struct {
+	Targets              []TargetConfig   `yaml:"targets"`
+	Clusters             []ClusterConfig  `yaml:"clusters"`
+	Views                []ViewConfig     `yaml:"views"`
+	MetricRelabelConfigs []*RelabelConfig `yaml:"metric_relabel_configs"`
+	// Sites groups the clients of every channel by the network they
+	// connect from, see --metrics.clients-by-site.
+	Sites []collector.Site `yaml:"sites"`
+	// Alerts sets the thresholds of the rules command.
+	Alerts AlertsConfig `yaml:"alerts"`
+
+	// hash identifies the content of the file, 0 without one.
+	hash uint64
+}
+
+// TargetConfig configures a single nsqd node.
+type TargetConfig struct {
+	URL string `yaml:"url"`
+	// FallbackURL is scraped instead of URL when that fails, e.g. the
+	// standby of an HA pair.
+	FallbackURL string `yaml:"fallback_url"`
+	// Filter replaces the expressions of the --filter.* flags it sets.
+	Filter nsqhttp.FilterConfig `yaml:"filter"`
+	// PollInterval replaces --scrape.interval for this target in poll
+	// mode.
+	PollInterval model.Duration `yaml:"poll_interval"`
+	// IPFamily replaces --nsqd.ip-family for this target.
+	IPFamily string `yaml:"ip_family"`
+	// SSHJumpHost replaces --nsqd.ssh.jump-host for this target.
+	SSHJumpHost string `yaml:"ssh_jump_host"`
+
+	// source tells where the target comes from, see targetSources.
+	source string
+	// cluster is the name of the cluster of the target, if any.
+	cluster string
+}
+
+// loadedConfig is the configuration file last applied.
+var loadedConfig atomic.Pointer[Config]
+
+var (
+	configReloadSuccessful  prometheus.Gauge
+	configReloadSuccessTime prometheus.Gauge
+	configHash              prometheus.Gauge
+)
+
+// initConfigMetrics creates the metrics of the configuration file, named
+// after --metrics.namespace.
+func initConfigMetrics() {
+	configReloadSuccessful = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: *metricsNamespace,
+		Subsystem: "exporter",
+		Name:      "config_last_reload_successful",
+		Help:      "Whether the last attempt to load the configuration file succeeded",
+	})
+	configReloadSuccessTime = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: *metricsNamespace,
+		Subsystem: "exporter",
+		Name:      "config_last_reload_success_timestamp_seconds",
+		Help:      "Time the configuration file was last loaded successfully",
+	})
+	configHash = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: *metricsNamespace,
+		Subsystem: "exporter",
+		Name:      "config_hash",
+		Help:      "Hash of the content of the configuration file in use, 0 without one",
+	})
+}
+
+// targetSources records where every target comes from: the "flag"
+// --nsqd.addr, the "config" file, or the "default" address.
+var targetSources = struct {
+	sync.RWMutex
+	m map[*collector.Target]string
+}{m: make(map[*collector.Target]string)}
+
+// targetSource returns where t comes from.
+func targetSource(t *collector.Target) string {
+	targetSources.RLock()
+	defer targetSources.RUnlock()
+	return targetSources.m[t]
+}
+
+// loadConfig reads the configuration file. Without a configuration file an
+// empty configuration is returned.
+func loadConfig(path string) (*Config, error) {
+	cfg := &Config{}
+	if path == "" {
+		return cfg, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+	if err := yaml.UnmarshalStrict(b, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s:\n%v", path, err)
+	}
+	// 48 bits, so the hash is exactly represented by the gauge.
+	sum := sha256.Sum256(b)
+	cfg.hash = binary.BigEndian.Uint64(sum[:8]) >> 16
+	return cfg, nil
+}
+
+// validate reports every invalid setting of the configuration.
+func (c *Config) validate() error {
+	errs := validateTargets("targets", c.Targets)
+	names := make(map[string]bool, len(c.Clusters))
+	for i, cl := range c.Clusters {
+		switch {
+		case cl.Name == "":
+			errs = append(errs, fmt.Errorf("clusters[%d]: missing name", i))
+		case strings.Contains(cl.Name, "/"):
+			errs = append(errs, fmt.Errorf("clusters[%d]: name %q must not contain /", i, cl.Name))
+		case names[cl.Name]:
+			errs = append(errs, fmt.Errorf("clusters[%d]: duplicate name %q", i, cl.Name))
+		}
+		names[cl.Name] = true
+		errs = append(errs, validateTargets(fmt.Sprintf("clusters[%d].targets", i), cl.Targets)...)
+	}
+	if _, ok := constLabels[clusterLabel]; ok && len(c.Clusters) > 0 {
+		errs = append(errs, errors.New("clusters: the cluster label is already set by --metrics.const-labels"))
+	}
+	errs = append(errs, validateNodes(targetConfigs(c))...)
+	errs = append(errs, validateViews(c.Views)...)
+	if _, err := collector.NewSites(c.Sites); err != nil {
+		errs = append(errs, fmt.Errorf("sites: %v", err))
+	}
+	for i, r := range c.MetricRelabelConfigs {
+		if err := r.compile(); err != nil {
+			errs = append(errs, fmt.Errorf("metric_relabel_configs[%d]: %v", i, err))
+		}
+	}
+	if err := c.Alerts.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// validateTargets reports every invalid setting of targets, the list at
+// path in the configuration.
+func validateTargets(path string, targets []TargetConfig) []error {
+	var errs []error
+	for i, t := range targets {
+		if t.URL == "" {
+			errs = append(errs, fmt.Errorf("%s[%d]: missing url", path, i))
+			continue
+		}
+		if _, err := nsqhttp.ParseURL(t.URL); err != nil {
+			errs = append(errs, fmt.Errorf("%s[%d]: %v", path, i, err))
+		} else if t.SSHJumpHost != "" && strings.HasPrefix(t.URL, "unix://") {
+			errs = append(errs, fmt.Errorf("%s[%d]: ssh_jump_host can't reach unix sockets", path, i))
+		}
+		if t.FallbackURL != "" {
+			if _, err := nsqhttp.ParseURL(t.FallbackURL); err != nil {
+				errs = append(errs, fmt.Errorf("%s[%d]: fallback_url: %v", path, i, err))
+			} else if t.FallbackURL == t.URL {
+				errs = append(errs, fmt.Errorf("%s[%d]: fallback_url must differ from url", path, i))
+			}
+		}
+		if _, err := nsqhttp.NewFilter(t.Filter); err != nil {
+			errs = append(errs, fmt.Errorf("%s[%d]: %v", path, i, err))
+		}
+		if err := checkIPFamily(t.IPFamily); err != nil {
+			errs = append(errs, fmt.Errorf("%s[%d]: ip_family: %v", path, i, err))
+		}
+		if t.SSHJumpHost != "" {
+			if _, _, err := parseJumpHost(t.SSHJumpHost); err != nil {
+				errs = append(errs, fmt.Errorf("%s[%d]: ssh_jump_host: %v", path, i, err))
+			}
+		}
+		if t.PollInterval < 0 {
+			errs = append(errs, fmt.Errorf("%s[%d]: poll_interval must not be negative", path, i))
+		} else if t.PollInterval > 0 && *scrapeMode != "poll" {
+			errs = append(errs, fmt.Errorf("%s[%d]: poll_interval requires --scrape.mode=poll", path, i))
+		} else if *cacheMaxAge > 0 && time.Duration(t.PollInterval) >= *cacheMaxAge {
+			errs = append(errs, fmt.Errorf("%s[%d]: poll_interval must be shorter than --cache.max-age", path, i))
+		}
+	}
+	return errs
+}
+
+// validateNodes reports every nsqd node listed more than once in configs,
+// e.g. as a flag and in the configuration, or as host:port and as the URL
+// of its stats, which would export every series of the node twice.
+func validateNodes(configs []TargetConfig) []error {
+	var errs []error
+	seen := make(map[string]TargetConfig, len(configs))
+	for _, tc := range configs {
+		node, err := nsqhttp.Node(tc.URL)
+		if err != nil {
+			// Reported by validateTargets.
+			continue
+		}
+		if first, ok := seen[node]; ok {
+			errs = append(errs, fmt.Errorf("node %s is listed twice, as %q (%s) and %q (%s)", node, first.URL, first.source, tc.URL, tc.source))
+			continue
+		}
+		seen[node] = tc
+	}
+	return errs
+}
+
+// flagFilter returns the filter expressions given by the --filter.* flags.
+func flagFilter() nsqhttp.FilterConfig {
+	return nsqhttp.FilterConfig{
+		TopicInclude:   *filterTopicInclude,
+		TopicExclude:   *filterTopicExclude,
+		ChannelInclude: *filterChannelInclude,
+		ChannelExclude: *filterChannelExclude,
+		SkipEphemeral:  *filterSkipEphemeral,
+	}
+}
+
+// mergeFilters returns base with the expressions set in override replaced,
+// and ephemeral topics and channels skipped if either skips them.
+func mergeFilters(base, override nsqhttp.FilterConfig) nsqhttp.FilterConfig {
+	for _, e := range []struct {
+		base     *string
+		override string
+	}{
+		{&base.TopicInclude, override.TopicInclude},
+		{&base.TopicExclude, override.TopicExclude},
+		{&base.ChannelInclude, override.ChannelInclude},
+		{&base.ChannelExclude, override.ChannelExclude},
+	} {
+		if e.override != "" {
+			*e.base = e.override
+		}
+	}
+	if override.SkipEphemeral {
+		base.SkipEphemeral = true
+	}
+	return base
+}
+
+// applyConfig (re)loads the configuration file, updating the targets of c
+// and the relabeling rules. The outcome is reported by the config_*
+// metrics.
+func applyConfig(c *collector.Collector, client *http.Client) (err error) {
+	defer func() {
+		if err != nil {
+			configReloadSuccessful.Set(0)
+			return
+		}
+		configReloadSuccessful.Set(1)
+		configReloadSuccessTime.SetToCurrentTime()
+		configHash.Set(float64(loadedConfig.Load().hash))
+	}()
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	targets, err := loadTargets(c, client, cfg, c.Targets())
+	if err != nil {
+		return err
+	}
+	sites, err := collector.NewSites(cfg.Sites)
+	if err != nil {
+		return err
+	}
+	c.SetTargets(targets)
+	c.SetSites(sites)
+	relabeling.set(cfg.MetricRelabelConfigs)
+	loadedConfig.Store(cfg)
+	return nil
+}
+
+// loadTargets builds the targets of c from the --nsqd.addr flags and the
+// configuration. Targets already present in previous with the same
+// settings are kept as they are, so their state survives a reload. The
+// source of every target is recorded in targetSources, the cluster of its
+// node in nodeClusters.
+func loadTargets(c *collector.Collector, client *http.Client, cfg *Config, previous []*collector.Target) ([]*collector.Target, error) {
+	configs := targetConfigs(cfg)
+	if errs := validateNodes(configs); len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	sources := make(map[*collector.Target]string, len(configs))
+	clusters := make(map[string]string)
+
+	known := make(map[string]*collector.Target, len(previous))
+	for _, t := range previous {
+		e, fallback := t.Endpoint(), ""
+		if f := t.Fallback(); f != nil {
+			fallback = f.URL
+		}
+		known[targetKey(e.URL, e.Filter, t.PollInterval(), e.IPFamily, e.JumpHost, fallback)] = t
+	}
+	targets := make([]*collector.Target, 0, len(configs))
+	for _, tc := range configs {
+		family, jumpHost := targetDialing(tc)
+		targetClient, err := sshClient(familyClient(client, family), jumpHost)
+		if err != nil {
+			return nil, err
+		}
+		e, err := nsqhttp.NewEndpoint(tc.URL, targetClient)
+		if err != nil {
+			return nil, err
+		}
+		e.IPFamily = family
+		e.JumpHost = jumpHost
+		e.Limiter = newLimiter(*nsqdRateLimit)
+		if tc.Filter != (nsqhttp.FilterConfig{}) {
+			e.Filter, err = nsqhttp.NewFilter(mergeFilters(flagFilter(), tc.Filter))
+			if err != nil {
+				return nil, err
+			}
+		}
+		t, ok := known[targetKey(e.URL, e.Filter, time.Duration(tc.PollInterval), e.IPFamily, e.JumpHost, tc.FallbackURL)]
+		if !ok {
+			t = c.NewTarget(e)
+			t.SetPollInterval(time.Duration(tc.PollInterval))
+			if tc.FallbackURL != "" {
+				fallback, err := nsqhttp.NewEndpoint(tc.FallbackURL, targetClient)
+				if err != nil {
+					return nil, err
+				}
+				fallback.IPFamily = e.IPFamily
+				fallback.JumpHost = e.JumpHost
+				fallback.Limiter = newLimiter(*nsqdRateLimit)
+				fallback.Filter = e.Filter
+				t.SetFallback(fallback)
+			}
+		}
+		if tc.cluster != "" {
+			clusters[e.Node] = tc.cluster
+		}
+		targets = append(targets, t)
+		sources[t] = tc.source
+	}
+	nodeClusters.Store(&clusters)
+	targetSources.Lock()
+	targetSources.m = sources
+	targetSources.Unlock()
+	return targets, nil
+}
+
+// targetConfigs returns the targets given by the --nsqd.addr flags and the
+// configuration, or the default one if there are none. When replaying a
+// recording, or generating fake stats, its nodes are the only targets.
+func targetConfigs(cfg *Config) []TargetConfig {
+	if replaying != nil {
+		return replaying.targets()
+	}
+	if faking != nil {
+		return faking.targets()
+	}
+	var configs []TargetConfig
+	for _, u := range nsqdURLs {
+		configs = append(configs, TargetConfig{URL: u, source: "flag"})
+	}
+	for _, tc := range cfg.Targets {
+		tc.source = "config"
+		configs = append(configs, tc)
+	}
+	for _, cl := range cfg.Clusters {
+		for _, tc := range cl.Targets {
+			tc.source = "config"
+			tc.cluster = cl.Name
+			configs = append(configs, tc)
+		}
+	}
+	if len(configs) == 0 {
+		configs = []TargetConfig{{URL: defaultNSQDURL, source: "default"}}
+	}
+	return configs
+}
+
+// targetDialing returns the preferred address family and the SSH jump
+// host of tc, falling back to the flags. The jump host resolves the nodes
+// behind it, so no family applies to them, and unix sockets are always
+// local.
+func targetDialing(tc TargetConfig) (family, jumpHost string) {
+	family, jumpHost = tc.IPFamily, tc.SSHJumpHost
+	if family == "" {
+		family = *nsqdIPFamily
+	}
+	if jumpHost == "" {
+		jumpHost = *nsqdSSHJumpHost
+	}
+	if strings.HasPrefix(tc.URL, "unix://") {
+		jumpHost = ""
+	}
+	if jumpHost != "" {
+		family = ""
+	}
+	return family, jumpHost
+}
+
+// targetKey identifies a target across reloads.
+func targetKey(url string, f *nsqhttp.Filter, pollInterval time.Duration, family, jumpHost, fallback string) string {
+	if f == nil {
+		return fmt.Sprintf("%s %s %s %s %s", url, pollInterval, family, jumpHost, fallback)
+	}
+	return fmt.Sprintf("%s %s %s %s %s %v %v %v %v %t", url, pollInterval, family, jumpHost, fallback, f.TopicInclude, f.TopicExclude, f.ChannelInclude, f.ChannelExclude, f.SkipEphemeral)
+}
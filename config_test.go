@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/amartorelli/nsq_exporter/pkg/collector"
+	"github.com/amartorelli/nsq_exporter/pkg/nsqhttp"
+)
+
+func TestLoadTargetsReload(t *testing.T) {
+	c := collector.New(collector.Options{})
+	config := func(filter nsqhttp.FilterConfig) *Config {
+		return &Config{Targets: []TargetConfig{{URL: "http://nsqd-1:4151", Filter: filter}}}
+	}
+	for _, tt := range []struct {
+		name   string
+		before nsqhttp.FilterConfig
+		after  nsqhttp.FilterConfig
+		kept   bool
+	}{
+		{
+			name:   "unchanged",
+			before: nsqhttp.FilterConfig{TopicInclude: "orders"},
+			after:  nsqhttp.FilterConfig{TopicInclude: "orders"},
+			kept:   true,
+		},
+		{
+			name:   "expression changed",
+			before: nsqhttp.FilterConfig{TopicInclude: "orders"},
+			after:  nsqhttp.FilterConfig{TopicInclude: "billing"},
+		},
+		{
+			name:   "skip_ephemeral set",
+			before: nsqhttp.FilterConfig{TopicInclude: "orders"},
+			after:  nsqhttp.FilterConfig{TopicInclude: "orders", SkipEphemeral: true},
+		},
+		{
+			name:   "skip_ephemeral unset",
+			before: nsqhttp.FilterConfig{TopicInclude: "orders", SkipEphemeral: true},
+			after:  nsqhttp.FilterConfig{TopicInclude: "orders"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			before, err := loadTargets(c, http.DefaultClient, config(tt.before), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			after, err := loadTargets(c, http.DefaultClient, config(tt.after), before)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if kept := after[0] == before[0]; kept != tt.kept {
+				t.Errorf("target kept = %t, want %t", kept, tt.kept)
+			}
+			if got := after[0].Endpoint().Filter.SkipEphemeral; got != tt.after.SkipEphemeral {
+				t.Errorf("SkipEphemeral = %t, want %t", got, tt.after.SkipEphemeral)
+			}
+		})
+	}
+}
+
+func TestValidateNodes(t *testing.T) {
+	for _, tt := range []struct {
+		first, second string
+		duplicate     bool
+	}{
+		{"host", "host", true},
+		{"host", "HOST:4151", true},
+		{"host", "http://host:4151/stats", true},
+		{"HOST:4151", "http://Host:4151/", true},
+		{"http://host/stats", "http://host:80", true},
+		{"https://host", "https://HOST:443/stats", true},
+		{"[::1]", "::1", true},
+		{"::1", "http://[::1]:4151/stats", true},
+		{"[fe80::1%eth0]:4151", "[FE80::1%eth0]:4151", true},
+		{"[fe80::1%eth0]:4151", "[fe80::1%ETH0]:4151", false},
+		{"host", "http://host", false},
+		{"host", "host:4152", false},
+		{"host", "other", false},
+		{"https://gateway/nsq/node-1/", "https://gateway/nsq/node-2/", false},
+		{"https://gateway/nsq/node-1/", "https://GATEWAY/nsq/node-1/stats", true},
+		{"[::1]", "[::2]", false},
+	} {
+		configs := []TargetConfig{{URL: tt.first, source: "flag"}, {URL: tt.second, source: "config"}}
+		errs := validateNodes(configs)
+		if got := len(errs) > 0; got != tt.duplicate {
+			t.Errorf("%q and %q: duplicate = %t, want %t (%v)", tt.first, tt.second, got, tt.duplicate, errs)
+		}
+		if tt.duplicate && len(errs) > 0 && !strings.Contains(errs[0].Error(), "listed twice") {
+			t.Errorf("%q and %q: unexpected error %v", tt.first, tt.second, errs[0])
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// dashboardPanel is a time series of a Grafana dashboard.
+type dashboardPanel struct {
+	title, expr, legend, unit string
+}
+
+// dashboardRow is a row of panels, generated for a metric group.
+type dashboardRow struct {
+	title  string
+	panels []dashboardPanel
+}
+
+// dashboardRows returns the rows of the dashboard for the metric names and
+// groups selected by the flags.
+func dashboardRows() []dashboardRow {
+	name := metricName
+	sel := `{node=~"$node"}`
+	topicSel := `{node=~"$node",topic=~"$topic"}`
+	channelLegend := "{{node}} {{topic}}/{{channel}}"
+
+	rows := []dashboardRow{{title: "Overview", panels: []dashboardPanel{
+		{"nsqd nodes up", "sum(" + name("up") + sel + ")", "up", "none"},
+		{"Scrape failures", "count(" + name("up") + sel + " == 0) or vector(0)", "down", "none"},
+	}}}
+	channels, topics := *channelsCollector, *topicsCollector
+	if *metricsCompatOnly {
+		channels, topics = false, false
+	}
+	if topics {
+		rows = append(rows, dashboardRow{title: "Topics", panels: []dashboardPanel{
+			{"Topic depth", "sum by (node, topic) (" + name("topic_queue_depth") + topicSel + " + " + name("topic_backend_queue_depth") + topicSel + ")", "{{node}} {{topic}}", "short"},
+			{"Messages published", "sum by (topic) (rate(" + name("topic_messages_total") + topicSel + "[$__rate_interval]))", "{{topic}}", "ops"},
+		}})
+	}
+	if channels {
+		panels := []dashboardPanel{
+			{"Channel depth", name("depth") + topicSel, channelLegend, "short"},
+			{"In-flight messages", name("in_flight_count") + topicSel, channelLegend, "short"},
+			{"Messages", "rate(" + name("message_count") + topicSel + "[$__rate_interval])", channelLegend, "ops"},
+			{"Clients", name("client_count") + topicSel, channelLegend, "short"},
+		}
+		if *metricsStarved {
+			panels = append(panels, dashboardPanel{"Starved clients", name("starved_client_count") + topicSel, channelLegend, "short"})
+		}
+		if *metricsReadyCap {
+			panels = append(panels, dashboardPanel{"Ready capacity", name("channel_ready_capacity") + topicSel, channelLegend, "short"})
+		}
+		if *metricsBySite {
+			panels = append(panels, dashboardPanel{"Clients by site", name("channel_clients_by_site") + topicSel, channelLegend + " {{site}}", "short"})
+		}
+		if *metricsRequeue {
+			panels = append(panels, dashboardPanel{"Requeues per finish", name("channel_requeue_ratio") + topicSel, channelLegend, "short"})
+		}
+		rows = append(rows, dashboardRow{title: "Channels", panels: panels})
+	}
+	if *metricsRates {
+		rows = append(rows, dashboardRow{title: "Rates", panels: []dashboardPanel{
+			{"Finished messages", name("finish_rate") + topicSel, channelLegend, "ops"},
+			{"Requeued messages", name("requeue_rate") + topicSel, channelLegend, "ops"},
+			{"Timed out messages", name("timeout_rate") + topicSel, channelLegend, "ops"},
+		}})
+	}
+	if *clientsCollector {
+		clientLegend := "{{topic}}/{{channel}} {{hostname}} {{client_id}}"
+		rows = append(rows, dashboardRow{title: "Clients", panels: []dashboardPanel{
+			{"Ready count", name("client_ready_count") + topicSel, clientLegend, "short"},
+			{"Finished messages", "rate(" + name("client_finished_total") + topicSel + "[$__rate_interval])", clientLegend, "ops"},
+		}})
+	}
+	if *consumersCollector {
+		consumerLegend := "{{topic}}/{{channel}} {{consumer_host}}"
+		rows = append(rows, dashboardRow{title: "Consumers", panels: []dashboardPanel{
+			{"In-flight messages", name("consumer_in_flight") + topicSel, consumerLegend, "short"},
+			{"Finished messages", "rate(" + name("consumer_finished_total") + topicSel + "[$__rate_interval])", consumerLegend, "ops"},
+		}})
+	}
+	if *memoryCollector {
+		rows = append(rows, dashboardRow{title: "Memory", panels: []dashboardPanel{
+			{"Heap in use", name("memory_heap_in_use_bytes") + sel, "{{node}}", "bytes"},
+			{"GC pauses", name("memory_gc_pause_seconds") + `{node=~"$node",quantile="0.99"}`, "{{node}} p99", "s"},
+		}})
+	}
+	if *lookupdCollector {
+		lookupd := func(n string) string {
+			return prometheus.BuildFQName(*metricsNamespace, "lookupd", n)
+		}
+		rows = append(rows, dashboardRow{title: "nsqlookupd", panels: []dashboardPanel{
+			{"nsqlookupd up", lookupd("up"), "{{lookupd}}", "none"},
+			{"Registered topics", lookupd("topics"), "{{lookupd}}", "short"},
+			{"Registered nsqd nodes", lookupd("producers"), "{{lookupd}}", "short"},
+		}})
+	}
+	if *metricsCompat == "nsqio" {
+		legacy := func(n string) string {
+			return prometheus.BuildFQName(*metricsNamespace, "topic", n)
+		}
+		rows = append(rows, dashboardRow{title: "nsqio/nsq_exporter compatible", panels: []dashboardPanel{
+			{"Topic depth", legacy("depth") + topicSel, "{{node}} {{topic}}", "short"},
+			{"Channel depth", legacy("channel_depth") + topicSel, channelLegend, "short"},
+		}})
+	}
+	return rows
+}
+
+// writeDashboard writes a Grafana dashboard for the metrics exported with
+// the current flags to w.
+func writeDashboard(w io.Writer) error {
+	if err := checkFlags(); err != nil {
+		return err
+	}
+	var (
+		panels []any
+		id     int
+		y      int
+	)
+	for _, row := range dashboardRows() {
+		id++
+		panels = append(panels, map[string]any{
+			"id":        id,
+			"type":      "row",
+			"title":     row.title,
+			"collapsed": false,
+			"gridPos":   map[string]int{"x": 0, "y": y, "w": 24, "h": 1},
+			"panels":    []any{},
+		})
+		y++
+		for i, p := range row.panels {
+			id++
+			panels = append(panels, map[string]any{
+				"id":         id,
+				"type":       "timeseries",
+				"title":      p.title,
+				"datasource": map[string]string{"type": "prometheus", "uid": "${datasource}"},
+				"gridPos":    map[string]int{"x": 12 * (i % 2), "y": y + 8*(i/2), "w": 12, "h": 8},
+				"fieldConfig": map[string]any{
+					"defaults":  map[string]any{"unit": p.unit},
+					"overrides": []any{},
+				},
+				"targets": []any{map[string]any{
+					"refId":        "A",
+					"expr":         p.expr,
+					"legendFormat": p.legend,
+					"datasource":   map[string]string{"type": "prometheus", "uid": "${datasource}"},
+				}},
+			})
+		}
+		y += 8 * ((len(row.panels) + 1) / 2)
+	}
+
+	up := prometheus.BuildFQName(*metricsNamespace, *metricsSubsystem, "up")
+	variable := func(name, query string) map[string]any {
+		return map[string]any{
+			"name":       name,
+			"type":       "query",
+			"datasource": map[string]string{"type": "prometheus", "uid": "${datasource}"},
+			"query":      map[string]string{"query": query, "refId": name},
+			"refresh":    2,
+			"multi":      true,
+			"includeAll": true,
+			"allValue":   ".*",
+			"current":    map[string]any{"text": "All", "value": "$__all"},
+		}
+	}
+	topicQuery := "label_values(topic)"
+	if name := dashboardTopicMetric(); name != "" {
+		topicQuery = `label_values(` + name + `{node=~"$node"}, topic)`
+	}
+	dashboard := map[string]any{
+		"title":         "NSQ",
+		"uid":           "nsq-exporter",
+		"tags":          []string{"nsq"},
+		"schemaVersion": 39,
+		"time":          map[string]string{"from": "now-6h", "to": "now"},
+		"refresh":       "30s",
+		"panels":        panels,
+		"templating": map[string]any{"list": []any{
+			map[string]any{
+				"name":  "datasource",
+				"label": "Data source",
+				"type":  "datasource",
+				"query": "prometheus",
+			},
+			variable("node", "label_values("+up+", node)"),
+			variable("topic", topicQuery),
+		}},
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(dashboard)
+}
+
+// dashboardTopicMetric returns a metric with a topic label exported with the
+// current flags, empty if there is none.
+func dashboardTopicMetric() string {
+	switch {
+	case *topicsCollector && !*metricsCompatOnly:
+		return prometheus.BuildFQName(*metricsNamespace, *metricsSubsystem, "topic_queue_depth")
+	case *channelsCollector && !*metricsCompatOnly:
+		return prometheus.BuildFQName(*metricsNamespace, *metricsSubsystem, "depth")
+	case *metricsCompat == "nsqio":
+		return prometheus.BuildFQName(*metricsNamespace, "topic", "depth")
+	}
+	return ""
+}
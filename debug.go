@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"time"
+
+	"github.com/amartorelli/nsq_exporter/pkg/collector"
+)
+
+var enableDebugStats = flag.Bool("web.enable-debug-stats", false, "Keep the raw stats last fetched from every nsqd node and serve them under /debug/nsqd-stats.")
+
+// debugStatsHandler serves the raw stats last fetched from every target.
+func debugStatsHandler(c *collector.Collector) http.Handler {
+	type entry struct {
+		FetchedAt time.Time `json:"fetched_at"`
+		Payload   any       `json:"payload"`
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		out := make(map[string]entry)
+		for _, t := range c.Targets() {
+			payload, fetchedAt := t.RawStats()
+			e := entry{FetchedAt: fetchedAt}
+			switch {
+			case payload == nil:
+			case json.Valid(payload):
+				e.Payload = json.RawMessage(payload)
+			default:
+				// Keep whatever came back (e.g. an HTML error page) readable.
+				e.Payload = string(payload)
+			}
+			out[t.Endpoint().Node] = e
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(out)
+	})
+}
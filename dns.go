@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	nsqdDNSCacheTTL = flag.Duration("nsqd.dns-cache-ttl", 0, "Cache the resolved addresses of nsqd hosts for this long instead of resolving them for every new connection. Failed refreshes keep using the addresses resolved before (0 disables caching).")
+	nsqdDNSServer   = flag.String("nsqd.dns-server", "", "Address of the DNS server nsqd and nsqlookupd hosts are resolved against instead of the system's resolvers, host[:port] with port 53 by default.")
+)
+
+// checkDNSFlags validates --nsqd.dns-server.
+func checkDNSFlags() error {
+	if *nsqdDNSServer == "" {
+		return nil
+	}
+	if _, err := dnsServerAddress(*nsqdDNSServer); err != nil {
+		return fmt.Errorf("invalid --nsqd.dns-server %q: %v", *nsqdDNSServer, err)
+	}
+	return nil
+}
+
+// dnsServerAddress returns the host:port address of a DNS server given as
+// host[:port].
+func dnsServerAddress(server string) (string, error) {
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		// Without a port, including bare IPv6 addresses.
+		host, port = strings.Trim(server, "[]"), "53"
+	}
+	if host == "" {
+		return "", errors.New("missing host")
+	}
+	if _, err := net.LookupPort("udp", port); err != nil {
+		return "", fmt.Errorf("invalid port %q", port)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// newResolver returns the resolver of nsqd hosts, the system's unless
+// --nsqd.dns-server is set. The hosts file is consulted either way.
+func newResolver() *net.Resolver {
+	if *nsqdDNSServer == "" {
+		return net.DefaultResolver
+	}
+	server, _ := dnsServerAddress(*nsqdDNSServer)
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+var (
+	dnsLookupsTotal   *prometheus.CounterVec
+	dnsCacheHitsTotal prometheus.Counter
+)
+
+// initDNSMetrics creates the metrics of the DNS cache, named after
+// --metrics.namespace.
+func initDNSMetrics() {
+	dnsLookupsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: *metricsNamespace,
+		Subsystem: "exporter",
+		Name:      "dns_lookups_total",
+		Help:      "Number of DNS lookups of nsqd hosts made to fill or refresh the DNS cache, by result",
+	}, []string{"result"})
+	dnsCacheHitsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: *metricsNamespace,
+		Subsystem: "exporter",
+		Name:      "dns_cache_hits_total",
+		Help:      "Number of connections to nsqd using addresses from the DNS cache",
+	})
+}
+
+// dnsCache caches the addresses hosts resolve to.
+type dnsCache struct {
+	ttl      time.Duration
+	resolver *net.Resolver
+
+	mu      sync.Mutex
+	entries map[string]dnsEntry
+}
+
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+func newDNSCache(ttl time.Duration, resolver *net.Resolver) *dnsCache {
+	return &dnsCache{
+		ttl:      ttl,
+		resolver: resolver,
+		entries:  make(map[string]dnsEntry),
+	}
+}
+
+// lookup returns the addresses of host, resolving it if they aren't cached
+// or have expired. The expired addresses are returned if that fails.
+func (c *dnsCache) lookup(ctx context.Context, host string) ([]string, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[host]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		dnsCacheHitsTotal.Inc()
+		return entry.addrs, nil
+	}
+
+	addrs, err := c.resolver.LookupHost(ctx, host)
+	if err != nil {
+		dnsLookupsTotal.WithLabelValues("failure").Inc()
+		if ok {
+			slog.Warn("Error refreshing DNS cache, using the previous addresses", "host", host, "err", err)
+			dnsCacheHitsTotal.Inc()
+			return entry.addrs, nil
+		}
+		return nil, err
+	}
+	dnsLookupsTotal.WithLabelValues("success").Inc()
+	c.mu.Lock()
+	c.entries[host] = dnsEntry{addrs: addrs, expires: time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+	return addrs, nil
+}
+
+// dialContext wraps dial, dialing the cached addresses of the host in
+// order until a connection succeeds.
+func (c *dnsCache) dialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return dial(ctx, network, addr)
+		}
+		addrs, err := c.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		var errs []error
+		for _, a := range addrs {
+			conn, err := dial(ctx, network, net.JoinHostPort(a, port))
+			if err == nil {
+				return conn, nil
+			}
+			errs = append(errs, err)
+		}
+		return nil, errors.Join(errs...)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/amartorelli/nsq_exporter/pkg/collector"
+	"github.com/amartorelli/nsq_exporter/pkg/nsqhttp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// certWarning is how long before its expiry doctor warns about the
+// certificate of a node.
+const certWarning = 14 * 24 * time.Hour
+
+// Outcomes of the checks of doctor.
+const (
+	checkOK   = "OK"
+	checkWarn = "WARN"
+	checkFail = "FAIL"
+	checkSkip = "SKIP"
+)
+
+// doctorCheck is the outcome of a check of a node.
+type doctorCheck struct {
+	name, outcome, detail string
+}
+
+// doctor scrapes every target once and writes a report of what works and
+// what doesn't to w. It fails if a check of any node did.
+func doctor(w io.Writer) error {
+	if err := checkConfig(); err != nil {
+		fmt.Fprintf(w, "Configuration is invalid:\n%v\n", err)
+		return errors.New("invalid configuration")
+	}
+	// Keep the payloads to report their size.
+	*enableDebugStats = true
+	c, _, err := setup()
+	if err != nil {
+		return err
+	}
+	targets := c.Targets()
+	failed := 0
+	for _, t := range targets {
+		e := t.Endpoint()
+		fmt.Fprintf(w, "nsqd %s (%s)\n", e.Node, redactURLs(e.URL))
+		ok := true
+		for _, check := range checkTarget(c, t) {
+			fmt.Fprintf(w, "  [%-4s] %-13s %s\n", check.outcome, check.name, check.detail)
+			ok = ok && check.outcome != checkFail
+		}
+		if !ok {
+			failed++
+		}
+		fmt.Fprintln(w)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d nsqd nodes failed the checks", failed, len(targets))
+	}
+	fmt.Fprintln(w, "All checks passed")
+	return nil
+}
+
+// checkTarget scrapes t and checks the outcome step by step. The checks
+// following a failed one are skipped.
+func checkTarget(c *collector.Collector, t *collector.Target) []doctorCheck {
+	ctx, cancel := context.WithTimeout(context.Background(), *nsqdTimeout*time.Duration(*nsqdRetries+1))
+	defer cancel()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(c.WithTargets(ctx, func(o *collector.Target) bool { return o == t }))
+	mfs, _ := registry.Gather()
+	series := 0
+	for _, mf := range mfs {
+		series += len(mf.Metric)
+	}
+
+	e := t.Endpoint()
+	status := t.Status()
+	err := status.Err
+	reason := nsqhttp.ErrorReason(err)
+	var checks []doctorCheck
+	failed := false
+	add := func(name string, check func() (string, string)) {
+		if failed {
+			checks = append(checks, doctorCheck{name, checkSkip, "not checked"})
+			return
+		}
+		outcome, detail := check()
+		failed = outcome == checkFail
+		checks = append(checks, doctorCheck{name, outcome, detail})
+	}
+
+	add("connectivity", func() (string, string) {
+		switch {
+		case err != nil && isTLSError(err):
+			return checkOK, "connected"
+		case reason == nsqhttp.ReasonNotHTTP:
+			return checkFail, "not nsqd's HTTP interface, e.g. its TCP port: " + err.Error()
+		case reason == nsqhttp.ReasonConnect || reason == nsqhttp.ReasonTimeout:
+			return checkFail, err.Error()
+		}
+		return checkOK, fmt.Sprintf("answered in %s", status.Duration.Round(time.Millisecond))
+	})
+	add("tls", func() (string, string) {
+		if err != nil && isTLSError(err) {
+			return checkFail, err.Error()
+		}
+		if !strings.HasPrefix(e.URL, "https://") {
+			return checkOK, "not used"
+		}
+		expiry := e.CertExpiry()
+		if expiry.IsZero() {
+			return checkWarn, "no certificate presented"
+		}
+		left := time.Until(expiry)
+		detail := fmt.Sprintf("certificate expires %s, in %d days", expiry.Format(time.DateOnly), int(left.Hours()/24))
+		if left < certWarning {
+			return checkWarn, detail
+		}
+		return checkOK, detail
+	})
+	add("auth", func() (string, string) {
+		switch code := nsqhttp.ErrorStatusCode(err); code {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return checkFail, fmt.Sprintf("rejected with HTTP status %d, check --nsqd.username, --nsqd.password and --nsqd.bearer-token", code)
+		}
+		if nsqdBearerToken.isSet() || *nsqdUsername != "" {
+			return checkOK, "credentials accepted"
+		}
+		return checkOK, "no credentials needed"
+	})
+	add("payload size", func() (string, string) {
+		if reason == nsqhttp.ReasonTooLarge {
+			return checkFail, err.Error() + ", raise --nsqd.max-response-size or filter topics"
+		}
+		payload, _ := t.RawStats()
+		detail := fmt.Sprintf("%d bytes", len(payload))
+		if limit := *nsqdMaxResponseSize; limit > 0 && int64(len(payload)) > limit/2 {
+			return checkWarn, fmt.Sprintf("%s, over half of --nsqd.max-response-size", detail)
+		}
+		return checkOK, detail
+	})
+	add("stats", func() (string, string) {
+		if err != nil {
+			return checkFail, err.Error()
+		}
+		return checkOK, fmt.Sprintf("%d topics, %d channels", status.Topics, status.Channels)
+	})
+	add("version", func() (string, string) {
+		stats, _ := t.LastStats()
+		if stats == nil {
+			return checkSkip, "unknown"
+		}
+		v, err := nsqhttp.ParseVersion(stats.Version)
+		if err != nil {
+			return checkWarn, fmt.Sprintf("unknown version %q, some metrics may be missing", stats.Version)
+		}
+		var missing []string
+		if *memoryCollector && !v.AtLeast(nsqhttp.VersionMemory) {
+			missing = append(missing, "memory stats")
+		}
+		if !v.AtLeast(nsqhttp.VersionIncludeClients) {
+			missing = append(missing, "stats without clients")
+		}
+		if *metricsAvgSize && !v.AtLeast(nsqhttp.VersionMessageBytes) {
+			missing = append(missing, "message sizes")
+		}
+		if len(missing) > 0 {
+			return checkWarn, fmt.Sprintf("nsqd %s, too old for %s", v, strings.Join(missing, ", "))
+		}
+		return checkOK, "nsqd " + v.String()
+	})
+	add("series", func() (string, string) {
+		return checkOK, fmt.Sprintf("about %d series per scrape", series)
+	})
+	return checks
+}
+
+// isTLSError reports whether err is a failed TLS handshake or certificate
+// verification.
+func isTLSError(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "tls:") || strings.Contains(msg, "x509:")
+}
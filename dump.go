@@ -0,0 +1,32 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/amartorelli/nsq_exporter/pkg/collector"
+)
+
+// dumpState logs the internal state of the exporter, to diagnose it
+// without restarting the process.
+func dumpState(logger *slog.Logger, c *collector.Collector) {
+	targets := c.Targets()
+	logger.Info("State dump", "targets", len(targets), "series", c.SeriesCount())
+	for _, t := range targets {
+		status := t.Status()
+		attrs := []any{
+			"node", t.Endpoint().Node,
+			"url", t.Endpoint().URL,
+			"last_scrape", status.LastScrape,
+			"age", time.Since(status.LastScrape).Round(time.Millisecond),
+			"duration", status.Duration,
+			"topics", status.Topics,
+			"channels", status.Channels,
+			"circuit_open", status.CircuitOpen,
+		}
+		if status.Err != nil {
+			attrs = append(attrs, "err", status.Err)
+		}
+		logger.Info("Target state", attrs...)
+	}
+}
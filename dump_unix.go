@@ -0,0 +1,28 @@
+//go:build !windows
+
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/amartorelli/nsq_exporter/pkg/collector"
+)
+
+// dumpStateOnSignal dumps the internal state on every SIGUSR1 until stop is
+// closed.
+func dumpStateOnSignal(logger *slog.Logger, c *collector.Collector, stop <-chan struct{}) {
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	defer signal.Stop(usr1)
+	for {
+		select {
+		case <-usr1:
+			dumpState(logger, c)
+		case <-stop:
+			return
+		}
+	}
+}
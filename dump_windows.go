@@ -0,0 +1,12 @@
+//go:build windows
+
+package main
+
+import (
+	"log/slog"
+
+	"github.com/amartorelli/nsq_exporter/pkg/collector"
+)
+
+// dumpStateOnSignal does nothing, Windows has no SIGUSR1.
+func dumpStateOnSignal(*slog.Logger, *collector.Collector, <-chan struct{}) {}
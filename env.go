@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// envPrefix prefixes the environment variables setting flags.
+const envPrefix = "NSQ_EXPORTER_"
+
+var envReplacer = strings.NewReplacer(".", "_", "-", "_")
+
+// envName returns the environment variable setting the flag name, e.g.
+// NSQ_EXPORTER_WEB_LISTEN for --web.listen.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(envReplacer.Replace(name))
+}
+
+// setFlagsFromEnv sets the flags of fs not given on the command line from
+// their environment variable, if set. The values of repeatable flags are
+// comma separated.
+func setFlagsFromEnv(fs *flag.FlagSet) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		if given[f.Name] {
+			return
+		}
+		name := envName(f.Name)
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+		values := []string{v}
+		if _, ok := f.Value.(*stringsFlag); ok {
+			values = strings.Split(v, ",")
+		}
+		for _, v := range values {
+			if err := fs.Set(f.Name, v); err != nil {
+				errs = append(errs, fmt.Errorf("invalid value %q for %s: %v", v, name, err))
+				return
+			}
+		}
+	})
+	return errors.Join(errs...)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/amartorelli/nsq_exporter/pkg/collector"
+)
+
+// eventsHandler streams the depths of every topic and channel as
+// Server-Sent Events, one stats event after every poll, until stop is
+// closed.
+func eventsHandler(c *collector.Collector, stop <-chan struct{}) http.Handler {
+	type channel struct {
+		Channel       string `json:"channel"`
+		Depth         int64  `json:"depth"`
+		BackendDepth  int64  `json:"backend_depth"`
+		InFlightCount int64  `json:"in_flight_count"`
+		ClientCount   int    `json:"client_count"`
+	}
+	type topic struct {
+		Node         string    `json:"node"`
+		Topic        string    `json:"topic"`
+		Depth        int64     `json:"depth"`
+		BackendDepth int64     `json:"backend_depth"`
+		Channels     []channel `json:"channels"`
+	}
+	type event struct {
+		Time   time.Time `json:"time"`
+		Topics []topic   `json:"topics"`
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		// Events outlive --web.write-timeout.
+		rc.SetWriteDeadline(time.Time{})
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		if err := rc.Flush(); err != nil {
+			return
+		}
+
+		for {
+			select {
+			case <-c.Polled():
+			case <-r.Context().Done():
+				return
+			case <-stop:
+				return
+			}
+			e := event{Time: time.Now(), Topics: []topic{}}
+			for _, t := range c.Targets() {
+				stats, _ := t.LastStats()
+				if stats == nil {
+					continue
+				}
+				for _, ts := range stats.Topics {
+					tp := topic{
+						Node:         t.Endpoint().Node,
+						Topic:        ts.TopicName,
+						Depth:        ts.Depth,
+						BackendDepth: ts.BackendDepth,
+						Channels:     make([]channel, 0, len(ts.Channels)),
+					}
+					for _, cs := range ts.Channels {
+						tp.Channels = append(tp.Channels, channel{
+							Channel:       cs.ChannelName,
+							Depth:         cs.Depth,
+							BackendDepth:  cs.BackendDepth,
+							InFlightCount: cs.InFlightCount,
+							ClientCount:   cs.ClientCount,
+						})
+					}
+					e.Topics = append(e.Topics, tp)
+				}
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: stats\ndata: %s\n\n", data); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"expvar"
+	"flag"
+	"time"
+
+	"github.com/amartorelli/nsq_exporter/pkg/collector"
+)
+
+var enableExpvar = flag.Bool("web.enable-expvar", false, "Serve the exporter's internal counters with expvar under /debug/vars.")
+
+// publishExpvar publishes the scrape counters of c's targets as the
+// nsq_exporter expvar variable.
+func publishExpvar(c *collector.Collector) {
+	type target struct {
+		Scrapes    uint64    `json:"scrapes"`
+		Failures   uint64    `json:"failures"`
+		LastScrape time.Time `json:"last_scrape"`
+		Error      string    `json:"error,omitempty"`
+		// CacheAge is the age of the stats last fetched, in seconds.
+		CacheAge *float64 `json:"cache_age_seconds,omitempty"`
+	}
+	expvar.Publish("nsq_exporter", expvar.Func(func() any {
+		var scrapes, failures uint64
+		targets := make(map[string]target)
+		for _, t := range c.Targets() {
+			status := t.Status()
+			v := target{
+				Scrapes:    status.Scrapes,
+				Failures:   status.Failures,
+				LastScrape: status.LastScrape,
+			}
+			if status.Err != nil {
+				v.Error = status.Err.Error()
+			}
+			if stats, fetchedAt := t.LastStats(); stats != nil {
+				age := time.Since(fetchedAt).Seconds()
+				v.CacheAge = &age
+			}
+			scrapes += v.Scrapes
+			failures += v.Failures
+			targets[t.Endpoint().Node] = v
+		}
+		return map[string]any{
+			"scrapes":  scrapes,
+			"failures": failures,
+			"targets":  targets,
+		}
+	}))
+}
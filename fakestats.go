@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/amartorelli/nsq_exporter/pkg/nsqhttp"
+)
+
+var (
+	devFakeStats    = flag.Bool("dev.fake-stats", false, "Serve synthetic stats of --dev.fake-nodes nodes instead of scraping nsqd, e.g. to load test the exporter and the Prometheus scraping it.")
+	devFakeNodes    = flag.Int("dev.fake-nodes", 1, "Number of nodes of --dev.fake-stats.")
+	devFakeTopics   = flag.Int("dev.fake-topics", 10, "Number of topics per node of --dev.fake-stats.")
+	devFakeChannels = flag.Int("dev.fake-channels", 2, "Number of channels per topic of --dev.fake-stats.")
+	devFakeClients  = flag.Int("dev.fake-clients", 2, "Number of clients per channel of --dev.fake-stats.")
+)
+
+// faking generates the stats of --dev.fake-stats, it is nil unless faking.
+var faking *fakeStatsTransport
+
+// checkFakeStatsFlags validates the --dev.fake-* flags.
+func checkFakeStatsFlags() error {
+	if !*devFakeStats {
+		return nil
+	}
+	if len(nsqdURLs) > 0 || *replayDir != "" {
+		return errors.New("--dev.fake-stats, --replay.dir and --nsqd.addr are mutually exclusive")
+	}
+	if *devFakeNodes < 1 {
+		return fmt.Errorf("--dev.fake-nodes must be at least 1, got %d", *devFakeNodes)
+	}
+	if *devFakeTopics < 0 || *devFakeChannels < 0 || *devFakeClients < 0 {
+		return errors.New("--dev.fake-topics, --dev.fake-channels and --dev.fake-clients must not be negative")
+	}
+	return nil
+}
+
+// fakeStatsTransport answers the stats and info requests of its nodes with
+// synthetic stats. The counters grow at a steady rate per topic, channel and
+// client since the transport was created, the depths vary randomly.
+type fakeStatsTransport struct {
+	nodes                     int
+	topics, channels, clients int
+	start                     time.Time
+}
+
+func newFakeStatsTransport(nodes, topics, channels, clients int) *fakeStatsTransport {
+	return &fakeStatsTransport{
+		nodes:    nodes,
+		topics:   topics,
+		channels: channels,
+		clients:  clients,
+		start:    time.Now(),
+	}
+}
+
+func fakeNode(i int) string {
+	return "fake-" + strconv.Itoa(i) + ":4151"
+}
+
+// targets returns the fake nodes as targets.
+func (t *fakeStatsTransport) targets() []TargetConfig {
+	configs := make([]TargetConfig, 0, t.nodes)
+	for i := 0; i < t.nodes; i++ {
+		configs = append(configs, TargetConfig{URL: "http://" + fakeNode(i) + "/stats", source: "fake"})
+	}
+	return configs
+}
+
+// stats generates the stats of a node at now.
+func (t *fakeStatsTransport) stats(now time.Time) *nsqhttp.Stats {
+	elapsed := uint64(now.Sub(t.start).Seconds())
+	stats := &nsqhttp.Stats{
+		Version:   "1.3.0",
+		StartTime: t.start.Unix(),
+		Topics:    make([]nsqhttp.TopicStats, 0, t.topics),
+		Memory: &nsqhttp.MemoryStats{
+			HeapObjects:    int64(t.topics*t.channels*t.clients) * 64,
+			HeapInUseBytes: 32<<20 + rand.Int63n(8<<20),
+			NextGCBytes:    64 << 20,
+			GCTotalRuns:    int64(elapsed / 10),
+		},
+	}
+	for i := 0; i < t.topics; i++ {
+		rate := uint64(i + 1)
+		topic := nsqhttp.TopicStats{
+			TopicName:    fmt.Sprintf("topic-%d", i),
+			Channels:     make([]nsqhttp.ChannelStats, 0, t.channels),
+			Depth:        rand.Int63n(100),
+			MessageCount: elapsed * rate * 10,
+			MessageBytes: elapsed * rate * 10 * 256,
+		}
+		for j := 0; j < t.channels; j++ {
+			ch := nsqhttp.ChannelStats{
+				ChannelName:   fmt.Sprintf("channel-%d", j),
+				Depth:         rand.Int63n(1000),
+				InFlightCount: int64(t.clients),
+				MessageCount:  topic.MessageCount,
+				RequeueCount:  elapsed * rate / 10,
+				TimeoutCount:  elapsed * rate / 100,
+				ClientCount:   t.clients,
+				Clients:       make([]nsqhttp.ClientStats, 0, t.clients),
+			}
+			for k := 0; k < t.clients; k++ {
+				ch.Clients = append(ch.Clients, nsqhttp.ClientStats{
+					ClientID:      fmt.Sprintf("consumer-%d", k),
+					Hostname:      fmt.Sprintf("consumer-%d.example.com", k),
+					Version:       "V2",
+					RemoteAddr:    fmt.Sprintf("10.0.%d.%d:%d", k/250, k%250+1, 40000+i*t.channels+j),
+					ReadyCount:    1,
+					InFlightCount: 1,
+					MessageCount:  ch.MessageCount / uint64(t.clients),
+					FinishCount:   ch.MessageCount / uint64(t.clients),
+					RequeueCount:  ch.RequeueCount / uint64(t.clients),
+					ConnectTS:     t.start.Unix(),
+				})
+			}
+			topic.Channels = append(topic.Channels, ch)
+		}
+		stats.Topics = append(stats.Topics, topic)
+	}
+	return stats
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *fakeStatsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var v any = t.stats(time.Now())
+	if req.URL.Path == "/info" {
+		v = &nsqhttp.NodeInfo{
+			Version:          "1.3.0",
+			BroadcastAddress: req.URL.Hostname(),
+			Hostname:         req.URL.Hostname(),
+			HTTPPort:         4151,
+			TCPPort:          4150,
+			StartTime:        t.start.Unix(),
+		}
+	}
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+)
+
+var nsqdIPFamily = flag.String("nsqd.ip-family", "", "Address family preferred when connecting to nsqd hosts resolving to both, ipv4 or ipv6, falling back to the other one if connecting fails. Empty lets the system decide. Overridden by the ip_family of a target.")
+
+// checkIPFamily validates an ip_family setting.
+func checkIPFamily(family string) error {
+	switch family {
+	case "", "ipv4", "ipv6":
+		return nil
+	}
+	return fmt.Errorf("address family must be ipv4 or ipv6, got %q", family)
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// preferFamily wraps dial, connecting over the network of family first and
+// over any network if that fails.
+func preferFamily(dial dialFunc, family string) dialFunc {
+	preferred := "tcp4"
+	if family == "ipv6" {
+		preferred = "tcp6"
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, preferred, addr)
+		if err == nil {
+			return conn, nil
+		}
+		if conn, fallbackErr := dial(ctx, network, addr); fallbackErr == nil {
+			return conn, nil
+		}
+		return nil, err
+	}
+}
+
+// familyClients holds the clients derived from the shared client per
+// preferred address family, so targets preferring the same family share
+// their connections.
+var familyClients = struct {
+	sync.Mutex
+	m map[string]*http.Client
+}{m: make(map[string]*http.Client)}
+
+// familyClient returns a client like client preferring the addresses of
+// family. client itself is returned if family is empty, or if its
+// transport isn't an *http.Transport, e.g. when replaying a recording.
+func familyClient(client *http.Client, family string) *http.Client {
+	transport, ok := client.Transport.(*http.Transport)
+	if family == "" || !ok {
+		return client
+	}
+	familyClients.Lock()
+	defer familyClients.Unlock()
+	if c, ok := familyClients.m[family]; ok {
+		return c
+	}
+	t := transport.Clone()
+	t.DialContext = preferFamily(transport.DialContext, family)
+	c := *client
+	c.Transport = t
+	familyClients.m[family] = &c
+	return &c
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	graphiteAddress = flag.String("push.graphite.address", "", "TCP address of a Graphite server the metrics are sent to with the plaintext protocol, e.g. carbon:2003. Disabled if empty.")
+	graphitePrefix  = flag.String("push.graphite.prefix", "", "Prefix of the Graphite metric paths, e.g. \"prod.\".")
+)
+
+// graphitePusher sends metrics to Graphite with the plaintext protocol,
+// over a new connection on every push.
+type graphitePusher struct {
+	gatherer prometheus.Gatherer
+	dialer   net.Dialer
+}
+
+func newGraphitePusher(g prometheus.Gatherer) *graphitePusher {
+	return &graphitePusher{gatherer: g}
+}
+
+func (p *graphitePusher) push(ctx context.Context) error {
+	mfs, err := p.gatherer.Gather()
+	if err != nil && len(mfs) == 0 {
+		return err
+	}
+	conn, err := p.dialer.DialContext(ctx, "tcp", *graphiteAddress)
+	if err != nil {
+		return fmt.Errorf("failed to connect to Graphite: %v", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	w := bufio.NewWriter(conn)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	line := func(name string, labels []*dto.LabelPair, value float64) {
+		fmt.Fprintf(w, "%s %s %s\n", graphitePath(*graphitePrefix, name, labels), strconv.FormatFloat(value, 'f', -1, 64), now)
+	}
+	for _, mf := range mfs {
+		name := mf.GetName()
+		for _, m := range mf.Metric {
+			switch {
+			case m.Counter != nil:
+				line(name, m.Label, m.Counter.GetValue())
+			case m.Gauge != nil:
+				line(name, m.Label, m.Gauge.GetValue())
+			case m.Untyped != nil:
+				line(name, m.Label, m.Untyped.GetValue())
+			case m.Summary != nil:
+				line(name+"_sum", m.Label, m.Summary.GetSampleSum())
+				line(name+"_count", m.Label, float64(m.Summary.GetSampleCount()))
+			case m.Histogram != nil:
+				line(name+"_sum", m.Label, m.Histogram.GetSampleSum())
+				line(name+"_count", m.Label, float64(m.Histogram.GetSampleCount()))
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to send metrics to Graphite: %v", err)
+	}
+	return nil
+}
+
+func (p *graphitePusher) close(context.Context) error {
+	return nil
+}
+
+func (p *graphitePusher) name() string {
+	return "graphite"
+}
+
+// graphitePath returns the Graphite path of a series: the prefixed metric
+// name followed by its label names and values, sorted by label name. Dots in
+// label values are replaced so every label is a single path component.
+func graphitePath(prefix, name string, labels []*dto.LabelPair) string {
+	pairs := make([]string, 0, len(labels))
+	for _, lp := range labels {
+		pairs = append(pairs, statsdEscape(lp.GetName())+"."+strings.ReplaceAll(statsdEscape(lp.GetValue()), ".", "_"))
+	}
+	sort.Strings(pairs)
+	return strings.Join(append([]string{statsdEscape(prefix + name)}, pairs...), ".")
+}
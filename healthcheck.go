@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/exporter-toolkit/web"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	healthcheckURL      = flag.String("healthcheck.url", "", "URL the healthcheck command queries, derived from the first --web.listen address when empty, over HTTPS if --web.config.file enables TLS.")
+	healthcheckTimeout  = flag.Duration("healthcheck.timeout", 5*time.Second, "Timeout of the healthcheck command.")
+	healthcheckUsername = flag.String("healthcheck.username", "", "User the healthcheck command authenticates as when --web.config.file enables basic authentication, the only user of the file when empty.")
+	healthcheckPassword = secretFlag("healthcheck.password", "Password of --healthcheck.username, the web configuration file only holds its hash.")
+)
+
+// healthcheck queries /readyz of the exporter listening locally and
+// returns an error unless it reports ready, for container health checks
+// that can't rely on curl being installed. It speaks TLS and authenticates
+// as --web.config.file requires.
+func healthcheck() error {
+	webConfig, err := loadWebConfig(*webConfigFile)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{
+		Timeout: *healthcheckTimeout,
+		Transport: &http.Transport{
+			// The local exporter's certificate is usually not valid for
+			// localhost.
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	url := *healthcheckURL
+	if url == "" {
+		addr := defaultListenAddress
+		if len(listenAddresses) > 0 {
+			addr = listenAddresses[0]
+		}
+		if path, ok := strings.CutPrefix(addr, "unix://"); ok {
+			client.Transport.(*http.Transport).DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			}
+			addr = "localhost"
+		} else {
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return fmt.Errorf("invalid listen address %s: %v", addr, err)
+			}
+			if host == "" || net.ParseIP(host).IsUnspecified() {
+				host = "localhost"
+			}
+			addr = net.JoinHostPort(host, port)
+		}
+		scheme := "http"
+		if webConfig.TLSConfig.TLSCertPath != "" || webConfig.TLSConfig.TLSCert != "" {
+			scheme = "https"
+		}
+		url = scheme + "://" + addr + "/readyz"
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("invalid --healthcheck.url: %v", err)
+	}
+	if len(webConfig.Users) > 0 {
+		user, password, err := healthcheckCredentials(webConfig)
+		if err != nil {
+			return err
+		}
+		req.SetBasicAuth(user, password)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("healthcheck failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("healthcheck failed: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// loadWebConfig reads the TLS and basic authentication settings of the web
+// configuration file, if any. The file is validated by exporter-toolkit
+// when serving.
+func loadWebConfig(path string) (*web.Config, error) {
+	var cfg web.Config
+	if path == "" {
+		return &cfg, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read web config file: %v", err)
+	}
+	if err := yaml.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("invalid web config file %s: %v", path, err)
+	}
+	return &cfg, nil
+}
+
+// healthcheckCredentials returns the user and password the healthcheck
+// authenticates with against the users of cfg.
+func healthcheckCredentials(cfg *web.Config) (user, password string, err error) {
+	user = *healthcheckUsername
+	if user == "" {
+		if len(cfg.Users) > 1 {
+			return "", "", errors.New("--web.config.file has several basic_auth_users, set --healthcheck.username")
+		}
+		for u := range cfg.Users {
+			user = u
+		}
+	}
+	if _, ok := cfg.Users[user]; !ok {
+		return "", "", fmt.Errorf("--healthcheck.username %q isn't a user of --web.config.file", user)
+	}
+	if !healthcheckPassword.isSet() {
+		return "", "", errors.New("--web.config.file enables basic authentication, set --healthcheck.password-file")
+	}
+	password, err = healthcheckPassword.get()
+	return user, password, err
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHealthcheckBasicAuth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "prometheus" || password != "hunter2" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("OK"))
+	}))
+	defer server.Close()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	writeFile := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	oneUser := writeFile("one.yml", "basic_auth_users:\n  prometheus: "+string(hash)+"\n")
+	twoUsers := writeFile("two.yml", "basic_auth_users:\n  prometheus: "+string(hash)+"\n  admin: "+string(hash)+"\n")
+	password := writeFile("password", "hunter2\n")
+	wrongPassword := writeFile("wrong", "hunter3\n")
+
+	for _, tt := range []struct {
+		name         string
+		webConfig    string
+		username     string
+		passwordFile string
+		err          string
+	}{
+		{name: "only user", webConfig: oneUser, passwordFile: password},
+		{name: "given user", webConfig: twoUsers, username: "prometheus", passwordFile: password},
+		{name: "no web config", err: "401"},
+		{name: "no password", webConfig: oneUser, err: "--healthcheck.password-file"},
+		{name: "wrong password", webConfig: oneUser, passwordFile: wrongPassword, err: "401"},
+		{name: "several users", webConfig: twoUsers, passwordFile: password, err: "--healthcheck.username"},
+		{name: "unknown user", webConfig: oneUser, username: "grafana", passwordFile: password, err: "isn't a user"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, "healthcheck.url", server.URL+"/readyz")
+			setFlag(t, "web.config.file", tt.webConfig)
+			setFlag(t, "healthcheck.username", tt.username)
+			setFlag(t, "healthcheck.password-file", tt.passwordFile)
+			err := healthcheck()
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("healthcheck: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("healthcheck err = %v, want an error containing %q", err, tt.err)
+			}
+		})
+	}
+}
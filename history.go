@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/amartorelli/nsq_exporter/pkg/collector"
+)
+
+var historySamples = flag.Int("history.samples", 0, "Number of depth samples kept in memory per channel and served under /api/v1/history, one per poll, e.g. 40 for 10 minutes with --scrape.interval=15s. Requires --scrape.mode=poll (0 disables the history).")
+
+// checkHistoryFlags validates the --history.* flags.
+func checkHistoryFlags() error {
+	if *historySamples < 0 {
+		return fmt.Errorf("--history.samples must not be negative, got %d", *historySamples)
+	}
+	if *historySamples > 0 && *scrapeMode != "poll" {
+		return fmt.Errorf("--history.samples requires --scrape.mode=poll")
+	}
+	return nil
+}
+
+// depthSample is the depth of a channel at a time.
+type depthSample struct {
+	Time          time.Time `json:"time"`
+	Depth         int64     `json:"depth"`
+	BackendDepth  int64     `json:"backend_depth"`
+	InFlightCount int64     `json:"in_flight_count"`
+}
+
+type historyKey struct {
+	node, topic, channel string
+}
+
+// depthRing holds the most recent samples of a channel, next is where the
+// next sample is written.
+type depthRing struct {
+	samples []depthSample
+	next    int
+}
+
+func (r *depthRing) add(s depthSample, size int) {
+	if len(r.samples) < size {
+		r.samples = append(r.samples, s)
+		return
+	}
+	r.samples[r.next] = s
+	r.next = (r.next + 1) % size
+}
+
+// ordered returns the samples from the oldest to the newest.
+func (r *depthRing) ordered() []depthSample {
+	out := make([]depthSample, 0, len(r.samples))
+	out = append(out, r.samples[r.next:]...)
+	return append(out, r.samples[:r.next]...)
+}
+
+// depthHistory keeps the recent depth samples of every channel.
+type depthHistory struct {
+	size int
+
+	mu      sync.Mutex
+	rings   map[historyKey]*depthRing
+	fetched map[string]time.Time
+}
+
+func newDepthHistory(size int) *depthHistory {
+	return &depthHistory{
+		size:    size,
+		rings:   make(map[historyKey]*depthRing),
+		fetched: make(map[string]time.Time),
+	}
+}
+
+// record adds a sample of every channel of targets whose stats were fetched
+// since the last call. Channels no longer reported by their node are
+// forgotten.
+func (h *depthHistory) record(targets []*collector.Target) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	seen := make(map[historyKey]bool)
+	for _, t := range targets {
+		node := t.Endpoint().Node
+		stats, fetchedAt := t.LastStats()
+		if stats == nil {
+			continue
+		}
+		fresh := !fetchedAt.Equal(h.fetched[node])
+		h.fetched[node] = fetchedAt
+		for _, topic := range stats.Topics {
+			for _, ch := range topic.Channels {
+				key := historyKey{node, topic.TopicName, ch.ChannelName}
+				seen[key] = true
+				r, ok := h.rings[key]
+				if !ok {
+					r = &depthRing{}
+					h.rings[key] = r
+				} else if !fresh {
+					continue
+				}
+				r.add(depthSample{
+					Time:          fetchedAt,
+					Depth:         ch.Depth,
+					BackendDepth:  ch.BackendDepth,
+					InFlightCount: ch.InFlightCount,
+				}, h.size)
+			}
+		}
+	}
+	for key := range h.rings {
+		if !seen[key] {
+			delete(h.rings, key)
+		}
+	}
+}
+
+// recordLoop records the depths after every poll of c until stop is closed.
+func (h *depthHistory) recordLoop(c *collector.Collector, stop <-chan struct{}) {
+	for {
+		select {
+		case <-c.Polled():
+		case <-stop:
+			return
+		}
+		h.record(c.Targets())
+	}
+}
+
+// historyAPIHandler serves the depth history of every channel as JSON,
+// optionally restricted with the node, topic and channel parameters.
+func historyAPIHandler(h *depthHistory) http.Handler {
+	type series struct {
+		Node    string        `json:"node"`
+		Topic   string        `json:"topic"`
+		Channel string        `json:"channel"`
+		Samples []depthSample `json:"samples"`
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		match := func(param, value string) bool {
+			return !q.Has(param) || q.Get(param) == value
+		}
+		out := []series{}
+		h.mu.Lock()
+		for key, ring := range h.rings {
+			if match("node", key.node) && match("topic", key.topic) && match("channel", key.channel) {
+				out = append(out, series{key.node, key.topic, key.channel, ring.ordered()})
+			}
+		}
+		h.mu.Unlock()
+		sort.Slice(out, func(i, j int) bool {
+			a, b := out[i], out[j]
+			if a.Node != b.Node {
+				return a.Node < b.Node
+			}
+			if a.Topic != b.Topic {
+				return a.Topic < b.Topic
+			}
+			return a.Channel < b.Channel
+		})
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(out)
+	})
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/amartorelli/nsq_exporter/pkg/collector"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const hostLabel = "host"
+
+var metricsHostLabel = flag.Bool("metrics.host-label", false, "Add the hostname every nsqd node advertises in its /info as the host label of its series, so they survive changes of the address scraped.")
+
+// hostGatherer adds the host label to the series of a gatherer whose node
+// is a target of c with a known hostname.
+type hostGatherer struct {
+	prometheus.Gatherer
+	c *collector.Collector
+}
+
+func (g hostGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+	if !*metricsHostLabel {
+		return mfs, err
+	}
+	hosts := make(map[string]string)
+	for _, t := range g.c.Targets() {
+		hosts[t.Endpoint().Node] = t.Hostname()
+	}
+	addNodeLabel(mfs, hostLabel, func(node string) string { return hosts[node] })
+	return mfs, err
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/version"
+)
+
+var (
+	influxURL      = flag.String("push.influxdb.url", "", "URL of an InfluxDB server the metrics are written to with the line protocol, e.g. http://influxdb:8086. Disabled if empty.")
+	influxToken    = secretFlag("push.influxdb.token", "API token sent to InfluxDB in the Authorization header.")
+	influxOrg      = flag.String("push.influxdb.org", "", "InfluxDB 2 organization the metrics are written to.")
+	influxBucket   = flag.String("push.influxdb.bucket", "", "InfluxDB 2 bucket the metrics are written to.")
+	influxDatabase = flag.String("push.influxdb.database", "", "InfluxDB 1 database the metrics are written to, instead of --push.influxdb.bucket.")
+	influxUsername = flag.String("push.influxdb.username", "", "Username for HTTP basic authentication against InfluxDB 1.")
+	influxPassword = secretFlag("push.influxdb.password", "Password for HTTP basic authentication against InfluxDB 1.")
+)
+
+// checkInfluxFlags validates the flags of the InfluxDB push mode.
+func checkInfluxFlags() error {
+	for _, s := range []*secret{influxToken, influxPassword} {
+		if err := s.validate(); err != nil {
+			return err
+		}
+	}
+	if *influxURL == "" {
+		return nil
+	}
+	if u, err := url.Parse(*influxURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid --push.influxdb.url %q", *influxURL)
+	}
+	switch {
+	case *influxDatabase != "" && *influxBucket != "":
+		return errors.New("--push.influxdb.database and --push.influxdb.bucket are mutually exclusive")
+	case *influxDatabase == "" && (*influxBucket == "" || *influxOrg == ""):
+		return errors.New("--push.influxdb.url requires --push.influxdb.org and --push.influxdb.bucket, or --push.influxdb.database")
+	}
+	return nil
+}
+
+// influxPusher writes metrics to InfluxDB 1 or 2 with the line protocol.
+// Every series is a point of the measurement named after the metric, with
+// the labels as tags and a single value field.
+type influxPusher struct {
+	gatherer prometheus.Gatherer
+	client   *http.Client
+	url      string
+}
+
+func newInfluxPusher(g prometheus.Gatherer) *influxPusher {
+	u, _ := url.Parse(*influxURL)
+	q := url.Values{"precision": {"ms"}}
+	if *influxDatabase != "" {
+		u = u.JoinPath("write")
+		q.Set("db", *influxDatabase)
+	} else {
+		u = u.JoinPath("api", "v2", "write")
+		q.Set("org", *influxOrg)
+		q.Set("bucket", *influxBucket)
+	}
+	u.RawQuery = q.Encode()
+	return &influxPusher{gatherer: g, client: &http.Client{}, url: u.String()}
+}
+
+func (p *influxPusher) push(ctx context.Context) error {
+	mfs, err := p.gatherer.Gather()
+	if err != nil && len(mfs) == 0 {
+		return err
+	}
+	body := encodeLineProtocol(mfs, time.Now())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create InfluxDB request: %v", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("User-Agent", "nsq_exporter/"+version.Version)
+	switch {
+	case influxToken.isSet():
+		token, err := influxToken.get()
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Token "+token)
+	case *influxUsername != "" || influxPassword.isSet():
+		password, err := influxPassword.get()
+		if err != nil {
+			return err
+		}
+		req.SetBasicAuth(*influxUsername, password)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to write metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("InfluxDB returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+func (p *influxPusher) close(context.Context) error {
+	p.client.CloseIdleConnections()
+	return nil
+}
+
+func (p *influxPusher) name() string {
+	return "influxdb"
+}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+)
+
+// encodeLineProtocol encodes the metric families in the InfluxDB line
+// protocol, with millisecond timestamps at now unless they carry one.
+// Summaries and histograms are written as their sum and count fields.
+func encodeLineProtocol(mfs []*dto.MetricFamily, now time.Time) []byte {
+	var buf bytes.Buffer
+	for _, mf := range mfs {
+		measurement := influxMeasurementEscaper.Replace(mf.GetName())
+		for _, m := range mf.Metric {
+			var fields [][2]string
+			switch {
+			case m.Counter != nil:
+				fields = [][2]string{{"value", formatFloat(m.Counter.GetValue())}}
+			case m.Gauge != nil:
+				fields = [][2]string{{"value", formatFloat(m.Gauge.GetValue())}}
+			case m.Untyped != nil:
+				fields = [][2]string{{"value", formatFloat(m.Untyped.GetValue())}}
+			case m.Summary != nil:
+				fields = [][2]string{{"sum", formatFloat(m.Summary.GetSampleSum())}, {"count", strconv.FormatUint(m.Summary.GetSampleCount(), 10)}}
+			case m.Histogram != nil:
+				fields = [][2]string{{"sum", formatFloat(m.Histogram.GetSampleSum())}, {"count", strconv.FormatUint(m.Histogram.GetSampleCount(), 10)}}
+			default:
+				continue
+			}
+			if !influxValid(fields) {
+				continue
+			}
+
+			buf.WriteString(measurement)
+			labels := append([]*dto.LabelPair(nil), m.Label...)
+			sort.Slice(labels, func(i, j int) bool { return labels[i].GetName() < labels[j].GetName() })
+			for _, lp := range labels {
+				// Tags with an empty value are invalid.
+				if lp.GetValue() == "" {
+					continue
+				}
+				buf.WriteByte(',')
+				buf.WriteString(influxTagEscaper.Replace(lp.GetName()))
+				buf.WriteByte('=')
+				buf.WriteString(influxTagEscaper.Replace(lp.GetValue()))
+			}
+			for i, f := range fields {
+				if i == 0 {
+					buf.WriteByte(' ')
+				} else {
+					buf.WriteByte(',')
+				}
+				buf.WriteString(f[0])
+				buf.WriteByte('=')
+				buf.WriteString(f[1])
+			}
+			ts := now.UnixMilli()
+			if m.TimestampMs != nil {
+				ts = m.GetTimestampMs()
+			}
+			buf.WriteByte(' ')
+			buf.WriteString(strconv.FormatInt(ts, 10))
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes()
+}
+
+// influxValid reports whether InfluxDB accepts the field values, it has no
+// representation of NaN and infinities.
+func influxValid(fields [][2]string) bool {
+	for _, f := range fields {
+		if v, _ := strconv.ParseFloat(f[1], 64); math.IsNaN(v) || math.IsInf(v, 0) {
+			return false
+		}
+	}
+	return true
+}
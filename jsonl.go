@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var jsonlFile = flag.String("push.jsonl.file", "", "File the metrics are appended to as JSON lines, one per series, or - for stdout. Disabled if empty.")
+
+// jsonlPusher writes metrics as JSON lines. The file is opened again on
+// every push, so it can be rotated by moving it away.
+type jsonlPusher struct {
+	gatherer prometheus.Gatherer
+}
+
+func newJSONLPusher(g prometheus.Gatherer) *jsonlPusher {
+	return &jsonlPusher{gatherer: g}
+}
+
+// jsonlLine is a sample in the JSON lines output. The topic and channel are
+// set apart from the other labels, as sinks of log pipelines usually index
+// top-level fields only.
+type jsonlLine struct {
+	Timestamp time.Time         `json:"timestamp"`
+	Metric    string            `json:"metric"`
+	Topic     string            `json:"topic,omitempty"`
+	Channel   string            `json:"channel,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Value     float64           `json:"value"`
+}
+
+func (p *jsonlPusher) push(ctx context.Context) error {
+	mfs, err := p.gatherer.Gather()
+	if err != nil && len(mfs) == 0 {
+		return err
+	}
+	var out io.Writer = os.Stdout
+	if *jsonlFile != "-" {
+		f, err := os.OpenFile(*jsonlFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			return fmt.Errorf("failed to open JSON lines file: %v", err)
+		}
+		defer f.Close()
+		out = f
+	}
+	w := bufio.NewWriter(out)
+	if err := encodeJSONLines(w, mfs, time.Now()); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write metrics: %v", err)
+	}
+	return nil
+}
+
+func (p *jsonlPusher) close(context.Context) error {
+	return nil
+}
+
+func (p *jsonlPusher) name() string {
+	return "jsonl"
+}
+
+// encodeJSONLines writes a JSON line for every series of the metric
+// families, timestamped at now unless they carry a timestamp. Summaries and
+// histograms are written as their _sum and _count series. JSON has no
+// representation of NaN and infinities, such values are left out.
+func encodeJSONLines(w io.Writer, mfs []*dto.MetricFamily, now time.Time) error {
+	enc := json.NewEncoder(w)
+	for _, mf := range mfs {
+		name := mf.GetName()
+		for _, m := range mf.Metric {
+			line := jsonlLine{Timestamp: now.UTC()}
+			if m.TimestampMs != nil {
+				line.Timestamp = time.UnixMilli(m.GetTimestampMs()).UTC()
+			}
+			for _, lp := range m.Label {
+				switch lp.GetName() {
+				case "topic":
+					line.Topic = lp.GetValue()
+				case "channel":
+					line.Channel = lp.GetValue()
+				default:
+					if line.Labels == nil {
+						line.Labels = make(map[string]string, len(m.Label))
+					}
+					line.Labels[lp.GetName()] = lp.GetValue()
+				}
+			}
+			write := func(metric string, value float64) error {
+				if math.IsNaN(value) || math.IsInf(value, 0) {
+					return nil
+				}
+				line.Metric, line.Value = metric, value
+				if err := enc.Encode(line); err != nil {
+					return fmt.Errorf("failed to write metrics: %v", err)
+				}
+				return nil
+			}
+			var err error
+			switch {
+			case m.Counter != nil:
+				err = write(name, m.Counter.GetValue())
+			case m.Gauge != nil:
+				err = write(name, m.Gauge.GetValue())
+			case m.Untyped != nil:
+				err = write(name, m.Untyped.GetValue())
+			case m.Summary != nil:
+				err = errors.Join(write(name+"_sum", m.Summary.GetSampleSum()), write(name+"_count", float64(m.Summary.GetSampleCount())))
+			case m.Histogram != nil:
+				err = errors.Join(write(name+"_sum", m.Histogram.GetSampleSum()), write(name+"_count", float64(m.Histogram.GetSampleCount())))
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
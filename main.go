@@ -1,179 +1,1224 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
+	"expvar"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
-	"strconv"
+	"net/http/pprof"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
 
+	"github.com/amartorelli/nsq_exporter/pkg/collector"
+	"github.com/amartorelli/nsq_exporter/pkg/nsqhttp"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/promslog"
+	"github.com/prometheus/common/version"
+	"github.com/prometheus/exporter-toolkit/web"
+	"go.opentelemetry.io/otel/propagation"
 )
 
-type Client struct {
-	ClientID      string `json:"client_id"`
-	Hostname      string `json:"hostname"`
-	Version       string `json:"version"`
-	RemoteAddr    string `json:"remote_address"`
-	ReadyCount    int    `json:"ready_count"`
-	InFlightCount int    `json:"in_flight_count"`
-	MessageCount  int    `json:"message_count"`
-	FinishCount   int    `json:"finish_count"`
-	RequeueCount  int    `json:"requeue_count"`
-}
-
-type Channel struct {
-	ChannelName   string   `json:"channel_name"`
-	Depth         int      `json:"depth"`
-	BackendDepth  int      `json:"backend_depth"`
-	InFlightCount int      `json:"in_flight_count"`
-	DeferredCount int      `json:"deferred_count"`
-	MessageCount  int      `json:"message_count"`
-	RequeueCount  int      `json:"requeue_count"`
-	TimeoutCount  int      `json:"timeout_count"`
-	ClientCount   int      `json:"client_count"`
-	Clients       []Client `json:"clients"`
-	Paused        bool     `json:"paused"`
-}
-
-type Topic struct {
-	TopicName string    `json:"topic_name"`
-	Channels  []Channel `json:"channels"`
-}
-
-type Stats struct {
-	Version string  `json:"version"`
-	Topics  []Topic `json:"topics"`
-}
-
-type nsqCollector struct {
-	namespace          string
-	clientCountGauge   *prometheus.GaugeVec
-	messageCountGauge  *prometheus.GaugeVec
-	depthGauge         *prometheus.GaugeVec
-	inFlightCountGauge *prometheus.GaugeVec
-}
-
-func NewNSQCollector(namespace string) *nsqCollector {
-	return &nsqCollector{
-		namespace: namespace,
-		clientCountGauge: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "client_count",
-				Help:      "Number of clients connected to the channel",
-			},
-			[]string{"topic", "channel", "paused"},
-		),
-		messageCountGauge: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "message_count",
-				Help:      "Number of messages in the channel",
-			},
-			[]string{"topic", "channel", "paused"},
-		),
-		depthGauge: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "depth",
-				Help:      "Depth of the channel's queue",
-			},
-			[]string{"topic", "channel", "paused"},
-		),
-		inFlightCountGauge: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "in_flight_count",
-				Help:      "Number of messages currently in-flight in the channel",
-			},
-			[]string{"topic", "channel", "paused"},
-		),
+// stringsFlag is a flag.Value collecting every occurrence of a repeated flag.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// labelsFlag is a flag.Value parsing comma separated name=value label pairs.
+type labelsFlag map[string]string
+
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// reservedLabels are used by the exported metrics themselves.
+var reservedLabels = []string{"node", "topic", "channel", "paused", "kind", "type", "client_id", "hostname", "remote_address", "consumer_host", "lookupd", "path", "code", "method", "le", "quantile", "version"}
+
+func (f labelsFlag) String() string {
+	pairs := make([]string, 0, len(f))
+	for name, value := range f {
+		pairs = append(pairs, name+"="+value)
 	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
 }
 
-func (c *nsqCollector) Describe(ch chan<- *prometheus.Desc) {
-	c.clientCountGauge.Describe(ch)
-	c.messageCountGauge.Describe(ch)
-	c.depthGauge.Describe(ch)
-	c.inFlightCountGauge.Describe(ch)
+func (f labelsFlag) Set(value string) error {
+	for _, pair := range strings.Split(value, ",") {
+		name, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("label %q must be of the form name=value", pair)
+		}
+		name = strings.TrimSpace(name)
+		if !labelNameRE.MatchString(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+		if slices.Contains(reservedLabels, name) {
+			return fmt.Errorf("label name %q is used by the exported metrics", name)
+		}
+		f[name] = v
+	}
+	return nil
 }
 
-func (c *nsqCollector) Collect(ch chan<- prometheus.Metric) {
-	stats, err := c.fetchStats()
+var (
+	listenAddresses   stringsFlag
+	metricsPath       = flag.String("web.path", "/metrics", "Path under which to expose metrics.")
+	maxRequests       = flag.Int("web.max-requests", 10, "Maximum number of concurrent scrape requests, further requests are rejected with 503 (0 means no limit).")
+	scrapeTimeout     = flag.Duration("web.scrape-timeout", 0, "Maximum duration of a scrape request, slower scrapes are answered with 503 (0 means no timeout).")
+	systemdSocket     = flag.Bool("web.systemd-socket", false, "Use systemd socket activation listeners instead of --web.listen.")
+	readyzMaxAge      = flag.Duration("web.readyz-max-age", 0, "If set, /readyz requires the most recent stats fetch to have succeeded within this duration, instead of any successful fetch since startup.")
+	enableLifecycle   = flag.Bool("web.enable-lifecycle", false, "Enable the /-/reload and /-/quit endpoints.")
+	enablePprof       = flag.Bool("web.enable-pprof", false, "Serve runtime profiling data under /debug/pprof/.")
+	shutdownTimeout   = flag.Duration("web.shutdown-timeout", 30*time.Second, "Time in-flight requests are given to complete on shutdown.")
+	readHeaderTimeout = flag.Duration("web.read-header-timeout", 10*time.Second, "Maximum time to read the headers of a request.")
+	readTimeout       = flag.Duration("web.read-timeout", 30*time.Second, "Maximum time to read an entire request.")
+	writeTimeout      = flag.Duration("web.write-timeout", 60*time.Second, "Maximum time to write a response, must be longer than a scrape takes.")
+	idleTimeout       = flag.Duration("web.idle-timeout", 120*time.Second, "Maximum time an idle keep-alive connection is kept open.")
+	accessLogEnabled  = flag.Bool("web.access-log", false, "Log every HTTP request served by the exporter.")
+	webConfigFile     = flag.String("web.config.file", "", "Path to an exporter-toolkit web configuration file enabling TLS and/or basic authentication.")
+	nsqdURLs          stringsFlag
+	lookupdURLs       stringsFlag
+
+	textfilePath     = flag.String("textfile.path", "", "File the textfile command writes the metrics to, must end in .prom.")
+	textfileInterval = flag.Duration("textfile.interval", 15*time.Second, "Interval at which the textfile command writes the metrics.")
+
+	goCollector        = flag.Bool("collector.go", true, "Export Go runtime metrics of the exporter.")
+	processCollector   = flag.Bool("collector.process", true, "Export process metrics of the exporter.")
+	channelsCollector  = flag.Bool("collector.channels", true, "Export the metrics of every channel.")
+	topicsCollector    = flag.Bool("collector.topics", true, "Export the metrics of every topic.")
+	clientsCollector   = flag.Bool("collector.clients", false, "Export the metrics of every client connected to a channel.")
+	clientsAddress     = flag.String("collector.clients.remote-address", "keep", "How the remote_address label of the client metrics is reported: keep, hash (a keyed hash of the address and port), subnet (see --collector.clients.ipv4-prefix) or drop. Clients left with the same labels are summed up.")
+	clientsIPv4Prefix  = flag.Int("collector.clients.ipv4-prefix", 24, "Prefix length of the IPv4 subnets of --collector.clients.remote-address=subnet.")
+	clientsIPv6Prefix  = flag.Int("collector.clients.ipv6-prefix", 64, "Prefix length of the IPv6 subnets of --collector.clients.remote-address=subnet.")
+	consumersCollector = flag.Bool("collector.consumers", false, "Export the metrics of the clients connected to every channel summed up by consumer hostname, bounded by the number of consumer hosts rather than connections.")
+	memoryCollector    = flag.Bool("collector.memory", false, "Export the memory statistics of nsqd.")
+	lookupdCollector   = flag.Bool("collector.lookupd", false, "Export the metrics of the nodes given with --nsqlookupd.addr.")
+	constLabels        = labelsFlag{}
+	metricsNamespace   = flag.String("metrics.namespace", "nsq", "Namespace prefixing the names of the exported metrics, the NSQ metrics and the exporter's own.")
+	metricsSubsystem   = flag.String("metrics.subsystem", "", "Subsystem added to the names of the nsqd metrics after the namespace, e.g. nsq_<subsystem>_depth.")
+	metricsCompat      = flag.String("metrics.compat", "", "Also export the topic and channel metrics under the names of another exporter to ease migrations. One of: [nsqio]")
+	metricsCompatOnly  = flag.Bool("metrics.compat-only", false, "Only export the metrics under the names selected by --metrics.compat.")
+	metricsRequeue     = flag.Bool("metrics.requeue-ratio", false, "Export nsq_channel_requeue_ratio, the messages requeued per message finished in every channel since the previous fetch. Decodes the clients of every channel to count finishes.")
+	metricsRates       = flag.Bool("metrics.rates", false, "Export per-second message, finish, requeue and timeout rates of every channel, derived from consecutive fetches. Decodes the clients of every channel to count finishes.")
+	metricsStarved     = flag.Bool("metrics.starved-clients", false, "Export the number of clients of every channel with a ready count of 0. Decodes the clients of every channel.")
+	metricsReadyCap    = flag.Bool("metrics.ready-capacity", false, "Export nsq_channel_ready_capacity, the sum of the ready counts of the clients of every channel, and nsq_channel_ready_saturation, its depth per message the clients are ready for. Decodes the clients of every channel.")
+	metricsBySite      = flag.Bool("metrics.clients-by-site", false, "Export nsq_channel_clients_by_site, the number of clients of every channel by the site of the configuration file their address belongs to. Decodes the clients of every channel.")
+	metricsAvgSize     = flag.Bool("metrics.avg-message-size", false, "Export nsq_topic_avg_message_bytes, the average size of the messages published to every topic since the previous fetch, for nodes running nsqd 1.2.1 or later.")
+	metricsTopicIdle   = flag.Bool("metrics.topic-idle", false, "Export the seconds since the message count of every topic last changed. Best used with --scrape.mode=poll, so changes are tracked independently of scrapes.")
+	metricsNodeInfo    = flag.Bool("metrics.node-info", false, "Export nsq_node_info with the broadcast address, TCP and HTTP ports every nsqd node advertises, fetched from its /info endpoint when first scraped and after it restarts.")
+	metricsChurn       = flag.Bool("metrics.churn", false, "Export nsq_topics_created_observed_total, nsq_channels_removed_observed_total and the like, counting the topics and channels that appeared or disappeared between two fetches of the stats of every node.")
+	metricsDepthHist   = flag.Bool("metrics.depth-histogram", false, "Export nsq_channel_depth_distribution, a histogram per topic of the depths of its channels sampled at every poll, native as well as classic. Requires --scrape.mode=poll.")
+	metricsTimestamps  = flag.Bool("metrics.timestamps", false, "Attach the time the stats of a node were fetched to its samples, so stats served from --scrape.mode=poll or --scrape.cache-ttl are stored at the time they were observed.")
+	labelReplacement   = flag.String("metrics.label-replacement", "\uFFFD", "Replacement for invalid UTF-8 sequences and control characters in topic and channel names.")
+	labelMaxLength     = flag.Int("metrics.label-max-length", 0, "Maximum length in characters of topic and channel names, longer ones are truncated (0 disables the limit).")
+
+	logLevel  = &promslog.AllowedLevel{}
+	logFormat = &promslog.AllowedFormat{}
+
+	nsqdRetries      = flag.Int("nsqd.retries", 2, "Number of times a failed stats fetch is retried before giving up.")
+	nsqdRetryBackoff = flag.Duration("nsqd.retry-backoff", 100*time.Millisecond, "Backoff before the first retry, doubled on every further attempt.")
+	nsqdRetryJitter  = flag.Float64("nsqd.retry-jitter", 0.2, "Random jitter applied to each backoff, as a fraction of the backoff (0-1).")
+
+	breakerThreshold = flag.Int("nsqd.breaker-threshold", 3, "Consecutive failed scrapes after which a node is skipped for a while (0 disables the circuit breaker).")
+	breakerSkip      = flag.Int("nsqd.breaker-skip", 5, "Number of scrapes a node is skipped for once its circuit is open.")
+	degradedAfter    = flag.Int("nsqd.degraded-threshold", 3, "Consecutive failed scrapes after which a node is reported degraded by nsq_exporter_target_degraded (0 never reports nodes degraded).")
+
+	nsqdTimeout             = flag.Duration("nsqd.timeout", 10*time.Second, "Timeout of a single stats request to nsqd.")
+	nsqdMaxIdleConnsPerHost = flag.Int("nsqd.max-idle-conns-per-host", 4, "Maximum number of idle keep-alive connections kept open to each nsqd node.")
+	nsqdIdleConnTimeout     = flag.Duration("nsqd.idle-conn-timeout", 90*time.Second, "How long an idle keep-alive connection to nsqd is kept open.")
+	nsqdSourceAddress       = flag.String("nsqd.source-address", "", "Local IP address or network interface outgoing connections to nsqd are bound to.")
+	nsqdUsername            = flag.String("nsqd.username", "", "Username for HTTP basic authentication against nsqd.")
+	nsqdPassword            = secretFlag("nsqd.password", "Password for HTTP basic authentication against nsqd.")
+	clientsAddressSalt      = secretFlag("collector.clients.remote-address-salt", "Key of the hashes of --collector.clients.remote-address=hash, without which IPv4 addresses are easily recovered from their hash.")
+	nsqdBearerToken         = secretFlag("nsqd.bearer-token", "Bearer token sent to nsqd in the Authorization header.")
+	nsqdStatsFormat         = flag.String("nsqd.stats-format", "json", "Format of the stats requested from nsqd, json or text for nodes only serving the text format. Text stats are decoded either way.")
+	nsqdMaxResponseSize     = flag.Int64("nsqd.max-response-size", 64<<20, "Maximum size in bytes of a stats response (0 disables the limit).")
+)
+
+// newHTTPClient builds the client shared by all stats requests, so
+// connections to the nsqd nodes are pooled and kept alive between scrapes.
+func newHTTPClient() (*http.Client, error) {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Resolver:  newResolver(),
+	}
+	if *nsqdSourceAddress != "" {
+		ip, err := sourceIP(*nsqdSourceAddress)
+		if err != nil {
+			return nil, err
+		}
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+
+	tlsConfig, err := newTLSConfig()
 	if err != nil {
-		log.Println("Error fetching stats:", err)
-		return
+		return nil, err
 	}
 
-	for _, topic := range stats.Topics {
-		for _, channel := range topic.Channels {
-			labels := prometheus.Labels{
-				"topic":   topic.TopicName,
-				"channel": channel.ChannelName,
-				"paused":  strconv.FormatBool(channel.Paused),
-			}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	if *nsqdDNSCacheTTL > 0 {
+		transport.DialContext = newDNSCache(*nsqdDNSCacheTTL, dialer.Resolver).dialContext(dialer.DialContext)
+	}
+	transport.TLSClientConfig = tlsConfig
+	transport.MaxIdleConns = 0
+	transport.MaxIdleConnsPerHost = *nsqdMaxIdleConnsPerHost
+	transport.IdleConnTimeout = *nsqdIdleConnTimeout
 
-			// Set gauge values
-			c.clientCountGauge.With(labels).Set(float64(channel.ClientCount))
-			c.messageCountGauge.With(labels).Set(float64(channel.MessageCount))
-			c.depthGauge.With(labels).Set(float64(channel.Depth))
-			c.inFlightCountGauge.With(labels).Set(float64(channel.InFlightCount))
+	return &http.Client{
+		Transport:     transport,
+		Timeout:       *nsqdTimeout,
+		CheckRedirect: checkRedirect,
+	}, nil
+}
+
+// sourceIP resolves the local address outgoing connections are bound to,
+// given either as an IP address or as the name of a network interface, in
+// which case the interface's first address is used.
+func sourceIP(addr string) (net.IP, error) {
+	if ip := net.ParseIP(addr); ip != nil {
+		return ip, nil
+	}
+	iface, err := net.InterfaceByName(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source address %q: not an IP address or network interface", addr)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list addresses of interface %s: %v", addr, err)
+	}
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok {
+			return ipNet.IP, nil
 		}
 	}
-
-	// Collect the metrics
-	c.clientCountGauge.Collect(ch)
-	c.messageCountGauge.Collect(ch)
-	c.depthGauge.Collect(ch)
-	c.inFlightCountGauge.Collect(ch)
+	return nil, fmt.Errorf("interface %s has no IP address", addr)
 }
 
-var (
-	listenAddress = flag.String("web.listen", ":9117", "Address on which to expose metrics and web interface.")
-	metricsPath   = flag.String("web.path", "/metrics", "Path under which to expose metrics.")
-	nsqdURL       = flag.String("nsqd.addr", "http://localhost:4151/stats", "Address of the nsqd node.")
+const (
+	defaultListenAddress = ":9117"
+	defaultNSQDURL       = "http://localhost:4151/stats"
 )
 
-func (c *nsqCollector) fetchStats() (*Stats, error) {
-	resp, err := http.Get(fmt.Sprintf("%s?format=json", *nsqdURL))
+func init() {
+	logLevel.Set("info")
+	logFormat.Set("logfmt")
+	flag.Var(logLevel, "log.level", "Only log messages with the given severity or above. One of: [debug, info, warn, error]")
+	flag.Var(logFormat, "log.format", "Output format of log messages. One of: [logfmt, json]")
+	flag.Var(&listenAddresses, "web.listen", "Address on which to expose metrics and web interface, or unix:///path/to/socket to listen on a unix socket. May be repeated (default "+defaultListenAddress+").")
+	flag.Var(constLabels, "metrics.const-labels", "Labels added to every exported series, as comma separated name=value pairs, e.g. cluster=prod-eu,team=payments.")
+	flag.Var(&lookupdURLs, "nsqlookupd.addr", "Address of the HTTP interface of an nsqlookupd node reported on by --collector.lookupd, e.g. http://nsqlookupd:4161. May be repeated.")
+	flag.Var(&nsqdURLs, "nsqd.addr", "Address of an nsqd node, the URL of its /stats endpoint or its host[:port]. May be repeated to scrape several nodes. Further nodes can be listed in the config file. Use unix:///path/to/nsqd.sock to connect over a unix socket (default "+defaultNSQDURL+").")
+}
+
+// serve serves on all given addresses, unix sockets included, and returns
+// as soon as one of the listeners fails.
+//
+// When started through systemd socket activation the listeners passed in by
+// systemd are used instead.
+func serve(server *http.Server, flags *web.FlagConfig, addrs []string, logger *slog.Logger) error {
+	if *flags.WebSystemdSocket {
+		return web.ListenAndServe(server, flags, logger)
+	}
+
+	errs := make(chan error, len(addrs))
+	var tcpAddrs []string
+	for _, addr := range addrs {
+		path, ok := strings.CutPrefix(addr, "unix://")
+		if !ok {
+			tcpAddrs = append(tcpAddrs, addr)
+			continue
+		}
+		listener, err := listenUnix(path)
+		if err != nil {
+			return err
+		}
+		go func() { errs <- web.Serve(listener, server, flags, logger) }()
+	}
+	if len(tcpAddrs) > 0 {
+		flags.WebListenAddresses = &tcpAddrs
+		go func() { errs <- web.ListenAndServe(server, flags, logger) }()
+	}
+	return <-errs
+}
+
+// checkWebFlags validates the listen addresses and the metrics path, so
+// mistakes are reported at startup rather than once listening fails.
+func checkWebFlags() error {
+	var errs []error
+	for _, addr := range listenAddresses {
+		if err := checkListenAddress(addr); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if !strings.HasPrefix(*metricsPath, "/") || strings.ContainsAny(*metricsPath, " {}?#") {
+		errs = append(errs, fmt.Errorf("invalid --web.path %q, must be a path starting with /, e.g. /metrics", *metricsPath))
+	}
+	if err := checkAuthFlags(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := checkTelemetryFlags(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := checkUIFlags(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// checkListenAddress validates an address of --web.listen.
+func checkListenAddress(addr string) error {
+	if path, ok := strings.CutPrefix(addr, "unix://"); ok {
+		if path == "" {
+			return fmt.Errorf("invalid --web.listen %q: missing socket path", addr)
+		}
+		if fi, err := os.Stat(filepath.Dir(path)); err != nil || !fi.IsDir() {
+			return fmt.Errorf("invalid --web.listen %q: directory %s doesn't exist", addr, filepath.Dir(path))
+		}
+		return nil
+	}
+	_, port, err := net.SplitHostPort(addr)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch stats: %v", err)
+		return fmt.Errorf("invalid --web.listen %q, expected [host]:port, e.g. :9117, or unix:///path: %v", addr, err)
 	}
-	defer resp.Body.Close()
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		return fmt.Errorf("invalid --web.listen %q: invalid port %q", addr, port)
+	}
+	return nil
+}
 
-	var stats Stats
-	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
-		return nil, fmt.Errorf("failed to decode stats JSON: %v", err)
+// listenUnix listens on the unix socket at path, replacing a stale socket
+// left behind by a previous run.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket %s: %v", path, err)
+		}
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on unix socket %s: %v", path, err)
 	}
+	return listener, nil
+}
 
-	return &stats, nil
+// fatal logs err and exits.
+func fatal(logger *slog.Logger, err error) {
+	logger.Error(err.Error())
+	os.Exit(1)
 }
 
+const usage = `Usage: nsq_exporter [command] [flags]
+
+Commands:
+  run           Run the exporter (default)
+  check-config  Validate flags and configuration file, then exit
+  doctor        Scrape every nsqd node once and report what works and what doesn't
+  scrape        Collect the metrics once, print them to stdout and exit
+  textfile      Periodically write the metrics to a file for node_exporter's textfile collector
+  push          Periodically push the metrics with the enabled --push.* modes, without serving them
+  dashboard     Print a Grafana dashboard for the metrics exported with the given flags
+  rules         Print Prometheus alerting rules for the metrics exported with the given flags
+  healthcheck   Query /readyz of the exporter running locally, exiting non-zero unless it is ready
+  install       Install the exporter as a Windows service, started with the given flags
+  uninstall     Remove the Windows service
+  version       Print version information
+  help          Show this help
+
+Every flag can also be set with an environment variable named after it, e.g.
+NSQ_EXPORTER_WEB_LISTEN for --web.listen, with comma separated values for
+repeatable flags. Flags given on the command line take precedence.
+
+Flags:
+`
+
 func main() {
-	namespace := "nsq"
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+
+	cmd, args := "run", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	switch cmd {
+	case "run", "check-config", "doctor", "scrape", "textfile", "push", "dashboard", "rules", "healthcheck", "install", "uninstall":
+	case "version":
+		fmt.Println(version.Print("nsq_exporter"))
+		return
+	case "help":
+		flag.Usage()
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", cmd)
+		flag.Usage()
+		os.Exit(2)
+	}
+	flag.CommandLine.Parse(args)
+	if err := setFlagsFromEnv(flag.CommandLine); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	// The exporter's own metrics share the namespace of the NSQ metrics.
+	initConfigMetrics()
+	initDNSMetrics()
+	initHTTPMetrics()
+	initRuntimeMetrics()
+
+	if cmd == "run" && isWindowsService() {
+		if err := runService(); err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+
+	logger := promslog.New(&promslog.Config{Level: logLevel, Format: logFormat})
+	slog.SetDefault(logger)
+
+	switch cmd {
+	case "run":
+		run(logger, stopOnSignal(logger))
+	case "install", "uninstall":
+		if err := manageService(cmd, args); err != nil {
+			fatal(logger, err)
+		}
+	case "check-config":
+		if err := checkConfig(); err != nil {
+			fmt.Fprintf(os.Stderr, "Configuration is invalid:\n%v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Configuration is valid")
+	case "doctor":
+		if err := doctor(os.Stdout); err != nil {
+			fatal(logger, err)
+		}
+	case "scrape":
+		if err := scrape(); err != nil {
+			fatal(logger, err)
+		}
+	case "textfile":
+		if err := writeTextfile(logger); err != nil {
+			fatal(logger, err)
+		}
+	case "push":
+		if err := pushMetrics(logger); err != nil {
+			fatal(logger, err)
+		}
+	case "dashboard":
+		if err := writeDashboard(os.Stdout); err != nil {
+			fatal(logger, err)
+		}
+	case "rules":
+		if err := writeRules(os.Stdout); err != nil {
+			fatal(logger, err)
+		}
+	case "healthcheck":
+		if err := healthcheck(); err != nil {
+			fatal(logger, err)
+		}
+	}
+	if err := shutdownTracing(); err != nil {
+		logger.Error("Error sending traces", "err", err)
+	}
+}
+
+// checkFlags validates flag combinations that can't be checked while
+// parsing them.
+func checkFlags() error {
+	for _, s := range []*secret{nsqdPassword, nsqdBearerToken, clientsAddressSalt} {
+		if err := s.validate(); err != nil {
+			return err
+		}
+	}
+	if *nsqdUsername != "" && nsqdBearerToken.isSet() {
+		return errors.New("--nsqd.username and --nsqd.bearer-token are mutually exclusive")
+	}
+	if err := checkRedirectFlags(); err != nil {
+		return err
+	}
+	if err := checkClusterFlags(); err != nil {
+		return err
+	}
+	if err := checkRateLimitFlags(); err != nil {
+		return err
+	}
+	if err := checkDNSFlags(); err != nil {
+		return err
+	}
+	if err := checkSSHFlags(); err != nil {
+		return err
+	}
+	if *nsqdStatsFormat != "json" && *nsqdStatsFormat != "text" {
+		return fmt.Errorf("--nsqd.stats-format must be json or text, got %q", *nsqdStatsFormat)
+	}
+	if *nsqdDNSCacheTTL < 0 {
+		return errors.New("--nsqd.dns-cache-ttl must not be negative")
+	}
+	if err := checkIPFamily(*nsqdIPFamily); err != nil {
+		return fmt.Errorf("--nsqd.ip-family: %v", err)
+	}
+	if !labelNameRE.MatchString(*metricsNamespace) {
+		return fmt.Errorf("invalid --metrics.namespace %q", *metricsNamespace)
+	}
+	if *metricsSubsystem != "" && !labelNameRE.MatchString(*metricsSubsystem) {
+		return fmt.Errorf("invalid --metrics.subsystem %q", *metricsSubsystem)
+	}
+	if !utf8.ValidString(*labelReplacement) {
+		return errors.New("--metrics.label-replacement must be valid UTF-8")
+	}
+	if *labelMaxLength < 0 {
+		return errors.New("--metrics.label-max-length must not be negative")
+	}
+	if _, ok := constLabels[hostLabel]; ok && *metricsHostLabel {
+		return errors.New("--metrics.host-label and a host label of --metrics.const-labels are mutually exclusive")
+	}
+	if *metricsDepthHist && *scrapeMode != "poll" {
+		return errors.New("--metrics.depth-histogram requires --scrape.mode=poll")
+	}
+	if *degradedAfter < 0 {
+		return errors.New("--nsqd.degraded-threshold must not be negative")
+	}
+	switch *clientsAddress {
+	case collector.RemoteAddressKeep, collector.RemoteAddressHash, collector.RemoteAddressSubnet, collector.RemoteAddressDrop:
+	default:
+		return fmt.Errorf("--collector.clients.remote-address must be keep, hash, subnet or drop, got %q", *clientsAddress)
+	}
+	if *clientsIPv4Prefix < 1 || *clientsIPv4Prefix > 32 {
+		return fmt.Errorf("--collector.clients.ipv4-prefix must be between 1 and 32, got %d", *clientsIPv4Prefix)
+	}
+	if *clientsIPv6Prefix < 1 || *clientsIPv6Prefix > 128 {
+		return fmt.Errorf("--collector.clients.ipv6-prefix must be between 1 and 128, got %d", *clientsIPv6Prefix)
+	}
+	if *lookupdCollector && len(lookupdURLs) == 0 {
+		return errors.New("--collector.lookupd requires --nsqlookupd.addr")
+	}
+	if *stateFile != "" && !*metricsRates {
+		return errors.New("--state.file requires --metrics.rates")
+	}
+	if *stateSaveInterval <= 0 {
+		return errors.New("--state.save-interval must be positive")
+	}
+	if err := checkNamesFlags(); err != nil {
+		return err
+	}
+	switch *metricsCompat {
+	case "":
+		if *metricsCompatOnly {
+			return errors.New("--metrics.compat-only requires --metrics.compat")
+		}
+	case "nsqio":
+		// The legacy names share the "topic" subsystem.
+		if *metricsSubsystem == "topic" && !*metricsCompatOnly {
+			return errors.New("--metrics.subsystem=topic clashes with the metric names of --metrics.compat=nsqio")
+		}
+	default:
+		return fmt.Errorf("invalid --metrics.compat %q, must be nsqio", *metricsCompat)
+	}
+	if err := checkPushFlags(); err != nil {
+		return err
+	}
+	if err := checkProbeFlags(); err != nil {
+		return err
+	}
+	if err := checkTracingFlags(); err != nil {
+		return err
+	}
+	if err := checkWebhookFlags(); err != nil {
+		return err
+	}
+	if err := checkHistoryFlags(); err != nil {
+		return err
+	}
+	if err := checkRecordFlags(); err != nil {
+		return err
+	}
+	if err := checkReplayFlags(); err != nil {
+		return err
+	}
+	if err := checkFakeStatsFlags(); err != nil {
+		return err
+	}
+	if err := checkAllowlistFlags(); err != nil {
+		return err
+	}
+	if err := checkRuntimeFlags(); err != nil {
+		return err
+	}
+	return checkScrapeFlags()
+}
+
+// checkConfig validates the flags, the configuration file and every file
+// they refer to, reporting all problems found.
+func checkConfig() error {
+	var errs []error
+	if err := checkFlags(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := checkWebFlags(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := web.Validate(*webConfigFile); err != nil {
+		errs = append(errs, fmt.Errorf("invalid web config file %s: %v", *webConfigFile, err))
+	}
+	for _, u := range nsqdURLs {
+		if _, err := nsqhttp.ParseURL(u); err != nil {
+			errs = append(errs, fmt.Errorf("--nsqd.addr: %v", err))
+		}
+	}
+	for _, u := range lookupdURLs {
+		if _, err := nsqhttp.ParseURL(u); err != nil {
+			errs = append(errs, fmt.Errorf("--nsqlookupd.addr: %v", err))
+		}
+	}
+	if _, err := nsqhttp.NewFilter(flagFilter()); err != nil {
+		errs = append(errs, fmt.Errorf("--filter: %v", err))
+	}
+	if _, err := loadConfig(*configFile); err != nil {
+		errs = append(errs, err)
+	}
+	if *configFile == "" {
+		// The configuration file validates its nodes with the flags.
+		errs = append(errs, validateNodes(targetConfigs(&Config{}))...)
+	}
+	if *allowlistFile != "" {
+		if _, err := loadAllowlist(*allowlistFile); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if _, err := newTLSConfig(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// setup validates the flags and creates the collector for the configured
+// targets, along with the HTTP client used to reach them.
+func setup() (*collector.Collector, *http.Client, error) {
+	if err := checkFlags(); err != nil {
+		return nil, nil, err
+	}
+	tuneRuntime()
+	client, err := newHTTPClient()
+	if err != nil {
+		return nil, nil, err
+	}
+	if *replayDir != "" {
+		if replaying, err = loadReplay(*replayDir); err != nil {
+			return nil, nil, err
+		}
+		client = &http.Client{Transport: replaying}
+		go replaying.advance(*replayInterval)
+	}
+	if *devFakeStats {
+		faking = newFakeStatsTransport(*devFakeNodes, *devFakeTopics, *devFakeChannels, *devFakeClients)
+		client = &http.Client{Transport: faking}
+	}
+	filter, err := nsqhttp.NewFilter(flagFilter())
+	if err != nil {
+		return nil, nil, err
+	}
+	tracer, err := newTracer()
+	if err != nil {
+		return nil, nil, err
+	}
+	var record func(*collector.Target, []byte)
+	if *debugRecordDir != "" {
+		recorder, err := newStatsRecorder(*debugRecordDir, *debugRecordMaxSize, *debugRecordMaxFiles)
+		if err != nil {
+			return nil, nil, err
+		}
+		record = recorder.record
+	}
+	salt, err := clientsAddressSalt.get()
+	if err != nil {
+		return nil, nil, err
+	}
+	c := collector.New(collector.Options{
+		Namespace: *metricsNamespace,
+		Subsystem: *metricsSubsystem,
+		Groups: &collector.Groups{
+			Channels:  *channelsCollector,
+			Topics:    *topicsCollector,
+			Clients:   *clientsCollector,
+			Consumers: *consumersCollector,
+			Memory:    *memoryCollector,
+			Lookupd:   *lookupdCollector,
+		},
+		LegacyNames:       *metricsCompat == "nsqio",
+		LegacyOnly:        *metricsCompatOnly,
+		Rates:             *metricsRates,
+		RequeueRatio:      *metricsRequeue,
+		StarvedClients:    *metricsStarved,
+		ReadyCapacity:     *metricsReadyCap,
+		ClientsBySite:     *metricsBySite,
+		TopicIdle:         *metricsTopicIdle,
+		AvgMessageSize:    *metricsAvgSize,
+		NodeInfo:          *metricsNodeInfo,
+		Hostnames:         *metricsHostLabel,
+		DepthHistogram:    *metricsDepthHist,
+		Churn:             *metricsChurn,
+		Timestamps:        *metricsTimestamps,
+		RemoteAddress:     *clientsAddress,
+		RemoteAddressSalt: salt,
+		SubnetPrefixIPv4:  *clientsIPv4Prefix,
+		SubnetPrefixIPv6:  *clientsIPv6Prefix,
+		LabelReplacement:  *labelReplacement,
+		LabelMaxLength:    *labelMaxLength,
+		OnCollect:         scrapeFailures.record,
+		Client: &nsqhttp.Client{
+			Retries:         *nsqdRetries,
+			RetryBackoff:    *nsqdRetryBackoff,
+			RetryJitter:     *nsqdRetryJitter,
+			MaxResponseSize: *nsqdMaxResponseSize,
+			Authenticate:    setAuth,
+			Tracer:          tracer,
+			TextFormat:      *nsqdStatsFormat == "text",
+			Limiter:         newLimiter(*nsqdGlobalRateLimit),
+			Decode: nsqhttp.DecodeOptions{
+				Clients:             *clientsCollector || *consumersCollector || *metricsRates || *metricsRequeue || *metricsStarved || *metricsReadyCap || *metricsBySite,
+				MaxTopics:           *limitsMaxTopics,
+				MaxChannelsPerTopic: *limitsMaxChannelsPerTopic,
+				MaxClients:          *limitsMaxClients,
+				Filter:              filter,
+			},
+		},
+		Concurrency:       *scrapeConcurrency,
+		TargetTimeout:     *scrapeTargetTimeout,
+		CacheTTL:          *scrapeCacheTTL,
+		PollOffset:        *scrapeOffset,
+		PollJitter:        *scrapeJitter,
+		MaxStaleness:      *scrapeMaxStale,
+		MaxAge:            *cacheMaxAge,
+		BreakerThreshold:  *breakerThreshold,
+		BreakerSkip:       *breakerSkip,
+		DegradedThreshold: *degradedAfter,
+		KeepRawStats:      *enableDebugStats,
+		RecordRawStats:    record,
+		Panics:            panicsTotal,
+		SeparateTelemetry: separateTelemetry(),
+		ConstLabels:       prometheus.Labels(constLabels),
+		Tracer:            tracer,
+	})
+	if err := applyConfig(c, client); err != nil {
+		return nil, nil, err
+	}
+	var lookupds []*nsqhttp.Endpoint
+	for _, u := range lookupdURLs {
+		e, err := nsqhttp.NewEndpoint(u, client)
+		if err != nil {
+			return nil, nil, fmt.Errorf("--nsqlookupd.addr: %v", err)
+		}
+		lookupds = append(lookupds, e)
+	}
+	c.SetLookupds(lookupds)
+	if *allowlistFile != "" {
+		a, err := loadAllowlist(*allowlistFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		c.SetAllowlist(a)
+	}
+	return c, client, nil
+}
+
+// scrape collects the metrics once and writes them to stdout. It fails if
+// none of the targets could be scraped.
+func scrape() error {
+	collector, _, err := setup()
+	if err != nil {
+		return err
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+	mfs, err := relabelGatherer{normalizeGatherer{hostGatherer{clusterGatherer{registry}, collector}}, &relabeling}.Gather()
+	if err != nil {
+		return err
+	}
+	enc := expfmt.NewEncoder(os.Stdout, expfmt.NewFormat(expfmt.TypeTextPlain))
+	for _, mf := range mfs {
+		if err := enc.Encode(mf); err != nil {
+			return err
+		}
+	}
+	if !collector.Ready(0) {
+		return errors.New("no nsqd node could be scraped")
+	}
+	return nil
+}
+
+// writeTextfile periodically writes the metrics to the file given by
+// --textfile.path, for node_exporter's textfile collector, until it is
+// terminated.
+func writeTextfile(logger *slog.Logger) error {
+	if *textfilePath == "" {
+		return errors.New("--textfile.path is required")
+	}
+	if !strings.HasSuffix(*textfilePath, ".prom") {
+		return errors.New("--textfile.path must end in .prom to be picked up by node_exporter")
+	}
+	collector, _, err := setup()
+	if err != nil {
+		return err
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+
+	stop := stopOnSignal(logger)
+	ticker := time.NewTicker(*textfileInterval)
+	defer ticker.Stop()
+	for {
+		// WriteToTextfile writes to a temporary file first and renames it,
+		// so node_exporter never reads a partially written file.
+		if err := prometheus.WriteToTextfile(*textfilePath, relabelGatherer{normalizeGatherer{hostGatherer{clusterGatherer{registry}, collector}}, &relabeling}); err != nil {
+			logger.Error("Error writing textfile", "path", *textfilePath, "err", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+// landingConfig describes the landing page, linking to every enabled
+// endpoint.
+func landingConfig() web.LandingConfig {
+	links := []web.LandingLinks{
+		{Address: *metricsPath, Text: "Metrics"},
+		{Address: "/status", Text: "Status", Description: "Targets and their last scrape results"},
+		{Address: "/healthz", Text: "Health", Description: "Liveness check"},
+		{Address: "/readyz", Text: "Readiness", Description: "Readiness check, requires nsqd to be reachable"},
+		{Address: "/-/config", Text: "Configuration", Description: "Running configuration, credentials redacted"},
+	}
+	if *webUI {
+		links = append(links, web.LandingLinks{Address: "/ui", Text: "Topics", Description: "Live table of the topics and channels"})
+	}
+	if *webTelemetryPath != "" && *webTelemetryListen == "" {
+		links = append(links, web.LandingLinks{Address: *webTelemetryPath, Text: "Telemetry", Description: "The exporter's own metrics"})
+	}
+	if *enableDebugStats {
+		links = append(links, web.LandingLinks{Address: "/debug/nsqd-stats", Text: "nsqd stats", Description: "Raw stats last fetched from every nsqd node"})
+	}
+	if *enablePprof {
+		links = append(links, web.LandingLinks{Address: "/debug/pprof/", Text: "pprof", Description: "Runtime profiling data"})
+	}
+	return web.LandingConfig{
+		Name:        "NSQ Exporter",
+		Description: "Prometheus exporter for NSQ",
+		Version:     version.Info(),
+		Links:       links,
+	}
+}
+
+// stopOnSignal returns a channel which is closed once SIGINT or SIGTERM is
+// received.
+func stopOnSignal(logger *slog.Logger) <-chan struct{} {
+	stop := make(chan struct{})
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-term
+		logger.Info("Received signal", "signal", sig.String())
+		close(stop)
+	}()
+	return stop
+}
+
+// withQuit returns a channel closed once stop is, or once quit is called.
+func withQuit(stop <-chan struct{}) (<-chan struct{}, func()) {
+	done := make(chan struct{})
+	var once sync.Once
+	quit := func() {
+		once.Do(func() { close(done) })
+	}
+	go func() {
+		select {
+		case <-stop:
+			quit()
+		case <-done:
+		}
+	}()
+	return done, quit
+}
+
+// metricsHandler serves the metrics of registry along with those of c. The
+// collector is registered with the context of every request, so the nsqd
+// fetches of a scrape the client gave up on, or which exceeded
+// --web.scrape-timeout, are cancelled. Served with a cluster path value,
+// only the NSQ metrics of the nodes of that cluster are, and with a view
+// path value only those of the topics of the view.
+func metricsHandler(registry *prometheus.Registry, c *collector.Collector, logger *slog.Logger) http.Handler {
+	opts := promhttp.HandlerOpts{
+		ErrorLog: slog.NewLogLogger(logger.Handler(), slog.LevelError),
+		// Counters carry their created timestamp in OpenMetrics.
+		EnableOpenMetrics:                   true,
+		EnableOpenMetricsTextCreatedSamples: true,
+	}
+	var inFlight chan struct{}
+	if *maxRequests > 0 {
+		inFlight = make(chan struct{}, *maxRequests)
+	}
+	var h http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if inFlight != nil {
+			select {
+			case inFlight <- struct{}{}:
+				defer func() { <-inFlight }()
+			default:
+				http.Error(w, fmt.Sprintf("Limit of concurrent requests reached (%d), try again later.", *maxRequests), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		cluster := r.PathValue("cluster")
+		if cluster != "" && !hasCluster(cluster) {
+			http.NotFound(w, r)
+			return
+		}
+		var view *ViewConfig
+		if name := r.PathValue("view"); name != "" {
+			if view = findView(name); view == nil {
+				http.NotFound(w, r)
+				return
+			}
+			if !view.authorized(r) {
+				w.Header().Set("WWW-Authenticate", view.challenge())
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+		}
+		scrape := prometheus.NewRegistry()
+		if *scrapeMode != "statsd" {
+			// Continue the trace of the scrape request, if any.
+			ctx := propagation.TraceContext{}.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+			if cluster != "" {
+				scrape.MustRegister(c.WithTargets(ctx, func(t *collector.Target) bool { return targetCluster(t) == cluster }))
+			} else {
+				scrape.MustRegister(c.WithContext(ctx))
+			}
+		}
+		topics := r.URL.Query()["topic"]
+		var gatherer prometheus.Gatherer = prometheus.Gatherers{registry, scrape}
+		if cluster != "" || view != nil || len(topics) > 0 {
+			gatherer = scrape
+		}
+		if view != nil {
+			// Only the NSQ metrics of the topics of the view.
+			gatherer = viewGatherer{gatherer, view}
+		}
+		if len(topics) > 0 {
+			// Only the NSQ metrics of the requested topics.
+			gatherer = topicGatherer{gatherer, topics}
+		}
+		gatherer = hostGatherer{clusterGatherer{gatherer}, c}
+		if cluster != "" {
+			// Only the NSQ metrics of the nodes of the cluster.
+			gatherer = onlyClusterGatherer{gatherer, cluster}
+		}
+		gatherer = relabelGatherer{normalizeGatherer{gatherer}, &relabeling}
+		promhttp.HandlerFor(gatherer, opts).ServeHTTP(w, r)
+	})
+	if *scrapeTimeout > 0 {
+		h = http.TimeoutHandler(h, *scrapeTimeout, fmt.Sprintf("Exceeded configured timeout of %v.\n", *scrapeTimeout))
+	}
+	return h
+}
+
+// run runs the exporter until stop is closed.
+func run(logger *slog.Logger, stop <-chan struct{}) {
+	logger.Info("Starting nsq_exporter", "version", version.Info())
+	logger.Info("Build context", "build_context", version.BuildContext())
+
+	if len(listenAddresses) == 0 {
+		listenAddresses = stringsFlag{defaultListenAddress}
+	}
+	// Report every problem of the flags and files at once, before
+	// scraping or listening.
+	if err := checkConfig(); err != nil {
+		for _, problem := range strings.Split(err.Error(), "\n") {
+			logger.Error("Invalid configuration", "err", problem)
+		}
+		os.Exit(1)
+	}
+
+	// Requests to /-/quit stop the exporter like a signal.
+	stop, quit := withQuit(stop)
 
 	// Create a new NSQ collector
-	collector := NewNSQCollector(namespace)
+	collector, client, err := setup()
+	if err != nil {
+		fatal(logger, err)
+	}
+
+	stateSaved := make(chan struct{})
+	if *stateFile != "" {
+		// A missing or unreadable state only costs the first rates.
+		if err := loadState(collector); err != nil {
+			logger.Warn("Error loading state", "err", err)
+		}
+		go persistState(logger, collector, stop, stateSaved)
+	} else {
+		close(stateSaved)
+	}
+
+	if *scrapeMode == "poll" {
+		collector.StartPolling(*scrapeInterval, stop)
+		if *alertsWebhookURL != "" {
+			go alertLoop(logger, collector, stop)
+		}
+	}
+	if *allowlistFile != "" {
+		go watchAllowlist(logger, collector, stop)
+	}
+	var history *depthHistory
+	if *historySamples > 0 {
+		history = newDepthHistory(*historySamples)
+		go history.recordLoop(collector, stop)
+	}
+
+	// The exporter's own metrics live on a dedicated registry, the Go
+	// runtime and process metrics are only added when enabled. The NSQ
+	// collector is added for every scrape by metricsHandler.
+	registry := prometheus.NewRegistry()
+	registerer := prometheus.WrapRegistererWith(prometheus.Labels(constLabels), registry)
+	registerer.MustRegister(panicsTotal,
+		metricsRequestsTotal, metricsRequestsInFlight, metricsRequestDuration,
+		gomaxprocsGauge, gomemlimitGauge,
+		configReloadSuccessful, configReloadSuccessTime, configHash)
+	if *nsqdDNSCacheTTL > 0 {
+		registerer.MustRegister(dnsLookupsTotal, dnsCacheHitsTotal)
+	}
+	if *goCollector {
+		registerer.MustRegister(collectors.NewGoCollector())
+	}
+	if *processCollector {
+		registerer.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	}
+	// Served apart, the exporter's own metrics of the collector join them,
+	// and the NSQ metrics of the StatsD bridge and the prober get a
+	// registry of their own.
+	nsqRegistry, nsqRegisterer := registry, registerer
+	if separateTelemetry() {
+		registry.MustRegister(collector.Telemetry())
+		nsqRegistry = prometheus.NewRegistry()
+		nsqRegisterer = prometheus.WrapRegistererWith(prometheus.Labels(constLabels), nsqRegistry)
+	}
+
+	var bridge *statsdBridge
+	if *scrapeMode == "statsd" {
+		bridge, err = newStatsdBridge(logger)
+		if err != nil {
+			fatal(logger, err)
+		}
+		nsqRegisterer.MustRegister(bridge)
+		go bridge.serve(stop)
+	}
+	if *probeTopic != "" {
+		p, err := newProber(logger, collector, client)
+		if err != nil {
+			fatal(logger, err)
+		}
+		nsqRegisterer.MustRegister(p.collectors()...)
+		go p.run(stop)
+	}
+
+	var pushed prometheus.Gatherer = registry
+	if nsqRegistry != registry {
+		pushed = prometheus.Gatherers{registry, nsqRegistry}
+	}
+	pushers, err := newPushers(context.Background(), pushGatherer(pushed, collector))
+	if err != nil {
+		fatal(logger, err)
+	}
+	pushDone := make(chan struct{})
+	if len(pushers) > 0 {
+		go pushLoop(logger, pushers, stop, pushDone)
+	} else {
+		close(pushDone)
+	}
 
-	// Register the collector with Prometheus
-	prometheus.MustRegister(collector)
+	reload := func() error {
+		if err := applyConfig(collector, client); err != nil {
+			return err
+		}
+		logger.Info("Configuration reloaded", "targets", len(collector.Targets()))
+		return nil
+	}
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			if err := reload(); err != nil {
+				logger.Error("Error reloading configuration", "err", err)
+			}
+		}
+	}()
+	mux, err := newMux(logger, collector, registry, nsqRegistry, bridge, history, reload, quit, stop)
+	if err != nil {
+		fatal(logger, err)
+	}
+
+	var handler http.Handler = recoverHandler(logger, mux)
+	if *accessLogEnabled {
+		handler = accessLog(logger, handler)
+	}
+
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: *readHeaderTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+	}
+	flags := &web.FlagConfig{
+		WebSystemdSocket: systemdSocket,
+		WebConfigFile:    webConfigFile,
+	}
+	errc := make(chan error, 2)
+	go func() { errc <- serve(server, flags, listenAddresses, logger) }()
+	var telemetryServer *http.Server
+	if *webTelemetryListen != "" {
+		var telemetryFlags *web.FlagConfig
+		telemetryServer, telemetryFlags = newTelemetryServer(registry, logger)
+		go func() { errc <- serve(telemetryServer, telemetryFlags, []string{*webTelemetryListen}, logger) }()
+	}
+	go notifySystemd(logger, collector, stop)
+	go dumpStateOnSignal(logger, collector, stop)
+
+	select {
+	case err := <-errc:
+		fatal(logger, err)
+	case err := <-scrapeFailures.failed:
+		fatal(logger, err)
+	case <-stop:
+		logger.Info("Shutting down")
+		// Let in-flight scrapes finish before closing the listeners.
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			logger.Error("Error shutting down", "err", err)
+		}
+		if telemetryServer != nil {
+			telemetryServer.Shutdown(ctx)
+		}
+		<-stateSaved
+		<-pushDone
+	}
+}
+
+// newMux routes the endpoints of the exporter, protected by the tokens of
+// the --web.*-token flags.
+func newMux(logger *slog.Logger, collector *collector.Collector, registry, nsqRegistry *prometheus.Registry, bridge *statsdBridge, history *depthHistory, reload func() error, quit func(), stop <-chan struct{}) (*http.ServeMux, error) {
+	// Use a dedicated mux, importing net/http/pprof registers its handlers
+	// on the default one.
+	mux := http.NewServeMux()
 
 	// Expose the metrics at /metrics using the updated HandlerFor function
-	http.Handle(*metricsPath, promhttp.Handler())
+	mux.Handle(*metricsPath, requireToken(webMetricsToken, instrumentMetricsHandler(promhttp.InstrumentMetricHandler(
+		registry,
+		metricsHandler(nsqRegistry, collector, logger),
+	))))
+	if *webClusterMetrics {
+		mux.Handle(strings.TrimSuffix(*metricsPath, "/")+"/cluster/{cluster}", requireToken(webMetricsToken, instrumentMetricsHandler(
+			metricsHandler(nsqRegistry, collector, logger),
+		)))
+	}
+	mux.Handle(strings.TrimSuffix(*metricsPath, "/")+"/view/{view}", requireViewToken(instrumentMetricsHandler(
+		metricsHandler(nsqRegistry, collector, logger),
+	)))
+	if *webTelemetryPath != "" && *webTelemetryListen == "" {
+		mux.Handle(*webTelemetryPath, requireToken(webMetricsToken, telemetryHandler(registry, logger)))
+	}
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		// Liveness only, nsqd is deliberately not contacted.
+		w.Write([]byte("OK"))
+	})
+	if bridge != nil {
+		mux.Handle("/readyz", statsdReadyHandler(bridge, *readyzMaxAge))
+	} else {
+		mux.Handle("/readyz", readyHandler(collector, *readyzMaxAge))
+	}
+
+	if *enableLifecycle {
+		mux.Handle("/-/reload", adminOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost && r.Method != http.MethodPut {
+				http.Error(w, "Only POST or PUT requests allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			if err := reload(); err != nil {
+				http.Error(w, fmt.Sprintf("failed to reload config: %s", err), http.StatusInternalServerError)
+			}
+		})))
+		mux.Handle("/-/quit", adminOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost && r.Method != http.MethodPut {
+				http.Error(w, "Only POST or PUT requests allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			logger.Info("Received quit request", "remote_addr", r.RemoteAddr)
+			w.Write([]byte("Requesting termination... Goodbye!"))
+			quit()
+		})))
+	}
+	// The status page lists the URLs of the targets and their errors, like
+	// /api/v1/targets.
+	mux.Handle("/status", adminOnly(statusHandler(collector, *metricsPath)))
+	mux.Handle("/-/config", adminOnly(configHandler()))
+	mux.Handle("/api/v1/metrics", requireToken(webMetricsToken, metricsAPIHandler(collector)))
+	mux.Handle("/api/v1/topics", requireToken(webMetricsToken, topicsAPIHandler(collector)))
+	mux.Handle("/api/v1/targets", adminOnly(targetsAPIHandler(collector)))
+	if *scrapeMode == "poll" {
+		mux.Handle("/events", requireToken(webMetricsToken, eventsHandler(collector, stop)))
+	}
+	if history != nil {
+		mux.Handle("/api/v1/history", requireToken(webMetricsToken, historyAPIHandler(history)))
+	}
+	if *webUI {
+		// The page asks for the token of /api/v1/topics.
+		mux.Handle("/ui", uiHandler())
+	}
+
+	if *enableDebugStats {
+		mux.Handle("/debug/nsqd-stats", adminOnly(debugStatsHandler(collector)))
+	}
+	if *enableExpvar {
+		publishExpvar(collector)
+		mux.Handle("/debug/vars", adminOnly(expvar.Handler()))
+	}
+	if *enablePprof {
+		mux.Handle("/debug/pprof/", adminOnly(http.HandlerFunc(pprof.Index)))
+		mux.Handle("/debug/pprof/cmdline", adminOnly(http.HandlerFunc(pprof.Cmdline)))
+		mux.Handle("/debug/pprof/profile", adminOnly(http.HandlerFunc(pprof.Profile)))
+		mux.Handle("/debug/pprof/symbol", adminOnly(http.HandlerFunc(pprof.Symbol)))
+		mux.Handle("/debug/pprof/trace", adminOnly(http.HandlerFunc(pprof.Trace)))
+	}
+
 	if *metricsPath != "" && *metricsPath != "/" {
-		http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-			w.Write([]byte(`<html>
-			<head><title>NSQ Exporter</title></head>
-			<body>
-			<h1>NSQ Exporter</h1>
-			<p><a href="` + *metricsPath + `">Metrics</a></p>
-			</body>
-			</html>`))
-		})
-	}
-	log.Printf("Listening on %s\n", *listenAddress)
-	log.Fatal(http.ListenAndServe(*listenAddress, nil))
+		landingPage, err := web.NewLandingPage(landingConfig())
+		if err != nil {
+			return nil, err
+		}
+		mux.Handle("/", landingPage)
+	}
+	return mux, nil
 }
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	panicsTotal             prometheus.Counter
+	metricsRequestsTotal    *prometheus.CounterVec
+	metricsRequestsInFlight prometheus.Gauge
+	metricsRequestDuration  *prometheus.HistogramVec
+)
+
+// initHTTPMetrics creates the metrics of the requests served, named after
+// --metrics.namespace.
+func initHTTPMetrics() {
+	panicsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: *metricsNamespace,
+		Subsystem: "exporter",
+		Name:      "panics_total",
+		Help:      "Number of panics recovered from while collecting metrics or serving requests",
+	})
+	metricsRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: *metricsNamespace,
+		Subsystem: "exporter",
+		Name:      "metrics_requests_total",
+		Help:      "Number of requests to the metrics endpoint, by status code and method",
+	}, []string{"code", "method"})
+	metricsRequestsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: *metricsNamespace,
+		Subsystem: "exporter",
+		Name:      "metrics_requests_in_flight",
+		Help:      "Number of requests to the metrics endpoint currently being served",
+	})
+	metricsRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: *metricsNamespace,
+		Subsystem: "exporter",
+		Name:      "metrics_request_duration_seconds",
+		Help:      "Time taken to serve requests to the metrics endpoint, by status code",
+		Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"code"})
+}
+
+// instrumentMetricsHandler tracks requests to the metrics endpoint, so
+// scrapes timing out at the exporter show up in its own metrics.
+func instrumentMetricsHandler(next http.Handler) http.Handler {
+	return promhttp.InstrumentHandlerInFlight(metricsRequestsInFlight,
+		promhttp.InstrumentHandlerCounter(metricsRequestsTotal,
+			promhttp.InstrumentHandlerDuration(metricsRequestDuration, next),
+		),
+	)
+}
+
+// recoverHandler keeps a panicking handler from taking down the connection
+// without an answer.
+func recoverHandler(logger *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if p := recover(); p != nil {
+				if p == http.ErrAbortHandler {
+					panic(p)
+				}
+				panicsTotal.Inc()
+				logger.Error("Panic serving request", "path", r.URL.Path, "panic", p, "stack", string(debug.Stack()))
+				http.Error(w, "internal server error", http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// statusRecorder captures the status code and size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.size += n
+	return n, err
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// accessLog logs every request handled by next.
+func accessLog(logger *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		user, _, _ := r.BasicAuth()
+		logger.Info("HTTP request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"size", rec.size,
+			"duration", time.Since(start),
+			"remote_addr", r.RemoteAddr,
+			"user", user,
+			"user_agent", r.UserAgent(),
+		)
+	})
+}
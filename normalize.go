@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+var metricsNames = flag.String("metrics.names", "current", "Names of the metrics not following the Prometheus naming conventions: current, normalized, or both to export them under both names while dashboards and alerts move. One of: [current, normalized, both]")
+
+// checkNamesFlags validates --metrics.names.
+func checkNamesFlags() error {
+	switch *metricsNames {
+	case "current", "normalized", "both":
+		return nil
+	}
+	return fmt.Errorf("invalid --metrics.names %q, must be current, normalized or both", *metricsNames)
+}
+
+// normalizedName is the name of a metric following the naming conventions.
+type normalizedName struct {
+	name string
+	// counter exports the metric as a counter, for counts only growing
+	// that are reported as gauges.
+	counter bool
+}
+
+// normalizedNames maps the names of the metrics not following the naming
+// conventions, below the namespace and subsystem, to their normalized
+// names. Counters end with _total, and the _count suffix, which belongs to
+// histograms and summaries, is replaced by what is counted. Durations and
+// sizes are already exported in seconds and bytes.
+var normalizedNames = map[string]normalizedName{
+	"message_count":          {"messages_total", true},
+	"requeue_count":          {"requeues_total", true},
+	"timeout_count":          {"timeouts_total", true},
+	"client_count":           {"clients", false},
+	"in_flight_count":        {"in_flight_messages", false},
+	"deferred_count":         {"deferred_messages", false},
+	"starved_client_count":   {"starved_clients", false},
+	"client_ready_count":     {"client_ready", false},
+	"client_in_flight_count": {"client_in_flight", false},
+}
+
+// metricName returns the full name n is exported under with the current
+// flags, its normalized name with --metrics.names=normalized.
+func metricName(n string) string {
+	if normalized, ok := normalizedNames[n]; ok && *metricsNames == "normalized" {
+		n = normalized.name
+	}
+	return prometheus.BuildFQName(*metricsNamespace, *metricsSubsystem, n)
+}
+
+// normalizeGatherer exports the metrics of a gatherer under their
+// normalized names as selected by --metrics.names.
+type normalizeGatherer struct {
+	prometheus.Gatherer
+}
+
+func (g normalizeGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+	if *metricsNames == "current" {
+		return mfs, err
+	}
+	names := make(map[string]normalizedName, len(normalizedNames))
+	for n, normalized := range normalizedNames {
+		normalized.name = prometheus.BuildFQName(*metricsNamespace, *metricsSubsystem, normalized.name)
+		names[prometheus.BuildFQName(*metricsNamespace, *metricsSubsystem, n)] = normalized
+	}
+	out := make([]*dto.MetricFamily, 0, len(mfs))
+	for _, mf := range mfs {
+		normalized, ok := names[mf.GetName()]
+		if !ok {
+			out = append(out, mf)
+			continue
+		}
+		if *metricsNames == "both" {
+			out = append(out, mf)
+		}
+		mf = proto.Clone(mf).(*dto.MetricFamily)
+		mf.Name = proto.String(normalized.name)
+		if normalized.counter && mf.GetType() == dto.MetricType_GAUGE {
+			mf.Type = dto.MetricType_COUNTER.Enum()
+			for _, m := range mf.Metric {
+				m.Counter = &dto.Counter{Value: proto.Float64(m.GetGauge().GetValue())}
+				m.Gauge = nil
+			}
+		}
+		out = append(out, mf)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].GetName() < out[j].GetName() })
+	return out, err
+}
@@ -0,0 +1,73 @@
+package collector
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/netip"
+)
+
+// Remote address modes of Options.RemoteAddress.
+const (
+	RemoteAddressKeep   = "keep"
+	RemoteAddressHash   = "hash"
+	RemoteAddressSubnet = "subnet"
+	RemoteAddressDrop   = "drop"
+)
+
+// addressMapper rewrites the remote addresses of clients into the values of
+// the remote_address label.
+type addressMapper struct {
+	mode       string
+	salt       []byte
+	ipv4, ipv6 int
+}
+
+func newAddressMapper(opts Options) *addressMapper {
+	switch opts.RemoteAddress {
+	case RemoteAddressHash, RemoteAddressSubnet, RemoteAddressDrop:
+	default:
+		return nil
+	}
+	m := &addressMapper{
+		mode: opts.RemoteAddress,
+		salt: []byte(opts.RemoteAddressSalt),
+		ipv4: opts.SubnetPrefixIPv4,
+		ipv6: opts.SubnetPrefixIPv6,
+	}
+	if m.ipv4 <= 0 {
+		m.ipv4 = 24
+	}
+	if m.ipv6 <= 0 {
+		m.ipv6 = 64
+	}
+	return m
+}
+
+// label returns the label value of addr, an IP and port.
+func (m *addressMapper) label(addr string) string {
+	switch m.mode {
+	case RemoteAddressHash:
+		// The port is hashed too, so clients of the same host stay
+		// distinct. Unkeyed hashes of IPv4 addresses are easily reversed.
+		h := hmac.New(sha256.New, m.salt)
+		h.Write([]byte(addr))
+		return hex.EncodeToString(h.Sum(nil))[:16]
+	case RemoteAddressSubnet:
+		ap, err := netip.ParseAddrPort(addr)
+		if err != nil {
+			return ""
+		}
+		ip := ap.Addr().Unmap()
+		bits := m.ipv6
+		if ip.Is4() {
+			bits = m.ipv4
+		}
+		prefix, err := ip.Prefix(min(bits, ip.BitLen()))
+		if err != nil {
+			return ""
+		}
+		return prefix.String()
+	}
+	return ""
+}
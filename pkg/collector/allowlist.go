@@ -0,0 +1,82 @@
+package collector
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/amartorelli/nsq_exporter/pkg/nsqhttp"
+)
+
+// AllowRule allows the channels of the topics matching Topic whose names
+// match one of Channels, or all their channels if there are none. Names
+// are matched as path.Match patterns, e.g. "orders-*".
+type AllowRule struct {
+	Topic    string   `yaml:"topic"`
+	Channels []string `yaml:"channels"`
+}
+
+// Allowlist selects the topics and channels exported by name, on top of
+// the filters of the client. A topic is kept if a rule matches it, its
+// channels if they are allowed by one of the rules matching the topic.
+type Allowlist struct {
+	rules []AllowRule
+}
+
+// NewAllowlist checks the patterns of rules.
+func NewAllowlist(rules []AllowRule) (*Allowlist, error) {
+	for i, r := range rules {
+		if r.Topic == "" {
+			return nil, fmt.Errorf("rule %d: missing topic", i)
+		}
+		for _, p := range append([]string{r.Topic}, r.Channels...) {
+			if _, err := path.Match(p, ""); err != nil {
+				return nil, fmt.Errorf("rule %d: invalid pattern %q: %v", i, p, err)
+			}
+		}
+	}
+	return &Allowlist{rules: rules}, nil
+}
+
+// allows reports whether the topic, and the channel unless empty, are
+// allowed.
+func (a *Allowlist) allows(topic, channel string) bool {
+	for _, r := range a.rules {
+		if ok, _ := path.Match(r.Topic, topic); !ok {
+			continue
+		}
+		if channel == "" || len(r.Channels) == 0 {
+			return true
+		}
+		for _, p := range r.Channels {
+			if ok, _ := path.Match(p, channel); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// apply removes the topics and channels a doesn't allow from stats.
+func (a *Allowlist) apply(stats *nsqhttp.Stats) {
+	topics := stats.Topics[:0]
+	for _, topic := range stats.Topics {
+		if !a.allows(topic.TopicName, "") {
+			continue
+		}
+		channels := topic.Channels[:0]
+		for _, ch := range topic.Channels {
+			if a.allows(topic.TopicName, ch.ChannelName) {
+				channels = append(channels, ch)
+			}
+		}
+		topic.Channels = channels
+		topics = append(topics, topic)
+	}
+	stats.Topics = topics
+}
+
+// SetAllowlist replaces the allowlist applied to the stats fetched from
+// then on, nil allows everything.
+func (c *Collector) SetAllowlist(a *Allowlist) {
+	c.allowlist.Store(a)
+}
@@ -0,0 +1,64 @@
+package collector
+
+import (
+	"errors"
+	"sync"
+)
+
+// circuitBreaker stops scraping a target after a number of consecutive
+// failures. While open, the next skip scrapes of the target are skipped
+// entirely; afterwards a single attempt is let through, which either closes
+// the circuit again or re-opens it for another round.
+type circuitBreaker struct {
+	threshold int
+	skip      int
+
+	mu       sync.Mutex
+	failures int
+	skipped  int
+}
+
+func newCircuitBreaker(threshold, skip int) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, skip: skip}
+}
+
+// allow reports whether the target should be scraped this time.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.threshold <= 0 || b.failures < b.threshold {
+		return true
+	}
+	if b.skipped < b.skip {
+		b.skipped++
+		return false
+	}
+	// Half-open: let one attempt through, the result decides what's next.
+	b.skipped = 0
+	return true
+}
+
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	b.failures = 0
+	b.skipped = 0
+	b.mu.Unlock()
+}
+
+func (b *circuitBreaker) failure() {
+	b.mu.Lock()
+	b.failures++
+	b.mu.Unlock()
+}
+
+// open reports whether the circuit is currently open.
+func (b *circuitBreaker) open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.threshold > 0 && b.failures >= b.threshold
+}
+
+// ErrCircuitOpen is the error of the scrapes of a target skipped while its
+// circuit breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker open, scrape skipped")
@@ -0,0 +1,85 @@
+package collector
+
+import (
+	"github.com/amartorelli/nsq_exporter/pkg/nsqhttp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// churnCounters count the topics and channels appearing and disappearing
+// between two fetches of the stats of a node.
+type churnCounters struct {
+	topicsCreated   *prometheus.CounterVec
+	topicsRemoved   *prometheus.CounterVec
+	channelsCreated *prometheus.CounterVec
+	channelsRemoved *prometheus.CounterVec
+}
+
+func newChurnCounters(namespace, subsystem string, constLabels prometheus.Labels) *churnCounters {
+	counter := func(name, help string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			Name:        name,
+			Help:        help,
+			ConstLabels: constLabels,
+		}, []string{"node"})
+	}
+	return &churnCounters{
+		topicsCreated:   counter("topics_created_observed_total", "Number of topics that appeared since the previous fetch of the stats of the node"),
+		topicsRemoved:   counter("topics_removed_observed_total", "Number of topics that disappeared since the previous fetch of the stats of the node"),
+		channelsCreated: counter("channels_created_observed_total", "Number of channels that appeared since the previous fetch of the stats of the node"),
+		channelsRemoved: counter("channels_removed_observed_total", "Number of channels that disappeared since the previous fetch of the stats of the node"),
+	}
+}
+
+func (cc *churnCounters) vecs() []*prometheus.CounterVec {
+	return []*prometheus.CounterVec{cc.topicsCreated, cc.topicsRemoved, cc.channelsCreated, cc.channelsRemoved}
+}
+
+// churnStore holds the topics and channels of a target seen last.
+type churnStore struct {
+	topics   map[string]bool
+	channels map[channelKey]bool
+}
+
+// observeChurn counts the topics and channels of stats, fetched from t,
+// that weren't there at its previous fetch and those that are gone. The
+// first stats of a target only set what was seen.
+func (c *Collector) observeChurn(t *Target, stats *nsqhttp.Stats) {
+	topics := make(map[string]bool, len(stats.Topics))
+	channels := make(map[channelKey]bool)
+	for _, topic := range stats.Topics {
+		topics[topic.TopicName] = true
+		for _, ch := range topic.Channels {
+			channels[channelKey{topic.TopicName, ch.ChannelName}] = true
+		}
+	}
+
+	node := t.endpoint.Node
+	t.churnMu.Lock()
+	defer t.churnMu.Unlock()
+	prev := t.churn
+	t.churn = churnStore{topics: topics, channels: channels}
+	if prev.topics == nil {
+		// Export the counters from the first fetch on.
+		for _, vec := range c.churn.vecs() {
+			vec.WithLabelValues(node)
+		}
+		return
+	}
+	c.churn.topicsCreated.WithLabelValues(node).Add(float64(countMissing(topics, prev.topics)))
+	c.churn.topicsRemoved.WithLabelValues(node).Add(float64(countMissing(prev.topics, topics)))
+	c.churn.channelsCreated.WithLabelValues(node).Add(float64(countMissing(channels, prev.channels)))
+	c.churn.channelsRemoved.WithLabelValues(node).Add(float64(countMissing(prev.channels, channels)))
+}
+
+// countMissing returns the number of keys of a missing from b.
+func countMissing[K comparable](a, b map[K]bool) int {
+	n := 0
+	for k := range a {
+		if !b[k] {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,1092 @@
+// Package collector implements a Prometheus collector for the statistics of
+// nsqd nodes, to be registered with any prometheus.Registerer.
+package collector
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/amartorelli/nsq_exporter/pkg/nsqhttp"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// Options configure a Collector. The zero value is usable.
+type Options struct {
+	// Namespace prefixes every metric name, "nsq" if empty.
+	Namespace string
+	// Subsystem, if set, is added to the names of the nsqd metrics after
+	// the namespace.
+	Subsystem string
+	// Client fetches the stats, a zero nsqhttp.Client if nil.
+	Client *nsqhttp.Client
+	// Concurrency is the maximum number of targets fetched concurrently,
+	// targets are fetched one at a time if it is less than 1.
+	Concurrency int
+	// TargetTimeout bounds the time spent fetching the stats of a single
+	// target, retries included. Zero means no limit.
+	TargetTimeout time.Duration
+	// CacheTTL makes scrapes reuse the stats of a target fetched less than
+	// this long ago. Zero disables caching.
+	CacheTTL time.Duration
+	// BreakerThreshold is the number of consecutive failed scrapes after
+	// which a target is skipped for BreakerSkip scrapes. Zero disables the
+	// circuit breaker.
+	BreakerThreshold int
+	BreakerSkip      int
+	// PollOffset delays the first poll of StartPolling, PollJitter by up
+	// to as much again, chosen at random, so exporters polling at the same
+	// interval don't all hit nsqd at once.
+	PollOffset time.Duration
+	PollJitter time.Duration
+	// KeepRawStats keeps the payload last fetched from every target,
+	// available through Target.RawStats.
+	KeepRawStats bool
+	// RecordRawStats, if set, is called with every payload fetched from a
+	// target, including those that failed to decode.
+	RecordRawStats func(t *Target, payload []byte)
+	// Panics, if set, is incremented whenever a panic during collection is
+	// recovered from.
+	Panics prometheus.Counter
+	// Groups selects the metric groups reported, DefaultGroups if nil.
+	Groups *Groups
+	// LegacyNames also reports the topic and channel metrics under the names
+	// of nsqio/nsq_exporter, in the same namespace, to ease migrations.
+	LegacyNames bool
+	// LegacyOnly disables the Topics and Channels groups, leaving the
+	// legacy metrics. It requires LegacyNames.
+	LegacyOnly bool
+	// Rates exports per-second rates of the message, finish, requeue and
+	// timeout counters of every channel, derived from consecutive fetches.
+	// Finishes are only counted when the client decodes clients.
+	Rates bool
+	// RequeueRatio exports the ratio of the requeues to the finishes of
+	// every channel since the previous fetch, derived like Rates. The
+	// client must decode clients, see nsqhttp.DecodeOptions.
+	RequeueRatio bool
+	// StarvedClients exports the number of clients of every channel with a
+	// ready count of 0, which receive no messages. The client must decode
+	// clients, see nsqhttp.DecodeOptions.
+	StarvedClients bool
+	// ReadyCapacity exports the sum of the ready counts of the clients of
+	// every channel, and its depth per message the clients are ready for.
+	// The client must decode clients, see nsqhttp.DecodeOptions.
+	ReadyCapacity bool
+	// ClientsBySite exports the number of clients of every channel by the
+	// site they connect from, see SetSites. The client must decode clients,
+	// see nsqhttp.DecodeOptions.
+	ClientsBySite bool
+	// TopicIdle exports how long the message count of every topic has not
+	// changed, with the resolution of the fetches of the stats. Topics are
+	// considered active when first seen.
+	TopicIdle bool
+	// AvgMessageSize exports the average size of the messages published to
+	// every topic since the previous fetch, from the message and byte
+	// counts nsqd reports since 1.2.1.
+	AvgMessageSize bool
+	// MaxStaleness keeps reporting the last stats of a target fetched up to
+	// this long ago when fetching its stats fails, with up 0, instead of
+	// dropping its series. It also exports the age of the stats reported
+	// (0 disables it).
+	MaxStaleness time.Duration
+	// MaxAge, in poll mode, stops serving the last poll once it is older,
+	// reporting every target down instead (0 disables the limit). It must
+	// exceed the poll intervals and MaxStaleness.
+	MaxAge time.Duration
+	// DepthHistogram samples the depth of every channel whenever the stats
+	// are fetched into a histogram per topic, native as well as classic,
+	// showing the distribution of depths over time. It is meant for
+	// polling, which samples at a steady rate.
+	DepthHistogram bool
+	// Churn counts the topics and channels created and removed between two
+	// fetches of the stats of every target. Short-lived ones can go
+	// unnoticed, more so with longer intervals.
+	Churn bool
+	// DegradedThreshold is the number of consecutive failed scrapes after
+	// which a target is reported degraded, telling persistent outages from
+	// one-off failures (0 never reports targets degraded).
+	DegradedThreshold int
+	// NodeInfo exports an info metric of every target with the addresses
+	// and ports it listens on, fetched from its /info endpoint when first
+	// scraped and after nsqd restarts.
+	NodeInfo bool
+	// Hostnames fetches the /info of every target like NodeInfo, so that
+	// Target.Hostname reports the hostname nsqd advertises.
+	Hostnames bool
+	// RemoteAddress is how the remote_address label of the client metrics
+	// is reported: RemoteAddressKeep (the default), RemoteAddressHash, a
+	// keyed hash of the address, RemoteAddressSubnet, the subnet of the
+	// address, or RemoteAddressDrop, leaving the label out.
+	RemoteAddress string
+	// RemoteAddressSalt is the key of the hashes of RemoteAddressHash.
+	RemoteAddressSalt string
+	// SubnetPrefixIPv4 and SubnetPrefixIPv6 are the prefix lengths of the
+	// subnets of RemoteAddressSubnet, 24 and 64 if 0.
+	SubnetPrefixIPv4, SubnetPrefixIPv6 int
+	// LabelReplacement replaces invalid UTF-8 sequences and control
+	// characters in topic and channel names, "\uFFFD" if empty.
+	LabelReplacement string
+	// LabelMaxLength caps topic and channel names at this many characters,
+	// 0 means no limit.
+	LabelMaxLength int
+	// Timestamps attaches the time the stats of a target were fetched to
+	// its metrics, so stats served from a poll or the cache are stored at
+	// the time they were observed rather than at the time of the scrape.
+	Timestamps bool
+	// ConstLabels are added to every metric of the collector.
+	ConstLabels prometheus.Labels
+	// SeparateTelemetry leaves the exporter's own metrics, e.g. the scrape
+	// errors and workers, out of the metrics collected, to be reported by
+	// Telemetry instead.
+	SeparateTelemetry bool
+	// OnCollect, if set, is called after every collection of all the
+	// targets with whether the stats of any of them could be fetched.
+	OnCollect func(ok bool)
+	// Logger receives scrape errors, slog.Default() is used if nil.
+	Logger *slog.Logger
+	// Tracer, if set, records a span of every collection and of every
+	// target collected. Set the client's Tracer too for the fetches.
+	Tracer trace.Tracer
+}
+
+// Collector collects the metrics of a set of nsqd nodes.
+type Collector struct {
+	opts      Options
+	logger    *slog.Logger
+	tracer    trace.Tracer
+	targetsMu sync.RWMutex
+	targets   []*Target
+	lookupds  []*nsqhttp.Endpoint
+	groups    Groups
+	readiness readiness
+	series    atomic.Int64
+	allowlist atomic.Pointer[Allowlist]
+	sites     atomic.Pointer[Sites]
+	// snapshot holds the polled metrics in poll mode, it is nil in live
+	// mode.
+	snapshot *snapshot
+
+	truncatedTotal      *prometheus.CounterVec
+	sanitizedTotal      *prometheus.CounterVec
+	decodeWarningsTotal *prometheus.CounterVec
+	scrapeErrorsTotal   *prometheus.CounterVec
+	httpErrorsTotal     *prometheus.CounterVec
+	consecutiveDesc     *prometheus.Desc
+	degradedDesc        *prometheus.Desc
+	certExpiryDesc      *prometheus.Desc
+	servedByDesc        *prometheus.Desc
+	workers             prometheus.Gauge
+	workersBusy         prometheus.Gauge
+	workerSeconds       prometheus.Counter
+	queueWait           prometheus.Histogram
+
+	upDesc            *prometheus.Desc
+	clientCountDesc   *prometheus.Desc
+	messageCountDesc  *prometheus.Desc
+	depthDesc         *prometheus.Desc
+	inFlightCountDesc *prometheus.Desc
+	topics            *topicDescs
+	clients           *clientDescs
+	consumers         *consumerDescs
+	memory            *memoryDescs
+	lookupd           *lookupdDescs
+	// legacy describes the metrics under their nsqio/nsq_exporter names, it
+	// is nil unless LegacyNames is set.
+	legacy *legacyDescs
+	// rates describes the rate gauges, it is nil unless Rates is set.
+	rates *rateDescs
+	// requeueRatioDesc describes the requeue ratio, it is nil unless
+	// RequeueRatio is set.
+	requeueRatioDesc *prometheus.Desc
+	// starvedDesc describes the starved client count, it is nil unless
+	// StarvedClients is set.
+	starvedDesc *prometheus.Desc
+	// readyCapacityDesc and readySaturationDesc describe the ready
+	// capacity of the channels, they are nil unless ReadyCapacity is set.
+	readyCapacityDesc   *prometheus.Desc
+	readySaturationDesc *prometheus.Desc
+	// sitesDesc describes the client counts by site, it is nil unless
+	// ClientsBySite is set.
+	sitesDesc *prometheus.Desc
+	// idleDesc describes the topic idle time, it is nil unless TopicIdle
+	// is set.
+	idleDesc *prometheus.Desc
+	// avgSizeDesc describes the average message size, it is nil unless
+	// AvgMessageSize is set.
+	avgSizeDesc *prometheus.Desc
+	// ageDesc describes the age of the stats reported, it is nil unless
+	// MaxStaleness is set.
+	ageDesc *prometheus.Desc
+	// infoDesc describes the node info, it is nil unless NodeInfo is set.
+	infoDesc *prometheus.Desc
+	// depthHistogram holds the sampled depths, it is nil unless
+	// DepthHistogram is set.
+	depthHistogram *prometheus.HistogramVec
+	// churn counts the topics and channels created and removed, it is nil
+	// unless Churn is set.
+	churn *churnCounters
+}
+
+// New creates a collector without targets, see SetTargets.
+func New(opts Options) *Collector {
+	if opts.Namespace == "" {
+		opts.Namespace = "nsq"
+	}
+	if opts.LabelReplacement == "" {
+		opts.LabelReplacement = string(utf8.RuneError)
+	}
+	if opts.Client == nil {
+		opts.Client = &nsqhttp.Client{}
+	}
+	logger := opts.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	var tracer trace.Tracer = noop.Tracer{}
+	if opts.Tracer != nil {
+		tracer = opts.Tracer
+	}
+
+	groups := DefaultGroups
+	if opts.Groups != nil {
+		groups = *opts.Groups
+	}
+	if opts.LegacyOnly {
+		groups.Topics, groups.Channels = false, false
+	}
+
+	namespace, subsystem, constLabels := opts.Namespace, opts.Subsystem, opts.ConstLabels
+	channelLabels := []string{"node", "topic", "channel", "paused"}
+	c := &Collector{
+		opts:   opts,
+		logger: logger,
+		tracer: tracer,
+		groups: groups,
+		truncatedTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   namespace,
+				Subsystem:   "exporter",
+				Name:        "truncated_total",
+				Help:        "Number of topics, channels or clients left out of scrapes for exceeding the configured limits",
+				ConstLabels: constLabels,
+			},
+			[]string{"node", "kind"},
+		),
+		sanitizedTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   namespace,
+				Subsystem:   "exporter",
+				Name:        "sanitized_label_values_total",
+				Help:        "Number of topic and channel names rewritten into valid label values",
+				ConstLabels: constLabels,
+			},
+			[]string{"node"},
+		),
+		decodeWarningsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   namespace,
+				Subsystem:   "exporter",
+				Name:        "decode_warnings_total",
+				Help:        "Number of unknown, missing or invalid fields in the stats of nsqd, by reason",
+				ConstLabels: constLabels,
+			},
+			[]string{"node", "reason"},
+		),
+		scrapeErrorsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   namespace,
+				Subsystem:   "exporter",
+				Name:        "scrape_errors_total",
+				Help:        "Number of failed scrapes of nsqd nodes, by reason, e.g. not_http when the address is nsqd's TCP port",
+				ConstLabels: constLabels,
+			},
+			[]string{"node", "reason"},
+		),
+		httpErrorsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   namespace,
+				Subsystem:   "exporter",
+				Name:        "nsqd_http_errors_total",
+				Help:        "Number of failed scrapes of nsqd nodes answered with an HTTP status other than 200, by status code",
+				ConstLabels: constLabels,
+			},
+			[]string{"node", "code"},
+		),
+		consecutiveDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "exporter", "target_consecutive_failures"),
+			"Number of scrapes of the nsqd node that failed since the last successful one",
+			[]string{"node"}, constLabels,
+		),
+		degradedDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "exporter", "target_degraded"),
+			"Whether the consecutive failed scrapes of the nsqd node reached the degraded threshold",
+			[]string{"node"}, constLabels,
+		),
+		servedByDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystem, "node_served_by"),
+			"Endpoint the stats of the nsqd node with a fallback were fetched from, the node itself or its fallback, always 1",
+			[]string{"node", "endpoint"}, constLabels,
+		),
+		certExpiryDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "nsqd", "tls_cert_expiry_timestamp_seconds"),
+			"Unix time the TLS certificate last presented by the nsqd node expires at",
+			[]string{"node"}, constLabels,
+		),
+		workers: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Subsystem:   "exporter",
+			Name:        "scrape_workers",
+			Help:        "Maximum number of nsqd and nsqlookupd nodes fetched concurrently",
+			ConstLabels: constLabels,
+		}),
+		workersBusy: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Subsystem:   "exporter",
+			Name:        "scrape_workers_busy",
+			Help:        "Number of nsqd and nsqlookupd nodes being fetched",
+			ConstLabels: constLabels,
+		}),
+		workerSeconds: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   "exporter",
+			Name:        "scrape_worker_seconds_total",
+			Help:        "Time spent fetching nsqd and nsqlookupd nodes, summed over the workers",
+			ConstLabels: constLabels,
+		}),
+		queueWait: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace:   namespace,
+			Subsystem:   "exporter",
+			Name:        "scrape_queue_wait_seconds",
+			Help:        "Time nodes waited for a free worker before being fetched",
+			Buckets:     []float64{.001, .01, .05, .1, .25, .5, 1, 2.5, 5, 10},
+			ConstLabels: constLabels,
+		}),
+		upDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystem, "up"),
+			"Whether the last scrape of the nsqd node was successful",
+			[]string{"node"}, constLabels,
+		),
+		clientCountDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystem, "client_count"),
+			"Number of clients connected to the channel",
+			channelLabels, constLabels,
+		),
+		messageCountDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystem, "message_count"),
+			"Number of messages in the channel",
+			channelLabels, constLabels,
+		),
+		depthDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystem, "depth"),
+			"Depth of the channel's queue",
+			channelLabels, constLabels,
+		),
+		inFlightCountDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystem, "in_flight_count"),
+			"Number of messages currently in-flight in the channel",
+			channelLabels, constLabels,
+		),
+		topics:    newTopicDescs(namespace, subsystem, constLabels),
+		clients:   newClientDescs(namespace, subsystem, constLabels, newAddressMapper(opts)),
+		consumers: newConsumerDescs(namespace, subsystem, constLabels),
+		memory:    newMemoryDescs(namespace, subsystem, constLabels),
+		lookupd:   newLookupdDescs(namespace, constLabels),
+	}
+	if opts.LegacyNames {
+		c.legacy = newLegacyDescs(namespace, constLabels)
+	}
+	if opts.Rates {
+		c.rates = newRateDescs(namespace, subsystem, channelLabels, constLabels)
+	}
+	if opts.RequeueRatio {
+		c.requeueRatioDesc = prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystem, "channel_requeue_ratio"),
+			"Messages requeued in the channel per message finished by its clients since the previous fetch",
+			channelLabels, constLabels,
+		)
+	}
+	if opts.StarvedClients {
+		c.starvedDesc = prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystem, "starved_client_count"),
+			"Number of clients connected to the channel with a ready count of 0",
+			channelLabels, constLabels,
+		)
+	}
+	if opts.ReadyCapacity {
+		c.readyCapacityDesc = prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystem, "channel_ready_capacity"),
+			"Sum of the ready counts of the clients connected to the channel, the messages they are ready to receive",
+			channelLabels, constLabels,
+		)
+		c.readySaturationDesc = prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystem, "channel_ready_saturation"),
+			"Depth of the channel per message its clients are ready to receive, +Inf with messages waiting for clients ready for none",
+			channelLabels, constLabels,
+		)
+	}
+	if opts.ClientsBySite {
+		c.sitesDesc = prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystem, "channel_clients_by_site"),
+			"Number of clients connected to the channel from the site, unknown for those of none",
+			append(channelLabels, "site"), constLabels,
+		)
+	}
+	if opts.TopicIdle {
+		c.idleDesc = prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystem, "topic_idle_seconds"),
+			"Seconds since the number of messages published to the topic last changed",
+			[]string{"node", "topic", "paused"}, constLabels,
+		)
+	}
+	if opts.AvgMessageSize {
+		c.avgSizeDesc = prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystem, "topic_avg_message_bytes"),
+			"Average size in bytes of the messages published to the topic since the previous fetch",
+			[]string{"node", "topic", "paused"}, constLabels,
+		)
+	}
+	if opts.NodeInfo {
+		c.infoDesc = prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystem, "node_info"),
+			"Addresses and ports the nsqd node listens on, always 1",
+			[]string{"node", "hostname", "broadcast_address", "tcp_port", "http_port", "version"}, constLabels,
+		)
+	}
+	if opts.MaxStaleness > 0 {
+		c.ageDesc = prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "exporter", "stats_age_seconds"),
+			"Seconds since the stats of the nsqd node reported were fetched",
+			[]string{"node"}, constLabels,
+		)
+	}
+	if opts.DepthHistogram {
+		c.depthHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:                      namespace,
+			Subsystem:                      subsystem,
+			Name:                           "channel_depth_distribution",
+			Help:                           "Depths of the channels of the topic, sampled whenever the stats are fetched",
+			Buckets:                        prometheus.ExponentialBuckets(1, 4, 11),
+			NativeHistogramBucketFactor:    1.1,
+			NativeHistogramMaxBucketNumber: 100,
+			ConstLabels:                    constLabels,
+		}, []string{"node", "topic"})
+	}
+	if opts.Churn {
+		c.churn = newChurnCounters(namespace, subsystem, constLabels)
+	}
+	c.workers.Set(float64(max(opts.Concurrency, 1)))
+	return c
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.upDesc
+	ch <- c.servedByDesc
+	ch <- c.certExpiryDesc
+	if c.groups.Channels {
+		ch <- c.clientCountDesc
+		ch <- c.messageCountDesc
+		ch <- c.depthDesc
+		ch <- c.inFlightCountDesc
+	}
+	if c.groups.Topics {
+		c.topics.describe(ch)
+	}
+	if c.groups.Clients {
+		c.clients.describe(ch)
+	}
+	if c.groups.Consumers {
+		c.consumers.describe(ch)
+	}
+	if c.groups.Memory {
+		c.memory.describe(ch)
+	}
+	if c.groups.Lookupd {
+		c.lookupd.describe(ch)
+	}
+	if c.legacy != nil {
+		c.legacy.describe(ch)
+	}
+	if c.rates != nil {
+		c.rates.describe(ch)
+	}
+	if c.requeueRatioDesc != nil {
+		ch <- c.requeueRatioDesc
+	}
+	if c.starvedDesc != nil {
+		ch <- c.starvedDesc
+	}
+	if c.readyCapacityDesc != nil {
+		ch <- c.readyCapacityDesc
+		ch <- c.readySaturationDesc
+	}
+	if c.sitesDesc != nil {
+		ch <- c.sitesDesc
+	}
+	if c.idleDesc != nil {
+		ch <- c.idleDesc
+	}
+	if c.avgSizeDesc != nil {
+		ch <- c.avgSizeDesc
+	}
+	if c.ageDesc != nil {
+		ch <- c.ageDesc
+	}
+	if c.infoDesc != nil {
+		ch <- c.infoDesc
+	}
+	if c.depthHistogram != nil {
+		c.depthHistogram.Describe(ch)
+	}
+	if c.churn != nil {
+		for _, vec := range c.churn.vecs() {
+			vec.Describe(ch)
+		}
+	}
+	if !c.opts.SeparateTelemetry {
+		c.describeTelemetry(ch)
+	}
+}
+
+// Telemetry returns a collector of the exporter's own metrics, left out of
+// c with SeparateTelemetry. It reports the state of the targets as of
+// their last scrape, without fetching any stats.
+func (c *Collector) Telemetry() prometheus.Collector {
+	return telemetryCollector{c}
+}
+
+type telemetryCollector struct {
+	c *Collector
+}
+
+func (tc telemetryCollector) Describe(ch chan<- *prometheus.Desc) {
+	tc.c.describeTelemetry(ch)
+}
+
+func (tc telemetryCollector) Collect(ch chan<- prometheus.Metric) {
+	tc.c.collectTelemetry(ch)
+	for _, t := range tc.c.Targets() {
+		tc.c.collectTargetFailures(t, func(m prometheus.Metric) { ch <- m })
+	}
+}
+
+func (c *Collector) describeTelemetry(ch chan<- *prometheus.Desc) {
+	ch <- c.consecutiveDesc
+	ch <- c.degradedDesc
+	c.truncatedTotal.Describe(ch)
+	c.sanitizedTotal.Describe(ch)
+	c.decodeWarningsTotal.Describe(ch)
+	c.scrapeErrorsTotal.Describe(ch)
+	c.httpErrorsTotal.Describe(ch)
+	c.workers.Describe(ch)
+	c.workersBusy.Describe(ch)
+	c.workerSeconds.Describe(ch)
+	c.queueWait.Describe(ch)
+}
+
+func (c *Collector) collectTelemetry(ch chan<- prometheus.Metric) {
+	c.truncatedTotal.Collect(ch)
+	c.sanitizedTotal.Collect(ch)
+	c.decodeWarningsTotal.Collect(ch)
+	c.scrapeErrorsTotal.Collect(ch)
+	c.httpErrorsTotal.Collect(ch)
+	c.workers.Collect(ch)
+	c.workersBusy.Collect(ch)
+	c.workerSeconds.Collect(ch)
+	c.queueWait.Collect(ch)
+}
+
+// Collect implements prometheus.Collector. It reports the metrics of every
+// target, fetching their stats unless the collector is polling.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.collectContext(context.Background(), nil, ch)
+}
+
+// WithContext returns a collector reporting the metrics of c whose stats
+// fetches are cancelled once ctx is done. Registered on a registry created
+// for a single scrape, it stops the fetches of a scrape the client gave up
+// on.
+func (c *Collector) WithContext(ctx context.Context) prometheus.Collector {
+	return &contextCollector{c: c, ctx: ctx}
+}
+
+// WithTargets is WithContext, only fetching the stats of the targets keep
+// returns true for and none of the lookupds. Such partial scrapes don't
+// count towards the readiness and the series count of c. In poll mode, the
+// metrics of every target are reported.
+func (c *Collector) WithTargets(ctx context.Context, keep func(*Target) bool) prometheus.Collector {
+	return &contextCollector{c: c, ctx: ctx, keep: keep}
+}
+
+type contextCollector struct {
+	c    *Collector
+	ctx  context.Context
+	keep func(*Target) bool
+}
+
+func (cc *contextCollector) Describe(ch chan<- *prometheus.Desc) {
+	cc.c.Describe(ch)
+}
+
+func (cc *contextCollector) Collect(ch chan<- prometheus.Metric) {
+	cc.c.collectContext(cc.ctx, cc.keep, ch)
+}
+
+func (c *Collector) collectContext(ctx context.Context, keep func(*Target) bool, ch chan<- prometheus.Metric) {
+	if c.snapshot != nil {
+		metrics, at := c.snapshot.get()
+		if age := time.Since(at); c.opts.MaxAge > 0 && !at.IsZero() && age > c.opts.MaxAge {
+			c.logger.Warn("Last poll is too old, reporting every node down", "age", age, "max_age", c.opts.MaxAge)
+			metrics = nil
+			for _, t := range c.Targets() {
+				ch <- prometheus.MustNewConstMetric(c.upDesc, prometheus.GaugeValue, 0, t.endpoint.Node)
+			}
+		}
+		for _, m := range metrics {
+			ch <- m
+		}
+	} else {
+		c.collect(ctx, keep, func(m prometheus.Metric) { ch <- m })
+	}
+	if !c.opts.SeparateTelemetry {
+		c.collectTelemetry(ch)
+	}
+	if c.depthHistogram != nil {
+		c.depthHistogram.Collect(ch)
+	}
+	if c.churn != nil {
+		for _, vec := range c.churn.vecs() {
+			vec.Collect(ch)
+		}
+	}
+	if c.groups.Lookupd {
+		c.lookupd.collect(ch)
+	}
+}
+
+// collect fetches the stats of every target, or of those keep returns true
+// for, and builds the metrics from them, so only topics and channels that
+// currently exist are reported.
+func (c *Collector) collect(ctx context.Context, keep func(*Target) bool, send func(prometheus.Metric)) {
+	ctx, span := c.tracer.Start(ctx, "collect")
+	defer span.End()
+	var (
+		mu     sync.Mutex
+		series int
+		ok     bool
+		wg     sync.WaitGroup
+	)
+	emit := func(m prometheus.Metric) {
+		mu.Lock()
+		defer mu.Unlock()
+		series++
+		send(m)
+	}
+
+	// Fetch the targets concurrently, at most Concurrency at a time. They
+	// are all queued at start.
+	start := time.Now()
+	sem := make(chan struct{}, max(c.opts.Concurrency, 1))
+	acquire := func() time.Time {
+		wg.Add(1)
+		sem <- struct{}{}
+		acquired := time.Now()
+		c.queueWait.Observe(acquired.Sub(start).Seconds())
+		c.workersBusy.Inc()
+		return acquired
+	}
+	release := func(acquired time.Time) {
+		c.workerSeconds.Add(time.Since(acquired).Seconds())
+		c.workersBusy.Dec()
+		<-sem
+		wg.Done()
+	}
+	for _, t := range c.Targets() {
+		if keep != nil && !keep(t) {
+			continue
+		}
+		acquired := acquire()
+		go func() {
+			defer release(acquired)
+			if c.safeCollectTarget(ctx, t, emit) {
+				mu.Lock()
+				ok = true
+				mu.Unlock()
+			}
+		}()
+	}
+	if c.groups.Lookupd && keep == nil {
+		for _, e := range c.Lookupds() {
+			acquired := acquire()
+			go func() {
+				defer release(acquired)
+				c.collectLookupd(ctx, e, emit)
+			}()
+		}
+	}
+	wg.Wait()
+	if keep == nil {
+		c.readiness.record(ok)
+		c.series.Store(int64(series))
+		if c.opts.OnCollect != nil {
+			c.opts.OnCollect(ok)
+		}
+	}
+	span.SetAttributes(attribute.Int("nsq.series", series))
+}
+
+// Targets returns the targets currently scraped.
+func (c *Collector) Targets() []*Target {
+	c.targetsMu.RLock()
+	defer c.targetsMu.RUnlock()
+	return c.targets
+}
+
+// SetTargets replaces the targets scraped.
+func (c *Collector) SetTargets(targets []*Target) {
+	c.targetsMu.Lock()
+	c.targets = targets
+	c.targetsMu.Unlock()
+}
+
+// SeriesCount returns the number of series exported by the most recent
+// scrape.
+func (c *Collector) SeriesCount() int64 {
+	return c.series.Load()
+}
+
+// safeCollectTarget is collectTarget, recovering from panics caused for
+// example by unexpected stats, so a single target can't crash the process
+// or fail the other targets. The target is reported down unless its metrics
+// were already partly emitted.
+func (c *Collector) safeCollectTarget(ctx context.Context, t *Target, emit func(prometheus.Metric)) (ok bool) {
+	start := time.Now()
+	emitted := false
+	ctx, span := c.tracer.Start(ctx, "collect target", trace.WithAttributes(attribute.String("nsq.node", t.endpoint.Node)))
+	defer func() {
+		if !ok {
+			span.SetStatus(codes.Error, "target not collected")
+		}
+		span.End()
+	}()
+	// Runs after the recovery, which records panics as failures.
+	defer c.collectTargetState(t, emit)
+	defer func() {
+		if r := recover(); r != nil {
+			if c.opts.Panics != nil {
+				c.opts.Panics.Inc()
+			}
+			c.logger.Error("Panic while collecting metrics", "node", t.endpoint.Node, "panic", r, "stack", string(debug.Stack()))
+			t.status.recordPanic(start, fmt.Errorf("panic while collecting metrics: %v", r))
+			if !emitted {
+				emit(prometheus.MustNewConstMetric(c.upDesc, prometheus.GaugeValue, 0, t.endpoint.Node))
+			}
+			ok = false
+		}
+	}()
+	return c.collectTarget(ctx, t, start, func(m prometheus.Metric) {
+		emitted = true
+		emit(m)
+	})
+}
+
+// collectTargetFailures emits the consecutive failures of t and whether it
+// is degraded.
+func (c *Collector) collectTargetFailures(t *Target, emit func(prometheus.Metric)) {
+	status := t.Status()
+	degraded := 0.0
+	if status.Degraded {
+		degraded = 1
+	}
+	emit(prometheus.MustNewConstMetric(c.consecutiveDesc, prometheus.GaugeValue, float64(status.ConsecutiveFailures), t.endpoint.Node))
+	emit(prometheus.MustNewConstMetric(c.degradedDesc, prometheus.GaugeValue, degraded, t.endpoint.Node))
+}
+
+// collectTargetState emits the consecutive failures of t, whether it is
+// degraded and, if reached over TLS, when its certificate expires.
+func (c *Collector) collectTargetState(t *Target, emit func(prometheus.Metric)) {
+	if !c.opts.SeparateTelemetry {
+		c.collectTargetFailures(t, emit)
+	}
+	if expiry := t.endpoint.CertExpiry(); !expiry.IsZero() {
+		emit(prometheus.MustNewConstMetric(c.certExpiryDesc, prometheus.GaugeValue, float64(expiry.Unix()), t.endpoint.Node))
+	}
+}
+
+// collectTarget emits the metrics of a single target, scraped at start, and
+// reports whether its stats could be fetched. If they couldn't, the last
+// stats fetched within MaxStaleness are emitted with up 0.
+func (c *Collector) collectTarget(ctx context.Context, t *Target, start time.Time, emit func(prometheus.Metric)) bool {
+	node := t.endpoint.Node
+	var (
+		stats     *nsqhttp.Stats
+		fetchedAt time.Time
+		err       error
+	)
+	if !t.breaker.allow() {
+		err = ErrCircuitOpen
+		t.status.record(start, err)
+		c.scrapeErrorsTotal.WithLabelValues(node, "circuit_open").Inc()
+	} else {
+		ttl := c.opts.CacheTTL
+		if c.snapshot != nil {
+			ttl = c.snapshot.ttl(t)
+		}
+		stats, fetchedAt, err = c.cachedStats(ctx, t, ttl)
+		t.status.record(start, err)
+		if err != nil {
+			c.scrapeErrorsTotal.WithLabelValues(node, nsqhttp.ErrorReason(err)).Inc()
+			if code := nsqhttp.ErrorStatusCode(err); code != 0 {
+				c.httpErrorsTotal.WithLabelValues(node, strconv.Itoa(code)).Inc()
+			}
+			t.breaker.failure()
+			if t.breaker.open() {
+				c.logger.Error("Error fetching stats, skipping node", "node", node, "scrapes", c.opts.BreakerSkip, "err", err)
+			} else {
+				c.logger.Error("Error fetching stats", "node", node, "err", err)
+			}
+		} else {
+			t.breaker.success()
+		}
+	}
+	up := 1.0
+	if err != nil {
+		up = 0
+		if stats, fetchedAt = c.staleStats(t); stats == nil {
+			emit(prometheus.MustNewConstMetric(c.upDesc, prometheus.GaugeValue, 0, node))
+			return false
+		}
+		c.logger.Debug("Reporting stale stats", "node", node, "age", time.Since(fetchedAt))
+	}
+	if c.ageDesc != nil {
+		emit(prometheus.MustNewConstMetric(c.ageDesc, prometheus.GaugeValue, time.Since(fetchedAt).Seconds(), node))
+	}
+	if c.opts.Timestamps {
+		send := emit
+		emit = func(m prometheus.Metric) {
+			send(prometheus.NewMetricWithTimestamp(fetchedAt, m))
+		}
+	}
+	emit(prometheus.MustNewConstMetric(c.upDesc, prometheus.GaugeValue, up, node))
+	if served := t.ServedBy(); t.fallback != nil && served != nil {
+		emit(prometheus.MustNewConstMetric(c.servedByDesc, prometheus.GaugeValue, 1, node, served.Node))
+	}
+	if err == nil {
+		c.logger.Debug("Fetched stats", "node", node, "topics", len(stats.Topics), "duration", time.Since(start))
+	}
+
+	if c.infoDesc != nil || c.opts.Hostnames {
+		if info := c.nodeInfo(ctx, t, stats); info != nil && c.infoDesc != nil {
+			emit(prometheus.MustNewConstMetric(c.infoDesc, prometheus.GaugeValue, 1, node, info.Hostname, info.BroadcastAddress,
+				strconv.Itoa(info.TCPPort), strconv.Itoa(info.HTTPPort), info.Version))
+		}
+	}
+	if c.groups.Memory && stats.Memory != nil {
+		c.memory.collect(node, stats.Memory, stats.StartTime, emit)
+	}
+	sites := c.sites.Load()
+	if sites == nil {
+		sites = &Sites{}
+	}
+	channels := 0
+	for _, topic := range stats.Topics {
+		channels += len(topic.Channels)
+		if c.legacy != nil {
+			c.legacy.collect(node, topic, emit)
+		}
+		if c.groups.Topics {
+			c.topics.collect(node, topic, stats.StartTime, emit)
+		}
+		if c.idleDesc != nil {
+			if idle, ok := t.idle.idle(topic.TopicName, fetchedAt); ok {
+				emit(prometheus.MustNewConstMetric(c.idleDesc, prometheus.GaugeValue, idle.Seconds(), node, topic.TopicName, strconv.FormatBool(topic.Paused)))
+			}
+		}
+		if c.avgSizeDesc != nil {
+			if size, ok := t.sizes.get(topic.TopicName); ok {
+				emit(prometheus.MustNewConstMetric(c.avgSizeDesc, prometheus.GaugeValue, size, node, topic.TopicName, strconv.FormatBool(topic.Paused)))
+			}
+		}
+		for _, channel := range topic.Channels {
+			labels := []string{node, topic.TopicName, channel.ChannelName, strconv.FormatBool(channel.Paused)}
+			if c.groups.Channels {
+				emit(prometheus.MustNewConstMetric(c.clientCountDesc, prometheus.GaugeValue, float64(channel.ClientCount), labels...))
+				emit(prometheus.MustNewConstMetric(c.messageCountDesc, prometheus.GaugeValue, float64(channel.MessageCount), labels...))
+				emit(prometheus.MustNewConstMetric(c.depthDesc, prometheus.GaugeValue, float64(channel.Depth), labels...))
+				emit(prometheus.MustNewConstMetric(c.inFlightCountDesc, prometheus.GaugeValue, float64(channel.InFlightCount), labels...))
+			}
+			if c.rates != nil {
+				if r, ok := t.rates.get(topic.TopicName, channel.ChannelName); ok {
+					c.rates.collect(r, emit, labels...)
+				}
+			}
+			if c.requeueRatioDesc != nil {
+				// Channels without requeues nor finishes have no ratio,
+				// those with requeues only an infinite one.
+				if r, ok := t.rates.get(topic.TopicName, channel.ChannelName); ok && (r.requeues > 0 || r.finishes > 0) {
+					emit(prometheus.MustNewConstMetric(c.requeueRatioDesc, prometheus.GaugeValue, r.requeues/r.finishes, labels...))
+				}
+			}
+			if c.starvedDesc != nil {
+				emit(prometheus.MustNewConstMetric(c.starvedDesc, prometheus.GaugeValue, float64(starvedClients(channel)), labels...))
+			}
+			if c.readyCapacityDesc != nil {
+				capacity := readyCapacity(channel)
+				// An empty channel isn't saturated, whatever its capacity.
+				saturation := 0.0
+				if channel.Depth > 0 {
+					saturation = float64(channel.Depth) / float64(capacity)
+				}
+				emit(prometheus.MustNewConstMetric(c.readyCapacityDesc, prometheus.GaugeValue, float64(capacity), labels...))
+				emit(prometheus.MustNewConstMetric(c.readySaturationDesc, prometheus.GaugeValue, saturation, labels...))
+			}
+			if c.sitesDesc != nil {
+				for site, n := range sites.count(channel) {
+					emit(prometheus.MustNewConstMetric(c.sitesDesc, prometheus.GaugeValue, float64(n), append(labels, site)...))
+				}
+			}
+			if c.groups.Clients {
+				c.clients.collect(node, topic.TopicName, channel, emit)
+			}
+			if c.groups.Consumers {
+				c.consumers.collect(node, topic.TopicName, channel, emit)
+			}
+		}
+	}
+	t.status.setSize(len(stats.Topics), channels)
+	return err == nil
+}
+
+// staleStats returns the last stats of t if they were fetched within
+// MaxStaleness, nil otherwise.
+func (c *Collector) staleStats(t *Target) (*nsqhttp.Stats, time.Time) {
+	if c.opts.MaxStaleness <= 0 {
+		return nil, time.Time{}
+	}
+	stats, fetchedAt := t.LastStats()
+	if stats == nil || time.Since(fetchedAt) > c.opts.MaxStaleness {
+		return nil, time.Time{}
+	}
+	return stats, fetchedAt
+}
+
+// starvedClients counts the clients of channel that are not ready to
+// receive messages, because they backed off or are at their max-in-flight.
+func starvedClients(channel nsqhttp.ChannelStats) int {
+	n := 0
+	for _, client := range channel.Clients {
+		if client.ReadyCount == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// readyCapacity returns the sum of the ready counts of the clients of
+// channel.
+func readyCapacity(channel nsqhttp.ChannelStats) int64 {
+	var n int64
+	for _, client := range channel.Clients {
+		n += client.ReadyCount
+	}
+	return n
+}
+
+// recordTruncation counts what was left out of the stats of node.
+func (c *Collector) recordTruncation(node string, tr nsqhttp.Truncation) {
+	for kind, n := range map[string]int{"topic": tr.Topics, "channel": tr.Channels, "client": tr.Clients} {
+		if n > 0 {
+			c.truncatedTotal.WithLabelValues(node, kind).Add(float64(n))
+			c.logger.Warn("Stats exceed the configured limits, truncated", "node", node, "kind", kind, "dropped", n)
+		}
+	}
+}
+
+// recordWarnings counts the unexpected fields in the stats of node. Unknown
+// fields are expected from newer nsqd versions and only logged at debug
+// level.
+func (c *Collector) recordWarnings(node string, warnings map[nsqhttp.DecodeWarning]int) {
+	for w, n := range warnings {
+		c.decodeWarningsTotal.WithLabelValues(node, w.Reason).Add(float64(n))
+		if w.Reason == "unknown" {
+			c.logger.Debug("Unknown field in stats", "node", node, "field", w.Field, "count", n)
+		} else {
+			c.logger.Warn("Unexpected stats, field "+w.Reason, "node", node, "field", w.Field, "count", n)
+		}
+	}
+}
+
+// fetchStats fetches the stats of t, bounded by TargetTimeout.
+func (c *Collector) fetchStats(ctx context.Context, t *Target) (*nsqhttp.Stats, error) {
+	if c.opts.TargetTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.opts.TargetTimeout)
+		defer cancel()
+	}
+	var raw func([]byte)
+	if c.opts.KeepRawStats || c.opts.RecordRawStats != nil {
+		raw = func(payload []byte) {
+			if c.opts.KeepRawStats {
+				t.raw.set(payload)
+			}
+			if c.opts.RecordRawStats != nil {
+				c.opts.RecordRawStats(t, payload)
+			}
+		}
+	}
+	served := t.endpoint
+	stats, err := c.opts.Client.Stats(ctx, t.endpoint, raw)
+	if err != nil && t.fallback != nil && ctx.Err() == nil {
+		var fallbackErr error
+		if stats, fallbackErr = c.opts.Client.Stats(ctx, t.fallback, raw); fallbackErr == nil {
+			c.logger.Warn("Fetching stats failed, using the fallback", "node", t.endpoint.Node, "fallback", t.fallback.Node, "err", err)
+			served, err = t.fallback, nil
+		} else {
+			c.logger.Debug("Fetching stats from the fallback failed", "node", t.endpoint.Node, "fallback", t.fallback.Node, "err", fallbackErr)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if prev := t.servedBy.Swap(served); prev != nil && prev != served {
+		// The counters of the other endpoint are no baseline for those of
+		// served.
+		t.resetBaselines()
+	}
+	c.recordTruncation(t.endpoint.Node, stats.Truncated)
+	c.recordWarnings(t.endpoint.Node, stats.Warnings)
+	c.sanitizeStats(t.endpoint.Node, stats)
+	if a := c.allowlist.Load(); a != nil {
+		a.apply(stats)
+	}
+	if c.rates != nil || c.requeueRatioDesc != nil {
+		t.rates.update(stats, time.Now())
+	}
+	if c.idleDesc != nil {
+		t.idle.update(stats, time.Now())
+	}
+	if c.avgSizeDesc != nil {
+		t.sizes.update(stats)
+	}
+	if c.depthHistogram != nil {
+		c.sampleDepths(t, stats)
+	}
+	if c.churn != nil {
+		c.observeChurn(t, stats)
+	}
+	if prev, _ := t.LastStats(); prev == nil || prev.Version != stats.Version {
+		c.checkVersion(t.endpoint.Node, stats.Version)
+	}
+	t.last.set(stats)
+	return stats, nil
+}
@@ -0,0 +1,29 @@
+package collector
+
+import (
+	"github.com/amartorelli/nsq_exporter/pkg/nsqhttp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sampleDepths observes the depth of every channel of stats, fetched from
+// t, in the depth histogram of its topic. The histograms of the topics t no
+// longer reports are removed.
+func (c *Collector) sampleDepths(t *Target, stats *nsqhttp.Stats) {
+	node := t.endpoint.Node
+	seen := make(map[string]bool, len(stats.Topics))
+	for _, topic := range stats.Topics {
+		seen[topic.TopicName] = true
+		h := c.depthHistogram.WithLabelValues(node, topic.TopicName)
+		for _, ch := range topic.Channels {
+			h.Observe(float64(ch.Depth))
+		}
+	}
+	t.sampledMu.Lock()
+	defer t.sampledMu.Unlock()
+	for topic := range t.sampled {
+		if !seen[topic] {
+			c.depthHistogram.Delete(prometheus.Labels{"node": node, "topic": topic})
+		}
+	}
+	t.sampled = seen
+}
@@ -0,0 +1,301 @@
+package collector
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/amartorelli/nsq_exporter/pkg/nsqhttp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Groups select the groups of metrics a collector reports, nsq_up is
+// always reported.
+type Groups struct {
+	// Channels are the depth, message, in-flight and client counts of
+	// every channel.
+	Channels bool
+	// Topics are the depth and message counts of every topic.
+	Topics bool
+	// Clients are the metrics of every client connected to a channel. The
+	// collector's client must decode clients, see nsqhttp.DecodeOptions.
+	Clients bool
+	// Consumers are the metrics of the clients connected to a channel
+	// summed up by hostname, bounded by the number of consumer hosts rather
+	// than connections. The client must decode clients too.
+	Consumers bool
+	// Memory are the Go runtime memory statistics of nsqd.
+	Memory bool
+	// Lookupd are the metrics of the nsqlookupd nodes, see SetLookupds.
+	Lookupd bool
+}
+
+// DefaultGroups are the groups reported unless Options.Groups is set.
+var DefaultGroups = Groups{Channels: true, Topics: true}
+
+// counter creates a counter, with its created timestamp if the Unix time
+// created is known, so OpenMetrics scrapers can detect resets.
+func counter(desc *prometheus.Desc, value float64, created int64, labels ...string) prometheus.Metric {
+	if created <= 0 {
+		return prometheus.MustNewConstMetric(desc, prometheus.CounterValue, value, labels...)
+	}
+	return prometheus.MustNewConstMetricWithCreatedTimestamp(desc, prometheus.CounterValue, value, time.Unix(created, 0), labels...)
+}
+
+// topicDescs describe the metrics of the topics group.
+type topicDescs struct {
+	depth        *prometheus.Desc
+	backendDepth *prometheus.Desc
+	messages     *prometheus.Desc
+	channels     *prometheus.Desc
+	depthSkew    *prometheus.Desc
+}
+
+func newTopicDescs(namespace, subsystem string, constLabels prometheus.Labels) *topicDescs {
+	labels := []string{"node", "topic", "paused"}
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, subsystem, name), help, labels, constLabels)
+	}
+	return &topicDescs{
+		depth:        desc("topic_queue_depth", "Number of messages queued in memory by the topic"),
+		backendDepth: desc("topic_backend_queue_depth", "Number of messages queued on disk by the topic"),
+		messages:     desc("topic_messages_total", "Number of messages published to the topic"),
+		channels:     desc("topic_channels", "Number of channels of the topic"),
+		depthSkew:    desc("topic_channel_depth_skew", "Difference between the largest and the smallest depth of the channels of the topic"),
+	}
+}
+
+func (d *topicDescs) describe(ch chan<- *prometheus.Desc) {
+	ch <- d.depth
+	ch <- d.backendDepth
+	ch <- d.messages
+	ch <- d.channels
+	ch <- d.depthSkew
+}
+
+// collect emits the metrics of topic, whose counters started at created.
+func (d *topicDescs) collect(node string, topic nsqhttp.TopicStats, created int64, emit func(prometheus.Metric)) {
+	labels := []string{node, topic.TopicName, strconv.FormatBool(topic.Paused)}
+	emit(prometheus.MustNewConstMetric(d.depth, prometheus.GaugeValue, float64(topic.Depth), labels...))
+	emit(prometheus.MustNewConstMetric(d.backendDepth, prometheus.GaugeValue, float64(topic.BackendDepth), labels...))
+	emit(counter(d.messages, float64(topic.MessageCount), created, labels...))
+	emit(prometheus.MustNewConstMetric(d.channels, prometheus.GaugeValue, float64(len(topic.Channels)), labels...))
+	if len(topic.Channels) > 0 {
+		lo, hi := topic.Channels[0].Depth, topic.Channels[0].Depth
+		for _, ch := range topic.Channels[1:] {
+			lo, hi = min(lo, ch.Depth), max(hi, ch.Depth)
+		}
+		emit(prometheus.MustNewConstMetric(d.depthSkew, prometheus.GaugeValue, float64(hi-lo), labels...))
+	}
+}
+
+// clientDescs describe the metrics of the clients group.
+type clientDescs struct {
+	ready    *prometheus.Desc
+	inFlight *prometheus.Desc
+	messages *prometheus.Desc
+	finished *prometheus.Desc
+	requeued *prometheus.Desc
+	// address rewrites the remote_address label, nil keeps the addresses.
+	address *addressMapper
+}
+
+func newClientDescs(namespace, subsystem string, constLabels prometheus.Labels, address *addressMapper) *clientDescs {
+	labels := []string{"node", "topic", "channel", "client_id", "hostname", "remote_address"}
+	if address != nil && address.mode == RemoteAddressDrop {
+		labels = labels[:len(labels)-1]
+	}
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, subsystem, name), help, labels, constLabels)
+	}
+	return &clientDescs{
+		ready:    desc("client_ready_count", "Number of messages the client is ready to receive"),
+		inFlight: desc("client_in_flight_count", "Number of messages in-flight to the client"),
+		messages: desc("client_messages_total", "Number of messages sent to the client"),
+		finished: desc("client_finished_total", "Number of messages finished by the client"),
+		requeued: desc("client_requeued_total", "Number of messages requeued by the client"),
+		address:  address,
+	}
+}
+
+func (d *clientDescs) describe(ch chan<- *prometheus.Desc) {
+	ch <- d.ready
+	ch <- d.inFlight
+	ch <- d.messages
+	ch <- d.finished
+	ch <- d.requeued
+}
+
+// collect emits the metrics of the clients of channel. When the remote
+// addresses are rewritten, clients left with the same labels, e.g. the
+// consumers of a host once the address is dropped, are summed up as of the
+// most recent connection.
+func (d *clientDescs) collect(node, topic string, channel nsqhttp.ChannelStats, emit func(prometheus.Metric)) {
+	type series struct {
+		labels []string
+		client nsqhttp.ClientStats
+	}
+	var (
+		all   []*series
+		index map[string]*series
+	)
+	if d.address != nil {
+		index = make(map[string]*series, len(channel.Clients))
+	}
+	for _, client := range channel.Clients {
+		labels := []string{node, topic, channel.ChannelName, client.ClientID, client.Hostname, client.RemoteAddr}
+		if d.address == nil {
+			all = append(all, &series{labels, client})
+			continue
+		}
+		if d.address.mode == RemoteAddressDrop {
+			labels = labels[:len(labels)-1]
+		} else {
+			labels[len(labels)-1] = d.address.label(client.RemoteAddr)
+		}
+		key := strings.Join(labels, "\xff")
+		s, ok := index[key]
+		if !ok {
+			s = &series{labels: labels}
+			index[key] = s
+			all = append(all, s)
+		}
+		s.client.ReadyCount += client.ReadyCount
+		s.client.InFlightCount += client.InFlightCount
+		s.client.MessageCount += client.MessageCount
+		s.client.FinishCount += client.FinishCount
+		s.client.RequeueCount += client.RequeueCount
+		s.client.ConnectTS = max(s.client.ConnectTS, client.ConnectTS)
+	}
+	for _, s := range all {
+		labels, client := s.labels, s.client
+		emit(prometheus.MustNewConstMetric(d.ready, prometheus.GaugeValue, float64(client.ReadyCount), labels...))
+		emit(prometheus.MustNewConstMetric(d.inFlight, prometheus.GaugeValue, float64(client.InFlightCount), labels...))
+		emit(counter(d.messages, float64(client.MessageCount), client.ConnectTS, labels...))
+		emit(counter(d.finished, float64(client.FinishCount), client.ConnectTS, labels...))
+		emit(counter(d.requeued, float64(client.RequeueCount), client.ConnectTS, labels...))
+	}
+}
+
+// consumerDescs describe the metrics of the consumers group.
+type consumerDescs struct {
+	clients  *prometheus.Desc
+	ready    *prometheus.Desc
+	inFlight *prometheus.Desc
+	messages *prometheus.Desc
+	finished *prometheus.Desc
+	requeued *prometheus.Desc
+}
+
+func newConsumerDescs(namespace, subsystem string, constLabels prometheus.Labels) *consumerDescs {
+	labels := []string{"node", "topic", "channel", "consumer_host"}
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, subsystem, name), help, labels, constLabels)
+	}
+	return &consumerDescs{
+		clients:  desc("consumer_clients", "Number of clients of the host connected to the channel"),
+		ready:    desc("consumer_ready", "Number of messages the clients of the host are ready to receive"),
+		inFlight: desc("consumer_in_flight", "Number of messages in-flight to the clients of the host"),
+		messages: desc("consumer_messages_total", "Number of messages sent to the connected clients of the host"),
+		finished: desc("consumer_finished_total", "Number of messages finished by the connected clients of the host"),
+		requeued: desc("consumer_requeued_total", "Number of messages requeued by the connected clients of the host"),
+	}
+}
+
+func (d *consumerDescs) describe(ch chan<- *prometheus.Desc) {
+	ch <- d.clients
+	ch <- d.ready
+	ch <- d.inFlight
+	ch <- d.messages
+	ch <- d.finished
+	ch <- d.requeued
+}
+
+// collect emits the metrics of the clients of channel summed up by
+// hostname. The counters only cover the clients currently connected, they
+// start over as of the most recent connection of the host.
+func (d *consumerDescs) collect(node, topic string, channel nsqhttp.ChannelStats, emit func(prometheus.Metric)) {
+	type host struct {
+		name    string
+		clients int
+		sum     nsqhttp.ClientStats
+	}
+	var hosts []*host
+	index := make(map[string]*host)
+	for _, client := range channel.Clients {
+		h, ok := index[client.Hostname]
+		if !ok {
+			h = &host{name: client.Hostname}
+			index[client.Hostname] = h
+			hosts = append(hosts, h)
+		}
+		h.clients++
+		h.sum.ReadyCount += client.ReadyCount
+		h.sum.InFlightCount += client.InFlightCount
+		h.sum.MessageCount += client.MessageCount
+		h.sum.FinishCount += client.FinishCount
+		h.sum.RequeueCount += client.RequeueCount
+		h.sum.ConnectTS = max(h.sum.ConnectTS, client.ConnectTS)
+	}
+	for _, h := range hosts {
+		labels := []string{node, topic, channel.ChannelName, h.name}
+		emit(prometheus.MustNewConstMetric(d.clients, prometheus.GaugeValue, float64(h.clients), labels...))
+		emit(prometheus.MustNewConstMetric(d.ready, prometheus.GaugeValue, float64(h.sum.ReadyCount), labels...))
+		emit(prometheus.MustNewConstMetric(d.inFlight, prometheus.GaugeValue, float64(h.sum.InFlightCount), labels...))
+		emit(counter(d.messages, float64(h.sum.MessageCount), h.sum.ConnectTS, labels...))
+		emit(counter(d.finished, float64(h.sum.FinishCount), h.sum.ConnectTS, labels...))
+		emit(counter(d.requeued, float64(h.sum.RequeueCount), h.sum.ConnectTS, labels...))
+	}
+}
+
+// memoryDescs describe the metrics of the memory group.
+type memoryDescs struct {
+	heapObjects       *prometheus.Desc
+	heapIdleBytes     *prometheus.Desc
+	heapInUseBytes    *prometheus.Desc
+	heapReleasedBytes *prometheus.Desc
+	nextGCBytes       *prometheus.Desc
+	gcRuns            *prometheus.Desc
+	gcPause           *prometheus.Desc
+}
+
+func newMemoryDescs(namespace, subsystem string, constLabels prometheus.Labels) *memoryDescs {
+	desc := func(name, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, subsystem, name), help, append([]string{"node"}, labels...), constLabels)
+	}
+	return &memoryDescs{
+		heapObjects:       desc("memory_heap_objects", "Number of objects allocated on the heap of nsqd"),
+		heapIdleBytes:     desc("memory_heap_idle_bytes", "Bytes of idle heap spans of nsqd"),
+		heapInUseBytes:    desc("memory_heap_in_use_bytes", "Bytes of in-use heap spans of nsqd"),
+		heapReleasedBytes: desc("memory_heap_released_bytes", "Bytes of heap memory nsqd returned to the OS"),
+		nextGCBytes:       desc("memory_next_gc_bytes", "Heap size at which nsqd runs the next garbage collection"),
+		gcRuns:            desc("memory_gc_runs_total", "Number of garbage collections run by nsqd"),
+		gcPause:           desc("memory_gc_pause_seconds", "Quantiles of the pauses of the last 100 garbage collections of nsqd", "quantile"),
+	}
+}
+
+func (d *memoryDescs) describe(ch chan<- *prometheus.Desc) {
+	ch <- d.heapObjects
+	ch <- d.heapIdleBytes
+	ch <- d.heapInUseBytes
+	ch <- d.heapReleasedBytes
+	ch <- d.nextGCBytes
+	ch <- d.gcRuns
+	ch <- d.gcPause
+}
+
+// collect emits the memory statistics of nsqd, started at created.
+func (d *memoryDescs) collect(node string, m *nsqhttp.MemoryStats, created int64, emit func(prometheus.Metric)) {
+	gauge := func(desc *prometheus.Desc, v int64, labels ...string) {
+		emit(prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(v), append([]string{node}, labels...)...))
+	}
+	gauge(d.heapObjects, m.HeapObjects)
+	gauge(d.heapIdleBytes, m.HeapIdleBytes)
+	gauge(d.heapInUseBytes, m.HeapInUseBytes)
+	gauge(d.heapReleasedBytes, m.HeapReleasedBytes)
+	gauge(d.nextGCBytes, m.NextGCBytes)
+	emit(counter(d.gcRuns, float64(m.GCTotalRuns), created, node))
+	for quantile, usec := range map[string]int64{"1": m.GCPauseUsec100, "0.99": m.GCPauseUsec99, "0.95": m.GCPauseUsec95} {
+		emit(prometheus.MustNewConstMetric(d.gcPause, prometheus.GaugeValue, float64(usec)/1e6, node, quantile))
+	}
+}
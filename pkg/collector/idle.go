@@ -0,0 +1,58 @@
+package collector
+
+import (
+	"sync"
+	"time"
+
+	"github.com/amartorelli/nsq_exporter/pkg/nsqhttp"
+)
+
+// topicActivity is the message count of a topic and when it last changed.
+type topicActivity struct {
+	messages  uint64
+	changedAt time.Time
+}
+
+// idleStore tracks when the message count of every topic of a target last
+// changed, to tell how long a topic has gone without publishes.
+type idleStore struct {
+	mu     sync.Mutex
+	topics map[string]topicActivity
+}
+
+// update records the message counts of stats fetched at now. Topics seen
+// for the first time, or whose count went down because nsqd restarted, are
+// considered to have changed at now.
+func (s *idleStore) update(stats *nsqhttp.Stats, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	topics := make(map[string]topicActivity, len(stats.Topics))
+	for _, topic := range stats.Topics {
+		activity := topicActivity{messages: topic.MessageCount, changedAt: now}
+		if prev, ok := s.topics[topic.TopicName]; ok && prev.messages == topic.MessageCount {
+			activity.changedAt = prev.changedAt
+		}
+		topics[topic.TopicName] = activity
+	}
+	s.topics = topics
+}
+
+// reset forgets the message counts, so topics are considered to change at
+// the next update.
+func (s *idleStore) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.topics = nil
+}
+
+// idle returns how long the message count of topic had not changed at now,
+// if the topic is known.
+func (s *idleStore) idle(topic string, now time.Time) (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	activity, ok := s.topics[topic]
+	if !ok {
+		return 0, false
+	}
+	return max(now.Sub(activity.changedAt), 0), true
+}
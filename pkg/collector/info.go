@@ -0,0 +1,50 @@
+package collector
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/amartorelli/nsq_exporter/pkg/nsqhttp"
+)
+
+// infoRetry is how long a target's info isn't fetched again after failing.
+const infoRetry = time.Minute
+
+// infoCache holds the /info of a target, fetched again when nsqd restarts.
+type infoCache struct {
+	mu        sync.Mutex
+	info      *nsqhttp.NodeInfo
+	startTime int64
+	retryAt   time.Time
+}
+
+// nodeInfo returns the info of t, fetching it if there is none yet or nsqd
+// restarted since, as told by stats. It returns the previous info, possibly
+// nil, if that fails.
+func (c *Collector) nodeInfo(ctx context.Context, t *Target, stats *nsqhttp.Stats) *nsqhttp.NodeInfo {
+	t.info.mu.Lock()
+	defer t.info.mu.Unlock()
+	if t.info.info != nil && t.info.startTime == stats.StartTime || time.Now().Before(t.info.retryAt) {
+		return t.info.info
+	}
+	info, err := c.opts.Client.Info(ctx, t.endpoint)
+	if err != nil {
+		c.logger.Warn("Error fetching node info", "node", t.endpoint.Node, "retry_in", infoRetry, "err", err)
+		t.info.retryAt = time.Now().Add(infoRetry)
+		return t.info.info
+	}
+	t.info.info, t.info.startTime = info, stats.StartTime
+	return info
+}
+
+// Hostname returns the hostname nsqd advertises in its /info, empty until
+// it was fetched.
+func (t *Target) Hostname() string {
+	t.info.mu.Lock()
+	defer t.info.mu.Unlock()
+	if t.info.info == nil {
+		return ""
+	}
+	return t.info.info.Hostname
+}
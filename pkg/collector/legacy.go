@@ -0,0 +1,84 @@
+package collector
+
+import (
+	"strconv"
+
+	"github.com/amartorelli/nsq_exporter/pkg/nsqhttp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// legacyDescs describe the metrics under the names used by
+// nsqio/nsq_exporter, e.g. nsq_topic_channel_depth, so existing dashboards
+// keep working. A node label is added to tell the targets apart.
+type legacyDescs struct {
+	topicDepth        *prometheus.Desc
+	topicBackendDepth *prometheus.Desc
+	topicChannelCount *prometheus.Desc
+	topicMessageCount *prometheus.Desc
+
+	channelDepth         *prometheus.Desc
+	channelBackendDepth  *prometheus.Desc
+	channelInFlightCount *prometheus.Desc
+	channelDeferredCount *prometheus.Desc
+	channelMessageCount  *prometheus.Desc
+	channelRequeueCount  *prometheus.Desc
+	channelTimeoutCount  *prometheus.Desc
+	channelClientCount   *prometheus.Desc
+}
+
+func newLegacyDescs(namespace string, constLabels prometheus.Labels) *legacyDescs {
+	topicLabels := []string{"node", "type", "topic", "paused"}
+	channelLabels := []string{"node", "type", "topic", "channel", "paused"}
+	desc := func(name, help string, labels []string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "topic", name), help, labels, constLabels)
+	}
+	return &legacyDescs{
+		topicDepth:        desc("depth", "Queue depth", topicLabels),
+		topicBackendDepth: desc("backend_depth", "Queue backend depth", topicLabels),
+		topicChannelCount: desc("channel_count", "Number of channels", topicLabels),
+		topicMessageCount: desc("message_count", "Queue message count", topicLabels),
+
+		channelDepth:         desc("channel_depth", "Queue depth", channelLabels),
+		channelBackendDepth:  desc("channel_backend_depth", "Queue backend depth", channelLabels),
+		channelInFlightCount: desc("channel_inflight_count", "In-flight count", channelLabels),
+		channelDeferredCount: desc("channel_deferred_count", "Deferred count", channelLabels),
+		channelMessageCount:  desc("channel_message_count", "Queue message count", channelLabels),
+		channelRequeueCount:  desc("channel_requeue_count", "Requeue count", channelLabels),
+		channelTimeoutCount:  desc("channel_timeout_count", "Timeout count", channelLabels),
+		channelClientCount:   desc("channel_client_count", "Number of clients", channelLabels),
+	}
+}
+
+func (d *legacyDescs) describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		d.topicDepth, d.topicBackendDepth, d.topicChannelCount, d.topicMessageCount,
+		d.channelDepth, d.channelBackendDepth, d.channelInFlightCount, d.channelDeferredCount,
+		d.channelMessageCount, d.channelRequeueCount, d.channelTimeoutCount, d.channelClientCount,
+	} {
+		ch <- desc
+	}
+}
+
+// collect emits the legacy metrics of a topic of node.
+func (d *legacyDescs) collect(node string, topic nsqhttp.TopicStats, emit func(prometheus.Metric)) {
+	gauge := func(desc *prometheus.Desc, v float64, labels ...string) {
+		emit(prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, v, labels...))
+	}
+	labels := []string{node, "topic", topic.TopicName, strconv.FormatBool(topic.Paused)}
+	gauge(d.topicDepth, float64(topic.Depth), labels...)
+	gauge(d.topicBackendDepth, float64(topic.BackendDepth), labels...)
+	gauge(d.topicChannelCount, float64(len(topic.Channels)), labels...)
+	gauge(d.topicMessageCount, float64(topic.MessageCount), labels...)
+
+	for _, channel := range topic.Channels {
+		labels := []string{node, "channel", topic.TopicName, channel.ChannelName, strconv.FormatBool(channel.Paused)}
+		gauge(d.channelDepth, float64(channel.Depth), labels...)
+		gauge(d.channelBackendDepth, float64(channel.BackendDepth), labels...)
+		gauge(d.channelInFlightCount, float64(channel.InFlightCount), labels...)
+		gauge(d.channelDeferredCount, float64(channel.DeferredCount), labels...)
+		gauge(d.channelMessageCount, float64(channel.MessageCount), labels...)
+		gauge(d.channelRequeueCount, float64(channel.RequeueCount), labels...)
+		gauge(d.channelTimeoutCount, float64(channel.TimeoutCount), labels...)
+		gauge(d.channelClientCount, float64(channel.ClientCount), labels...)
+	}
+}
@@ -0,0 +1,129 @@
+package collector
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/amartorelli/nsq_exporter/pkg/nsqhttp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// lookupdDescs describe the metrics of the lookupd group, along with the
+// latency and errors of the queries.
+type lookupdDescs struct {
+	up        *prometheus.Desc
+	topics    *prometheus.Desc
+	producers *prometheus.Desc
+	producer  *prometheus.Desc
+
+	duration *prometheus.HistogramVec
+	errors   *prometheus.CounterVec
+}
+
+func newLookupdDescs(namespace string, constLabels prometheus.Labels) *lookupdDescs {
+	labels := []string{"lookupd"}
+	return &lookupdDescs{
+		up: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "lookupd", "up"),
+			"Whether the last query of the nsqlookupd node was successful",
+			labels, constLabels,
+		),
+		topics: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "lookupd", "topics"),
+			"Number of topics registered with the nsqlookupd node",
+			labels, constLabels,
+		),
+		producers: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "lookupd", "producers"),
+			"Number of nsqd nodes registered with the nsqlookupd node",
+			labels, constLabels,
+		),
+		producer: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "lookupd", "producer_info"),
+			"An nsqd node registered with the nsqlookupd node, always 1",
+			append(labels, "hostname", "broadcast_address", "tcp_port", "http_port", "version"), constLabels,
+		),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   namespace,
+			Subsystem:   "exporter",
+			Name:        "lookupd_request_duration_seconds",
+			Help:        "Duration of the queries of nsqlookupd nodes, by path",
+			Buckets:     []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+			ConstLabels: constLabels,
+		}, []string{"lookupd", "path"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   "exporter",
+			Name:        "lookupd_request_errors_total",
+			Help:        "Number of failed queries of nsqlookupd nodes, by path",
+			ConstLabels: constLabels,
+		}, []string{"lookupd", "path"}),
+	}
+}
+
+func (d *lookupdDescs) describe(ch chan<- *prometheus.Desc) {
+	ch <- d.up
+	ch <- d.topics
+	ch <- d.producers
+	ch <- d.producer
+	d.duration.Describe(ch)
+	d.errors.Describe(ch)
+}
+
+func (d *lookupdDescs) collect(ch chan<- prometheus.Metric) {
+	d.duration.Collect(ch)
+	d.errors.Collect(ch)
+}
+
+// Lookupds returns the nsqlookupd nodes reported on.
+func (c *Collector) Lookupds() []*nsqhttp.Endpoint {
+	c.targetsMu.RLock()
+	defer c.targetsMu.RUnlock()
+	return c.lookupds
+}
+
+// SetLookupds replaces the nsqlookupd nodes reported on when the Lookupd
+// group is enabled.
+func (c *Collector) SetLookupds(endpoints []*nsqhttp.Endpoint) {
+	c.targetsMu.Lock()
+	c.lookupds = endpoints
+	c.targetsMu.Unlock()
+}
+
+// collectLookupd emits the metrics of a single nsqlookupd node.
+func (c *Collector) collectLookupd(ctx context.Context, e *nsqhttp.Endpoint, emit func(prometheus.Metric)) {
+	if c.opts.TargetTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.opts.TargetTimeout)
+		defer cancel()
+	}
+	// observe records the latency and outcome of the query of path.
+	observe := func(path string, start time.Time, err error) {
+		c.lookupd.duration.WithLabelValues(e.Node, path).Observe(time.Since(start).Seconds())
+		if err != nil {
+			c.lookupd.errors.WithLabelValues(e.Node, path).Inc()
+		}
+	}
+	start := time.Now()
+	topics, err := c.opts.Client.LookupdTopics(ctx, e)
+	observe("/topics", start, err)
+	var producers []nsqhttp.LookupdProducer
+	if err == nil {
+		start = time.Now()
+		producers, err = c.opts.Client.LookupdNodes(ctx, e)
+		observe("/nodes", start, err)
+	}
+	if err != nil {
+		c.logger.Error("Error querying nsqlookupd", "lookupd", e.Node, "err", err)
+		emit(prometheus.MustNewConstMetric(c.lookupd.up, prometheus.GaugeValue, 0, e.Node))
+		return
+	}
+	emit(prometheus.MustNewConstMetric(c.lookupd.up, prometheus.GaugeValue, 1, e.Node))
+	emit(prometheus.MustNewConstMetric(c.lookupd.topics, prometheus.GaugeValue, float64(len(topics)), e.Node))
+	emit(prometheus.MustNewConstMetric(c.lookupd.producers, prometheus.GaugeValue, float64(len(producers)), e.Node))
+	for _, p := range producers {
+		emit(prometheus.MustNewConstMetric(c.lookupd.producer, prometheus.GaugeValue, 1,
+			e.Node, p.Hostname, p.BroadcastAddress, strconv.Itoa(p.TCPPort), strconv.Itoa(p.HTTPPort), p.Version))
+	}
+}
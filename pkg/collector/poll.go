@@ -0,0 +1,132 @@
+package collector
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// snapshot holds the metrics of the most recent poll.
+type snapshot struct {
+	mu      sync.RWMutex
+	metrics []prometheus.Metric
+	// at is when the last poll completed.
+	at time.Time
+	// polled is closed, and replaced, when the next poll completes.
+	polled chan struct{}
+
+	// interval is the poll interval of targets without their own, step
+	// the interval polls currently run at. They are only accessed by the
+	// polling goroutine.
+	interval, step time.Duration
+}
+
+func newSnapshot() *snapshot {
+	return &snapshot{polled: make(chan struct{})}
+}
+
+func (s *snapshot) set(metrics []prometheus.Metric) {
+	s.mu.Lock()
+	s.metrics = metrics
+	s.at = time.Now()
+	close(s.polled)
+	s.polled = make(chan struct{})
+	s.mu.Unlock()
+}
+
+// get returns the metrics of the last poll and when it completed.
+func (s *snapshot) get() ([]prometheus.Metric, time.Time) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.metrics, s.at
+}
+
+// ttl returns how long the stats of t are reused by the polls, so they are
+// only fetched every poll interval of t.
+func (s *snapshot) ttl(t *Target) time.Duration {
+	interval := t.pollInterval
+	if interval <= 0 {
+		interval = s.interval
+	}
+	if interval <= s.step {
+		return 0
+	}
+	// Fetches take time, fetch once the target is due within half a step.
+	return interval - s.step/2
+}
+
+// pollStep returns the interval polls must run at for every target to be
+// fetched at its own interval, the shortest one.
+func (c *Collector) pollStep(interval time.Duration) time.Duration {
+	step := interval
+	for _, t := range c.Targets() {
+		if t.pollInterval > 0 && t.pollInterval < step {
+			step = t.pollInterval
+		}
+	}
+	return step
+}
+
+// StartPolling makes the collector fetch the stats every interval until
+// stop is closed, Collect then serves the result of the latest poll instead
+// of contacting nsqd. It must be called before the collector is first
+// collected. The first poll is delayed by PollOffset and PollJitter.
+// Targets with their own poll interval, see Target.SetPollInterval, are
+// fetched at that interval instead, their stats are reused in between.
+func (c *Collector) StartPolling(interval time.Duration, stop <-chan struct{}) {
+	c.snapshot = newSnapshot()
+	c.snapshot.interval = interval
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+	go func() {
+		delay := c.opts.PollOffset
+		if c.opts.PollJitter > 0 {
+			delay += time.Duration(rand.Int63n(int64(c.opts.PollJitter)))
+		}
+		if delay > 0 {
+			c.logger.Debug("Delaying the first poll", "delay", delay)
+			select {
+			case <-time.After(delay):
+			case <-stop:
+				return
+			}
+		}
+		for {
+			start := time.Now()
+			// Targets may have changed on reload.
+			c.snapshot.step = c.pollStep(interval)
+			var metrics []prometheus.Metric
+			c.collect(ctx, nil, func(m prometheus.Metric) {
+				metrics = append(metrics, m)
+			})
+			c.snapshot.set(metrics)
+			c.logger.Debug("Polled nsqd", "series", len(metrics), "duration", time.Since(start))
+
+			timer := time.NewTimer(time.Until(start.Add(c.snapshot.step)))
+			select {
+			case <-timer.C:
+			case <-stop:
+				timer.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// Polled returns a channel closed when the next poll completes, after which
+// Target.LastStats returns its stats. It returns nil if the collector
+// isn't polling.
+func (c *Collector) Polled() <-chan struct{} {
+	if c.snapshot == nil {
+		return nil
+	}
+	c.snapshot.mu.RLock()
+	defer c.snapshot.mu.RUnlock()
+	return c.snapshot.polled
+}
@@ -0,0 +1,153 @@
+package collector
+
+import (
+	"sync"
+	"time"
+
+	"github.com/amartorelli/nsq_exporter/pkg/nsqhttp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// channelKey identifies a channel of a target.
+type channelKey struct {
+	topic, channel string
+}
+
+// channelCounters are the counters of a channel rates are derived from.
+type channelCounters struct {
+	messages, requeues, timeouts uint64
+	// finishes are the finish counts of the connected clients by
+	// clientKey, nsqd only counts finished messages per client.
+	finishes map[string]uint64
+}
+
+func countersOf(channel nsqhttp.ChannelStats) channelCounters {
+	counters := channelCounters{
+		messages: channel.MessageCount,
+		requeues: channel.RequeueCount,
+		timeouts: channel.TimeoutCount,
+		finishes: make(map[string]uint64, len(channel.Clients)),
+	}
+	for _, client := range channel.Clients {
+		counters.finishes[clientKey(client)] = client.FinishCount
+	}
+	return counters
+}
+
+// clientKey identifies the connection of a client. Client IDs default to
+// the short hostname, so consumers on the same host share theirs.
+func clientKey(client nsqhttp.ClientStats) string {
+	return client.ClientID + " " + client.RemoteAddr
+}
+
+// finishedSince returns the number of messages finished by the clients of
+// a channel since the fetch at prevAt, given the finish counts of its
+// clients back then. Clients that disconnected take their finishes with
+// them, so they are missing from the count rather than making it go down.
+func finishedSince(clients []nsqhttp.ClientStats, prev map[string]uint64, prevAt time.Time) uint64 {
+	var finishes uint64
+	for _, client := range clients {
+		before, ok := prev[clientKey(client)]
+		switch {
+		case ok && client.FinishCount >= before:
+			finishes += client.FinishCount - before
+		case !ok && client.ConnectTS >= prevAt.Unix():
+			// Connected since the previous fetch.
+			finishes += client.FinishCount
+		}
+	}
+	return finishes
+}
+
+// channelRates are per-second rates of the counters of a channel.
+type channelRates struct {
+	messages, finishes, requeues, timeouts float64
+}
+
+// rateStore keeps the counters of the previous fetch of a target to derive
+// per-second rates from, for systems without PromQL.
+type rateStore struct {
+	mu        sync.Mutex
+	fetchedAt time.Time
+	counters  map[channelKey]channelCounters
+	rates     map[channelKey]channelRates
+}
+
+// update derives the rates from the counters of stats fetched at now.
+// Channels whose counters went down, e.g. because nsqd restarted, get no
+// rate until the next fetch. Finishes are counted per client, as their sum
+// goes down whenever a client disconnects.
+func (s *rateStore) update(stats *nsqhttp.Stats, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elapsed := now.Sub(s.fetchedAt).Seconds()
+	counters := make(map[channelKey]channelCounters)
+	rates := make(map[channelKey]channelRates)
+	for _, topic := range stats.Topics {
+		for _, channel := range topic.Channels {
+			key := channelKey{topic.TopicName, channel.ChannelName}
+			cur := countersOf(channel)
+			counters[key] = cur
+			prev, ok := s.counters[key]
+			if !ok || elapsed <= 0 || cur.messages < prev.messages || cur.requeues < prev.requeues || cur.timeouts < prev.timeouts {
+				continue
+			}
+			rates[key] = channelRates{
+				messages: float64(cur.messages-prev.messages) / elapsed,
+				finishes: float64(finishedSince(channel.Clients, prev.finishes, s.fetchedAt)) / elapsed,
+				requeues: float64(cur.requeues-prev.requeues) / elapsed,
+				timeouts: float64(cur.timeouts-prev.timeouts) / elapsed,
+			}
+		}
+	}
+	s.fetchedAt, s.counters, s.rates = now, counters, rates
+}
+
+// reset forgets the counters, so the next update derives no rates.
+func (s *rateStore) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fetchedAt, s.counters, s.rates = time.Time{}, nil, nil
+}
+
+// get returns the rates of a channel, if known.
+func (s *rateStore) get(topic, channel string) (channelRates, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.rates[channelKey{topic, channel}]
+	return r, ok
+}
+
+// rateDescs describe the rate gauges, see Options.Rates.
+type rateDescs struct {
+	messages *prometheus.Desc
+	finishes *prometheus.Desc
+	requeues *prometheus.Desc
+	timeouts *prometheus.Desc
+}
+
+func newRateDescs(namespace, subsystem string, labels []string, constLabels prometheus.Labels) *rateDescs {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, subsystem, name), help, labels, constLabels)
+	}
+	return &rateDescs{
+		messages: desc("message_rate", "Messages per second received by the channel since the previous fetch"),
+		finishes: desc("finish_rate", "Messages per second finished by the clients of the channel since the previous fetch"),
+		requeues: desc("requeue_rate", "Messages per second requeued in the channel since the previous fetch"),
+		timeouts: desc("timeout_rate", "Messages per second timed out in the channel since the previous fetch"),
+	}
+}
+
+func (d *rateDescs) describe(ch chan<- *prometheus.Desc) {
+	ch <- d.messages
+	ch <- d.finishes
+	ch <- d.requeues
+	ch <- d.timeouts
+}
+
+func (d *rateDescs) collect(r channelRates, emit func(prometheus.Metric), labels ...string) {
+	emit(prometheus.MustNewConstMetric(d.messages, prometheus.GaugeValue, r.messages, labels...))
+	emit(prometheus.MustNewConstMetric(d.finishes, prometheus.GaugeValue, r.finishes, labels...))
+	emit(prometheus.MustNewConstMetric(d.requeues, prometheus.GaugeValue, r.requeues, labels...))
+	emit(prometheus.MustNewConstMetric(d.timeouts, prometheus.GaugeValue, r.timeouts, labels...))
+}
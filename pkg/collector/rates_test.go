@@ -0,0 +1,79 @@
+package collector
+
+import (
+	"testing"
+	"time"
+
+	"github.com/amartorelli/nsq_exporter/pkg/nsqhttp"
+)
+
+func TestRateStoreUpdate(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	client := func(id, addr string, finishes uint64, connected time.Time) nsqhttp.ClientStats {
+		return nsqhttp.ClientStats{ClientID: id, RemoteAddr: addr, FinishCount: finishes, ConnectTS: connected.Unix()}
+	}
+	stats := func(messages, requeues uint64, clients ...nsqhttp.ClientStats) *nsqhttp.Stats {
+		return &nsqhttp.Stats{Topics: []nsqhttp.TopicStats{{
+			TopicName: "orders",
+			Channels: []nsqhttp.ChannelStats{{
+				ChannelName:  "billing",
+				MessageCount: messages,
+				RequeueCount: requeues,
+				Clients:      clients,
+			}},
+		}}}
+	}
+	before := stats(100, 10,
+		client("worker", "10.0.0.1:1000", 40, start.Add(-time.Hour)),
+		client("worker", "10.0.0.1:1001", 50, start.Add(-time.Hour)),
+	)
+	for _, tt := range []struct {
+		name  string
+		after *nsqhttp.Stats
+		want  channelRates
+		ok    bool
+	}{
+		{
+			name: "steady",
+			after: stats(200, 20,
+				client("worker", "10.0.0.1:1000", 80, start.Add(-time.Hour)),
+				client("worker", "10.0.0.1:1001", 100, start.Add(-time.Hour)),
+			),
+			want: channelRates{messages: 10, finishes: 9, requeues: 1},
+			ok:   true,
+		},
+		{
+			name: "client disconnected",
+			after: stats(200, 20,
+				client("worker", "10.0.0.1:1000", 80, start.Add(-time.Hour)),
+			),
+			want: channelRates{messages: 10, finishes: 4, requeues: 1},
+			ok:   true,
+		},
+		{
+			name: "client reconnected",
+			after: stats(200, 20,
+				client("worker", "10.0.0.1:1000", 80, start.Add(-time.Hour)),
+				client("worker", "10.0.0.1:1002", 30, start.Add(5*time.Second)),
+			),
+			want: channelRates{messages: 10, finishes: 7, requeues: 1},
+			ok:   true,
+		},
+		{
+			name: "nsqd restarted",
+			after: stats(5, 0,
+				client("worker", "10.0.0.1:1003", 5, start.Add(5*time.Second)),
+			),
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var s rateStore
+			s.update(before, start)
+			s.update(tt.after, start.Add(10*time.Second))
+			got, ok := s.get("orders", "billing")
+			if ok != tt.ok || got != tt.want {
+				t.Errorf("rates = %+v, %t, want %+v, %t", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package collector
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// readiness tracks the outcome of the most recent stats fetch.
+type readiness struct {
+	mu        sync.Mutex
+	lastFetch time.Time
+	lastOK    bool
+	everOK    bool
+}
+
+func (r *readiness) record(ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastFetch = time.Now()
+	r.lastOK = ok
+	r.everOK = r.everOK || ok
+}
+
+// Ready reports whether a scrape reached any target. With a positive maxAge
+// the most recent scrape must have succeeded and be younger than maxAge,
+// otherwise a single successful scrape since startup is enough.
+func (c *Collector) Ready(maxAge time.Duration) bool {
+	r := &c.readiness
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if maxAge <= 0 {
+		return r.everOK
+	}
+	return r.lastOK && time.Since(r.lastFetch) <= maxAge
+}
+
+// CheckConnectivity fetches the stats of every target until one succeeds,
+// and reports whether one did.
+func (c *Collector) CheckConnectivity(ctx context.Context) bool {
+	for _, t := range c.Targets() {
+		if _, err := c.fetchStats(ctx, t); err == nil {
+			c.readiness.record(true)
+			return true
+		}
+	}
+	c.readiness.record(false)
+	return false
+}
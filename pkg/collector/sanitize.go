@@ -0,0 +1,60 @@
+package collector
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/amartorelli/nsq_exporter/pkg/nsqhttp"
+)
+
+// sanitizeStats rewrites the topic and channel names of stats into valid
+// label values, counting the names that were changed. Invalid UTF-8 would
+// otherwise fail the whole target.
+func (c *Collector) sanitizeStats(node string, stats *nsqhttp.Stats) {
+	sanitized := 0
+	for i := range stats.Topics {
+		topic := &stats.Topics[i]
+		if c.sanitize(&topic.TopicName) {
+			sanitized++
+		}
+		for j := range topic.Channels {
+			if c.sanitize(&topic.Channels[j].ChannelName) {
+				sanitized++
+			}
+		}
+	}
+	if sanitized > 0 {
+		c.sanitizedTotal.WithLabelValues(node).Add(float64(sanitized))
+		c.logger.Debug("Sanitized topic and channel names", "node", node, "count", sanitized)
+	}
+}
+
+// sanitize replaces invalid UTF-8 sequences and control characters in s
+// with LabelReplacement and caps it at LabelMaxLength runes. The JSON
+// decoder already turns invalid sequences into U+FFFD, so that rune is
+// replaced as well. It reports whether s was changed.
+func (c *Collector) sanitize(s *string) bool {
+	value := *s
+	if strings.IndexFunc(value, invalidRune) >= 0 {
+		var b strings.Builder
+		for _, r := range value {
+			if invalidRune(r) {
+				b.WriteString(c.opts.LabelReplacement)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+		value = b.String()
+	}
+	if limit := c.opts.LabelMaxLength; limit > 0 && utf8.RuneCountInString(value) > limit {
+		value = string([]rune(value)[:limit])
+	}
+	changed := value != *s
+	*s = value
+	return changed
+}
+
+func invalidRune(r rune) bool {
+	return r == utf8.RuneError || unicode.IsControl(r)
+}
@@ -0,0 +1,97 @@
+package collector
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/amartorelli/nsq_exporter/pkg/nsqhttp"
+)
+
+// UnknownSite is the site of the clients whose address is in none of the
+// sites' networks.
+const UnknownSite = "unknown"
+
+// Site names the networks of a site or datacenter, e.g. "eu-west" for
+// 10.1.0.0/16.
+type Site struct {
+	Name  string   `yaml:"name"`
+	CIDRs []string `yaml:"cidrs"`
+}
+
+// Sites maps the addresses of clients to the site they connect from.
+type Sites struct {
+	names    []string
+	prefixes []sitePrefix
+}
+
+type sitePrefix struct {
+	prefix netip.Prefix
+	site   string
+}
+
+// NewSites checks the networks of sites.
+func NewSites(sites []Site) (*Sites, error) {
+	s := &Sites{}
+	seen := make(map[string]bool, len(sites))
+	for i, site := range sites {
+		switch {
+		case site.Name == "":
+			return nil, fmt.Errorf("site %d: missing name", i)
+		case site.Name == UnknownSite:
+			return nil, fmt.Errorf("site %d: name %q is reserved for clients of no site", i, UnknownSite)
+		case seen[site.Name]:
+			return nil, fmt.Errorf("site %d: duplicate name %q", i, site.Name)
+		case len(site.CIDRs) == 0:
+			return nil, fmt.Errorf("site %d: missing cidrs", i)
+		}
+		seen[site.Name] = true
+		s.names = append(s.names, site.Name)
+		for _, cidr := range site.CIDRs {
+			prefix, err := netip.ParsePrefix(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("site %d: %v", i, err)
+			}
+			s.prefixes = append(s.prefixes, sitePrefix{prefix.Masked(), site.Name})
+		}
+	}
+	return s, nil
+}
+
+// site returns the site of addr, an IP and port, the one of the most
+// specific network containing it.
+func (s *Sites) site(addr string) string {
+	ip, err := netip.ParseAddr(addr)
+	if ap, apErr := netip.ParseAddrPort(addr); apErr == nil {
+		ip, err = ap.Addr(), nil
+	}
+	if err != nil {
+		return UnknownSite
+	}
+	ip = ip.Unmap()
+	site, bits := UnknownSite, -1
+	for _, p := range s.prefixes {
+		if p.prefix.Bits() > bits && p.prefix.Contains(ip) {
+			site, bits = p.site, p.prefix.Bits()
+		}
+	}
+	return site
+}
+
+// count returns the number of clients of channel by site. Every site is
+// included, clients of no site only if there are any.
+func (s *Sites) count(channel nsqhttp.ChannelStats) map[string]int {
+	counts := make(map[string]int, len(s.names)+1)
+	for _, name := range s.names {
+		counts[name] = 0
+	}
+	for _, client := range channel.Clients {
+		counts[s.site(client.RemoteAddr)]++
+	}
+	return counts
+}
+
+// SetSites replaces the sites the clients are grouped by from then on, nil
+// reports every client of an unknown site.
+func (c *Collector) SetSites(s *Sites) {
+	c.sites.Store(s)
+}
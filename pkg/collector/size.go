@@ -0,0 +1,57 @@
+package collector
+
+import (
+	"sync"
+
+	"github.com/amartorelli/nsq_exporter/pkg/nsqhttp"
+)
+
+// topicVolume are the counters of a topic message sizes are derived from.
+type topicVolume struct {
+	messages, bytes uint64
+}
+
+// sizeStore keeps the message and byte counts of the topics of the previous
+// fetch of a target, to derive the average size of the messages published
+// in between.
+type sizeStore struct {
+	mu      sync.Mutex
+	volumes map[string]topicVolume
+	sizes   map[string]float64
+}
+
+// update derives the average message sizes from stats. Topics without
+// new messages, whose counters went down because nsqd restarted, or whose
+// node doesn't report message_bytes (before nsqd 1.2.1) get none.
+func (s *sizeStore) update(stats *nsqhttp.Stats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	volumes := make(map[string]topicVolume, len(stats.Topics))
+	sizes := make(map[string]float64)
+	for _, topic := range stats.Topics {
+		cur := topicVolume{messages: topic.MessageCount, bytes: topic.MessageBytes}
+		volumes[topic.TopicName] = cur
+		prev, ok := s.volumes[topic.TopicName]
+		if !ok || cur.bytes == 0 || cur.messages <= prev.messages || cur.bytes < prev.bytes {
+			continue
+		}
+		sizes[topic.TopicName] = float64(cur.bytes-prev.bytes) / float64(cur.messages-prev.messages)
+	}
+	s.volumes, s.sizes = volumes, sizes
+}
+
+// reset forgets the volumes, so the next update derives no sizes.
+func (s *sizeStore) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.volumes, s.sizes = nil, nil
+}
+
+// get returns the average size of the messages last published to topic, if
+// known.
+func (s *sizeStore) get(topic string) (float64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	size, ok := s.sizes[topic]
+	return size, ok
+}
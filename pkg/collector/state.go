@@ -0,0 +1,82 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// state is the serialized form of the counter baselines of every target.
+type state struct {
+	Targets map[string]targetState `json:"targets"`
+}
+
+type targetState struct {
+	FetchedAt time.Time      `json:"fetched_at"`
+	Channels  []channelState `json:"channels"`
+}
+
+type channelState struct {
+	Topic    string `json:"topic"`
+	Channel  string `json:"channel"`
+	Messages uint64 `json:"messages"`
+	Requeues uint64 `json:"requeues"`
+	Timeouts uint64 `json:"timeouts"`
+	// Finishes are the finish counts of the clients by connection.
+	Finishes map[string]uint64 `json:"client_finishes,omitempty"`
+}
+
+// SaveState writes the counters rates are derived from, see Options.Rates,
+// so a restarted exporter can continue from them with LoadState instead of
+// starting without rates.
+func (c *Collector) SaveState(w io.Writer) error {
+	s := state{Targets: make(map[string]targetState)}
+	for _, t := range c.Targets() {
+		t.rates.mu.Lock()
+		if t.rates.counters != nil {
+			ts := targetState{FetchedAt: t.rates.fetchedAt}
+			for key, counters := range t.rates.counters {
+				ts.Channels = append(ts.Channels, channelState{
+					Topic:    key.topic,
+					Channel:  key.channel,
+					Messages: counters.messages,
+					Finishes: counters.finishes,
+					Requeues: counters.requeues,
+					Timeouts: counters.timeouts,
+				})
+			}
+			s.Targets[t.endpoint.URL] = ts
+		}
+		t.rates.mu.Unlock()
+	}
+	return json.NewEncoder(w).Encode(s)
+}
+
+// LoadState restores the counters written by SaveState for the targets
+// currently scraped, matched by URL.
+func (c *Collector) LoadState(r io.Reader) error {
+	var s state
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return fmt.Errorf("failed to decode state: %v", err)
+	}
+	for _, t := range c.Targets() {
+		ts, ok := s.Targets[t.endpoint.URL]
+		if !ok {
+			continue
+		}
+		counters := make(map[channelKey]channelCounters, len(ts.Channels))
+		for _, ch := range ts.Channels {
+			counters[channelKey{ch.Topic, ch.Channel}] = channelCounters{
+				messages: ch.Messages,
+				finishes: ch.Finishes,
+				requeues: ch.Requeues,
+				timeouts: ch.Timeouts,
+			}
+		}
+		t.rates.mu.Lock()
+		t.rates.fetchedAt, t.rates.counters = ts.FetchedAt, counters
+		t.rates.mu.Unlock()
+	}
+	return nil
+}
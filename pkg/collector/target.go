@@ -0,0 +1,340 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/amartorelli/nsq_exporter/pkg/nsqhttp"
+)
+
+// Target is a single nsqd node scraped by a collector.
+type Target struct {
+	endpoint *nsqhttp.Endpoint
+	// fallback is scraped instead of endpoint when fetching from it fails,
+	// nil if there is none.
+	fallback *nsqhttp.Endpoint
+	// servedBy is the endpoint the stats last fetched came from.
+	servedBy atomic.Pointer[nsqhttp.Endpoint]
+	breaker  *circuitBreaker
+	raw      rawStats
+	status   scrapeStatus
+	cache    statsCache
+	// flight is the stats fetch shared by concurrent scrapes, nil when none
+	// is in progress.
+	flightMu sync.Mutex
+	flight   *statsFetch
+	last     statsCache
+	rates    rateStore
+	idle     idleStore
+	sizes    sizeStore
+	info     infoCache
+	// sampled are the topics of the depth histograms of the target.
+	sampledMu sync.Mutex
+	sampled   map[string]bool
+	// churn are the topics and channels last seen, see observeChurn.
+	churnMu sync.Mutex
+	churn   churnStore
+	// pollInterval overrides the interval of StartPolling if positive.
+	pollInterval time.Duration
+}
+
+// NewTarget creates a target scraping e with the circuit breaker settings
+// of the collector.
+func (c *Collector) NewTarget(e *nsqhttp.Endpoint) *Target {
+	t := &Target{
+		endpoint: e,
+		breaker:  newCircuitBreaker(c.opts.BreakerThreshold, c.opts.BreakerSkip),
+	}
+	t.status.degradedAfter = c.opts.DegradedThreshold
+	return t
+}
+
+// SetPollInterval makes a polling collector fetch the stats of t every
+// interval rather than at the interval given to StartPolling. It must be
+// called before t is passed to SetTargets.
+func (t *Target) SetPollInterval(interval time.Duration) {
+	t.pollInterval = interval
+}
+
+// PollInterval returns the interval set with SetPollInterval.
+func (t *Target) PollInterval() time.Duration {
+	return t.pollInterval
+}
+
+// Endpoint returns the endpoint the target scrapes.
+func (t *Target) Endpoint() *nsqhttp.Endpoint {
+	return t.endpoint
+}
+
+// SetFallback makes t fetch the stats from e, e.g. the standby of an HA
+// pair, whenever fetching them from its endpoint fails. The metrics keep
+// the node label of the endpoint. It must be called before t is passed to
+// SetTargets.
+func (t *Target) SetFallback(e *nsqhttp.Endpoint) {
+	t.fallback = e
+}
+
+// resetBaselines forgets the counters and the topics and channels of the
+// previous fetches, when the stats start coming from another endpoint.
+func (t *Target) resetBaselines() {
+	t.rates.reset()
+	t.idle.reset()
+	t.sizes.reset()
+	t.churnMu.Lock()
+	t.churn = churnStore{}
+	t.churnMu.Unlock()
+}
+
+// Fallback returns the endpoint set with SetFallback, nil if there is
+// none.
+func (t *Target) Fallback() *nsqhttp.Endpoint {
+	return t.fallback
+}
+
+// ServedBy returns the endpoint the stats last fetched from t came from,
+// its endpoint or its fallback, nil before the first successful fetch.
+func (t *Target) ServedBy() *nsqhttp.Endpoint {
+	return t.servedBy.Load()
+}
+
+// TargetStatus is the outcome of the last scrape of a target.
+type TargetStatus struct {
+	// LastScrape is the start of the last scrape, zero if there was none.
+	LastScrape time.Time
+	Duration   time.Duration
+	// Err is the error the last scrape failed with.
+	Err error
+	// Topics and Channels count the topics and channels last seen.
+	Topics      int
+	Channels    int
+	CircuitOpen bool
+	// Scrapes and Failures count the scrapes of the target and those that
+	// failed, including the ones skipped while the circuit was open.
+	Scrapes  uint64
+	Failures uint64
+	// ConsecutiveFailures counts the scrapes that failed since the last
+	// successful one.
+	ConsecutiveFailures uint64
+	// Degraded is set once ConsecutiveFailures reaches the collector's
+	// DegradedThreshold.
+	Degraded bool
+}
+
+// Status returns the outcome of the last scrape of t.
+func (t *Target) Status() TargetStatus {
+	t.status.mu.Lock()
+	defer t.status.mu.Unlock()
+	return TargetStatus{
+		LastScrape:  t.status.last,
+		Duration:    t.status.duration,
+		Err:         t.status.err,
+		Topics:      t.status.topics,
+		Channels:    t.status.channels,
+		CircuitOpen: t.breaker.open(),
+		Scrapes:     t.status.scrapes,
+		Failures:    t.status.failures,
+
+		ConsecutiveFailures: t.status.consecutive,
+		Degraded:            t.status.degraded(),
+	}
+}
+
+// RawStats returns the payload last fetched from t and when it was
+// fetched. It is only kept when the collector's KeepRawStats option is set.
+func (t *Target) RawStats() ([]byte, time.Time) {
+	t.raw.mu.Lock()
+	defer t.raw.mu.Unlock()
+	return t.raw.payload, t.raw.fetchedAt
+}
+
+// LastStats returns the stats last fetched from t and when they were
+// fetched, nil if none were fetched yet. They must not be modified.
+func (t *Target) LastStats() (*nsqhttp.Stats, time.Time) {
+	t.last.mu.Lock()
+	defer t.last.mu.Unlock()
+	return t.last.stats, t.last.fetchedAt
+}
+
+// scrapeStatus is the outcome of the last scrape of a target.
+type scrapeStatus struct {
+	mu       sync.Mutex
+	last     time.Time
+	duration time.Duration
+	err      error
+	topics   int
+	channels int
+	scrapes  uint64
+	failures uint64
+	// consecutive counts the failures since the last success, the target
+	// is degraded once there are degradedAfter, if positive.
+	consecutive   uint64
+	degradedAfter int
+}
+
+func (s *scrapeStatus) degraded() bool {
+	return s.degradedAfter > 0 && s.consecutive >= uint64(s.degradedAfter)
+}
+
+func (s *scrapeStatus) record(start time.Time, err error) {
+	s.mu.Lock()
+	s.last = start
+	s.duration = time.Since(start)
+	s.err = err
+	s.scrapes++
+	if err != nil {
+		s.failures++
+		s.consecutive++
+	} else {
+		s.consecutive = 0
+	}
+	s.mu.Unlock()
+}
+
+// recordPanic records a scrape started at start as failed with err, once
+// even if it was already recorded before panicking.
+func (s *scrapeStatus) recordPanic(start time.Time, err error) {
+	s.mu.Lock()
+	recorded := s.last.Equal(start)
+	s.mu.Unlock()
+	if !recorded {
+		s.record(start, err)
+		return
+	}
+	s.mu.Lock()
+	if s.err == nil {
+		s.failures++
+		s.consecutive++
+	}
+	s.err = err
+	s.mu.Unlock()
+}
+
+// setSize records the number of topics and channels last seen.
+func (s *scrapeStatus) setSize(topics, channels int) {
+	s.mu.Lock()
+	s.topics = topics
+	s.channels = channels
+	s.mu.Unlock()
+}
+
+// rawStats is the last stats payload fetched from a target.
+type rawStats struct {
+	mu        sync.Mutex
+	payload   []byte
+	fetchedAt time.Time
+}
+
+func (r *rawStats) set(payload []byte) {
+	r.mu.Lock()
+	r.payload = payload
+	r.fetchedAt = time.Now()
+	r.mu.Unlock()
+}
+
+// statsCache holds the most recently fetched stats of a target.
+type statsCache struct {
+	mu        sync.Mutex
+	stats     *nsqhttp.Stats
+	fetchedAt time.Time
+}
+
+func (s *statsCache) set(stats *nsqhttp.Stats) {
+	s.mu.Lock()
+	s.stats = stats
+	s.fetchedAt = time.Now()
+	s.mu.Unlock()
+}
+
+// cachedStats returns the stats of t and when they were fetched, fetching
+// them only when the cached ones are older than ttl. Scrapes arriving while
+// a fetch is in progress wait for it and use its result, see sharedStats.
+func (c *Collector) cachedStats(ctx context.Context, t *Target, ttl time.Duration) (*nsqhttp.Stats, time.Time, error) {
+	if ttl <= 0 {
+		stats, err := c.sharedStats(ctx, t)
+		return stats, time.Now(), err
+	}
+	t.cache.mu.Lock()
+	if age := time.Since(t.cache.fetchedAt); t.cache.stats != nil && age < ttl {
+		c.logger.Debug("Using cached stats", "node", t.endpoint.Node, "age", age)
+		defer t.cache.mu.Unlock()
+		return t.cache.stats, t.cache.fetchedAt, nil
+	}
+	t.cache.mu.Unlock()
+	stats, err := c.sharedStats(ctx, t)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	t.cache.mu.Lock()
+	defer t.cache.mu.Unlock()
+	t.cache.stats = stats
+	t.cache.fetchedAt = time.Now()
+	return stats, t.cache.fetchedAt, nil
+}
+
+// statsFetch is a fetch of the stats of a target shared by the scrapes
+// waiting for it.
+type statsFetch struct {
+	done   chan struct{}
+	stats  *nsqhttp.Stats
+	err    error
+	cancel context.CancelFunc
+	// waiters is the number of scrapes waiting for the fetch.
+	waiters int
+}
+
+// sharedStats fetches the stats of t, sharing the fetch in flight if there
+// is one, so concurrent scrapes, e.g. by several Prometheus servers, don't
+// each fetch the same stats. The shared fetch is cancelled once every
+// scrape waiting for it is, so it lasts until the latest deadline of the
+// scrapes, and the TargetTimeout of the collector.
+func (c *Collector) sharedStats(ctx context.Context, t *Target) (*nsqhttp.Stats, error) {
+	t.flightMu.Lock()
+	f := t.flight
+	if f == nil {
+		// Detached from ctx, which may be cancelled while other scrapes
+		// still wait, but keeping its values, e.g. the trace.
+		fetchCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		f = &statsFetch{done: make(chan struct{}), cancel: cancel}
+		t.flight = f
+		go func() {
+			f.stats, f.err = c.fetchStats(fetchCtx, t)
+			cancel()
+			t.flightMu.Lock()
+			if t.flight == f {
+				t.flight = nil
+			}
+			t.flightMu.Unlock()
+			close(f.done)
+		}()
+	} else {
+		c.logger.Debug("Shared stats fetch", "node", t.endpoint.Node)
+	}
+	f.waiters++
+	t.flightMu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.stats, f.err
+	case <-ctx.Done():
+		t.flightMu.Lock()
+		f.waiters--
+		if f.waiters == 0 {
+			// Nobody waits for the fetch anymore, later scrapes start
+			// their own.
+			f.cancel()
+			if t.flight == f {
+				t.flight = nil
+			}
+		}
+		t.flightMu.Unlock()
+		reason := nsqhttp.ReasonCanceled
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			reason = nsqhttp.ReasonTimeout
+		}
+		return nil, &nsqhttp.FetchError{Reason: reason, Err: fmt.Errorf("failed to fetch stats: %v", ctx.Err())}
+	}
+}
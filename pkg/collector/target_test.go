@@ -0,0 +1,206 @@
+package collector
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/amartorelli/nsq_exporter/pkg/nsqhttp"
+)
+
+// slowNode is an nsqd answering stats requests once released.
+type slowNode struct {
+	server   *httptest.Server
+	requests atomic.Int32
+	// received gets the context of every stats request.
+	received chan context.Context
+	release  chan struct{}
+	once     sync.Once
+}
+
+func newSlowNode(t *testing.T) *slowNode {
+	n := &slowNode{received: make(chan context.Context, 10), release: make(chan struct{})}
+	n.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n.requests.Add(1)
+		n.received <- r.Context()
+		select {
+		case <-n.release:
+		case <-r.Context().Done():
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"version":"1.2.1","topics":[]}`))
+	}))
+	t.Cleanup(func() {
+		n.unblock()
+		n.server.Close()
+	})
+	return n
+}
+
+// unblock answers the stats requests waiting and those to come.
+func (n *slowNode) unblock() {
+	n.once.Do(func() { close(n.release) })
+}
+
+func (n *slowNode) target(t *testing.T, c *Collector) *Target {
+	e, err := nsqhttp.NewEndpoint(n.server.URL, n.server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.NewTarget(e)
+}
+
+// waitRequest returns the context of the next stats request.
+func (n *slowNode) waitRequest(t *testing.T) context.Context {
+	t.Helper()
+	select {
+	case ctx := <-n.received:
+		return ctx
+	case <-time.After(5 * time.Second):
+		t.Fatal("no stats request")
+		return nil
+	}
+}
+
+type fetchResult struct {
+	stats *nsqhttp.Stats
+	err   error
+}
+
+func fetch(ctx context.Context, c *Collector, t *Target, ttl time.Duration) <-chan fetchResult {
+	ch := make(chan fetchResult, 1)
+	go func() {
+		stats, _, err := c.cachedStats(ctx, t, ttl)
+		ch <- fetchResult{stats, err}
+	}()
+	return ch
+}
+
+func TestSharedStatsJoin(t *testing.T) {
+	n := newSlowNode(t)
+	c := New(Options{})
+	target := n.target(t, c)
+
+	first := fetch(context.Background(), c, target, 0)
+	n.waitRequest(t)
+	second := fetch(context.Background(), c, target, 0)
+	// Let the second scrape join before releasing the fetch.
+	time.Sleep(50 * time.Millisecond)
+	n.unblock()
+	for _, ch := range []<-chan fetchResult{first, second} {
+		if r := <-ch; r.err != nil || r.stats == nil {
+			t.Fatalf("stats = %v, %v", r.stats, r.err)
+		}
+	}
+	if got := n.requests.Load(); got != 1 {
+		t.Errorf("requests = %d, want 1", got)
+	}
+}
+
+func TestSharedStatsLongerDeadline(t *testing.T) {
+	n := newSlowNode(t)
+	c := New(Options{})
+	target := n.target(t, c)
+
+	shortCtx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	longCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	short := fetch(shortCtx, c, target, 0)
+	reqCtx := n.waitRequest(t)
+	long := fetch(longCtx, c, target, 0)
+
+	r := <-short
+	if nsqhttp.ErrorReason(r.err) != nsqhttp.ReasonTimeout {
+		t.Fatalf("short scrape err = %v, want a timeout", r.err)
+	}
+	if reqCtx.Err() != nil {
+		t.Fatal("fetch cancelled at the deadline of the scrape starting it")
+	}
+	n.unblock()
+	if r := <-long; r.err != nil {
+		t.Fatalf("long scrape err = %v", r.err)
+	}
+	if got := n.requests.Load(); got != 1 {
+		t.Errorf("requests = %d, want 1", got)
+	}
+}
+
+func TestSharedStatsLastWaiterLeaves(t *testing.T) {
+	n := newSlowNode(t)
+	c := New(Options{})
+	target := n.target(t, c)
+
+	firstCtx, cancelFirst := context.WithCancel(context.Background())
+	secondCtx, cancelSecond := context.WithCancel(context.Background())
+	first := fetch(firstCtx, c, target, 0)
+	reqCtx := n.waitRequest(t)
+	second := fetch(secondCtx, c, target, 0)
+	time.Sleep(50 * time.Millisecond)
+
+	cancelFirst()
+	if r := <-first; nsqhttp.ErrorReason(r.err) != nsqhttp.ReasonCanceled {
+		t.Fatalf("first scrape err = %v, want it canceled", r.err)
+	}
+	select {
+	case <-reqCtx.Done():
+		t.Fatal("fetch cancelled while a scrape still waits for it")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancelSecond()
+	if r := <-second; nsqhttp.ErrorReason(r.err) != nsqhttp.ReasonCanceled {
+		t.Fatalf("second scrape err = %v, want it canceled", r.err)
+	}
+	select {
+	case <-reqCtx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("fetch not cancelled once no scrape waits for it")
+	}
+
+	// The next scrape starts a fetch of its own.
+	next := fetch(context.Background(), c, target, 0)
+	n.waitRequest(t)
+	n.unblock()
+	if r := <-next; r.err != nil {
+		t.Fatalf("next scrape err = %v", r.err)
+	}
+}
+
+func TestCachedStatsCancel(t *testing.T) {
+	n := newSlowNode(t)
+	c := New(Options{})
+	target := n.target(t, c)
+
+	first := fetch(context.Background(), c, target, time.Minute)
+	n.waitRequest(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	second := fetch(ctx, c, target, time.Minute)
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case r := <-second:
+		if nsqhttp.ErrorReason(r.err) != nsqhttp.ReasonCanceled {
+			t.Fatalf("second scrape err = %v, want it canceled", r.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("scrape waiting for the cache ignores its cancellation")
+	}
+
+	n.unblock()
+	if r := <-first; r.err != nil {
+		t.Fatalf("first scrape err = %v", r.err)
+	}
+	// Cached now.
+	if r := <-fetch(context.Background(), c, target, time.Minute); r.err != nil {
+		t.Fatalf("cached scrape err = %v", r.err)
+	}
+	if got := n.requests.Load(); got != 1 {
+		t.Errorf("requests = %d, want 1", got)
+	}
+}
@@ -0,0 +1,18 @@
+package collector
+
+import "github.com/amartorelli/nsq_exporter/pkg/nsqhttp"
+
+// checkVersion logs the version of nsqd reported by node, and the metrics
+// it is too old to provide. It is called when a target's version is first
+// seen or changes.
+func (c *Collector) checkVersion(node, version string) {
+	v, err := nsqhttp.ParseVersion(version)
+	if err != nil {
+		c.logger.Warn("Unknown nsqd version, some metrics may be missing or zero", "node", node, "err", err)
+		return
+	}
+	c.logger.Info("Detected nsqd version", "node", node, "version", v)
+	if c.groups.Memory && !v.AtLeast(nsqhttp.VersionMemory) {
+		c.logger.Warn("nsqd reports memory stats from version "+nsqhttp.VersionMemory.String()+", memory metrics are not exported", "node", node, "version", v)
+	}
+}
@@ -0,0 +1,467 @@
+package nsqhttp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// Endpoint is the HTTP interface of a single nsqd node.
+type Endpoint struct {
+	// URL is the address the endpoint was created from.
+	URL string
+	// Node identifies the node in metrics and logs: the host and port of
+	// the URL followed by the prefix of its path, if any, or the socket
+	// path for unix sockets.
+	Node string
+	// Filter, if set, replaces the filter of the client's DecodeOptions
+	// for this endpoint.
+	Filter *Filter
+	// IPFamily is the address family, ipv4 or ipv6, preferred by the
+	// client of the endpoint, if any.
+	IPFamily string
+	// JumpHost is the SSH server the client of the endpoint connects
+	// through, if any.
+	JumpHost string
+	// Limiter, if set, limits the rate of the stats requests to the
+	// endpoint.
+	Limiter *Limiter
+
+	statsURL string
+	// baseURL is the root of the node's HTTP interface.
+	baseURL string
+	client  *http.Client
+	// version is the version of nsqd reported by the last stats decoded.
+	version atomic.Pointer[Version]
+	// certExpiry is the Unix time the certificate of the node expires at,
+	// 0 unless it was reached over TLS.
+	certExpiry atomic.Int64
+}
+
+// CertExpiry returns when the TLS certificate the node last presented
+// expires, the zero time if it wasn't reached over TLS.
+func (e *Endpoint) CertExpiry() time.Time {
+	if expiry := e.certExpiry.Load(); expiry != 0 {
+		return time.Unix(expiry, 0)
+	}
+	return time.Time{}
+}
+
+// recordCert records the expiry of the certificate the node presented in
+// the TLS handshake of resp, if any.
+func (e *Endpoint) recordCert(resp *http.Response) {
+	if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+		e.certExpiry.Store(resp.TLS.PeerCertificates[0].NotAfter.Unix())
+	}
+}
+
+// recordRejectedCert records the expiry of the certificate the node
+// presented if err is its failed verification, e.g. because it expired.
+func (e *Endpoint) recordRejectedCert(err error) {
+	var certErr *tls.CertificateVerificationError
+	if errors.As(err, &certErr) && len(certErr.UnverifiedCertificates) > 0 {
+		e.certExpiry.Store(certErr.UnverifiedCertificates[0].NotAfter.Unix())
+	}
+}
+
+// omitsClients reports whether the node is known to leave out the clients
+// of its stats when asked to.
+func (e *Endpoint) omitsClients() bool {
+	v := e.version.Load()
+	return v != nil && v.AtLeast(VersionIncludeClients)
+}
+
+// NewEndpoint creates the endpoint of the nsqd node at rawURL, the URL of
+// its /stats endpoint. Addresses of the form unix:///path/to/nsqd.sock are
+// reached over that unix socket, all other endpoints share client. The
+// endpoint of an nsqlookupd node is created the same way from the root of
+// its HTTP interface.
+func NewEndpoint(rawURL string, client *http.Client) (*Endpoint, error) {
+	u, err := ParseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	e := &Endpoint{
+		URL:      rawURL,
+		Node:     nodeName(u),
+		statsURL: u.String(),
+		baseURL:  (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: basePath(u.Path)}).String(),
+		client:   client,
+	}
+	if u.Scheme == "unix" {
+		e.statsURL = "http://localhost/stats"
+		e.baseURL = "http://localhost"
+		e.client = unixSocketClient(client, u.Path)
+	}
+	return e, nil
+}
+
+// ParseURL parses and validates the address of an nsqd node. Bare
+// host[:port] addresses are accepted for convenience: the scheme defaults
+// to http, the port to 4151 and the path to /stats. A path ending with a
+// slash is the prefix nsqd is reached under through a reverse proxy, e.g.
+// https://gateway/nsq/node-3/ for https://gateway/nsq/node-3/stats. IPv6
+// addresses are bracketed, e.g. [2001:db8::1]:4151, except for bare
+// addresses without a port. Their zone needn't be escaped, e.g.
+// [fe80::1%eth0]:4151.
+func ParseURL(rawURL string) (*url.URL, error) {
+	addr := rawURL
+	bare := !strings.Contains(addr, "://")
+	if bare {
+		if ip, err := netip.ParseAddr(addr); err == nil && ip.Is6() {
+			addr = "[" + addr + "]"
+		}
+		addr = "http://" + addr
+	}
+	u, err := url.Parse(escapeZone(addr))
+	if err != nil {
+		return nil, fmt.Errorf("invalid nsqd address %q: %v", rawURL, err)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid nsqd address %q: missing host", rawURL)
+		}
+		if strings.Count(u.Host, ":") > 1 && !strings.HasPrefix(u.Host, "[") {
+			return nil, fmt.Errorf("invalid nsqd address %q: IPv6 addresses must be enclosed in brackets, e.g. [2001:db8::1]:%s", rawURL, defaultHTTPPort)
+		}
+		if bare && u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), defaultHTTPPort)
+		}
+		if u.Port() == defaultTCPPort {
+			return nil, fmt.Errorf("invalid nsqd address %q: %s is the TCP port of nsqd, use its HTTP port (%s)", rawURL, defaultTCPPort, defaultHTTPPort)
+		}
+		if u.Path == "" || strings.HasSuffix(u.Path, "/") {
+			u.Path = strings.TrimSuffix(u.Path, "/") + "/stats"
+		}
+		u.Host = normalizeHost(u)
+	case "unix":
+		if u.Path == "" {
+			return nil, fmt.Errorf("invalid nsqd address %q: missing socket path", rawURL)
+		}
+	default:
+		return nil, fmt.Errorf("invalid nsqd address %q: scheme must be http, https or unix", rawURL)
+	}
+	return u, nil
+}
+
+// Node returns the name of the nsqd node at rawURL, the Node of its
+// endpoint. Addresses of the same node have the same name.
+func Node(rawURL string) (string, error) {
+	u, err := ParseURL(rawURL)
+	if err != nil {
+		return "", err
+	}
+	return nodeName(u), nil
+}
+
+// nodeName returns the name of the node at u, its host, or its socket.
+// Nodes behind the same reverse proxy are told apart by their prefix.
+func nodeName(u *url.URL) string {
+	if u.Scheme == "unix" {
+		return u.Path
+	}
+	return u.Host + basePath(u.Path)
+}
+
+// normalizeHost returns the host of the HTTP URL u in lower case, without
+// the default port of its scheme, so equivalent addresses of a node have the
+// same host. Zones are left as they are, interface names are case
+// sensitive.
+func normalizeHost(u *url.URL) string {
+	host, port := u.Hostname(), u.Port()
+	addr, zone, ok := strings.Cut(host, "%")
+	host = strings.ToLower(addr)
+	if ok {
+		host += "%" + zone
+	}
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	if port != "" {
+		return net.JoinHostPort(host, port)
+	}
+	if strings.Contains(host, ":") {
+		return "[" + host + "]"
+	}
+	return host
+}
+
+// basePath returns the root of the HTTP interface of the node whose stats
+// are at path: the prefix of /stats, if path ends with it.
+func basePath(path string) string {
+	if prefix, ok := strings.CutSuffix(path, "/stats"); ok {
+		return prefix
+	}
+	return ""
+}
+
+// escapeZone escapes the % introducing the zone of the bracketed IPv6 host
+// of addr, as url.Parse requires, unless it already is.
+func escapeZone(addr string) string {
+	open := strings.Index(addr, "[")
+	end := strings.Index(addr, "]")
+	if open < 0 || end < open {
+		return addr
+	}
+	i := strings.Index(addr[open:end], "%")
+	if i < 0 || strings.HasPrefix(addr[open+i:end], "%25") {
+		return addr
+	}
+	return addr[:open+i] + "%25" + addr[open+i+1:]
+}
+
+// The default ports of nsqd.
+const (
+	defaultTCPPort  = "4150"
+	defaultHTTPPort = "4151"
+)
+
+// unixSocketClient derives a client from base which sends every request to
+// the unix socket at path, regardless of the request's host.
+func unixSocketClient(base *http.Client, path string) *http.Client {
+	transport, ok := base.Transport.(*http.Transport)
+	if !ok {
+		transport = http.DefaultTransport.(*http.Transport)
+	}
+	transport = transport.Clone()
+	transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", path)
+	}
+	return &http.Client{
+		Transport:     transport,
+		Timeout:       base.Timeout,
+		CheckRedirect: base.CheckRedirect,
+	}
+}
+
+// Client fetches stats from nsqd endpoints. The zero value fetches once,
+// without a size limit or credentials.
+type Client struct {
+	// Retries is the number of times a failed fetch is retried.
+	Retries int
+	// RetryBackoff is the backoff before the first retry, doubled on every
+	// further attempt.
+	RetryBackoff time.Duration
+	// RetryJitter randomly spreads each backoff by up to this fraction of
+	// its value.
+	RetryJitter float64
+	// MaxResponseSize is the maximum size in bytes of a stats response,
+	// 0 disables the limit.
+	MaxResponseSize int64
+	// Decode controls what is kept from the stats.
+	Decode DecodeOptions
+	// TextFormat requests the plain text stats, for nodes only serving
+	// those. JSON stats are requested otherwise, text stats returned
+	// instead are decoded too.
+	TextFormat bool
+	// Authenticate, if set, adds credentials to every request.
+	Authenticate func(*http.Request) error
+	// Logger receives retries and decoding failures, slog.Default() is
+	// used if nil.
+	Logger *slog.Logger
+	// Tracer, if set, records spans of fetching and decoding stats.
+	Tracer trace.Tracer
+	// Limiter, if set, limits the rate of the stats requests to all
+	// endpoints, on top of the Limiter of each endpoint.
+	Limiter *Limiter
+}
+
+func (c *Client) tracer() trace.Tracer {
+	if c.Tracer != nil {
+		return c.Tracer
+	}
+	return noop.Tracer{}
+}
+
+func (c *Client) logger() *slog.Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return slog.Default()
+}
+
+// Stats fetches the stats of e, retrying transient failures with an
+// exponential, jittered backoff. If raw is not nil it is called with the
+// response body of every attempt.
+func (c *Client) Stats(ctx context.Context, e *Endpoint, raw func(body []byte)) (stats *Stats, err error) {
+	ctx, span := c.tracer().Start(ctx, "nsqd.stats", trace.WithAttributes(attribute.String("nsq.node", e.Node)))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+	backoff := c.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		stats, err := c.fetch(ctx, e, raw)
+		if err == nil || attempt >= c.Retries || ctx.Err() != nil || !retryable(err) {
+			span.SetAttributes(attribute.Int("nsq.attempts", attempt+1))
+			return stats, err
+		}
+		c.logger().Warn("Fetching stats failed, retrying", "node", e.Node, "attempt", attempt+1, "attempts", c.Retries+1, "err", err)
+		select {
+		case <-time.After(jitter(backoff, c.RetryJitter)):
+		case <-ctx.Done():
+			return nil, requestError(ctx.Err())
+		}
+		backoff *= 2
+	}
+}
+
+// jitter randomly spreads d by up to +/- factor of its value.
+func jitter(d time.Duration, factor float64) time.Duration {
+	if factor <= 0 {
+		return d
+	}
+	return d + time.Duration((rand.Float64()*2-1)*factor*float64(d))
+}
+
+func (c *Client) fetch(ctx context.Context, e *Endpoint, raw func([]byte)) (*Stats, error) {
+	opts := c.Decode
+	if e.Filter != nil {
+		opts.Filter = e.Filter
+	}
+	query := opts.Filter.Query()
+	if !opts.Clients && e.omitsClients() {
+		// Clients make up most of the stats of busy nodes. The parameter
+		// is only sent to nodes known to support it.
+		query.Set("include_clients", "false")
+	}
+	if c.TextFormat {
+		query.Set("format", "text")
+	} else {
+		query.Set("format", "json")
+	}
+	for _, l := range []*Limiter{e.Limiter, c.Limiter} {
+		if l == nil {
+			continue
+		}
+		if err := l.Wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.statsURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stats request: %v", err)
+	}
+	if c.Authenticate != nil {
+		if err := c.Authenticate(req); err != nil {
+			return nil, err
+		}
+	}
+	_, span := c.tracer().Start(ctx, "nsqd.fetch")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		e.recordRejectedCert(err)
+		return nil, requestError(err)
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	span.End()
+	e.recordCert(resp)
+	body := newMaxBytesReader(resp.Body, c.MaxResponseSize)
+	defer func() {
+		// Drain the body so the connection can be reused.
+		discard(body)
+		resp.Body.Close()
+	}()
+
+	// The beginning of the body is kept for error messages.
+	prefix := new(prefixWriter)
+	var r io.Reader = io.TeeReader(body, prefix)
+	if raw != nil {
+		buf := new(bytes.Buffer)
+		r = io.TeeReader(r, buf)
+		defer func() { raw(buf.Bytes()) }()
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, io.LimitReader(r, snippetSize))
+		return nil, &FetchError{Reason: ReasonHTTPStatus, StatusCode: resp.StatusCode, Err: fmt.Errorf("nsqd returned HTTP status %s: %s", resp.Status, snippet(prefix.buf.Bytes()))}
+	}
+	if strings.HasPrefix(contentType, "text/html") {
+		io.Copy(io.Discard, io.LimitReader(r, snippetSize))
+		return nil, &FetchError{Reason: ReasonNotJSON, Err: fmt.Errorf("nsqd returned %s rather than JSON: %s", contentType, snippet(prefix.buf.Bytes()))}
+	}
+
+	_, span = c.tracer().Start(ctx, "nsqd.decode")
+	br := bufio.NewReader(r)
+	decode := DecodeStats
+	if start, _ := br.Peek(len(textPrefix)); string(start) == textPrefix {
+		decode = DecodeTextStats
+	}
+	stats, err := decode(br, opts)
+	if stats != nil {
+		span.SetAttributes(attribute.Int("nsq.topics", len(stats.Topics)))
+	}
+	span.End()
+	if err != nil {
+		if body.exceeded() {
+			return nil, &FetchError{Reason: ReasonTooLarge, Err: fmt.Errorf("stats response exceeds the limit of %d bytes", c.MaxResponseSize)}
+		}
+		c.logger().Debug("Failed to decode stats", "node", e.Node, "status", resp.Status, "content_type", contentType, "err", err)
+		if !looksLikeJSON(prefix.buf.Bytes()) {
+			return nil, &FetchError{Reason: ReasonNotJSON, Err: fmt.Errorf("nsqd returned a response of type %q that isn't JSON: %s", contentType, snippet(prefix.buf.Bytes()))}
+		}
+		return nil, &FetchError{Reason: ReasonDecode, Err: fmt.Errorf("failed to decode stats JSON: %v", err)}
+	}
+	if v, err := ParseVersion(stats.Version); err == nil {
+		e.version.Store(&v)
+	}
+	return stats, nil
+}
+
+// maxBytesReader reads at most limit bytes from r and fails afterwards, so
+// an unexpectedly huge response can't exhaust the exporter's memory.
+// A limit <= 0 disables the check.
+type maxBytesReader struct {
+	r     io.Reader
+	limit int64
+	read  int64
+}
+
+func newMaxBytesReader(r io.Reader, limit int64) *maxBytesReader {
+	return &maxBytesReader{r: r, limit: limit}
+}
+
+func (m *maxBytesReader) Read(p []byte) (int, error) {
+	if m.limit > 0 {
+		if m.exceeded() {
+			return 0, fmt.Errorf("response body exceeds %d bytes", m.limit)
+		}
+		// Allow reading a single byte beyond the limit to detect overflows.
+		if left := m.limit + 1 - m.read; int64(len(p)) > left {
+			p = p[:left]
+		}
+	}
+	n, err := m.r.Read(p)
+	m.read += int64(n)
+	return n, err
+}
+
+func (m *maxBytesReader) exceeded() bool {
+	return m.limit > 0 && m.read > m.limit
+}
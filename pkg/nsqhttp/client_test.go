@@ -0,0 +1,66 @@
+package nsqhttp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseURL(t *testing.T) {
+	for _, tt := range []struct {
+		addr string
+		want string
+		err  string
+	}{
+		// Bare host[:port] addresses.
+		{addr: "nsqd-1", want: "http://nsqd-1:4151/stats"},
+		{addr: "nsqd-1:4152", want: "http://nsqd-1:4152/stats"},
+		{addr: "NSQD-1", want: "http://nsqd-1:4151/stats"},
+		{addr: "10.0.0.1", want: "http://10.0.0.1:4151/stats"},
+
+		// Full URLs, the path defaulting to /stats.
+		{addr: "http://nsqd-1:4151", want: "http://nsqd-1:4151/stats"},
+		{addr: "http://nsqd-1:4151/stats", want: "http://nsqd-1:4151/stats"},
+		{addr: "https://nsqd-1", want: "https://nsqd-1/stats"},
+		{addr: "http://nsqd-1:80/stats", want: "http://nsqd-1/stats"},
+		{addr: "https://nsqd-1:443", want: "https://nsqd-1/stats"},
+
+		// Reverse proxy prefixes.
+		{addr: "https://gateway/nsq/node-3/", want: "https://gateway/nsq/node-3/stats"},
+		{addr: "https://gateway/nsq/node-3/stats", want: "https://gateway/nsq/node-3/stats"},
+
+		// IPv6.
+		{addr: "[2001:db8::1]:4151", want: "http://[2001:db8::1]:4151/stats"},
+		{addr: "2001:db8::1", want: "http://[2001:db8::1]:4151/stats"},
+		{addr: "[2001:DB8::1]", want: "http://[2001:db8::1]:4151/stats"},
+		{addr: "http://[2001:db8::1]:4151/stats", want: "http://[2001:db8::1]:4151/stats"},
+		{addr: "[fe80::1%eth0]:4151", want: "http://[fe80::1%25eth0]:4151/stats"},
+		{addr: "fe80::1%eth0", want: "http://[fe80::1%25eth0]:4151/stats"},
+		{addr: "http://[fe80::1%25eth0]:4151/stats", want: "http://[fe80::1%25eth0]:4151/stats"},
+		{addr: "http://2001:db8::1:4151", err: "must be enclosed in brackets"},
+
+		// Unix sockets.
+		{addr: "unix:///var/run/nsqd.sock", want: "unix:///var/run/nsqd.sock"},
+		{addr: "unix://", err: "missing socket path"},
+
+		// Invalid addresses.
+		{addr: "nsqd-1:4150", err: "TCP port of nsqd"},
+		{addr: "http://nsqd-1:4150/stats", err: "TCP port of nsqd"},
+		{addr: "http://", err: "missing host"},
+		{addr: "ftp://nsqd-1", err: "scheme must be http, https or unix"},
+	} {
+		u, err := ParseURL(tt.addr)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("ParseURL(%q) = %v, %v, want an error containing %q", tt.addr, u, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseURL(%q): %v", tt.addr, err)
+			continue
+		}
+		if got := u.String(); got != tt.want {
+			t.Errorf("ParseURL(%q) = %s, want %s", tt.addr, got, tt.want)
+		}
+	}
+}
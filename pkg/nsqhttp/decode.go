@@ -0,0 +1,380 @@
+package nsqhttp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// DecodeOptions control what DecodeStats keeps from a stats payload.
+type DecodeOptions struct {
+	// Clients makes DecodeStats keep the clients of every channel. They
+	// make up most of the payload on busy nodes and are skipped otherwise.
+	Clients bool
+	// MaxTopics, MaxChannelsPerTopic and MaxClients bound the number of
+	// topics, channels per topic and clients per node decoded, anything
+	// beyond them is skipped. Zero means no limit.
+	MaxTopics           int
+	MaxChannelsPerTopic int
+	MaxClients          int
+	// Filter selects the topics and channels decoded, all are if nil.
+	Filter *Filter
+}
+
+// Truncation counts what DecodeStats skipped for exceeding the limits of
+// its DecodeOptions.
+type Truncation struct {
+	Topics   int
+	Channels int
+	Clients  int
+}
+
+// DecodeWarning describes a field of the stats DecodeStats didn't expect.
+type DecodeWarning struct {
+	// Reason is "unknown" for fields the exporter doesn't know, "missing"
+	// for expected fields nsqd didn't send and "invalid" for fields of an
+	// unexpected type, left at their zero value.
+	Reason string
+	// Field is the path of the field, e.g. "channel.depth".
+	Field string
+}
+
+// Fields of the stats objects nsqd is known to send, and those the
+// exporter needs.
+var (
+	knownStatsFields   = fieldSet("version", "health", "start_time", "topics", "memory", "producers")
+	knownTopicFields   = fieldSet("topic_name", "channels", "depth", "backend_depth", "message_count", "message_bytes", "paused", "e2e_processing_latency")
+	knownChannelFields = fieldSet("channel_name", "depth", "backend_depth", "in_flight_count", "deferred_count", "message_count", "requeue_count", "timeout_count", "client_count", "clients", "paused", "e2e_processing_latency")
+
+	requiredTopicFields   = []string{"topic_name", "depth", "message_count"}
+	requiredChannelFields = []string{"channel_name", "depth", "in_flight_count", "message_count"}
+)
+
+func fieldSet(fields ...string) map[string]bool {
+	set := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		set[f] = true
+	}
+	return set
+}
+
+// decoder decodes a single stats payload.
+type decoder struct {
+	dec     *json.Decoder
+	opts    DecodeOptions
+	clients int
+	stats   Stats
+}
+
+// warn records a warning about field of object.
+func (d *decoder) warn(reason, object, field string) {
+	if object != "" {
+		field = object + "." + field
+	}
+	if d.stats.Warnings == nil {
+		d.stats.Warnings = make(map[DecodeWarning]int)
+	}
+	d.stats.Warnings[DecodeWarning{Reason: reason, Field: field}]++
+}
+
+// decodeField decodes the value of field of object into v. A value of an
+// unexpected type is skipped with a warning rather than failing the whole
+// payload.
+func (d *decoder) decodeField(object, field string, v any) error {
+	err := d.dec.Decode(v)
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		if typeErr.Field != "" {
+			field += "." + typeErr.Field
+		}
+		d.warn("invalid", object, field)
+		return nil
+	}
+	return err
+}
+
+// skipField skips the value of field of object, with a warning if the
+// exporter doesn't know the field.
+func (d *decoder) skipField(object, field string, known map[string]bool) error {
+	if !known[field] {
+		d.warn("unknown", object, field)
+	}
+	return skipValue(d.dec)
+}
+
+// DecodeStats decodes the nsqd stats from r one channel at a time, so the
+// whole payload never has to be held in memory. The stats may be wrapped in
+// the {"status_code":200,"status_txt":"OK","data":{...}} envelope of nsqd
+// versions before 1.0. Fields of an unexpected type are skipped and, like
+// unknown and missing fields, reported in the Warnings of the stats.
+func DecodeStats(r io.Reader, opts DecodeOptions) (*Stats, error) {
+	d := &decoder{dec: json.NewDecoder(r), opts: opts}
+	var (
+		statusCode = http.StatusOK
+		statusText string
+	)
+	err := d.decodeStats(func(key string) error {
+		switch key {
+		case "data":
+			return d.decodeStats(nil)
+		case "status_code":
+			return d.dec.Decode(&statusCode)
+		case "status_txt":
+			return d.dec.Decode(&statusText)
+		default:
+			return d.skipField("", key, knownStatsFields)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if statusCode != http.StatusOK {
+		return nil, fmt.Errorf("nsqd returned status %d: %s", statusCode, statusText)
+	}
+	if d.stats.Version == "" {
+		d.warn("missing", "", "version")
+	}
+	return &d.stats, nil
+}
+
+// decodeStats decodes a stats object, passing the keys it doesn't know to
+// other, if not nil.
+func (d *decoder) decodeStats(other func(key string) error) error {
+	stats := &d.stats
+	return decodeObject(d.dec, func(key string) error {
+		switch key {
+		case "version":
+			return d.decodeField("", key, &stats.Version)
+		case "topics":
+			return decodeArray(d.dec, func() error {
+				topic, err := d.decodeTopic()
+				if err != nil || !d.opts.Filter.KeepTopic(topic.TopicName) {
+					return err
+				}
+				if d.opts.MaxTopics > 0 && len(stats.Topics) >= d.opts.MaxTopics {
+					stats.Truncated.Topics++
+					return nil
+				}
+				stats.Topics = append(stats.Topics, topic)
+				return nil
+			})
+		case "start_time":
+			return d.decodeField("", key, &stats.StartTime)
+		case "memory":
+			return d.decodeField("", key, &stats.Memory)
+		default:
+			if other != nil {
+				return other(key)
+			}
+			return d.skipField("", key, knownStatsFields)
+		}
+	})
+}
+
+// decodeTopic decodes a topic. Its channels are skipped if the topic name,
+// which nsqd sends first, shows the topic is filtered out.
+func (d *decoder) decodeTopic() (TopicStats, error) {
+	var topic TopicStats
+	named := false
+	seen := make(map[string]bool, len(requiredTopicFields))
+	err := decodeObject(d.dec, func(key string) error {
+		seen[key] = true
+		switch key {
+		case "topic_name":
+			named = true
+			return d.decodeField("topic", key, &topic.TopicName)
+		case "channels":
+			if named && !d.opts.Filter.KeepTopic(topic.TopicName) {
+				return skipValue(d.dec)
+			}
+			return decodeArray(d.dec, func() error {
+				channel, err := d.decodeChannel()
+				if err != nil || !d.opts.Filter.KeepChannel(channel.ChannelName) {
+					return err
+				}
+				if limit := d.opts.MaxChannelsPerTopic; limit > 0 && len(topic.Channels) >= limit {
+					d.stats.Truncated.Channels++
+					return nil
+				}
+				topic.Channels = append(topic.Channels, channel)
+				return nil
+			})
+		case "depth":
+			return d.decodeField("topic", key, &topic.Depth)
+		case "backend_depth":
+			return d.decodeField("topic", key, &topic.BackendDepth)
+		case "message_count":
+			return d.decodeField("topic", key, &topic.MessageCount)
+		case "message_bytes":
+			return d.decodeField("topic", key, &topic.MessageBytes)
+		case "paused":
+			return d.decodeField("topic", key, &topic.Paused)
+		default:
+			return d.skipField("topic", key, knownTopicFields)
+		}
+	})
+	for _, field := range requiredTopicFields {
+		if !seen[field] {
+			d.warn("missing", "topic", field)
+		}
+	}
+	return topic, err
+}
+
+// decodeChannel decodes a channel, its clients only if enabled.
+func (d *decoder) decodeChannel() (ChannelStats, error) {
+	var channel ChannelStats
+	seen := make(map[string]bool, len(requiredChannelFields))
+	// Versions before 1.2.1 don't report client_count, the clients are
+	// counted instead.
+	clientCount := 0
+	err := decodeObject(d.dec, func(key string) error {
+		seen[key] = true
+		switch key {
+		case "channel_name":
+			return d.decodeField("channel", key, &channel.ChannelName)
+		case "clients":
+			return decodeArray(d.dec, func() error {
+				clientCount++
+				if !d.opts.Clients {
+					return skipValue(d.dec)
+				}
+				if d.opts.MaxClients > 0 && d.clients >= d.opts.MaxClients {
+					d.stats.Truncated.Clients++
+					return skipValue(d.dec)
+				}
+				client, err := d.decodeClient()
+				if err != nil {
+					return err
+				}
+				d.clients++
+				channel.Clients = append(channel.Clients, client)
+				return nil
+			})
+		case "depth":
+			return d.decodeField("channel", key, &channel.Depth)
+		case "backend_depth":
+			return d.decodeField("channel", key, &channel.BackendDepth)
+		case "in_flight_count":
+			return d.decodeField("channel", key, &channel.InFlightCount)
+		case "deferred_count":
+			return d.decodeField("channel", key, &channel.DeferredCount)
+		case "message_count":
+			return d.decodeField("channel", key, &channel.MessageCount)
+		case "requeue_count":
+			return d.decodeField("channel", key, &channel.RequeueCount)
+		case "timeout_count":
+			return d.decodeField("channel", key, &channel.TimeoutCount)
+		case "client_count":
+			return d.decodeField("channel", key, &channel.ClientCount)
+		case "paused":
+			return d.decodeField("channel", key, &channel.Paused)
+		default:
+			return d.skipField("channel", key, knownChannelFields)
+		}
+	})
+	if err != nil {
+		return ChannelStats{}, err
+	}
+	for _, field := range requiredChannelFields {
+		if !seen[field] {
+			d.warn("missing", "channel", field)
+		}
+	}
+	if !seen["client_count"] {
+		channel.ClientCount = clientCount
+	}
+	return channel, nil
+}
+
+// decodeClient decodes a client. Versions before 1.0 also name the client
+// ID "name", it is used if client_id is missing.
+func (d *decoder) decodeClient() (ClientStats, error) {
+	var client struct {
+		ClientStats
+		Name string `json:"name"`
+	}
+	if err := d.decodeField("", "client", &client); err != nil {
+		return ClientStats{}, err
+	}
+	if client.ClientID == "" {
+		client.ClientID = client.Name
+	}
+	return client.ClientStats, nil
+}
+
+// decodeObject reads a JSON object from dec, calling fn for every key. fn
+// must consume the key's value.
+func decodeObject(dec *json.Decoder, fn func(key string) error) error {
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return fmt.Errorf("expected object key, got %v", tok)
+		}
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+// decodeArray reads a JSON array from dec, calling fn for every element.
+// fn must consume the element. A null array is treated as empty.
+func decodeArray(dec *json.Decoder, fn func() error) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		return nil
+	}
+	if tok != json.Delim('[') {
+		return fmt.Errorf("expected [, got %v", tok)
+	}
+	for dec.More() {
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, ']')
+}
+
+// skipValue consumes the next value from dec without retaining it.
+func skipValue(dec *json.Decoder) error {
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != delim {
+		return fmt.Errorf("expected %v, got %v", delim, tok)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package nsqhttp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeChannel(t *testing.T) {
+	payload := `{"version":"1.2.1","topics":[{"topic_name":"orders","depth":1,"message_count":2,"channels":[
+		{"channel_name":"billing","depth":3,"backend_depth":4,"in_flight_count":5,"deferred_count":6,
+		 "message_count":7,"requeue_count":8,"timeout_count":9,"paused":true,"e2e_processing_latency":{"count":0},
+		 "clients":[{"client_id":"c1","ready_count":10},{"name":"c2","ready_count":0}]},
+		{"channel_name":"audit","depth":"deep","message_count":1,"surprise":1}]}]}`
+	stats, err := DecodeStats(strings.NewReader(payload), DecodeOptions{Clients: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := stats.Topics[0].Channels
+	want := []ChannelStats{
+		{
+			ChannelName: "billing", Depth: 3, BackendDepth: 4, InFlightCount: 5, DeferredCount: 6,
+			MessageCount: 7, RequeueCount: 8, TimeoutCount: 9, Paused: true, ClientCount: 2,
+			Clients: []ClientStats{{ClientID: "c1", ReadyCount: 10}, {ClientID: "c2"}},
+		},
+		{ChannelName: "audit", MessageCount: 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("channels = %+v, want %+v", got, want)
+	}
+	wantWarnings := map[DecodeWarning]int{
+		{Reason: "invalid", Field: "channel.depth"}:           1,
+		{Reason: "unknown", Field: "channel.surprise"}:        1,
+		{Reason: "missing", Field: "channel.in_flight_count"}: 1,
+	}
+	if !reflect.DeepEqual(stats.Warnings, wantWarnings) {
+		t.Errorf("warnings = %v, want %v", stats.Warnings, wantWarnings)
+	}
+}
+
+// benchmarkStats returns the stats of a node with topics topics of
+// channels channels, each with clients clients.
+func benchmarkStats(topics, channels, clients int) []byte {
+	stats := Stats{Version: "1.2.1", StartTime: 1700000000}
+	for i := 0; i < topics; i++ {
+		topic := TopicStats{TopicName: fmt.Sprintf("topic-%d", i), Depth: 10, MessageCount: 1 << 20}
+		for j := 0; j < channels; j++ {
+			channel := ChannelStats{
+				ChannelName: fmt.Sprintf("channel-%d", j), Depth: 100, InFlightCount: 5,
+				MessageCount: 1 << 20, RequeueCount: 100, TimeoutCount: 3, ClientCount: clients,
+			}
+			for k := 0; k < clients; k++ {
+				channel.Clients = append(channel.Clients, ClientStats{
+					ClientID: fmt.Sprintf("client-%d", k), Hostname: "worker", Version: "V2",
+					RemoteAddr: "10.0.0.1:4150", ReadyCount: 10, MessageCount: 1 << 10,
+				})
+			}
+			topic.Channels = append(topic.Channels, channel)
+		}
+		stats.Topics = append(stats.Topics, topic)
+	}
+	b, err := json.Marshal(stats)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func benchmarkDecodeStats(b *testing.B, payload []byte, opts DecodeOptions) {
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := DecodeStats(bytes.NewReader(payload), opts); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeStats(b *testing.B) {
+	benchmarkDecodeStats(b, benchmarkStats(20, 10, 5), DecodeOptions{})
+}
+
+func BenchmarkDecodeStatsClients(b *testing.B) {
+	benchmarkDecodeStats(b, benchmarkStats(20, 10, 5), DecodeOptions{Clients: true})
+}
+
+func BenchmarkDecodeStatsManyChannels(b *testing.B) {
+	benchmarkDecodeStats(b, benchmarkStats(10, 200, 0), DecodeOptions{})
+}
@@ -0,0 +1,127 @@
+package nsqhttp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Reasons of the failures to fetch stats, see FetchError.
+const (
+	ReasonConnect     = "connect"
+	ReasonTimeout     = "timeout"
+	ReasonCanceled    = "canceled"
+	ReasonNotHTTP     = "not_http"
+	ReasonHTTPStatus  = "http_status"
+	ReasonNotJSON     = "not_json"
+	ReasonDecode      = "decode"
+	ReasonTooLarge    = "too_large"
+	ReasonRateLimited = "rate_limited"
+)
+
+// FetchError is a failure to fetch the stats of a node, with a short
+// Reason, one of the Reason* constants, telling misconfigurations such as
+// an address pointing at nsqd's TCP port apart from transient failures.
+type FetchError struct {
+	Reason string
+	// StatusCode is the HTTP status of the response with reason
+	// ReasonHTTPStatus, 0 otherwise.
+	StatusCode int
+	Err        error
+}
+
+func (e *FetchError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorReason returns the Reason of err if it is a FetchError, "other"
+// otherwise.
+func ErrorReason(err error) string {
+	var fe *FetchError
+	if errors.As(err, &fe) {
+		return fe.Reason
+	}
+	return "other"
+}
+
+// ErrorStatusCode returns the HTTP status nsqd answered with if err is a
+// FetchError caused by a status other than 200, 0 otherwise.
+func ErrorStatusCode(err error) int {
+	var fe *FetchError
+	if errors.As(err, &fe) {
+		return fe.StatusCode
+	}
+	return 0
+}
+
+// retryable reports whether a fetch failing with err may succeed when
+// retried: only failures to connect, timeouts, and server errors, timeouts
+// and rate limiting reported by nsqd are. Responses that aren't HTTP, aren't
+// JSON, don't decode or are too large would be the same the next time, and
+// requests limited by the exporter itself aren't retried either.
+func retryable(err error) bool {
+	switch ErrorReason(err) {
+	case ReasonConnect, ReasonTimeout:
+		return true
+	case ReasonHTTPStatus:
+		code := ErrorStatusCode(err)
+		return code >= 500 || code == http.StatusRequestTimeout || code == http.StatusTooManyRequests
+	default:
+		return false
+	}
+}
+
+// requestError classifies the error of an HTTP request.
+func requestError(err error) *FetchError {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout():
+		return &FetchError{Reason: ReasonTimeout, Err: fmt.Errorf("failed to fetch stats: %v", err)}
+	case errors.Is(err, context.Canceled):
+		return &FetchError{Reason: ReasonCanceled, Err: fmt.Errorf("failed to fetch stats: %v", err)}
+	case strings.Contains(err.Error(), "malformed HTTP"):
+		// nsqd's TCP interface answers an HTTP request with E_BAD_PROTOCOL.
+		return &FetchError{Reason: ReasonNotHTTP, Err: fmt.Errorf("failed to fetch stats, not an HTTP server, is the address nsqd's TCP port (4150) rather than its HTTP port (4151)? %v", err)}
+	default:
+		return &FetchError{Reason: ReasonConnect, Err: fmt.Errorf("failed to fetch stats: %v", err)}
+	}
+}
+
+// snippetSize is the size of the beginning of a response body quoted in
+// errors.
+const snippetSize = 256
+
+// prefixWriter keeps the first snippetSize bytes written to it.
+type prefixWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	if left := snippetSize - w.buf.Len(); left > 0 {
+		w.buf.Write(p[:min(left, len(p))])
+	}
+	return len(p), nil
+}
+
+// snippet returns the beginning of a response body for error messages.
+func snippet(body []byte) string {
+	body = bytes.TrimSpace(body)
+	if len(body) > snippetSize {
+		body = body[:snippetSize]
+	}
+	return fmt.Sprintf("%q", body)
+}
+
+// looksLikeJSON reports whether body starts like a JSON object.
+func looksLikeJSON(body []byte) bool {
+	body = bytes.TrimSpace(body)
+	return len(body) == 0 || body[0] == '{'
+}
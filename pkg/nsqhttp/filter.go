@@ -0,0 +1,112 @@
+package nsqhttp
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Filter selects the topics and channels decoded from the stats. A topic or
+// channel is kept if it matches the include expression, when set, and does
+// not match the exclude expression, when set.
+type Filter struct {
+	TopicInclude   *regexp.Regexp
+	TopicExclude   *regexp.Regexp
+	ChannelInclude *regexp.Regexp
+	ChannelExclude *regexp.Regexp
+	// SkipEphemeral drops ephemeral topics and channels, whose names end
+	// with "#ephemeral".
+	SkipEphemeral bool
+
+	// topic and channel are the names matched by the include expressions
+	// when they are plain names, which nsqd can select by itself.
+	topic, channel string
+}
+
+// FilterConfig holds the expressions of a Filter. Every expression is
+// anchored at both ends, an empty one is not applied.
+type FilterConfig struct {
+	TopicInclude   string `yaml:"topic_include"`
+	TopicExclude   string `yaml:"topic_exclude"`
+	ChannelInclude string `yaml:"channel_include"`
+	ChannelExclude string `yaml:"channel_exclude"`
+	SkipEphemeral  bool   `yaml:"skip_ephemeral"`
+}
+
+// NewFilter compiles the expressions of cfg. It returns nil, keeping
+// everything, if none is set.
+func NewFilter(cfg FilterConfig) (*Filter, error) {
+	if cfg == (FilterConfig{}) {
+		return nil, nil
+	}
+	f := Filter{SkipEphemeral: cfg.SkipEphemeral}
+	for _, e := range []struct {
+		name string
+		expr string
+		re   **regexp.Regexp
+	}{
+		{"topic include", cfg.TopicInclude, &f.TopicInclude},
+		{"topic exclude", cfg.TopicExclude, &f.TopicExclude},
+		{"channel include", cfg.ChannelInclude, &f.ChannelInclude},
+		{"channel exclude", cfg.ChannelExclude, &f.ChannelExclude},
+	} {
+		if e.expr == "" {
+			continue
+		}
+		re, err := regexp.Compile("^(?:" + e.expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s expression %q: %v", e.name, e.expr, err)
+		}
+		*e.re = re
+	}
+	if isLiteral(cfg.TopicInclude) {
+		f.topic = cfg.TopicInclude
+	}
+	if isLiteral(cfg.ChannelInclude) {
+		f.channel = cfg.ChannelInclude
+	}
+	return &f, nil
+}
+
+// KeepTopic reports whether the topic with the given name is kept.
+func (f *Filter) KeepTopic(name string) bool {
+	return f == nil || f.keepEphemeral(name) && keep(name, f.TopicInclude, f.TopicExclude)
+}
+
+// KeepChannel reports whether the channel with the given name is kept.
+func (f *Filter) KeepChannel(name string) bool {
+	return f == nil || f.keepEphemeral(name) && keep(name, f.ChannelInclude, f.ChannelExclude)
+}
+
+func (f *Filter) keepEphemeral(name string) bool {
+	return !f.SkipEphemeral || !strings.HasSuffix(name, "#ephemeral")
+}
+
+// Query returns the parameters of the stats request scoping it to the topic
+// and channel the filter keeps, if they are single names. nsqd then only
+// returns their stats.
+func (f *Filter) Query() url.Values {
+	q := url.Values{}
+	if f == nil {
+		return q
+	}
+	if f.topic != "" {
+		q.Set("topic", f.topic)
+	}
+	if f.channel != "" {
+		q.Set("channel", f.channel)
+	}
+	return q
+}
+
+func isLiteral(expr string) bool {
+	return expr != "" && regexp.QuoteMeta(expr) == expr
+}
+
+func keep(name string, include, exclude *regexp.Regexp) bool {
+	if include != nil && !include.MatchString(name) {
+		return false
+	}
+	return exclude == nil || !exclude.MatchString(name)
+}
@@ -0,0 +1,31 @@
+package nsqhttp
+
+import "context"
+
+// NodeInfo is the identity of an nsqd node, as returned by its /info
+// endpoint: the addresses consumers and producers connect to.
+type NodeInfo struct {
+	Version          string `json:"version"`
+	BroadcastAddress string `json:"broadcast_address"`
+	Hostname         string `json:"hostname"`
+	HTTPPort         int    `json:"http_port"`
+	TCPPort          int    `json:"tcp_port"`
+	// StartTime is the Unix time nsqd started at.
+	StartTime int64 `json:"start_time"`
+}
+
+// Info returns the identity of the nsqd node of e. Versions before 1.0.0
+// wrap it in a {"status_code":200,"status_txt":"OK","data":{...}} envelope.
+func (c *Client) Info(ctx context.Context, e *Endpoint) (*NodeInfo, error) {
+	var resp struct {
+		NodeInfo
+		Data *NodeInfo `json:"data"`
+	}
+	if err := c.getJSON(ctx, e, "/info", &resp); err != nil {
+		return nil, err
+	}
+	if resp.Data != nil {
+		return resp.Data, nil
+	}
+	return &resp.NodeInfo, nil
+}
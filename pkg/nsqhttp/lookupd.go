@@ -0,0 +1,73 @@
+package nsqhttp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// LookupdTopics returns the topics registered with the nsqlookupd node of
+// e.
+func (c *Client) LookupdTopics(ctx context.Context, e *Endpoint) ([]string, error) {
+	var resp struct {
+		Topics []string `json:"topics"`
+	}
+	if err := c.getJSON(ctx, e, "/topics", &resp); err != nil {
+		return nil, err
+	}
+	return resp.Topics, nil
+}
+
+// LookupdProducer is an nsqd node registered with nsqlookupd.
+type LookupdProducer struct {
+	RemoteAddress    string   `json:"remote_address"`
+	Hostname         string   `json:"hostname"`
+	BroadcastAddress string   `json:"broadcast_address"`
+	TCPPort          int      `json:"tcp_port"`
+	HTTPPort         int      `json:"http_port"`
+	Version          string   `json:"version"`
+	Topics           []string `json:"topics"`
+}
+
+// LookupdNodes returns the nsqd nodes registered with the nsqlookupd node
+// of e.
+func (c *Client) LookupdNodes(ctx context.Context, e *Endpoint) ([]LookupdProducer, error) {
+	var resp struct {
+		Producers []LookupdProducer `json:"producers"`
+	}
+	if err := c.getJSON(ctx, e, "/nodes", &resp); err != nil {
+		return nil, err
+	}
+	return resp.Producers, nil
+}
+
+// getJSON decodes the JSON response to a GET request of path on e into v.
+func (c *Client) getJSON(ctx context.Context, e *Endpoint, path string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.baseURL+path, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create %s request: %v", path, err)
+	}
+	if c.Authenticate != nil {
+		if err := c.Authenticate(req); err != nil {
+			return err
+		}
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	e.recordCert(resp)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch %s: %s", path, resp.Status)
+	}
+	body := newMaxBytesReader(resp.Body, c.MaxResponseSize)
+	if err := json.NewDecoder(body).Decode(v); err != nil {
+		if body.exceeded() {
+			return fmt.Errorf("%s response exceeds the limit of %d bytes", path, c.MaxResponseSize)
+		}
+		return fmt.Errorf("failed to decode %s JSON: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+package nsqhttp
+
+import (
+	"io"
+	"sync"
+)
+
+// copyPool holds the buffers draining response bodies, which are otherwise
+// allocated for every request.
+var copyPool = sync.Pool{New: func() any { b := make([]byte, 32<<10); return &b }}
+
+// discard reads r until EOF with a pooled buffer.
+func discard(r io.Reader) {
+	buf := copyPool.Get().(*[]byte)
+	defer copyPool.Put(buf)
+	io.CopyBuffer(io.Discard, r, *buf)
+}
@@ -0,0 +1,33 @@
+package nsqhttp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// Publish publishes a message with body to topic on the nsqd node of e.
+func (c *Client) Publish(ctx context.Context, e *Endpoint, topic string, body []byte) error {
+	u := e.baseURL + "/pub?" + url.Values{"topic": {topic}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create publish request: %v", err)
+	}
+	if c.Authenticate != nil {
+		if err := c.Authenticate(req); err != nil {
+			return err
+		}
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to publish: %v", err)
+	}
+	defer resp.Body.Close()
+	discard(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to publish: %s", resp.Status)
+	}
+	return nil
+}
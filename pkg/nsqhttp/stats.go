@@ -0,0 +1,73 @@
+// Package nsqhttp fetches statistics from the HTTP interface of nsqd.
+package nsqhttp
+
+// ClientStats are the statistics of a client connected to a channel.
+// Counters are unsigned and, like depths, 64 bits wide as in nsqd, so they
+// can't overflow on long-lived nodes.
+type ClientStats struct {
+	ClientID      string `json:"client_id"`
+	Hostname      string `json:"hostname"`
+	Version       string `json:"version"`
+	RemoteAddr    string `json:"remote_address"`
+	ReadyCount    int64  `json:"ready_count"`
+	InFlightCount int64  `json:"in_flight_count"`
+	MessageCount  uint64 `json:"message_count"`
+	FinishCount   uint64 `json:"finish_count"`
+	RequeueCount  uint64 `json:"requeue_count"`
+	// ConnectTS is the Unix time the client connected at.
+	ConnectTS int64 `json:"connect_ts"`
+}
+
+// ChannelStats are the statistics of a channel.
+type ChannelStats struct {
+	ChannelName   string        `json:"channel_name"`
+	Depth         int64         `json:"depth"`
+	BackendDepth  int64         `json:"backend_depth"`
+	InFlightCount int64         `json:"in_flight_count"`
+	DeferredCount int64         `json:"deferred_count"`
+	MessageCount  uint64        `json:"message_count"`
+	RequeueCount  uint64        `json:"requeue_count"`
+	TimeoutCount  uint64        `json:"timeout_count"`
+	ClientCount   int           `json:"client_count"`
+	Clients       []ClientStats `json:"clients"`
+	Paused        bool          `json:"paused"`
+}
+
+// TopicStats are the statistics of a topic and its channels.
+type TopicStats struct {
+	TopicName    string         `json:"topic_name"`
+	Channels     []ChannelStats `json:"channels"`
+	Depth        int64          `json:"depth"`
+	BackendDepth int64          `json:"backend_depth"`
+	MessageCount uint64         `json:"message_count"`
+	MessageBytes uint64         `json:"message_bytes"`
+	Paused       bool           `json:"paused"`
+}
+
+// MemoryStats are the Go runtime memory statistics of nsqd.
+type MemoryStats struct {
+	HeapObjects       int64 `json:"heap_objects"`
+	HeapIdleBytes     int64 `json:"heap_idle_bytes"`
+	HeapInUseBytes    int64 `json:"heap_in_use_bytes"`
+	HeapReleasedBytes int64 `json:"heap_released_bytes"`
+	GCPauseUsec100    int64 `json:"gc_pause_usec_100"`
+	GCPauseUsec99     int64 `json:"gc_pause_usec_99"`
+	GCPauseUsec95     int64 `json:"gc_pause_usec_95"`
+	NextGCBytes       int64 `json:"next_gc_bytes"`
+	GCTotalRuns       int64 `json:"gc_total_runs"`
+}
+
+// Stats are the statistics returned by the /stats endpoint of nsqd.
+type Stats struct {
+	Version string       `json:"version"`
+	Topics  []TopicStats `json:"topics"`
+	// StartTime is the Unix time nsqd started at.
+	StartTime int64 `json:"start_time"`
+	// Memory is nil if nsqd did not report memory statistics.
+	Memory *MemoryStats `json:"memory"`
+	// Truncated counts what was skipped while decoding the stats.
+	Truncated Truncation `json:"-"`
+	// Warnings counts the fields of the stats that were unknown, missing
+	// or invalid, nil if there were none.
+	Warnings map[DecodeWarning]int `json:"-"`
+}
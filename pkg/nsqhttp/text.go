@@ -0,0 +1,255 @@
+package nsqhttp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// textPrefix starts the text stats of nsqd, "nsqd v1.2.1 (built w/go1.16)".
+const textPrefix = "nsqd v"
+
+var (
+	// textNameRE matches the bracketed, padded name of a topic, channel or
+	// client.
+	textNameRE = regexp.MustCompile(`^\[(.*?)\s*\]`)
+	// textFieldRE matches the "key: value" fields following the name.
+	textFieldRE = regexp.MustCompile(`([\w%-]+): (\S*)`)
+)
+
+// DecodeTextStats decodes the stats nsqd returns with format=text, its
+// default before 1.0, into the same Stats as DecodeStats. Clients have no
+// ID in this format, their hostname is used instead, and the remote address
+// only has a port.
+func DecodeTextStats(r io.Reader, opts DecodeOptions) (*Stats, error) {
+	var (
+		stats   Stats
+		topic   *TopicStats
+		channel *ChannelStats
+		section string
+		clients int
+	)
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64<<10), 1<<20)
+	for line := 0; sc.Scan(); line++ {
+		text := sc.Text()
+		if line == 0 {
+			if !strings.HasPrefix(text, textPrefix) {
+				return nil, fmt.Errorf("not nsqd text stats, first line %q", text)
+			}
+			stats.Version, _, _ = strings.Cut(strings.TrimPrefix(text, textPrefix), " ")
+			continue
+		}
+		trimmed := strings.TrimLeft(text, " ")
+		indent := len(text) - len(trimmed)
+		paused := false
+		if rest, ok := strings.CutPrefix(trimmed, "*P "); ok {
+			trimmed, paused = rest, true
+			indent += 3
+		}
+
+		switch {
+		case strings.HasPrefix(text, "start_time "):
+			t, err := time.Parse(time.RFC3339, strings.TrimPrefix(text, "start_time "))
+			if err != nil {
+				return nil, fmt.Errorf("invalid start_time: %v", err)
+			}
+			stats.StartTime = t.Unix()
+		case indent == 0:
+			// Sections start with a heading, e.g. "Topics:".
+			if name, _, ok := strings.Cut(text, ":"); ok {
+				section = name
+			}
+			if section == "Memory" && stats.Memory == nil {
+				stats.Memory = &MemoryStats{}
+			}
+		case section == "Memory":
+			if err := setMemoryStat(stats.Memory, trimmed); err != nil {
+				return nil, err
+			}
+		case section != "Topics":
+		case indent == 3 && strings.HasPrefix(trimmed, "["):
+			name, fields, err := parseTextLine(trimmed)
+			if err != nil {
+				return nil, err
+			}
+			topic, channel = nil, nil
+			if !opts.Filter.KeepTopic(name) {
+				continue
+			}
+			if opts.MaxTopics > 0 && len(stats.Topics) >= opts.MaxTopics {
+				stats.Truncated.Topics++
+				continue
+			}
+			stats.Topics = append(stats.Topics, TopicStats{
+				TopicName:    name,
+				Depth:        fields.int("depth"),
+				BackendDepth: fields.int("be-depth"),
+				MessageCount: fields.uint("msgs"),
+				Paused:       paused,
+			})
+			topic = &stats.Topics[len(stats.Topics)-1]
+			if fields.err != nil {
+				return nil, fmt.Errorf("invalid stats of topic %s: %v", name, fields.err)
+			}
+		case indent == 6 && strings.HasPrefix(trimmed, "[") && topic != nil:
+			name, fields, err := parseTextLine(trimmed)
+			if err != nil {
+				return nil, err
+			}
+			channel = nil
+			if !opts.Filter.KeepChannel(name) {
+				continue
+			}
+			if opts.MaxChannelsPerTopic > 0 && len(topic.Channels) >= opts.MaxChannelsPerTopic {
+				stats.Truncated.Channels++
+				continue
+			}
+			topic.Channels = append(topic.Channels, ChannelStats{
+				ChannelName:   name,
+				Depth:         fields.int("depth"),
+				BackendDepth:  fields.int("be-depth"),
+				InFlightCount: fields.int("inflt"),
+				DeferredCount: fields.int("def"),
+				RequeueCount:  fields.uint("re-q"),
+				TimeoutCount:  fields.uint("timeout"),
+				MessageCount:  fields.uint("msgs"),
+				Paused:        paused,
+			})
+			channel = &topic.Channels[len(topic.Channels)-1]
+			if fields.err != nil {
+				return nil, fmt.Errorf("invalid stats of channel %s: %v", name, fields.err)
+			}
+		case indent == 8 && strings.HasPrefix(trimmed, "[") && channel != nil:
+			channel.ClientCount++
+			if !opts.Clients {
+				continue
+			}
+			if opts.MaxClients > 0 && clients >= opts.MaxClients {
+				stats.Truncated.Clients++
+				continue
+			}
+			client, err := parseTextClient(trimmed)
+			if err != nil {
+				return nil, err
+			}
+			clients++
+			channel.Clients = append(channel.Clients, client)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// textFields are the fields of a line of text stats. The first parsing
+// error is kept in err.
+type textFields struct {
+	values map[string]string
+	err    error
+}
+
+func (f *textFields) int(key string) int64 {
+	n, err := strconv.ParseInt(f.values[key], 10, 64)
+	if err != nil && f.err == nil {
+		f.err = fmt.Errorf("invalid %s %q", key, f.values[key])
+	}
+	return n
+}
+
+func (f *textFields) uint(key string) uint64 {
+	n, err := strconv.ParseUint(f.values[key], 10, 64)
+	if err != nil && f.err == nil {
+		f.err = fmt.Errorf("invalid %s %q", key, f.values[key])
+	}
+	return n
+}
+
+// parseTextLine parses a topic, channel or client line, "[name   ] key:
+// value key: value...".
+func parseTextLine(line string) (string, *textFields, error) {
+	m := textNameRE.FindStringSubmatch(line)
+	if m == nil {
+		return "", nil, fmt.Errorf("invalid stats line %q", line)
+	}
+	fields := &textFields{values: make(map[string]string)}
+	for _, f := range textFieldRE.FindAllStringSubmatch(line[len(m[0]):], -1) {
+		fields.values[f[1]] = f[2]
+	}
+	return m[1], fields, nil
+}
+
+// parseTextClient parses the line of a consumer, "[V2 hostname:port
+// user-agent] state: 3 inflt: 0 rdy: 1 fin: 10 re-q: 0 msgs: 10
+// connected: 1h2m3s".
+func parseTextClient(line string) (ClientStats, error) {
+	id, fields, err := parseTextLine(line)
+	if err != nil {
+		return ClientStats{}, err
+	}
+	version, addr, _ := strings.Cut(id, " ")
+	addr, _, _ = strings.Cut(addr, " ")
+	hostname, port := addr, ""
+	if i := strings.LastIndexByte(addr, ':'); i >= 0 {
+		hostname, port = addr[:i], addr[i+1:]
+	}
+	client := ClientStats{
+		ClientID:      hostname,
+		Hostname:      hostname,
+		Version:       version,
+		InFlightCount: fields.int("inflt"),
+		ReadyCount:    fields.int("rdy"),
+		FinishCount:   fields.uint("fin"),
+		RequeueCount:  fields.uint("re-q"),
+		MessageCount:  fields.uint("msgs"),
+	}
+	if port != "" {
+		client.RemoteAddr = ":" + port
+	}
+	if connected, err := time.ParseDuration(fields.values["connected"]); err == nil {
+		client.ConnectTS = time.Now().Add(-connected).Unix()
+	}
+	if fields.err != nil {
+		return ClientStats{}, fmt.Errorf("invalid stats of client %s: %v", hostname, fields.err)
+	}
+	return client, nil
+}
+
+// setMemoryStat sets the memory statistic of a "name value" line.
+func setMemoryStat(m *MemoryStats, line string) error {
+	fields := strings.Fields(line)
+	if len(fields) != 2 {
+		return fmt.Errorf("invalid memory stats line %q", line)
+	}
+	name := fields[0]
+	n, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid memory statistic %s: %v", name, err)
+	}
+	switch name {
+	case "heap_objects":
+		m.HeapObjects = n
+	case "heap_idle_bytes":
+		m.HeapIdleBytes = n
+	case "heap_in_use_bytes":
+		m.HeapInUseBytes = n
+	case "heap_released_bytes":
+		m.HeapReleasedBytes = n
+	case "gc_pause_usec_100":
+		m.GCPauseUsec100 = n
+	case "gc_pause_usec_99":
+		m.GCPauseUsec99 = n
+	case "gc_pause_usec_95":
+		m.GCPauseUsec95 = n
+	case "next_gc_bytes":
+		m.NextGCBytes = n
+	case "gc_total_runs":
+		m.GCTotalRuns = n
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package nsqhttp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is the version of an nsqd node.
+type Version struct {
+	Major, Minor, Patch int
+}
+
+// ParseVersion parses versions as reported by nsqd, e.g. "1.2.1" or
+// "0.3.8-alpha", ignoring pre-release and build suffixes.
+func ParseVersion(s string) (Version, error) {
+	core, _, _ := strings.Cut(s, "-")
+	core, _, _ = strings.Cut(core, "+")
+	parts := strings.Split(core, ".")
+	if len(parts) != 3 {
+		return Version{}, fmt.Errorf("invalid nsqd version %q", s)
+	}
+	var v Version
+	for i, p := range []*int{&v.Major, &v.Minor, &v.Patch} {
+		n, err := strconv.Atoi(parts[i])
+		if err != nil || n < 0 {
+			return Version{}, fmt.Errorf("invalid nsqd version %q", s)
+		}
+		*p = n
+	}
+	return v, nil
+}
+
+// AtLeast reports whether v is o or a later version.
+func (v Version) AtLeast(o Version) bool {
+	if v.Major != o.Major {
+		return v.Major > o.Major
+	}
+	if v.Minor != o.Minor {
+		return v.Minor > o.Minor
+	}
+	return v.Patch >= o.Patch
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// VersionMemory is the first version of nsqd reporting memory stats.
+var VersionMemory = Version{1, 1, 0}
+
+// VersionIncludeClients is the first version of nsqd leaving out the
+// clients of its stats with include_clients=false.
+var VersionIncludeClients = Version{1, 2, 0}
+
+// VersionMessageBytes is the first version of nsqd reporting the size of the
+// messages published to every topic.
+var VersionMessageBytes = Version{1, 2, 1}
@@ -0,0 +1,158 @@
+// Package nsqtcp implements the subset of the TCP protocol of nsqd needed to
+// consume messages from a channel.
+package nsqtcp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Frame types of the protocol.
+const (
+	frameTypeResponse = 0
+	frameTypeError    = 1
+	frameTypeMessage  = 2
+)
+
+// maxFrameSize bounds the frames read, nsqd's default --max-msg-size is
+// 1MiB.
+const maxFrameSize = 4 << 20
+
+var heartbeat = []byte("_heartbeat_")
+
+// Message is a message received from nsqd.
+type Message struct {
+	ID        [16]byte
+	Timestamp time.Time
+	Attempts  uint16
+	Body      []byte
+}
+
+// Consumer receives the messages of a channel over a single connection,
+// one at a time.
+type Consumer struct {
+	conn net.Conn
+	r    *bufio.Reader
+	// mu serializes the commands written by Next and Finish.
+	mu sync.Mutex
+}
+
+// Subscribe connects to the nsqd node at addr, its TCP address, and
+// subscribes to channel of topic.
+func Subscribe(ctx context.Context, addr, topic, channel string) (*Consumer, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to nsqd: %v", err)
+	}
+	c := &Consumer{conn: conn, r: bufio.NewReader(conn)}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := c.subscribe(topic, channel); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return c, nil
+}
+
+func (c *Consumer) subscribe(topic, channel string) error {
+	if _, err := c.conn.Write([]byte("  V2")); err != nil {
+		return fmt.Errorf("failed to send protocol version: %v", err)
+	}
+	if err := c.command("SUB %s %s\n", topic, channel); err != nil {
+		return err
+	}
+	typ, data, err := c.readFrame()
+	if err != nil {
+		return err
+	}
+	if typ != frameTypeResponse || !bytes.Equal(data, []byte("OK")) {
+		return fmt.Errorf("failed to subscribe to %s/%s: %s", topic, channel, data)
+	}
+	return c.command("RDY 1\n")
+}
+
+// Next returns the next message, answering heartbeats while waiting for
+// it. Every message must be finished with Finish before the next one is
+// delivered.
+func (c *Consumer) Next() (*Message, error) {
+	for {
+		typ, data, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case frameTypeResponse:
+			if bytes.Equal(data, heartbeat) {
+				if err := c.command("NOP\n"); err != nil {
+					return nil, err
+				}
+			}
+		case frameTypeError:
+			return nil, fmt.Errorf("nsqd returned an error: %s", data)
+		case frameTypeMessage:
+			return decodeMessage(data)
+		}
+	}
+}
+
+// Finish acknowledges the message with the given ID.
+func (c *Consumer) Finish(id [16]byte) error {
+	return c.command("FIN %s\n", id[:])
+}
+
+// Close closes the connection.
+func (c *Consumer) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Consumer) command(format string, args ...any) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := fmt.Fprintf(c.conn, format, args...); err != nil {
+		return fmt.Errorf("failed to send command: %v", err)
+	}
+	return nil
+}
+
+// readFrame reads a frame: its size, type and data.
+func (c *Consumer) readFrame() (int32, []byte, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return 0, nil, fmt.Errorf("failed to read frame: %v", err)
+	}
+	size := binary.BigEndian.Uint32(header[:4])
+	if size < 4 || size > maxFrameSize {
+		return 0, nil, fmt.Errorf("invalid frame size %d", size)
+	}
+	data := make([]byte, size-4)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return 0, nil, fmt.Errorf("failed to read frame: %v", err)
+	}
+	return int32(binary.BigEndian.Uint32(header[4:])), data, nil
+}
+
+// decodeMessage decodes the data of a message frame: its timestamp in
+// nanoseconds, attempts, ID and body.
+func decodeMessage(data []byte) (*Message, error) {
+	if len(data) < 26 {
+		return nil, errors.New("invalid message frame")
+	}
+	m := &Message{
+		Timestamp: time.Unix(0, int64(binary.BigEndian.Uint64(data[:8]))),
+		Attempts:  binary.BigEndian.Uint16(data[8:10]),
+		Body:      data[26:],
+	}
+	copy(m.ID[:], data[10:26])
+	return m, nil
+}
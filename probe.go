@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/amartorelli/nsq_exporter/pkg/collector"
+	"github.com/amartorelli/nsq_exporter/pkg/nsqhttp"
+	"github.com/amartorelli/nsq_exporter/pkg/nsqtcp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	probeTopic    = flag.String("probe.topic", "", "Topic the end-to-end probe publishes its messages to. The probe is disabled if empty.")
+	probeChannel  = flag.String("probe.channel", "nsq_exporter_probe#ephemeral", "Channel of --probe.topic the probe consumes its messages from.")
+	probeInterval = flag.Duration("probe.interval", 30*time.Second, "Interval at which the probe publishes a message.")
+	probeTimeout  = flag.Duration("probe.timeout", 10*time.Second, "Time after which a probe message that was not consumed counts as a failure.")
+	probeHTTPAddr = flag.String("probe.nsqd.addr", "", "HTTP address of the nsqd node probed. Defaults to the first nsqd node scraped.")
+	probeTCPAddr  = flag.String("probe.nsqd.tcp-addr", "", "TCP address of the nsqd node probed, to consume from. Defaults to the host of the node on port 4150.")
+)
+
+// nsqNameRE matches the topic and channel names nsqd accepts.
+var nsqNameRE = regexp.MustCompile(`^[.a-zA-Z0-9_-]{1,64}$|^[.a-zA-Z0-9_-]{1,54}#ephemeral$`)
+
+// checkProbeFlags validates the flags of the probe.
+func checkProbeFlags() error {
+	if *probeTopic == "" {
+		return nil
+	}
+	if !nsqNameRE.MatchString(*probeTopic) {
+		return fmt.Errorf("invalid --probe.topic %q", *probeTopic)
+	}
+	if !nsqNameRE.MatchString(*probeChannel) {
+		return fmt.Errorf("invalid --probe.channel %q", *probeChannel)
+	}
+	if *probeInterval <= 0 || *probeTimeout <= 0 {
+		return errors.New("--probe.interval and --probe.timeout must be positive")
+	}
+	if *probeHTTPAddr != "" {
+		if _, err := nsqhttp.ParseURL(*probeHTTPAddr); err != nil {
+			return fmt.Errorf("--probe.nsqd.addr: %v", err)
+		}
+	}
+	if *probeTCPAddr != "" {
+		if _, _, err := net.SplitHostPort(*probeTCPAddr); err != nil {
+			return fmt.Errorf("invalid --probe.nsqd.tcp-addr %q: %v", *probeTCPAddr, err)
+		}
+	}
+	return nil
+}
+
+// prober periodically publishes a message to an nsqd node and measures
+// how long it takes to consume it, checking the data path the stats can't.
+type prober struct {
+	logger   *slog.Logger
+	client   *nsqhttp.Client
+	endpoint *nsqhttp.Endpoint
+	tcpAddr  string
+	// received are the bodies of the messages consumed.
+	received chan []byte
+
+	success  prometheus.Gauge
+	duration prometheus.Histogram
+}
+
+// newProber creates the prober of the node given by --probe.nsqd.addr, or
+// else of the first target of c.
+func newProber(logger *slog.Logger, c *collector.Collector, client *http.Client) (*prober, error) {
+	var (
+		e   *nsqhttp.Endpoint
+		err error
+	)
+	switch targets := c.Targets(); {
+	case *probeHTTPAddr != "":
+		e, err = nsqhttp.NewEndpoint(*probeHTTPAddr, client)
+		if err != nil {
+			return nil, err
+		}
+	case len(targets) > 0:
+		e = targets[0].Endpoint()
+	default:
+		return nil, errors.New("no nsqd node to probe, see --probe.nsqd.addr")
+	}
+	tcpAddr := *probeTCPAddr
+	if tcpAddr == "" {
+		u, err := nsqhttp.ParseURL(e.URL)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme == "unix" {
+			return nil, errors.New("--probe.nsqd.tcp-addr is required to probe an nsqd node reached over a unix socket")
+		}
+		tcpAddr = net.JoinHostPort(u.Hostname(), "4150")
+	}
+
+	labels := prometheus.Labels{"node": e.Node, "topic": *probeTopic}
+	return &prober{
+		logger:   logger,
+		client:   &nsqhttp.Client{Authenticate: setAuth},
+		endpoint: e,
+		tcpAddr:  tcpAddr,
+		received: make(chan []byte, 16),
+		success: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   *metricsNamespace,
+			Subsystem:   "probe",
+			Name:        "success",
+			Help:        "Whether the last probe message was published and consumed in time",
+			ConstLabels: labels,
+		}),
+		duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace:   *metricsNamespace,
+			Subsystem:   "probe",
+			Name:        "duration_seconds",
+			Help:        "Time between publishing a probe message and consuming it",
+			ConstLabels: labels,
+			Buckets:     prometheus.ExponentialBuckets(0.001, 4, 8),
+		}),
+	}, nil
+}
+
+// collectors returns the metrics of the probe.
+func (p *prober) collectors() []prometheus.Collector {
+	return []prometheus.Collector{p.success, p.duration}
+}
+
+// run probes every --probe.interval until stop is closed.
+func (p *prober) run(stop <-chan struct{}) {
+	go p.consume(stop)
+	ticker := time.NewTicker(*probeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		if err := p.probe(stop); err != nil {
+			p.logger.Error("Probe failed", "node", p.endpoint.Node, "topic", *probeTopic, "err", err)
+			p.success.Set(0)
+			continue
+		}
+		p.success.Set(1)
+	}
+}
+
+// probe publishes a message and waits for it to be consumed.
+func (p *prober) probe(stop <-chan struct{}) error {
+	// Forget messages of earlier probes that arrived too late.
+	for len(p.received) > 0 {
+		<-p.received
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *probeTimeout)
+	defer cancel()
+	body := []byte("nsq_exporter probe " + strconv.FormatInt(time.Now().UnixNano(), 10))
+	start := time.Now()
+	if err := p.client.Publish(ctx, p.endpoint, *probeTopic, body); err != nil {
+		return err
+	}
+	for {
+		select {
+		case b := <-p.received:
+			if bytes.Equal(b, body) {
+				p.duration.Observe(time.Since(start).Seconds())
+				return nil
+			}
+		case <-ctx.Done():
+			return errors.New("message not consumed in time")
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+// consume subscribes to the probe channel, reconnecting after errors, and
+// forwards the messages to received until stop is closed.
+func (p *prober) consume(stop <-chan struct{}) {
+	for {
+		if err := p.subscribe(stop); err != nil {
+			p.logger.Error("Error consuming probe messages", "addr", p.tcpAddr, "err", err)
+		}
+		select {
+		case <-time.After(time.Second):
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (p *prober) subscribe(stop <-chan struct{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), *probeTimeout)
+	c, err := nsqtcp.Subscribe(ctx, p.tcpAddr, *probeTopic, *probeChannel)
+	cancel()
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		// Unblock Next on shutdown.
+		select {
+		case <-stop:
+		case <-done:
+		}
+		c.Close()
+	}()
+	for {
+		m, err := c.Next()
+		if err != nil {
+			select {
+			case <-stop:
+				return nil
+			default:
+				return err
+			}
+		}
+		if err := c.Finish(m.ID); err != nil {
+			return err
+		}
+		select {
+		case p.received <- m.Body:
+		default:
+		}
+	}
+}
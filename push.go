@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/amartorelli/nsq_exporter/pkg/collector"
+	"github.com/prometheus/client_golang/prometheus"
+	promexporter "go.opentelemetry.io/contrib/bridges/prometheus"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+var (
+	pushInterval = flag.Duration("push.interval", 30*time.Second, "Interval at which the metrics are pushed by the enabled push modes.")
+	pushOnce     = flag.Bool("push.once", false, "Make the push command push the metrics once and exit, e.g. from a cron job.")
+	otlpURL      = flag.String("push.otlp.url", "", "URL of the OpenTelemetry collector the metrics are pushed to over OTLP, e.g. http://otel-collector:4317 for gRPC or http://otel-collector:4318/v1/metrics for HTTP. Disabled if empty.")
+	otlpProtocol = flag.String("push.otlp.protocol", "grpc", "Protocol used to push metrics over OTLP. One of: [grpc, http]")
+	otlpHeaders  stringsFlag
+)
+
+func init() {
+	flag.Var(&otlpHeaders, "push.otlp.header", "Header sent with every OTLP request, as name=value. May be repeated.")
+}
+
+// pusher pushes the metrics of a gatherer to a remote system.
+type pusher interface {
+	// push pushes the current metrics once.
+	push(ctx context.Context) error
+	// close pushes anything still buffered and releases the resources of
+	// the pusher.
+	close(ctx context.Context) error
+	// name identifies the pusher in logs.
+	name() string
+}
+
+// checkPushFlags validates the flags of the push modes.
+func checkPushFlags() error {
+	if *pushInterval <= 0 {
+		return errors.New("--push.interval must be positive")
+	}
+	switch *otlpProtocol {
+	case "grpc", "http":
+	default:
+		return fmt.Errorf("invalid --push.otlp.protocol %q, must be grpc or http", *otlpProtocol)
+	}
+	for _, h := range otlpHeaders {
+		if name, _, ok := strings.Cut(h, "="); !ok || name == "" {
+			return fmt.Errorf("invalid --push.otlp.header %q, must be name=value", h)
+		}
+	}
+	for _, h := range remoteWriteHeaders {
+		if name, _, ok := strings.Cut(h, "="); !ok || name == "" {
+			return fmt.Errorf("invalid --push.remote-write.header %q, must be name=value", h)
+		}
+	}
+	for _, s := range []*secret{remoteWritePassword, remoteWriteBearerToken} {
+		if err := s.validate(); err != nil {
+			return err
+		}
+	}
+	if *remoteWriteUsername != "" && remoteWriteBearerToken.isSet() {
+		return errors.New("--push.remote-write.username and --push.remote-write.bearer-token are mutually exclusive")
+	}
+	for name, raw := range map[string]string{"push.remote-write.url": *remoteWriteURL, "push.pushgateway.url": *pushgatewayURL} {
+		if raw == "" {
+			continue
+		}
+		if u, err := url.Parse(raw); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid --%s %q", name, raw)
+		}
+	}
+	if *pushgatewayJob == "" {
+		return errors.New("--push.pushgateway.job must not be empty")
+	}
+	if err := checkInfluxFlags(); err != nil {
+		return err
+	}
+	if *jsonlFile != "" && *jsonlFile != "-" {
+		if fi, err := os.Stat(filepath.Dir(*jsonlFile)); err != nil || !fi.IsDir() {
+			return fmt.Errorf("invalid --push.jsonl.file %q: directory %s doesn't exist", *jsonlFile, filepath.Dir(*jsonlFile))
+		}
+	}
+	switch *statsdFormat {
+	case "graphite", "dogstatsd":
+	default:
+		return fmt.Errorf("invalid --push.statsd.format %q, must be graphite or dogstatsd", *statsdFormat)
+	}
+	for name, addr := range map[string]string{"push.statsd.address": *statsdAddress, "push.graphite.address": *graphiteAddress} {
+		if addr == "" {
+			continue
+		}
+		if path, ok := strings.CutPrefix(addr, "unix://"); ok && name == "push.statsd.address" {
+			if path == "" {
+				return fmt.Errorf("invalid --%s %q: missing socket path", name, addr)
+			}
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid --%s %q: %v", name, addr, err)
+		}
+	}
+	return nil
+}
+
+// newPushers creates a pusher for every enabled push mode.
+func newPushers(ctx context.Context, g prometheus.Gatherer) ([]pusher, error) {
+	var pushers []pusher
+	if *otlpURL != "" {
+		p, err := newOTLPPusher(ctx, g)
+		if err != nil {
+			return nil, err
+		}
+		pushers = append(pushers, p)
+	}
+	if *remoteWriteURL != "" {
+		pushers = append(pushers, newRemoteWritePusher(g))
+	}
+	if *pushgatewayURL != "" {
+		pushers = append(pushers, newPushgatewayPusher(g))
+	}
+	if *statsdAddress != "" {
+		p, err := newStatsdPusher(g)
+		if err != nil {
+			return nil, err
+		}
+		pushers = append(pushers, p)
+	}
+	if *graphiteAddress != "" {
+		pushers = append(pushers, newGraphitePusher(g))
+	}
+	if *influxURL != "" {
+		pushers = append(pushers, newInfluxPusher(g))
+	}
+	if *jsonlFile != "" {
+		pushers = append(pushers, newJSONLPusher(g))
+	}
+	return pushers, nil
+}
+
+// pushLoop pushes the metrics every --push.interval until stop is closed,
+// then closes the pushers and done.
+func pushLoop(logger *slog.Logger, pushers []pusher, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(*pushInterval)
+	defer ticker.Stop()
+	for {
+		for _, p := range pushers {
+			ctx, cancel := context.WithTimeout(context.Background(), *pushInterval)
+			if err := p.push(ctx); err != nil {
+				logger.Error("Error pushing metrics", "mode", p.name(), "err", err)
+			}
+			cancel()
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			for _, p := range pushers {
+				ctx, cancel := context.WithTimeout(context.Background(), *pushInterval)
+				if err := p.close(ctx); err != nil {
+					logger.Error("Error closing pusher", "mode", p.name(), "err", err)
+				}
+				cancel()
+			}
+			return
+		}
+	}
+}
+
+// pushGatherer returns the gatherer of the metrics pushed: those of c and
+// of registry, relabeled.
+func pushGatherer(registry prometheus.Gatherer, c *collector.Collector) prometheus.Gatherer {
+	nsq := prometheus.NewRegistry()
+	if *scrapeMode != "statsd" {
+		nsq.MustRegister(c)
+	}
+	return relabelGatherer{normalizeGatherer{hostGatherer{clusterGatherer{prometheus.Gatherers{registry, nsq}}, c}}, &relabeling}
+}
+
+// pushMetrics runs the enabled push modes without serving the metrics,
+// until it is terminated.
+func pushMetrics(logger *slog.Logger) error {
+	c, _, err := setup()
+	if err != nil {
+		return err
+	}
+	registry := prometheus.NewRegistry()
+	stop := stopOnSignal(logger)
+	if *scrapeMode == "statsd" {
+		bridge, err := newStatsdBridge(logger)
+		if err != nil {
+			return err
+		}
+		registry.MustRegister(bridge)
+		go bridge.serve(stop)
+	}
+	pushers, err := newPushers(context.Background(), pushGatherer(registry, c))
+	if err != nil {
+		return err
+	}
+	if len(pushers) == 0 {
+		return errors.New("no push mode is enabled, see the --push.* flags")
+	}
+	if *pushOnce {
+		return pushOnly(pushers)
+	}
+	if *scrapeMode == "poll" {
+		c.StartPolling(*scrapeInterval, stop)
+	}
+	done := make(chan struct{})
+	go pushLoop(logger, pushers, stop, done)
+	<-done
+	return nil
+}
+
+// pushOnly pushes the metrics once with every pusher.
+func pushOnly(pushers []pusher) error {
+	ctx, cancel := context.WithTimeout(context.Background(), *pushInterval)
+	defer cancel()
+	var errs []error
+	for _, p := range pushers {
+		if err := p.push(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", p.name(), err))
+		}
+		if err := p.close(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", p.name(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// otlpPusher pushes metrics to an OpenTelemetry collector.
+type otlpPusher struct {
+	reader   *metric.ManualReader
+	provider *metric.MeterProvider
+	exporter metric.Exporter
+}
+
+func newOTLPPusher(ctx context.Context, g prometheus.Gatherer) (*otlpPusher, error) {
+	headers := make(map[string]string)
+	for _, h := range otlpHeaders {
+		name, value, _ := strings.Cut(h, "=")
+		headers[name] = value
+	}
+	var (
+		exporter metric.Exporter
+		err      error
+	)
+	switch *otlpProtocol {
+	case "grpc":
+		exporter, err = otlpmetricgrpc.New(ctx, otlpmetricgrpc.WithEndpointURL(*otlpURL), otlpmetricgrpc.WithHeaders(headers))
+	case "http":
+		exporter, err = otlpmetrichttp.New(ctx, otlpmetrichttp.WithEndpointURL(*otlpURL), otlpmetrichttp.WithHeaders(headers))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %v", err)
+	}
+	// The reader only collects the bridged Prometheus metrics, the meter
+	// provider is needed to register it.
+	reader := metric.NewManualReader(metric.WithProducer(promexporter.NewMetricProducer(promexporter.WithGatherer(g))))
+	provider := metric.NewMeterProvider(
+		metric.WithReader(reader),
+		metric.WithResource(resource.NewSchemaless(semconv.ServiceName("nsq_exporter"))),
+	)
+	return &otlpPusher{reader: reader, provider: provider, exporter: exporter}, nil
+}
+
+func (p *otlpPusher) push(ctx context.Context) error {
+	var rm metricdata.ResourceMetrics
+	if err := p.reader.Collect(ctx, &rm); err != nil {
+		return err
+	}
+	return p.exporter.Export(ctx, &rm)
+}
+
+func (p *otlpPusher) close(ctx context.Context) error {
+	return errors.Join(p.provider.Shutdown(ctx), p.exporter.Shutdown(ctx))
+}
+
+func (p *otlpPusher) name() string {
+	return "otlp"
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+var (
+	pushgatewayURL      = flag.String("push.pushgateway.url", "", "URL of a Prometheus Pushgateway the metrics are pushed to, e.g. http://pushgateway:9091. Disabled if empty.")
+	pushgatewayJob      = flag.String("push.pushgateway.job", "nsq_exporter", "Job label of the metrics pushed to the Pushgateway.")
+	pushgatewayGrouping = labelsFlag{}
+)
+
+func init() {
+	flag.Var(pushgatewayGrouping, "push.pushgateway.grouping", "Grouping labels of the metrics pushed to the Pushgateway besides the job, as comma separated name=value pairs, e.g. instance=edge-1.")
+}
+
+// pushgatewayPusher pushes metrics to a Pushgateway, replacing the metrics
+// of its group on every push.
+type pushgatewayPusher struct {
+	pusher *push.Pusher
+}
+
+func newPushgatewayPusher(g prometheus.Gatherer) *pushgatewayPusher {
+	p := push.New(*pushgatewayURL, *pushgatewayJob).Gatherer(g)
+	names := make([]string, 0, len(pushgatewayGrouping))
+	for name := range pushgatewayGrouping {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p = p.Grouping(name, pushgatewayGrouping[name])
+	}
+	return &pushgatewayPusher{pusher: p}
+}
+
+func (p *pushgatewayPusher) push(ctx context.Context) error {
+	return p.pusher.PushContext(ctx)
+}
+
+func (p *pushgatewayPusher) close(context.Context) error {
+	return nil
+}
+
+func (p *pushgatewayPusher) name() string {
+	return "pushgateway"
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"flag"
+
+	"github.com/amartorelli/nsq_exporter/pkg/nsqhttp"
+)
+
+var (
+	nsqdRateLimit       = flag.Float64("nsqd.rate-limit", 0, "Maximum number of stats requests per second to each nsqd node, 0 disables the limit. Fetches that would wait past --scrape.target-timeout fail instead.")
+	nsqdGlobalRateLimit = flag.Float64("nsqd.global-rate-limit", 0, "Maximum number of stats requests per second to all nsqd nodes together, 0 disables the limit.")
+	nsqdRateLimitBurst  = flag.Int("nsqd.rate-limit-burst", 1, "Number of stats requests allowed at once by --nsqd.rate-limit and --nsqd.global-rate-limit before they apply.")
+)
+
+// checkRateLimitFlags validates the --nsqd.*rate-limit* flags.
+func checkRateLimitFlags() error {
+	var errs []error
+	if *nsqdRateLimit < 0 {
+		errs = append(errs, errors.New("--nsqd.rate-limit must not be negative"))
+	}
+	if *nsqdGlobalRateLimit < 0 {
+		errs = append(errs, errors.New("--nsqd.global-rate-limit must not be negative"))
+	}
+	if *nsqdRateLimitBurst < 1 {
+		errs = append(errs, errors.New("--nsqd.rate-limit-burst must be at least 1"))
+	}
+	return errors.Join(errs...)
+}
+
+// newLimiter returns a limiter of rate requests per second, nil if rate is
+// 0.
+func newLimiter(rate float64) *nsqhttp.Limiter {
+	if rate == 0 {
+		return nil
+	}
+	return nsqhttp.NewLimiter(rate, *nsqdRateLimitBurst)
+}
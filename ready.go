@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/amartorelli/nsq_exporter/pkg/collector"
+)
+
+// readyHandler serves /readyz. When no scrape happened recently enough to
+// tell, nsqd is contacted directly.
+func readyHandler(c *collector.Collector, maxAge time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !c.Ready(maxAge) && !c.CheckConnectivity(r.Context()) {
+			http.Error(w, "nsqd is not reachable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("OK"))
+	})
+}
+
+// statsdReadyHandler serves /readyz in statsd mode, when nsqd must have sent
+// its stats in the last maxAge.
+func statsdReadyHandler(b *statsdBridge, maxAge time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !b.ready(maxAge) {
+			http.Error(w, "no stats received from nsqd", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("OK"))
+	})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/amartorelli/nsq_exporter/pkg/collector"
+)
+
+var (
+	debugRecordDir      = flag.String("debug.record-dir", "", "Directory every stats payload fetched from nsqd is recorded to, with the time and node, e.g. to reproduce decoding problems.")
+	debugRecordMaxSize  = flag.Int64("debug.record-max-file-size", 64<<20, "Size in bytes after which the recording continues in a new file.")
+	debugRecordMaxFiles = flag.Int("debug.record-max-files", 10, "Number of recording files kept in --debug.record-dir, the oldest are removed.")
+)
+
+// recordFilePattern matches the files of a recording, named after the time
+// they were started at so they sort chronologically.
+const recordFilePattern = "stats-*.jsonl"
+
+// checkRecordFlags validates the --debug.record-* flags.
+func checkRecordFlags() error {
+	if *debugRecordDir == "" {
+		return nil
+	}
+	if *debugRecordMaxSize <= 0 {
+		return fmt.Errorf("--debug.record-max-file-size must be positive, got %d", *debugRecordMaxSize)
+	}
+	if *debugRecordMaxFiles < 1 {
+		return fmt.Errorf("--debug.record-max-files must be at least 1, got %d", *debugRecordMaxFiles)
+	}
+	return nil
+}
+
+// recordedStats is a line of a recording.
+type recordedStats struct {
+	Time time.Time `json:"time"`
+	Node string    `json:"node"`
+	URL  string    `json:"url"`
+	// Payload is the JSON stats as they were received, or a string if
+	// they weren't JSON.
+	Payload any `json:"payload"`
+}
+
+// statsRecorder appends the payloads fetched from nsqd to rotating files
+// of JSON lines.
+type statsRecorder struct {
+	dir      string
+	maxSize  int64
+	maxFiles int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func newStatsRecorder(dir string, maxSize int64, maxFiles int) (*statsRecorder, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create --debug.record-dir: %v", err)
+	}
+	return &statsRecorder{dir: dir, maxSize: maxSize, maxFiles: maxFiles}, nil
+}
+
+// record appends payload, fetched from t, to the current file.
+func (r *statsRecorder) record(t *collector.Target, payload []byte) {
+	rec := recordedStats{Time: time.Now(), Node: t.Endpoint().Node, URL: redactURLs(t.Endpoint().URL)}
+	if json.Valid(payload) {
+		rec.Payload = json.RawMessage(payload)
+	} else {
+		rec.Payload = string(payload)
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		slog.Warn("Failed to record stats", "node", rec.Node, "err", err)
+		return
+	}
+	line = append(line, '\n')
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil || r.size+int64(len(line)) > r.maxSize {
+		if err := r.rotate(rec.Time); err != nil {
+			slog.Warn("Failed to record stats", "node", rec.Node, "err", err)
+			return
+		}
+	}
+	n, err := r.file.Write(line)
+	r.size += int64(n)
+	if err != nil {
+		slog.Warn("Failed to record stats", "node", rec.Node, "err", err)
+	}
+}
+
+// rotate starts a new file and removes the oldest ones beyond maxFiles.
+func (r *statsRecorder) rotate(now time.Time) error {
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+	name := filepath.Join(r.dir, "stats-"+now.UTC().Format("20060102T150405.000000000Z")+".jsonl")
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	r.file, r.size = f, 0
+
+	files, err := filepath.Glob(filepath.Join(r.dir, recordFilePattern))
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+	for len(files) > r.maxFiles {
+		if err := os.Remove(files[0]); err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+)
+
+var (
+	nsqdMaxRedirects     = flag.Int("nsqd.max-redirects", 3, "Maximum number of redirects followed by a stats request (0 doesn't follow redirects).")
+	nsqdRedirectSameHost = flag.Bool("nsqd.redirect-same-host", false, "Only follow redirects to the host of the nsqd node, on any port or scheme.")
+)
+
+// checkRedirectFlags validates the --nsqd.*redirect* flags.
+func checkRedirectFlags() error {
+	if *nsqdMaxRedirects < 0 {
+		return errors.New("--nsqd.max-redirects must not be negative")
+	}
+	return nil
+}
+
+// checkRedirect is the redirect policy of the stats requests. Unlike the
+// default policy, which keeps credentials for subdomains, the Authorization
+// header is only sent again to the same origin: scheme, host and port.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > *nsqdMaxRedirects {
+		if *nsqdMaxRedirects == 0 {
+			return fmt.Errorf("redirected to %s, redirects are not followed (see --nsqd.max-redirects)", req.URL.Redacted())
+		}
+		return fmt.Errorf("stopped after %d redirects", *nsqdMaxRedirects)
+	}
+	orig := via[0].URL
+	if *nsqdRedirectSameHost && req.URL.Hostname() != orig.Hostname() {
+		return fmt.Errorf("redirected to another host, %s, refused by --nsqd.redirect-same-host", req.URL.Redacted())
+	}
+	if req.URL.Scheme != orig.Scheme || req.URL.Host != orig.Host {
+		req.Header.Del("Authorization")
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+const metricNameLabel = "__name__"
+
+// RelabelConfig rewrites the labels of exported series, following the
+// semantics of Prometheus' metric_relabel_configs. The metric name is
+// available as the __name__ source label but can't be changed.
+type RelabelConfig struct {
+	SourceLabels []string `yaml:"source_labels"`
+	Separator    *string  `yaml:"separator"`
+	Regex        *string  `yaml:"regex"`
+	TargetLabel  string   `yaml:"target_label"`
+	Replacement  *string  `yaml:"replacement"`
+	Action       string   `yaml:"action"`
+
+	regex *regexp.Regexp
+}
+
+// compile applies the defaults, validates the rule and compiles its
+// expression.
+func (r *RelabelConfig) compile() error {
+	if r.Action == "" {
+		r.Action = "replace"
+	}
+	if r.Separator == nil {
+		sep := ";"
+		r.Separator = &sep
+	}
+	if r.Replacement == nil {
+		repl := "$1"
+		r.Replacement = &repl
+	}
+	regex := "(.*)"
+	if r.Regex != nil {
+		regex = *r.Regex
+	}
+	re, err := regexp.Compile("^(?:" + regex + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid regex %q: %v", regex, err)
+	}
+	r.regex = re
+
+	switch r.Action {
+	case "replace":
+		if r.TargetLabel == "" {
+			return fmt.Errorf("target_label is required for action %s", r.Action)
+		}
+	case "keep", "drop":
+		if len(r.SourceLabels) == 0 {
+			return fmt.Errorf("source_labels are required for action %s", r.Action)
+		}
+	case "labeldrop", "labelkeep", "labelmap":
+	default:
+		return fmt.Errorf("unknown action %q", r.Action)
+	}
+	if r.TargetLabel == metricNameLabel {
+		return fmt.Errorf("the metric name can't be relabeled")
+	}
+	return nil
+}
+
+// apply relabels labels in place and reports whether the series is kept.
+func (r *RelabelConfig) apply(labels map[string]string) bool {
+	values := make([]string, len(r.SourceLabels))
+	for i, name := range r.SourceLabels {
+		values[i] = labels[name]
+	}
+	value := strings.Join(values, *r.Separator)
+
+	switch r.Action {
+	case "keep":
+		return r.regex.MatchString(value)
+	case "drop":
+		return !r.regex.MatchString(value)
+	case "replace":
+		idx := r.regex.FindStringSubmatchIndex(value)
+		if idx == nil {
+			return true
+		}
+		labels[r.TargetLabel] = string(r.regex.ExpandString(nil, *r.Replacement, value, idx))
+	case "labeldrop", "labelkeep":
+		for name := range labels {
+			if name == metricNameLabel {
+				continue
+			}
+			if r.regex.MatchString(name) == (r.Action == "labeldrop") {
+				delete(labels, name)
+			}
+		}
+	case "labelmap":
+		mapped := make(map[string]string)
+		for name, v := range labels {
+			if idx := r.regex.FindStringSubmatchIndex(name); idx != nil {
+				mapped[string(r.regex.ExpandString(nil, *r.Replacement, name, idx))] = v
+			}
+		}
+		for name, v := range mapped {
+			labels[name] = v
+		}
+	}
+	return true
+}
+
+// relabelGatherer applies relabel rules to the metrics of a gatherer.
+// Series whose labels become identical are merged, summing the values of
+// counters, gauges and untyped metrics, so dropping e.g. the channel label
+// yields per-topic totals.
+type relabelGatherer struct {
+	prometheus.Gatherer
+	rules *relabelRules
+}
+
+func (g relabelGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+	rules := g.rules.get()
+	if len(rules) == 0 {
+		return mfs, err
+	}
+	kept := mfs[:0]
+	for _, mf := range mfs {
+		if mf.Metric = relabelMetrics(mf, rules); len(mf.Metric) > 0 {
+			kept = append(kept, mf)
+		}
+	}
+	return kept, err
+}
+
+// relabelRules holds the rules currently applied, replaced on reload.
+type relabelRules struct {
+	rules atomic.Pointer[[]*RelabelConfig]
+}
+
+func (r *relabelRules) get() []*RelabelConfig {
+	if rules := r.rules.Load(); rules != nil {
+		return *rules
+	}
+	return nil
+}
+
+func (r *relabelRules) set(rules []*RelabelConfig) {
+	r.rules.Store(&rules)
+}
+
+// relabeling holds the metric_relabel_configs of the configuration file.
+var relabeling relabelRules
+
+func relabelMetrics(mf *dto.MetricFamily, rules []*RelabelConfig) []*dto.Metric {
+	var (
+		out  []*dto.Metric
+		seen = make(map[string]*dto.Metric)
+	)
+metrics:
+	for _, m := range mf.Metric {
+		labels := map[string]string{metricNameLabel: mf.GetName()}
+		for _, lp := range m.Label {
+			labels[lp.GetName()] = lp.GetValue()
+		}
+		for _, r := range rules {
+			if !r.apply(labels) {
+				continue metrics
+			}
+		}
+
+		pairs := make([]*dto.LabelPair, 0, len(labels))
+		for name, value := range labels {
+			if name == metricNameLabel || value == "" {
+				continue
+			}
+			pairs = append(pairs, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+		}
+		sort.Slice(pairs, func(i, j int) bool { return pairs[i].GetName() < pairs[j].GetName() })
+
+		var key strings.Builder
+		for _, lp := range pairs {
+			key.WriteString(lp.GetName() + "\xff" + lp.GetValue() + "\xff")
+		}
+		if prev, ok := seen[key.String()]; ok {
+			mergeMetric(prev, m)
+			continue
+		}
+		m.Label = pairs
+		seen[key.String()] = m
+		out = append(out, m)
+	}
+	return out
+}
+
+// mergeMetric adds the value of m to prev. Histograms and summaries can't
+// be merged meaningfully, the first series is kept.
+func mergeMetric(prev, m *dto.Metric) {
+	switch {
+	case prev.Counter != nil && m.Counter != nil:
+		prev.Counter.Value = proto.Float64(prev.Counter.GetValue() + m.Counter.GetValue())
+	case prev.Gauge != nil && m.Gauge != nil:
+		prev.Gauge.Value = proto.Float64(prev.Gauge.GetValue() + m.Gauge.GetValue())
+	case prev.Untyped != nil && m.Untyped != nil:
+		prev.Untyped.Value = proto.Float64(prev.Untyped.GetValue() + m.Untyped.GetValue())
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/version"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var (
+	remoteWriteURL         = flag.String("push.remote-write.url", "", "URL of a Prometheus remote write endpoint the metrics are pushed to, e.g. http://mimir:9009/api/v1/push. Disabled if empty.")
+	remoteWriteUsername    = flag.String("push.remote-write.username", "", "Username for HTTP basic authentication against the remote write endpoint.")
+	remoteWritePassword    = secretFlag("push.remote-write.password", "Password for HTTP basic authentication against the remote write endpoint.")
+	remoteWriteBearerToken = secretFlag("push.remote-write.bearer-token", "Bearer token sent to the remote write endpoint in the Authorization header.")
+	remoteWriteHeaders     stringsFlag
+)
+
+func init() {
+	flag.Var(&remoteWriteHeaders, "push.remote-write.header", "Header sent with every remote write request as name=value, e.g. X-Scope-OrgID=tenant. May be repeated.")
+}
+
+// remoteWritePusher pushes metrics with the Prometheus remote write
+// protocol (version 1.0).
+type remoteWritePusher struct {
+	gatherer prometheus.Gatherer
+	client   *http.Client
+}
+
+func newRemoteWritePusher(g prometheus.Gatherer) *remoteWritePusher {
+	return &remoteWritePusher{gatherer: g, client: &http.Client{}}
+}
+
+func (p *remoteWritePusher) push(ctx context.Context) error {
+	mfs, err := p.gatherer.Gather()
+	if err != nil && len(mfs) == 0 {
+		return err
+	}
+	body := snappy.Encode(nil, encodeWriteRequest(mfs, time.Now()))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, *remoteWriteURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create remote write request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Set("User-Agent", "nsq_exporter/"+version.Version)
+	for _, h := range remoteWriteHeaders {
+		name, value, _ := strings.Cut(h, "=")
+		req.Header.Set(name, value)
+	}
+	if err := setRemoteWriteAuth(req); err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to push metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("remote write endpoint returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+func (p *remoteWritePusher) close(context.Context) error {
+	p.client.CloseIdleConnections()
+	return nil
+}
+
+func (p *remoteWritePusher) name() string {
+	return "remote-write"
+}
+
+// setRemoteWriteAuth adds the configured remote write credentials to req.
+func setRemoteWriteAuth(req *http.Request) error {
+	switch {
+	case remoteWriteBearerToken.isSet():
+		token, err := remoteWriteBearerToken.get()
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	case *remoteWriteUsername != "" || remoteWritePassword.isSet():
+		password, err := remoteWritePassword.get()
+		if err != nil {
+			return err
+		}
+		req.SetBasicAuth(*remoteWriteUsername, password)
+	}
+	return nil
+}
+
+// encodeWriteRequest encodes the metric families as a remote write
+// WriteRequest protobuf message, with samples at now unless they carry a
+// timestamp.
+func encodeWriteRequest(mfs []*dto.MetricFamily, now time.Time) []byte {
+	var buf []byte
+	series := func(name string, labels []*dto.LabelPair, value float64, ts int64, extra ...string) {
+		pairs := [][2]string{{"__name__", name}}
+		for _, lp := range labels {
+			pairs = append(pairs, [2]string{lp.GetName(), lp.GetValue()})
+		}
+		for i := 0; i+1 < len(extra); i += 2 {
+			pairs = append(pairs, [2]string{extra[i], extra[i+1]})
+		}
+		sort.Slice(pairs, func(i, j int) bool { return pairs[i][0] < pairs[j][0] })
+
+		var timeseries []byte
+		for _, p := range pairs {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, p[0])
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, p[1])
+			timeseries = protowire.AppendTag(timeseries, 1, protowire.BytesType)
+			timeseries = protowire.AppendBytes(timeseries, label)
+		}
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(ts))
+		timeseries = protowire.AppendTag(timeseries, 2, protowire.BytesType)
+		timeseries = protowire.AppendBytes(timeseries, sample)
+
+		buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, timeseries)
+	}
+
+	for _, mf := range mfs {
+		name := mf.GetName()
+		for _, m := range mf.Metric {
+			ts := now.UnixMilli()
+			if m.TimestampMs != nil {
+				ts = m.GetTimestampMs()
+			}
+			switch {
+			case m.Counter != nil:
+				series(name, m.Label, m.Counter.GetValue(), ts)
+			case m.Gauge != nil:
+				series(name, m.Label, m.Gauge.GetValue(), ts)
+			case m.Untyped != nil:
+				series(name, m.Label, m.Untyped.GetValue(), ts)
+			case m.Summary != nil:
+				for _, q := range m.Summary.Quantile {
+					series(name, m.Label, q.GetValue(), ts, "quantile", formatFloat(q.GetQuantile()))
+				}
+				series(name+"_sum", m.Label, m.Summary.GetSampleSum(), ts)
+				series(name+"_count", m.Label, float64(m.Summary.GetSampleCount()), ts)
+			case m.Histogram != nil:
+				for _, b := range m.Histogram.Bucket {
+					if !math.IsInf(b.GetUpperBound(), 1) {
+						series(name+"_bucket", m.Label, float64(b.GetCumulativeCount()), ts, "le", formatFloat(b.GetUpperBound()))
+					}
+				}
+				series(name+"_bucket", m.Label, float64(m.Histogram.GetSampleCount()), ts, "le", "+Inf")
+				series(name+"_sum", m.Label, m.Histogram.GetSampleSum(), ts)
+				series(name+"_count", m.Label, float64(m.Histogram.GetSampleCount()), ts)
+			}
+		}
+	}
+	return buf
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	replayDir      = flag.String("replay.dir", "", "Serve the stats recorded with --debug.record-dir in this directory instead of scraping nsqd, e.g. to develop dashboards or test alerting rules. The recorded nodes are the targets.")
+	replayInterval = flag.Duration("replay.interval", 15*time.Second, "Interval at which the replay advances to the next recorded stats of every node, starting over after the last ones.")
+)
+
+// replaying serves the recording of --replay.dir, it is nil unless
+// replaying.
+var replaying *replayTransport
+
+// checkReplayFlags validates the --replay.* flags.
+func checkReplayFlags() error {
+	if *replayDir == "" {
+		return nil
+	}
+	if len(nsqdURLs) > 0 {
+		return errors.New("--replay.dir and --nsqd.addr are mutually exclusive, the recorded nodes are replayed")
+	}
+	if *replayInterval <= 0 {
+		return fmt.Errorf("--replay.interval must be positive, got %s", *replayInterval)
+	}
+	return nil
+}
+
+// replayedStats is a payload of a recording.
+type replayedStats struct {
+	body        []byte
+	contentType string
+}
+
+// replayTransport answers the stats requests of every recorded node with
+// its recorded payloads, in order.
+type replayTransport struct {
+	nodes    []string
+	payloads map[string][]replayedStats
+
+	mu  sync.Mutex
+	pos int
+}
+
+// loadReplay reads the recording files of dir.
+func loadReplay(dir string) (*replayTransport, error) {
+	files, err := filepath.Glob(filepath.Join(dir, recordFilePattern))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no recordings found in --replay.dir %s", dir)
+	}
+	sort.Strings(files)
+	t := &replayTransport{payloads: make(map[string][]replayedStats)}
+	for _, name := range files {
+		if err := t.load(name); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func (t *replayTransport) load(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return fmt.Errorf("failed to read recording: %v", err)
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	for {
+		var rec struct {
+			Node    string          `json:"node"`
+			Payload json.RawMessage `json:"payload"`
+		}
+		if err := dec.Decode(&rec); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("invalid recording %s: %v", name, err)
+		}
+		if strings.HasPrefix(rec.Node, "/") {
+			slog.Warn("Skipping recorded stats of a unix socket, only HTTP nodes are replayed", "node", rec.Node)
+			continue
+		}
+		stats := replayedStats{body: rec.Payload, contentType: "application/json"}
+		// Payloads that weren't JSON, e.g. text stats, are recorded as
+		// strings.
+		var text string
+		if json.Unmarshal(rec.Payload, &text) == nil {
+			stats = replayedStats{body: []byte(text), contentType: "text/plain; charset=utf-8"}
+		}
+		if _, ok := t.payloads[rec.Node]; !ok {
+			t.nodes = append(t.nodes, rec.Node)
+		}
+		t.payloads[rec.Node] = append(t.payloads[rec.Node], stats)
+	}
+}
+
+// targets returns the recorded nodes as targets.
+func (t *replayTransport) targets() []TargetConfig {
+	configs := make([]TargetConfig, 0, len(t.nodes))
+	for _, node := range t.nodes {
+		configs = append(configs, TargetConfig{URL: "http://" + node + "/stats", source: "replay"})
+	}
+	return configs
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	payloads := t.payloads[req.URL.Host]
+	if len(payloads) == 0 {
+		return nil, fmt.Errorf("no recorded stats of %s", req.URL.Host)
+	}
+	if req.URL.Path != "/stats" {
+		return nil, fmt.Errorf("only the stats of %s are recorded, not %s", req.URL.Host, req.URL.Path)
+	}
+	t.mu.Lock()
+	stats := payloads[t.pos%len(payloads)]
+	t.mu.Unlock()
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {stats.contentType}},
+		Body:          io.NopCloser(bytes.NewReader(stats.body)),
+		ContentLength: int64(len(stats.body)),
+		Request:       req,
+	}, nil
+}
+
+// advance moves to the next recorded stats of every node every interval.
+func (t *replayTransport) advance(interval time.Duration) {
+	for range time.Tick(interval) {
+		t.mu.Lock()
+		t.pos++
+		t.mu.Unlock()
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// AlertsConfig sets the thresholds of the alerting rules generated by the
+// rules command.
+type AlertsConfig struct {
+	// DepthThreshold is the channel depth above which a growing channel
+	// alerts.
+	DepthThreshold int `yaml:"depth_threshold"`
+	// DepthGrowthWindow is the range over which the depth must be growing.
+	DepthGrowthWindow model.Duration `yaml:"depth_growth_window"`
+	DepthFor          model.Duration `yaml:"depth_for"`
+	PausedFor         model.Duration `yaml:"paused_for"`
+	NoConsumersFor    model.Duration `yaml:"no_consumers_for"`
+	DownFor           model.Duration `yaml:"down_for"`
+}
+
+// defaultAlertsConfig are the thresholds used for the settings missing from
+// the configuration file.
+var defaultAlertsConfig = AlertsConfig{
+	DepthThreshold:    10000,
+	DepthGrowthWindow: model.Duration(10 * time.Minute),
+	DepthFor:          model.Duration(10 * time.Minute),
+	PausedFor:         model.Duration(30 * time.Minute),
+	NoConsumersFor:    model.Duration(10 * time.Minute),
+	DownFor:           model.Duration(5 * time.Minute),
+}
+
+// withDefaults returns c with its unset settings taken from
+// defaultAlertsConfig.
+func (c AlertsConfig) withDefaults() AlertsConfig {
+	d := defaultAlertsConfig
+	if c.DepthThreshold == 0 {
+		c.DepthThreshold = d.DepthThreshold
+	}
+	for _, e := range []struct{ v, d *model.Duration }{
+		{&c.DepthGrowthWindow, &d.DepthGrowthWindow},
+		{&c.DepthFor, &d.DepthFor},
+		{&c.PausedFor, &d.PausedFor},
+		{&c.NoConsumersFor, &d.NoConsumersFor},
+		{&c.DownFor, &d.DownFor},
+	} {
+		if *e.v == 0 {
+			*e.v = *e.d
+		}
+	}
+	return c
+}
+
+func (c AlertsConfig) validate() error {
+	if c.DepthThreshold < 0 {
+		return errors.New("alerts: depth_threshold must not be negative")
+	}
+	return nil
+}
+
+type ruleFile struct {
+	Groups []ruleGroup `yaml:"groups"`
+}
+
+type ruleGroup struct {
+	Name  string `yaml:"name"`
+	Rules []rule `yaml:"rules"`
+}
+
+type rule struct {
+	Alert       string            `yaml:"alert"`
+	Expr        string            `yaml:"expr"`
+	For         model.Duration    `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+// writeRules writes Prometheus alerting rules for the metrics exported with
+// the current flags to w, with the thresholds of the configuration file.
+func writeRules(w io.Writer) error {
+	if err := checkFlags(); err != nil {
+		return err
+	}
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	a := cfg.Alerts.withDefaults()
+	name := metricName
+
+	rules := []rule{
+		{
+			Alert:  "NSQExporterDown",
+			Expr:   "absent(" + name("up") + ")",
+			For:    a.DownFor,
+			Labels: map[string]string{"severity": "critical"},
+			Annotations: map[string]string{
+				"summary": "nsq_exporter reports no metrics",
+			},
+		},
+		{
+			Alert:  "NSQNodeDown",
+			Expr:   name("up") + " == 0",
+			For:    a.DownFor,
+			Labels: map[string]string{"severity": "critical"},
+			Annotations: map[string]string{
+				"summary": "nsqd {{ $labels.node }} cannot be scraped",
+			},
+		},
+	}
+	if *channelsCollector && !*metricsCompatOnly {
+		depth, clients := name("depth"), name("client_count")
+		rules = append(rules,
+			rule{
+				Alert:  "NSQChannelDepthGrowing",
+				Expr:   fmt.Sprintf("%s > %d and deriv(%s[%s]) > 0", depth, a.DepthThreshold, depth, a.DepthGrowthWindow),
+				For:    a.DepthFor,
+				Labels: map[string]string{"severity": "warning"},
+				Annotations: map[string]string{
+					"summary": "Channel {{ $labels.topic }}/{{ $labels.channel }} on {{ $labels.node }} is backing up",
+					"description": "The channel holds {{ $value }} messages, more than " + strconv.Itoa(a.DepthThreshold) +
+						", and kept growing over " + a.DepthGrowthWindow.String() + ".",
+				},
+			},
+			rule{
+				Alert:  "NSQChannelPaused",
+				Expr:   depth + `{paused="true"}`,
+				For:    a.PausedFor,
+				Labels: map[string]string{"severity": "warning"},
+				Annotations: map[string]string{
+					"summary": "Channel {{ $labels.topic }}/{{ $labels.channel }} on {{ $labels.node }} is paused",
+				},
+			},
+			rule{
+				Alert:  "NSQChannelNoConsumers",
+				Expr:   clients + " == 0 and " + depth + " > 0",
+				For:    a.NoConsumersFor,
+				Labels: map[string]string{"severity": "warning"},
+				Annotations: map[string]string{
+					"summary": "Channel {{ $labels.topic }}/{{ $labels.channel }} on {{ $labels.node }} has messages but no consumers",
+				},
+			},
+		)
+	}
+
+	b, err := yaml.Marshal(ruleFile{Groups: []ruleGroup{{Name: "nsq", Rules: rules}}})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
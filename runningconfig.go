@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/amartorelli/nsq_exporter/pkg/collector"
+	"github.com/amartorelli/nsq_exporter/pkg/nsqhttp"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// redacted replaces the values of secrets in the running configuration.
+const redacted = "<secret>"
+
+// runningConfig is the configuration the exporter runs with, the flags
+// merged with the configuration file.
+type runningConfig struct {
+	Flags                map[string]string `yaml:"flags"`
+	Targets              []runningTarget   `yaml:"targets"`
+	Views                []ViewConfig      `yaml:"views,omitempty"`
+	Sites                []collector.Site  `yaml:"sites,omitempty"`
+	MetricRelabelConfigs []*RelabelConfig  `yaml:"metric_relabel_configs"`
+	Alerts               AlertsConfig      `yaml:"alerts"`
+}
+
+// runningTarget is a target with the filter it is scraped with.
+type runningTarget struct {
+	URL          string               `yaml:"url"`
+	FallbackURL  string               `yaml:"fallback_url,omitempty"`
+	Source       string               `yaml:"source"`
+	Cluster      string               `yaml:"cluster,omitempty"`
+	Filter       nsqhttp.FilterConfig `yaml:"filter"`
+	PollInterval model.Duration       `yaml:"poll_interval,omitempty"`
+	IPFamily     string               `yaml:"ip_family,omitempty"`
+	SSHJumpHost  string               `yaml:"ssh_jump_host,omitempty"`
+}
+
+// currentConfig returns the running configuration, with credentials
+// redacted.
+func currentConfig() runningConfig {
+	cfg := loadedConfig.Load()
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	rc := runningConfig{
+		Flags:                make(map[string]string),
+		Views:                redactedViews(cfg.Views),
+		Sites:                cfg.Sites,
+		MetricRelabelConfigs: cfg.MetricRelabelConfigs,
+		Alerts:               cfg.Alerts.withDefaults(),
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		v := f.Value.String()
+		if secretFlags[f.Name] && v != "" {
+			v = redacted
+		}
+		rc.Flags[f.Name] = redactURLs(v)
+	})
+	for _, tc := range targetConfigs(cfg) {
+		tc.IPFamily, tc.SSHJumpHost = targetDialing(tc)
+		filter := flagFilter()
+		if tc.Filter != (nsqhttp.FilterConfig{}) {
+			filter = mergeFilters(filter, tc.Filter)
+		}
+		rc.Targets = append(rc.Targets, runningTarget{
+			URL:          redactURLs(tc.URL),
+			FallbackURL:  redactURLs(tc.FallbackURL),
+			Source:       tc.source,
+			Cluster:      tc.cluster,
+			Filter:       filter,
+			PollInterval: tc.PollInterval,
+			IPFamily:     tc.IPFamily,
+			SSHJumpHost:  tc.SSHJumpHost,
+		})
+	}
+	return rc
+}
+
+// redactURLs hides the passwords of the comma separated URLs in s.
+func redactURLs(s string) string {
+	parts := strings.Split(s, ",")
+	for i, p := range parts {
+		if u, err := url.Parse(p); err == nil && u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				parts[i] = u.Redacted()
+			}
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// configHandler serves the running configuration as JSON, or as YAML with
+// ?format=yaml.
+func configHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := yaml.Marshal(currentConfig())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to encode config: %s", err), http.StatusInternalServerError)
+			return
+		}
+		if r.URL.Query().Get("format") == "yaml" {
+			w.Header().Set("Content-Type", "application/yaml")
+			w.Write(b)
+			return
+		}
+		// Go through YAML so the keys are those of the configuration file.
+		var v any
+		if err := yaml.Unmarshal(b, &v); err != nil {
+			http.Error(w, fmt.Sprintf("failed to encode config: %s", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		enc.Encode(jsonValue(v))
+	})
+}
+
+// jsonValue converts the maps decoded by yaml.v2, keyed by any, into maps
+// JSON can encode.
+func jsonValue(v any) any {
+	switch v := v.(type) {
+	case map[any]any:
+		m := make(map[string]any, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = jsonValue(e)
+		}
+		return m
+	case []any:
+		for i, e := range v {
+			v[i] = jsonValue(e)
+		}
+	}
+	return v
+}
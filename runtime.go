@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	runtimeAutoMaxProcs  = flag.Bool("runtime.auto-gomaxprocs", true, "Set GOMAXPROCS to the CPU quota of the container, rounded down, unless the GOMAXPROCS environment variable is set.")
+	runtimeMemLimit      = flag.Int64("runtime.gomemlimit", 0, "Soft memory limit of the Go runtime in bytes, overriding the GOMEMLIMIT environment variable (0 derives it from --runtime.gomemlimit-ratio).")
+	runtimeMemLimitRatio = flag.Float64("runtime.gomemlimit-ratio", 0.9, "Fraction of the memory limit of the container used as the soft memory limit of the Go runtime, unless GOMEMLIMIT or --runtime.gomemlimit is set (0 disables it).")
+)
+
+var gomaxprocsGauge, gomemlimitGauge prometheus.GaugeFunc
+
+// initRuntimeMetrics creates the metrics of the runtime settings, named
+// after --metrics.namespace.
+func initRuntimeMetrics() {
+	gomaxprocsGauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: *metricsNamespace,
+		Subsystem: "exporter",
+		Name:      "gomaxprocs",
+		Help:      "Effective GOMAXPROCS of the exporter",
+	}, func() float64 { return float64(runtime.GOMAXPROCS(0)) })
+	gomemlimitGauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: *metricsNamespace,
+		Subsystem: "exporter",
+		Name:      "gomemlimit_bytes",
+		Help:      "Effective soft memory limit of the Go runtime of the exporter, math.MaxInt64 if there is none",
+	}, func() float64 { return float64(debug.SetMemoryLimit(-1)) })
+}
+
+// checkRuntimeFlags validates the --runtime.* flags.
+func checkRuntimeFlags() error {
+	if *runtimeMemLimit < 0 {
+		return fmt.Errorf("--runtime.gomemlimit must not be negative, got %d", *runtimeMemLimit)
+	}
+	if *runtimeMemLimitRatio < 0 || *runtimeMemLimitRatio > 1 {
+		return fmt.Errorf("--runtime.gomemlimit-ratio must be between 0 and 1, got %g", *runtimeMemLimitRatio)
+	}
+	return nil
+}
+
+// tuneRuntime sizes GOMAXPROCS and the soft memory limit of the runtime
+// after the limits of the container, if any, as set by the --runtime.*
+// flags. The environment variables take precedence over the limits of the
+// container.
+func tuneRuntime() {
+	if *runtimeAutoMaxProcs && os.Getenv("GOMAXPROCS") == "" {
+		if quota, ok := cgroupCPUQuota(); ok {
+			procs := max(int(math.Floor(quota)), 1)
+			if procs < runtime.NumCPU() {
+				runtime.GOMAXPROCS(procs)
+				slog.Info("Set GOMAXPROCS to the CPU quota of the container", "gomaxprocs", procs, "quota", quota)
+			}
+		}
+	}
+
+	switch {
+	case *runtimeMemLimit > 0:
+		debug.SetMemoryLimit(*runtimeMemLimit)
+		slog.Info("Set the soft memory limit", "bytes", *runtimeMemLimit)
+	case os.Getenv("GOMEMLIMIT") != "" || *runtimeMemLimitRatio == 0:
+	default:
+		if limit, ok := cgroupMemoryLimit(); ok {
+			bytes := int64(float64(limit) * *runtimeMemLimitRatio)
+			debug.SetMemoryLimit(bytes)
+			slog.Info("Set the soft memory limit after the memory limit of the container", "bytes", bytes, "container_limit", limit)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The limits are read from the cgroup filesystem as mounted in containers,
+// version 2 first.
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cgroupCPUQuota returns the number of CPUs the cgroup of the process may
+// use, false if it isn't limited.
+func cgroupCPUQuota() (float64, bool) {
+	// cgroup v2: "<quota> <period>" or "max <period>".
+	if b, err := os.ReadFile(cgroupRoot + "/cpu.max"); err == nil {
+		fields := strings.Fields(string(b))
+		if len(fields) != 2 || fields[0] == "max" {
+			return 0, false
+		}
+		return cpuQuota(fields[0], fields[1])
+	}
+	quota, err := os.ReadFile(cgroupRoot + "/cpu/cpu.cfs_quota_us")
+	if err != nil {
+		return 0, false
+	}
+	period, err := os.ReadFile(cgroupRoot + "/cpu/cpu.cfs_period_us")
+	if err != nil {
+		return 0, false
+	}
+	return cpuQuota(strings.TrimSpace(string(quota)), strings.TrimSpace(string(period)))
+}
+
+func cpuQuota(quota, period string) (float64, bool) {
+	q, err := strconv.ParseFloat(quota, 64)
+	if err != nil || q <= 0 {
+		return 0, false
+	}
+	p, err := strconv.ParseFloat(period, 64)
+	if err != nil || p <= 0 {
+		return 0, false
+	}
+	return q / p, true
+}
+
+// cgroupMemoryLimit returns the memory limit in bytes of the cgroup of the
+// process, false if it isn't limited.
+func cgroupMemoryLimit() (int64, bool) {
+	b, err := os.ReadFile(cgroupRoot + "/memory.max")
+	if err != nil {
+		if b, err = os.ReadFile(cgroupRoot + "/memory/memory.limit_in_bytes"); err != nil {
+			return 0, false
+		}
+	}
+	limit, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	// cgroup v2 reports "max" without a limit, v1 a page-aligned
+	// math.MaxInt64.
+	if err != nil || limit <= 0 || limit >= 1<<62 {
+		return 0, false
+	}
+	return limit, true
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+// Container limits are only detected on Linux.
+
+func cgroupCPUQuota() (float64, bool) {
+	return 0, false
+}
+
+func cgroupMemoryLimit() (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// topicGatherer only keeps the series of a gatherer labelled with one of
+// the given topics, for teams scraping their own topics via
+// /metrics?topic=<name>.
+type topicGatherer struct {
+	prometheus.Gatherer
+	topics []string
+}
+
+func (g topicGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+	kept := mfs[:0]
+	for _, mf := range mfs {
+		metrics := mf.Metric[:0]
+		for _, m := range mf.Metric {
+			for _, lp := range m.Label {
+				if lp.GetName() == "topic" && slices.Contains(g.topics, lp.GetValue()) {
+					metrics = append(metrics, m)
+					break
+				}
+			}
+		}
+		if mf.Metric = metrics; len(metrics) > 0 {
+			kept = append(kept, mf)
+		}
+	}
+	return kept, err
+}
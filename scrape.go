@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	scrapeMode     = flag.String("scrape.mode", "live", "How nsqd is scraped: live fetches the stats on every request to the metrics endpoint, poll fetches them every --scrape.interval and serves the latest result, statsd doesn't scrape nsqd but receives the stats nsqd sends with StatsD, see --statsd.*.")
+	scrapeInterval = flag.Duration("scrape.interval", 15*time.Second, "Interval at which nsqd is scraped in poll mode.")
+	scrapeOffset   = flag.Duration("scrape.poll-offset", 0, "In poll mode, delay of the first poll, e.g. to stagger the replicas of the exporter.")
+	scrapeJitter   = flag.Duration("scrape.poll-jitter", 0, "In poll mode, maximum random delay added to --scrape.poll-offset, so exporters polling at the same interval spread their load on nsqd.")
+	scrapeMaxStale = flag.Duration("scrape.max-staleness", 0, "In poll mode, keep serving the last stats of a node fetched up to this long ago when polling it fails, with nsq_up 0, instead of dropping its series (0 disables it).")
+
+	scrapeConcurrency   = flag.Int("scrape.concurrency", 10, "Maximum number of nsqd nodes scraped concurrently.")
+	scrapeTargetTimeout = flag.Duration("scrape.target-timeout", 0, "Maximum time spent fetching the stats of a single node, retries included (0 means no limit besides --nsqd.timeout per attempt).")
+	scrapeCacheTTL      = flag.Duration("scrape.cache-ttl", 0, "In live mode, reuse the stats of a node fetched less than this long ago, so concurrent scrapes share a single fetch (0 disables caching).")
+	scrapeFailFastAfter = flag.Int("scrape.fail-fast-after", 0, "Exit with a non-zero status once this many consecutive scrapes failed to fetch the stats of every nsqd node, e.g. so Kubernetes restarts the exporter rather than it serving empty metrics (0 disables it).")
+	cacheMaxAge         = flag.Duration("cache.max-age", 0, "Never serve stats older than this: in poll mode, when no poll completed for this long, e.g. because they hang, only nsq_up 0 is reported for every node instead of the last poll (0 disables the limit).")
+
+	limitsMaxTopics           = flag.Int("limits.max-topics", 0, "Maximum number of topics scraped per nsqd node, further topics are left out (0 means no limit).")
+	limitsMaxChannelsPerTopic = flag.Int("limits.max-channels-per-topic", 0, "Maximum number of channels scraped per topic, further channels are left out (0 means no limit).")
+	limitsMaxClients          = flag.Int("limits.max-clients", 0, "Maximum number of clients scraped per nsqd node for client metrics, further clients are left out (0 means no limit).")
+)
+
+// checkScrapeFlags validates the --scrape.* and --limits.* flags.
+func checkScrapeFlags() error {
+	switch *scrapeMode {
+	case "live", "statsd":
+	case "poll":
+		if *scrapeInterval <= 0 {
+			return fmt.Errorf("--scrape.interval must be positive, got %s", *scrapeInterval)
+		}
+		if *scrapeOffset < 0 {
+			return fmt.Errorf("--scrape.poll-offset must not be negative, got %s", *scrapeOffset)
+		}
+		if *scrapeJitter < 0 {
+			return fmt.Errorf("--scrape.poll-jitter must not be negative, got %s", *scrapeJitter)
+		}
+		if *scrapeMaxStale < 0 {
+			return fmt.Errorf("--scrape.max-staleness must not be negative, got %s", *scrapeMaxStale)
+		}
+	default:
+		return fmt.Errorf("--scrape.mode must be live, poll or statsd, got %q", *scrapeMode)
+	}
+	if *scrapeMaxStale > 0 && *scrapeMode != "poll" {
+		return fmt.Errorf("--scrape.max-staleness requires --scrape.mode=poll")
+	}
+	if *scrapeFailFastAfter < 0 {
+		return fmt.Errorf("--scrape.fail-fast-after must not be negative, got %d", *scrapeFailFastAfter)
+	}
+	if *scrapeFailFastAfter > 0 && *scrapeMode == "statsd" {
+		return errors.New("--scrape.fail-fast-after requires nsqd to be scraped, not --scrape.mode=statsd")
+	}
+	if *scrapeConcurrency < 1 {
+		return fmt.Errorf("--scrape.concurrency must be at least 1, got %d", *scrapeConcurrency)
+	}
+	if *scrapeCacheTTL < 0 {
+		return fmt.Errorf("--scrape.cache-ttl must not be negative, got %s", *scrapeCacheTTL)
+	}
+	if *cacheMaxAge < 0 {
+		return fmt.Errorf("--cache.max-age must not be negative, got %s", *cacheMaxAge)
+	}
+	if *cacheMaxAge > 0 {
+		switch {
+		case *scrapeCacheTTL >= *cacheMaxAge:
+			return errors.New("--scrape.cache-ttl must be shorter than --cache.max-age")
+		case *scrapeMode == "poll" && *scrapeInterval >= *cacheMaxAge:
+			return errors.New("--scrape.interval must be shorter than --cache.max-age")
+		case *scrapeMaxStale > *cacheMaxAge:
+			return errors.New("--scrape.max-staleness must not exceed --cache.max-age")
+		}
+	}
+	for name, limit := range map[string]int{
+		"limits.max-topics":             *limitsMaxTopics,
+		"limits.max-channels-per-topic": *limitsMaxChannelsPerTopic,
+		"limits.max-clients":            *limitsMaxClients,
+	} {
+		if limit < 0 {
+			return fmt.Errorf("--%s must not be negative, got %d", name, limit)
+		}
+	}
+	return nil
+}
+
+// failFast counts the consecutive scrapes that failed to fetch the stats of
+// every node, reporting on failed once they reach --scrape.fail-fast-after.
+type failFast struct {
+	failures atomic.Int64
+	failed   chan error
+}
+
+var scrapeFailures = &failFast{failed: make(chan error, 1)}
+
+// record is the collector's OnCollect.
+func (f *failFast) record(ok bool) {
+	if ok {
+		f.failures.Store(0)
+		return
+	}
+	if n := f.failures.Add(1); *scrapeFailFastAfter > 0 && n == int64(*scrapeFailFastAfter) {
+		f.failed <- fmt.Errorf("the last %d scrapes failed to fetch the stats of any nsqd node, exiting as requested by --scrape.fail-fast-after", n)
+	}
+}
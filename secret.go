@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// secret is a credential given either inline on the command line or as the
+// path of a file holding it. Files are read every time the secret is used,
+// so rotated secrets (e.g. mounted Kubernetes or Docker secrets) are picked
+// up without restarting the exporter.
+type secret struct {
+	name  string
+	value *string
+	file  *string
+}
+
+// secretFlags are the names of the flags holding credentials, redacted
+// when the configuration is shown. Headers and webhook URLs may carry API
+// keys.
+var secretFlags = map[string]bool{
+	"alerts.webhook-url":       true,
+	"push.otlp.header":         true,
+	"push.remote-write.header": true,
+}
+
+// secretFlag registers the flags --<name> and --<name>-file for a secret.
+func secretFlag(name, usage string) *secret {
+	secretFlags[name] = true
+	return &secret{
+		name:  name,
+		value: flag.String(name, "", usage+" Prefer --"+name+"-file, flags are visible in the process list."),
+		file:  flag.String(name+"-file", "", "File to read the value of --"+name+" from."),
+	}
+}
+
+func (s *secret) isSet() bool {
+	return *s.value != "" || *s.file != ""
+}
+
+func (s *secret) get() (string, error) {
+	if *s.file == "" {
+		return *s.value, nil
+	}
+	b, err := os.ReadFile(*s.file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %v", s.name, err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func (s *secret) validate() error {
+	if *s.value != "" && *s.file != "" {
+		return fmt.Errorf("--%s and --%s-file are mutually exclusive", s.name, s.name)
+	}
+	_, err := s.get()
+	return err
+}
+
+// setAuth adds the configured nsqd credentials to req.
+func setAuth(req *http.Request) error {
+	switch {
+	case nsqdBearerToken.isSet():
+		token, err := nsqdBearerToken.get()
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	case *nsqdUsername != "" || nsqdPassword.isSet():
+		password, err := nsqdPassword.get()
+		if err != nil {
+			return err
+		}
+		req.SetBasicAuth(*nsqdUsername, password)
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package main
+
+import "errors"
+
+func isWindowsService() bool {
+	return false
+}
+
+func runService() error {
+	return errors.New("not running as a Windows service")
+}
+
+func manageService(cmd string, args []string) error {
+	return errors.New("the " + cmd + " command is only supported on Windows")
+}
@@ -0,0 +1,182 @@
+//go:build windows
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const serviceName = "nsq_exporter"
+
+func isWindowsService() bool {
+	ok, err := svc.IsWindowsService()
+	return err == nil && ok
+}
+
+// runService runs the exporter under the Windows service control manager,
+// logging to the Windows event log.
+func runService() error {
+	elog, err := eventlog.Open(serviceName)
+	if err != nil {
+		return err
+	}
+	defer elog.Close()
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(logLevel.String())); err != nil {
+		return err
+	}
+	logger := slog.New(newEventLogHandler(elog, level))
+	slog.SetDefault(logger)
+
+	if err := svc.Run(serviceName, &service{logger: logger}); err != nil {
+		logger.Error("Service failed", "err", err)
+		return err
+	}
+	return nil
+}
+
+type service struct {
+	logger *slog.Logger
+}
+
+// Execute implements svc.Handler.
+func (s *service) Execute(_ []string, requests <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		run(s.logger, stop)
+		close(done)
+	}()
+
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				changes <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				changes <- svc.Status{State: svc.StopPending}
+				close(stop)
+				<-done
+				return false, 0
+			}
+		case <-done:
+			return false, 1
+		}
+	}
+}
+
+// manageService installs or removes the Windows service. The installed
+// service runs the exporter with the flags given to install.
+func manageService(cmd string, args []string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service manager: %v", err)
+	}
+	defer m.Disconnect()
+
+	switch cmd {
+	case "install":
+		exe, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		exe, err = filepath.Abs(exe)
+		if err != nil {
+			return err
+		}
+		s, err := m.CreateService(serviceName, exe, mgr.Config{
+			DisplayName: "NSQ Exporter",
+			Description: "Prometheus exporter for NSQ",
+			StartType:   mgr.StartAutomatic,
+		}, append([]string{"run"}, args...)...)
+		if err != nil {
+			return fmt.Errorf("failed to install service: %v", err)
+		}
+		defer s.Close()
+		if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+			s.Delete()
+			return fmt.Errorf("failed to set up event log source: %v", err)
+		}
+		fmt.Printf("Service %s installed\n", serviceName)
+	case "uninstall":
+		s, err := m.OpenService(serviceName)
+		if err != nil {
+			return fmt.Errorf("service %s is not installed: %v", serviceName, err)
+		}
+		defer s.Close()
+		if err := s.Delete(); err != nil {
+			return fmt.Errorf("failed to remove service: %v", err)
+		}
+		if err := eventlog.Remove(serviceName); err != nil {
+			return fmt.Errorf("failed to remove event log source: %v", err)
+		}
+		fmt.Printf("Service %s removed\n", serviceName)
+	}
+	return nil
+}
+
+// eventLogHandler is a slog.Handler writing records to the Windows event
+// log, formatted like the text handler.
+type eventLogHandler struct {
+	elog  *eventlog.Log
+	inner slog.Handler
+
+	mu  *sync.Mutex
+	buf *bytes.Buffer
+}
+
+func newEventLogHandler(elog *eventlog.Log, level slog.Level) *eventLogHandler {
+	buf := new(bytes.Buffer)
+	return &eventLogHandler{
+		elog:  elog,
+		inner: slog.NewTextHandler(buf, &slog.HandlerOptions{Level: level}),
+		mu:    new(sync.Mutex),
+		buf:   buf,
+	}
+}
+
+func (h *eventLogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
+
+func (h *eventLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.buf.Reset()
+	if err := h.inner.Handle(ctx, r); err != nil {
+		return err
+	}
+	msg := h.buf.String()
+	switch {
+	case r.Level >= slog.LevelError:
+		return h.elog.Error(1, msg)
+	case r.Level >= slog.LevelWarn:
+		return h.elog.Warning(1, msg)
+	default:
+		return h.elog.Info(1, msg)
+	}
+}
+
+func (h *eventLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &eventLogHandler{elog: h.elog, inner: h.inner.WithAttrs(attrs), mu: h.mu, buf: h.buf}
+}
+
+func (h *eventLogHandler) WithGroup(name string) slog.Handler {
+	return &eventLogHandler{elog: h.elog, inner: h.inner.WithGroup(name), mu: h.mu, buf: h.buf}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var (
+	nsqdSSHJumpHost   = flag.String("nsqd.ssh.jump-host", "", "SSH server, [user@]host[:port], nsqd nodes are reached through instead of directly. The server resolves and connects to the nodes. Overridden by the ssh_jump_host of a target.")
+	nsqdSSHKeyFile    = flag.String("nsqd.ssh.key-file", "", "Unencrypted private key to authenticate to SSH jump hosts with. Keys of the agent at $SSH_AUTH_SOCK are tried as well.")
+	nsqdSSHKnownHosts = flag.String("nsqd.ssh.known-hosts", "", "known_hosts file the keys of SSH jump hosts are verified against, ~/.ssh/known_hosts by default.")
+)
+
+// checkSSHFlags validates --nsqd.ssh.jump-host.
+func checkSSHFlags() error {
+	if *nsqdSSHJumpHost == "" {
+		return nil
+	}
+	if _, _, err := parseJumpHost(*nsqdSSHJumpHost); err != nil {
+		return fmt.Errorf("invalid --nsqd.ssh.jump-host %q: %v", *nsqdSSHJumpHost, err)
+	}
+	return nil
+}
+
+// parseJumpHost returns the user and host:port address of an SSH server
+// given as [user@]host[:port]. The user defaults to the current one, the
+// port to 22.
+func parseJumpHost(s string) (string, string, error) {
+	name, hostport, ok := strings.Cut(s, "@")
+	if !ok {
+		hostport, name = s, ""
+	}
+	if ok && name == "" {
+		return "", "", errors.New("missing user")
+	}
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host, port = strings.Trim(hostport, "[]"), "22"
+	}
+	if host == "" {
+		return "", "", errors.New("missing host")
+	}
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		return "", "", fmt.Errorf("invalid port %q", port)
+	}
+	if name == "" {
+		u, err := user.Current()
+		if err != nil {
+			return "", "", fmt.Errorf("missing user: %v", err)
+		}
+		name = u.Username
+	}
+	return name, net.JoinHostPort(host, port), nil
+}
+
+// sshTunnel is a connection to an SSH jump host, opened on the first dial
+// and again after it breaks, that nsqd nodes are dialed through.
+type sshTunnel struct {
+	addr   string
+	config *ssh.ClientConfig
+	// dial connects to the jump host itself.
+	dial dialFunc
+
+	mu     sync.Mutex
+	client *ssh.Client
+}
+
+// connect returns the connection to the jump host, opening it if needed.
+func (t *sshTunnel) connect(ctx context.Context) (*ssh.Client, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.client != nil {
+		return t.client, nil
+	}
+	conn, err := t.dial(ctx, "tcp", t.addr)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to SSH jump host %s: %v", t.addr, err)
+	}
+	// The handshake isn't aware of ctx, bound it by its deadline.
+	deadline := time.Now().Add(*nsqdTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	config := *t.config
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		// The agent signs during the handshake only.
+		if a, err := net.Dial("unix", sock); err != nil {
+			slog.Warn("Failed to connect to SSH agent", "err", err)
+		} else {
+			defer a.Close()
+			config.Auth = append(config.Auth[:len(config.Auth):len(config.Auth)], ssh.PublicKeysCallback(agent.NewClient(a).Signers))
+		}
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, t.addr, &config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SSH handshake with jump host %s: %v", t.addr, err)
+	}
+	conn.SetDeadline(time.Time{})
+	client := ssh.NewClient(c, chans, reqs)
+	slog.Info("Connected to SSH jump host", "addr", t.addr, "user", t.config.User)
+	go func() {
+		err := client.Wait()
+		slog.Warn("Connection to SSH jump host closed", "addr", t.addr, "err", err)
+		t.mu.Lock()
+		if t.client == client {
+			t.client = nil
+		}
+		t.mu.Unlock()
+	}()
+	t.client = client
+	return client, nil
+}
+
+// dialContext connects to addr from the jump host.
+func (t *sshTunnel) dialContext(ctx context.Context, _, addr string) (net.Conn, error) {
+	client, err := t.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := client.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("dialing %s through SSH jump host %s: %v", addr, t.addr, err)
+	}
+	return conn, nil
+}
+
+// sshClients holds the clients tunneling through each jump host, so
+// targets behind the same one share its connection.
+var sshClients = struct {
+	sync.Mutex
+	m map[string]*http.Client
+}{m: make(map[string]*http.Client)}
+
+// sshClient returns a client like client connecting to nsqd through the
+// SSH jump host, given as [user@]host[:port]. client itself is returned
+// if jumpHost is empty, or if its transport isn't an *http.Transport, e.g.
+// when replaying a recording.
+func sshClient(client *http.Client, jumpHost string) (*http.Client, error) {
+	transport, ok := client.Transport.(*http.Transport)
+	if jumpHost == "" || !ok {
+		return client, nil
+	}
+	sshClients.Lock()
+	defer sshClients.Unlock()
+	if c, ok := sshClients.m[jumpHost]; ok {
+		return c, nil
+	}
+	name, addr, err := parseJumpHost(jumpHost)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SSH jump host %q: %v", jumpHost, err)
+	}
+	config, err := sshClientConfig(name)
+	if err != nil {
+		return nil, err
+	}
+	tunnel := &sshTunnel{addr: addr, config: config, dial: transport.DialContext}
+	t := transport.Clone()
+	t.DialContext = tunnel.dialContext
+	c := *client
+	c.Transport = t
+	sshClients.m[jumpHost] = &c
+	return &c, nil
+}
+
+// sshClientConfig returns the configuration of the connections to jump
+// hosts as name, authenticating with --nsqd.ssh.key-file. The keys of the
+// SSH agent are added on every connection.
+func sshClientConfig(name string) (*ssh.ClientConfig, error) {
+	var methods []ssh.AuthMethod
+	if *nsqdSSHKeyFile != "" {
+		key, err := os.ReadFile(*nsqdSSHKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading SSH key: %v", err)
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) {
+			return nil, fmt.Errorf("SSH key %s is encrypted, add it to an SSH agent instead", *nsqdSSHKeyFile)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parsing SSH key %s: %v", *nsqdSSHKeyFile, err)
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+	if len(methods) == 0 && os.Getenv("SSH_AUTH_SOCK") == "" {
+		return nil, errors.New("SSH jump hosts require --nsqd.ssh.key-file or an SSH agent")
+	}
+
+	knownHosts := *nsqdSSHKnownHosts
+	if knownHosts == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("locating known_hosts: %v", err)
+		}
+		knownHosts = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("loading SSH known hosts: %v", err)
+	}
+	return &ssh.ClientConfig{
+		User:            name,
+		Auth:            methods,
+		HostKeyCallback: hostKeyCallback,
+	}, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/amartorelli/nsq_exporter/pkg/collector"
+)
+
+var (
+	stateFile         = flag.String("state.file", "", "File the counter baselines of --metrics.rates are persisted to, so rates continue across restarts.")
+	stateSaveInterval = flag.Duration("state.save-interval", time.Minute, "Interval at which the state file is written, it is also written on shutdown.")
+)
+
+// loadState restores the state file, if it exists.
+func loadState(c *collector.Collector) error {
+	f, err := os.Open(*stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open state file: %v", err)
+	}
+	defer f.Close()
+	return c.LoadState(f)
+}
+
+// saveState writes the state file, replacing it atomically.
+func saveState(c *collector.Collector) error {
+	f, err := os.CreateTemp(filepath.Dir(*stateFile), filepath.Base(*stateFile)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create state file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	if err := c.SaveState(f); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+	if err := os.Rename(f.Name(), *stateFile); err != nil {
+		return fmt.Errorf("failed to replace state file: %v", err)
+	}
+	return nil
+}
+
+// persistState writes the state file every --state.save-interval and once
+// more when stop is closed, then closes done.
+func persistState(logger *slog.Logger, c *collector.Collector, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(*stateSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			if err := saveState(c); err != nil {
+				logger.Error("Error saving state", "err", err)
+			}
+			return
+		}
+		if err := saveState(c); err != nil {
+			logger.Error("Error saving state", "err", err)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	statsdAddress = flag.String("push.statsd.address", "", "UDP address of a StatsD server the metrics are sent to, e.g. localhost:8125, or unix:///path/to/socket for a unix datagram socket such as the one of the Datadog agent. Disabled if empty.")
+	statsdPrefix  = flag.String("push.statsd.prefix", "", "Prefix of the StatsD metric names, e.g. \"prod.\".")
+	statsdFormat  = flag.String("push.statsd.format", "graphite", "How labels are sent to StatsD: appended to the metric name as name.value pairs (graphite) or as tags (dogstatsd). One of: [graphite, dogstatsd]")
+)
+
+// statsdMaxPacketSize keeps UDP packets below the usual MTU, unix
+// datagrams can be larger.
+const (
+	statsdMaxPacketSize     = 1432
+	statsdMaxUnixPacketSize = 8192
+)
+
+// statsdPusher sends metrics to StatsD over UDP. Gauges are sent as gauges,
+// counters as counters incremented by their increase since the previous
+// push.
+type statsdPusher struct {
+	gatherer      prometheus.Gatherer
+	conn          net.Conn
+	maxPacketSize int
+	counters      map[string]float64
+}
+
+func newStatsdPusher(g prometheus.Gatherer) (*statsdPusher, error) {
+	network, addr, maxPacketSize := "udp", *statsdAddress, statsdMaxPacketSize
+	if path, ok := strings.CutPrefix(addr, "unix://"); ok {
+		network, addr, maxPacketSize = "unixgram", path, statsdMaxUnixPacketSize
+	}
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to StatsD: %v", err)
+	}
+	return &statsdPusher{gatherer: g, conn: conn, maxPacketSize: maxPacketSize, counters: make(map[string]float64)}, nil
+}
+
+func (p *statsdPusher) push(context.Context) error {
+	mfs, err := p.gatherer.Gather()
+	if err != nil && len(mfs) == 0 {
+		return err
+	}
+	var (
+		packet bytes.Buffer
+		errs   []error
+	)
+	send := func() {
+		if packet.Len() == 0 {
+			return
+		}
+		if _, err := p.conn.Write(packet.Bytes()); err != nil {
+			errs = append(errs, err)
+		}
+		packet.Reset()
+	}
+	write := func(line string) {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > p.maxPacketSize {
+			send()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+
+	seen := make(map[string]float64)
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			name := mf.GetName()
+			switch {
+			case m.Counter != nil:
+				key := statsdName(name, m.Label)
+				value := m.Counter.GetValue()
+				seen[key] = value
+				prev, ok := p.counters[key]
+				if !ok {
+					// The first push only records the baseline.
+					continue
+				}
+				if value >= prev {
+					value -= prev
+				}
+				write(statsdLine(name, m.Label, value, "c"))
+			case m.Gauge != nil:
+				write(statsdLine(name, m.Label, m.Gauge.GetValue(), "g"))
+			case m.Untyped != nil:
+				write(statsdLine(name, m.Label, m.Untyped.GetValue(), "g"))
+			case m.Summary != nil:
+				write(statsdLine(name+"_sum", m.Label, m.Summary.GetSampleSum(), "g"))
+				write(statsdLine(name+"_count", m.Label, float64(m.Summary.GetSampleCount()), "g"))
+			case m.Histogram != nil:
+				write(statsdLine(name+"_sum", m.Label, m.Histogram.GetSampleSum(), "g"))
+				write(statsdLine(name+"_count", m.Label, float64(m.Histogram.GetSampleCount()), "g"))
+			}
+		}
+	}
+	send()
+	p.counters = seen
+	return errors.Join(errs...)
+}
+
+func (p *statsdPusher) close(context.Context) error {
+	return p.conn.Close()
+}
+
+func (p *statsdPusher) name() string {
+	return "statsd"
+}
+
+// statsdLine formats a single StatsD sample.
+func statsdLine(name string, labels []*dto.LabelPair, value float64, kind string) string {
+	v := strconv.FormatFloat(value, 'f', -1, 64)
+	if *statsdFormat == "dogstatsd" {
+		line := statsdEscape(*statsdPrefix+name) + ":" + v + "|" + kind
+		if len(labels) == 0 {
+			return line
+		}
+		tags := make([]string, 0, len(labels))
+		for _, lp := range labels {
+			tags = append(tags, statsdEscape(lp.GetName())+":"+statsdEscape(lp.GetValue()))
+		}
+		sort.Strings(tags)
+		return line + "|#" + strings.Join(tags, ",")
+	}
+	return statsdName(name, labels) + ":" + v + "|" + kind
+}
+
+// statsdName returns the Graphite style name of a series.
+func statsdName(name string, labels []*dto.LabelPair) string {
+	return graphitePath(*statsdPrefix, name, labels)
+}
+
+var statsdReplacer = strings.NewReplacer(":", "_", "|", "_", "@", "_", "#", "_", ",", "_", " ", "_", "\n", "_")
+
+// statsdEscape replaces the characters with a meaning in the StatsD line
+// format.
+func statsdEscape(s string) string {
+	return statsdReplacer.Replace(s)
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	statsdListenAddress = flag.String("statsd.listen-address", ":8125", "UDP address the StatsD stream of nsqd (--statsd-address) is received on, with --scrape.mode=statsd.")
+	statsdNSQDPrefix    = flag.String("statsd.prefix", "nsq.%s", "The --statsd-prefix of nsqd, %s standing for the node's host and port.")
+	statsdSeriesTTL     = flag.Duration("statsd.series-ttl", 5*time.Minute, "Time after which a series no longer received over StatsD, e.g. of a deleted channel, is dropped.")
+)
+
+// statsdStat is an nsqd StatsD stat translated to a metric.
+type statsdStat struct {
+	desc      *prometheus.Desc
+	valueType prometheus.ValueType
+	// scale converts the value to the unit of the metric.
+	scale float64
+}
+
+// statsdSeries is the latest value of a series received over StatsD.
+type statsdSeries struct {
+	stat    *statsdStat
+	labels  []string
+	value   float64
+	updated time.Time
+}
+
+// statsdBridge receives the stats nsqd sends with StatsD and exports them
+// as metrics, so nsqd doesn't need to be scraped.
+type statsdBridge struct {
+	logger *slog.Logger
+	conn   net.PacketConn
+	// prefix and suffix surround the node in the names of the stats, if
+	// hasNode is set.
+	prefix, suffix string
+	hasNode        bool
+
+	channelStats map[string]*statsdStat
+	topicStats   map[string]*statsdStat
+	memStats     map[string]*statsdStat
+	latency      [2]*prometheus.Desc
+	ignored      prometheus.Counter
+
+	mu       sync.Mutex
+	series   map[string]*statsdSeries
+	received time.Time
+}
+
+func newStatsdBridge(logger *slog.Logger) (*statsdBridge, error) {
+	conn, err := net.ListenPacket("udp", *statsdListenAddress)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for StatsD: %v", err)
+	}
+	// Like nsqd, terminate the prefix with a dot.
+	template := *statsdNSQDPrefix
+	if template != "" && !strings.HasSuffix(template, ".") {
+		template += "."
+	}
+	prefix, suffix, hasNode := strings.Cut(template, "%s")
+
+	ns := *metricsNamespace
+	desc := func(name, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(ns, *metricsSubsystem, name), help, labels, nil)
+	}
+	channelLabels := []string{"node", "topic", "channel"}
+	topicLabels := []string{"node", "topic"}
+	gauge := func(d *prometheus.Desc) *statsdStat {
+		return &statsdStat{desc: d, valueType: prometheus.GaugeValue, scale: 1}
+	}
+	counter := func(d *prometheus.Desc) *statsdStat {
+		return &statsdStat{desc: d, valueType: prometheus.CounterValue, scale: 1}
+	}
+	b := &statsdBridge{
+		logger:  logger,
+		conn:    conn,
+		prefix:  prefix,
+		suffix:  suffix,
+		hasNode: hasNode,
+		channelStats: map[string]*statsdStat{
+			"depth":           gauge(desc("depth", "Queue depth", channelLabels...)),
+			"backend_depth":   gauge(desc("backend_depth", "Number of messages queued on disk by the channel", channelLabels...)),
+			"in_flight_count": gauge(desc("in_flight_count", "In-flight count", channelLabels...)),
+			"deferred_count":  gauge(desc("deferred_count", "Number of deferred messages of the channel", channelLabels...)),
+			"clients":         gauge(desc("client_count", "Number of clients", channelLabels...)),
+			"message_count":   counter(desc("message_count", "Queue message count", channelLabels...)),
+			"requeue_count":   counter(desc("requeue_count", "Number of messages requeued in the channel", channelLabels...)),
+			"timeout_count":   counter(desc("timeout_count", "Number of messages of the channel that timed out", channelLabels...)),
+		},
+		topicStats: map[string]*statsdStat{
+			"depth":         gauge(desc("topic_queue_depth", "Number of messages queued in memory by the topic", topicLabels...)),
+			"backend_depth": gauge(desc("topic_backend_queue_depth", "Number of messages queued on disk by the topic", topicLabels...)),
+			"message_count": counter(desc("topic_messages_total", "Number of messages published to the topic", topicLabels...)),
+			"message_bytes": counter(desc("topic_message_bytes_total", "Bytes of the messages published to the topic", topicLabels...)),
+		},
+		memStats: map[string]*statsdStat{
+			"heap_objects":        gauge(desc("memory_heap_objects", "Number of objects allocated on the heap of nsqd", "node")),
+			"heap_idle_bytes":     gauge(desc("memory_heap_idle_bytes", "Bytes of idle heap spans of nsqd", "node")),
+			"heap_in_use_bytes":   gauge(desc("memory_heap_in_use_bytes", "Bytes of in-use heap spans of nsqd", "node")),
+			"heap_released_bytes": gauge(desc("memory_heap_released_bytes", "Bytes of heap memory nsqd returned to the OS", "node")),
+			"next_gc_bytes":       gauge(desc("memory_next_gc_bytes", "Heap size at which nsqd runs the next garbage collection", "node")),
+			"gc_runs":             counter(desc("memory_gc_runs_total", "Number of garbage collections run by nsqd", "node")),
+		},
+		latency: [2]*prometheus.Desc{
+			desc("topic_e2e_processing_latency_seconds", "Quantiles of the time between publishing messages to the topic and finishing them", append(topicLabels, "quantile")...),
+			desc("channel_e2e_processing_latency_seconds", "Quantiles of the time between publishing messages to the channel and finishing them", append(channelLabels, "quantile")...),
+		},
+		ignored: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: "exporter",
+			Name:      "statsd_ignored_lines_total",
+			Help:      "Number of StatsD lines received that are not nsqd stats",
+		}),
+		series: make(map[string]*statsdSeries),
+	}
+	return b, nil
+}
+
+// serve receives StatsD packets until stop is closed.
+func (b *statsdBridge) serve(stop <-chan struct{}) {
+	go func() {
+		<-stop
+		b.conn.Close()
+	}()
+	buf := make([]byte, 65535)
+	for {
+		n, _, err := b.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			b.logger.Error("Error receiving StatsD packet", "err", err)
+			continue
+		}
+		now := time.Now()
+		b.mu.Lock()
+		b.received = now
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !b.handle(line, now) {
+				b.ignored.Inc()
+			}
+		}
+		b.mu.Unlock()
+	}
+}
+
+// handle records a StatsD line, reporting whether it is an nsqd stat.
+func (b *statsdBridge) handle(line string, now time.Time) bool {
+	name, rest, ok := strings.Cut(line, ":")
+	if !ok {
+		return false
+	}
+	fields := strings.Split(rest, "|")
+	if len(fields) < 2 {
+		return false
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return false
+	}
+	if len(fields) > 2 && strings.HasPrefix(fields[2], "@") {
+		if rate, err := strconv.ParseFloat(fields[2][1:], 64); err == nil && rate > 0 {
+			value /= rate
+		}
+	}
+	stat, labels, ok := b.parseName(name)
+	if !ok {
+		return false
+	}
+	switch {
+	case fields[1] == "c" && stat.valueType == prometheus.CounterValue:
+	case fields[1] == "g" && stat.valueType == prometheus.GaugeValue:
+	default:
+		return false
+	}
+
+	key := stat.desc.String() + "\xff" + strings.Join(labels, "\xff")
+	s, ok := b.series[key]
+	if !ok {
+		s = &statsdSeries{stat: stat, labels: labels}
+		b.series[key] = s
+	}
+	if stat.valueType == prometheus.CounterValue {
+		// nsqd sends the increase since its previous report.
+		s.value += value * stat.scale
+	} else {
+		s.value = value * stat.scale
+	}
+	s.updated = now
+	return true
+}
+
+// parseName maps the name of an nsqd stat to its metric and label values.
+// Names are, after the prefix, topic.<topic>.<stat>,
+// topic.<topic>.channel.<channel>.<stat> or mem.<stat>.
+func (b *statsdBridge) parseName(name string) (*statsdStat, []string, bool) {
+	rest, ok := strings.CutPrefix(name, b.prefix)
+	if !ok {
+		return nil, nil, false
+	}
+	var node string
+	if b.hasNode {
+		if node, rest, ok = strings.Cut(rest, b.suffix); !ok {
+			return nil, nil, false
+		}
+	}
+	if mem, ok := strings.CutPrefix(rest, "mem."); ok {
+		stat, found := b.memStats[mem]
+		return stat, []string{node}, found
+	}
+	rest, ok = strings.CutPrefix(rest, "topic.")
+	if !ok {
+		return nil, nil, false
+	}
+	i := strings.LastIndexByte(rest, '.')
+	if i < 0 {
+		return nil, nil, false
+	}
+	path, statName := rest[:i], rest[i+1:]
+
+	stats, labels := b.topicStats, []string{node, path}
+	latency := b.latency[0]
+	if j := strings.LastIndex(path, ".channel."); j >= 0 {
+		stats, labels = b.channelStats, []string{node, path[:j], path[j+len(".channel."):]}
+		latency = b.latency[1]
+	}
+	if pct, ok := strings.CutPrefix(statName, "e2e_processing_latency_"); ok {
+		q, err := strconv.ParseFloat(pct, 64)
+		if err != nil {
+			return nil, nil, false
+		}
+		// Latencies are reported in nanoseconds.
+		stat := &statsdStat{desc: latency, valueType: prometheus.GaugeValue, scale: 1e-9}
+		return stat, append(labels, strconv.FormatFloat(q/100, 'g', -1, 64)), true
+	}
+	stat, found := stats[statName]
+	return stat, labels, found
+}
+
+// ready reports whether StatsD stats were received in the last maxAge, or
+// at all if maxAge is 0.
+func (b *statsdBridge) ready(maxAge time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.received.IsZero() && (maxAge <= 0 || time.Since(b.received) <= maxAge)
+}
+
+// Describe implements prometheus.Collector.
+func (b *statsdBridge) Describe(ch chan<- *prometheus.Desc) {
+	b.ignored.Describe(ch)
+	for _, stats := range []map[string]*statsdStat{b.channelStats, b.topicStats, b.memStats} {
+		for _, stat := range stats {
+			ch <- stat.desc
+		}
+	}
+	for _, d := range b.latency {
+		ch <- d
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (b *statsdBridge) Collect(ch chan<- prometheus.Metric) {
+	b.ignored.Collect(ch)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for key, s := range b.series {
+		if time.Since(s.updated) > *statsdSeriesTTL {
+			delete(b.series, key)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(s.stat.desc, s.stat.valueType, s.value, s.labels...)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"html/template"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/amartorelli/nsq_exporter/pkg/collector"
+)
+
+var statusTemplate = template.Must(template.New("status").Parse(`<html>
+<head><title>NSQ Exporter - Status</title></head>
+<body>
+<h1>NSQ Exporter - Status</h1>
+<p><a href="/">Home</a> | <a href="{{.MetricsPath}}">Metrics</a></p>
+<h2>Targets</h2>
+<table border="1" cellpadding="4">
+<tr><th>Node</th><th>URL</th><th>Last scrape</th><th>Duration</th><th>State</th><th>Error</th></tr>
+{{range .Targets}}<tr>
+<td>{{.Node}}</td>
+<td>{{.URL}}</td>
+<td>{{if .Last.IsZero}}never{{else}}{{.Last.Format "2006-01-02T15:04:05Z07:00"}}{{end}}</td>
+<td>{{.Duration}}</td>
+<td>{{if .Last.IsZero}}-{{else if .Error}}DOWN{{else}}UP{{end}}</td>
+<td>{{.Error}}</td>
+</tr>{{end}}
+</table>
+</body>
+</html>
+`))
+
+// statusHandler serves a page listing every target with the result of its
+// last scrape.
+func statusHandler(c *collector.Collector, metricsPath string) http.Handler {
+	type targetStatus struct {
+		Node, URL, Error string
+		Last             time.Time
+		Duration         time.Duration
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data := struct {
+			MetricsPath string
+			Targets     []targetStatus
+		}{MetricsPath: metricsPath}
+		for _, t := range c.Targets() {
+			status := t.Status()
+			ts := targetStatus{
+				Node:     t.Endpoint().Node,
+				URL:      t.Endpoint().URL,
+				Last:     status.LastScrape,
+				Duration: status.Duration.Round(time.Millisecond),
+			}
+			if status.Err != nil {
+				ts.Error = status.Err.Error()
+			}
+			data.Targets = append(data.Targets, ts)
+		}
+		if err := statusTemplate.Execute(w, data); err != nil {
+			slog.Error("Error rendering status page", "err", err)
+		}
+	})
+}
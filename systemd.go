@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/amartorelli/nsq_exporter/pkg/collector"
+	"github.com/coreos/go-systemd/v22/daemon"
+)
+
+// notifySystemd tells systemd the exporter is ready once the first stats
+// fetch succeeded and keeps its watchdog happy until stop is closed. It does
+// nothing unless the exporter runs as a Type=notify unit.
+func notifySystemd(logger *slog.Logger, c *collector.Collector, stop <-chan struct{}) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for !c.Ready(0) && !c.CheckConnectivity(context.Background()) {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+	if _, err := daemon.SdNotify(false, daemon.SdNotifyReady); err != nil {
+		logger.Error("Error notifying systemd", "err", err)
+	}
+	logger.Info("Notified systemd of readiness")
+
+	interval, err := daemon.SdWatchdogEnabled(false)
+	if err != nil || interval == 0 {
+		<-stop
+	} else {
+		watchdog := time.NewTicker(interval / 2)
+		defer watchdog.Stop()
+	loop:
+		for {
+			select {
+			case <-watchdog.C:
+				daemon.SdNotify(false, daemon.SdNotifyWatchdog)
+			case <-stop:
+				break loop
+			}
+		}
+	}
+	daemon.SdNotify(false, daemon.SdNotifyStopping)
+}
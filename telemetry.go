@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/exporter-toolkit/web"
+)
+
+var (
+	webTelemetryPath   = flag.String("web.telemetry-path", "", "Path under which to expose the exporter's own metrics, e.g. the Go runtime and the scrape errors, leaving only the NSQ metrics on --web.path. /metrics by default with --web.telemetry-listen.")
+	webTelemetryListen = flag.String("web.telemetry-listen", "", "Address on which to expose the exporter's own metrics apart from the NSQ metrics, [host]:port. Empty serves them on --web.listen.")
+)
+
+// checkTelemetryFlags validates the --web.telemetry-* flags.
+func checkTelemetryFlags() error {
+	var errs []error
+	if path := *webTelemetryPath; path != "" {
+		if !strings.HasPrefix(path, "/") || strings.ContainsAny(path, " {}?#") {
+			errs = append(errs, fmt.Errorf("invalid --web.telemetry-path %q, must be a path starting with /, e.g. /telemetry", path))
+		} else if path == *metricsPath && *webTelemetryListen == "" {
+			errs = append(errs, errors.New("--web.telemetry-path must differ from --web.path"))
+		}
+	}
+	if addr := *webTelemetryListen; addr != "" {
+		if _, port, err := net.SplitHostPort(addr); err != nil {
+			errs = append(errs, fmt.Errorf("invalid --web.telemetry-listen %q, expected [host]:port, e.g. :9118: %v", addr, err))
+		} else if _, err := net.LookupPort("tcp", port); err != nil {
+			errs = append(errs, fmt.Errorf("invalid --web.telemetry-listen %q: invalid port %q", addr, port))
+		}
+		for _, a := range listenAddresses {
+			if a == addr {
+				errs = append(errs, fmt.Errorf("--web.telemetry-listen %q is also in --web.listen", addr))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// separateTelemetry reports whether the exporter's own metrics are served
+// apart from the NSQ metrics.
+func separateTelemetry() bool {
+	return *webTelemetryPath != "" || *webTelemetryListen != ""
+}
+
+// telemetryPath returns the path the exporter's own metrics are served
+// under.
+func telemetryPath() string {
+	if *webTelemetryPath == "" {
+		return "/metrics"
+	}
+	return *webTelemetryPath
+}
+
+// telemetryHandler serves the exporter's own metrics of registry.
+func telemetryHandler(registry prometheus.Gatherer, logger *slog.Logger) http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{
+		ErrorLog:          slog.NewLogLogger(logger.Handler(), slog.LevelError),
+		EnableOpenMetrics: true,
+	})
+}
+
+// newTelemetryServer returns the server of --web.telemetry-listen, serving
+// the exporter's own metrics and the liveness check, and the flags to
+// serve it with, sharing --web.config.file.
+func newTelemetryServer(registry prometheus.Gatherer, logger *slog.Logger) (*http.Server, *web.FlagConfig) {
+	mux := http.NewServeMux()
+	mux.Handle(telemetryPath(), requireToken(webMetricsToken, telemetryHandler(registry, logger)))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})
+	server := &http.Server{
+		Handler:           recoverHandler(logger, mux),
+		ReadHeaderTimeout: *readHeaderTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+	}
+	noSystemdSocket := false
+	return server, &web.FlagConfig{
+		WebSystemdSocket: &noSystemdSocket,
+		WebConfigFile:    webConfigFile,
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	nsqdTLSCAFile             = flag.String("nsqd.tls.ca-file", "", "CA certificate file used to verify the nsqd server certificates.")
+	nsqdTLSCertFile           = flag.String("nsqd.tls.cert-file", "", "Client certificate file presented to nsqd.")
+	nsqdTLSKeyFile            = flag.String("nsqd.tls.key-file", "", "Key file of the client certificate presented to nsqd.")
+	nsqdTLSServerName         = flag.String("nsqd.tls.server-name", "", "Server name used to verify the nsqd server certificates.")
+	nsqdTLSInsecureSkipVerify = flag.Bool("nsqd.tls.insecure-skip-verify", false, "Skip verification of the nsqd server certificates.")
+)
+
+// certReloader keeps the TLS files used to connect to nsqd up to date. The
+// files are checked for changes whenever a new connection is established and
+// reloaded once their modification time changes, so rotated certificates
+// are used without restarting the exporter.
+type certReloader struct {
+	caFile, certFile, keyFile string
+
+	mu      sync.Mutex
+	roots   *x509.CertPool
+	caMod   time.Time
+	cert    *tls.Certificate
+	certMod time.Time
+}
+
+// newTLSConfig builds the TLS configuration for connections to nsqd.
+func newTLSConfig() (*tls.Config, error) {
+	if (*nsqdTLSCertFile == "") != (*nsqdTLSKeyFile == "") {
+		return nil, errors.New("--nsqd.tls.cert-file and --nsqd.tls.key-file must be set together")
+	}
+	if err := nsqdTLSKeyPassphrase.validate(); err != nil {
+		return nil, err
+	}
+	if nsqdTLSKeyPassphrase.isSet() && *nsqdTLSKeyFile == "" {
+		return nil, errors.New("--nsqd.tls.key-passphrase requires --nsqd.tls.key-file")
+	}
+
+	r := &certReloader{caFile: *nsqdTLSCAFile, certFile: *nsqdTLSCertFile, keyFile: *nsqdTLSKeyFile}
+	// Load everything once upfront so broken files are reported at startup.
+	if err := r.reload(); err != nil {
+		return nil, fmt.Errorf("invalid nsqd TLS configuration: %v", err)
+	}
+
+	cfg := &tls.Config{
+		ServerName:         *nsqdTLSServerName,
+		InsecureSkipVerify: *nsqdTLSInsecureSkipVerify,
+	}
+	if r.certFile != "" {
+		cfg.GetClientCertificate = r.clientCertificate
+	}
+	if r.caFile != "" && !cfg.InsecureSkipVerify {
+		// The built-in verification can't pick up a changed CA pool, so
+		// verify the server certificates ourselves.
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = r.verifyConnection
+	}
+	return cfg, nil
+}
+
+func (r *certReloader) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	if err := r.reload(); err != nil {
+		slog.Warn("Failed to reload nsqd TLS files, using the previous ones", "err", err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cert, nil
+}
+
+func (r *certReloader) verifyConnection(cs tls.ConnectionState) error {
+	if err := r.reload(); err != nil {
+		slog.Warn("Failed to reload nsqd TLS files, using the previous ones", "err", err)
+	}
+	r.mu.Lock()
+	roots := r.roots
+	r.mu.Unlock()
+
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("nsqd did not present a certificate")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       cs.ServerName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := cs.PeerCertificates[0].Verify(opts); err != nil {
+		// Like the built-in verification, so the certificate can be
+		// inspected.
+		return &tls.CertificateVerificationError{UnverifiedCertificates: cs.PeerCertificates, Err: err}
+	}
+	return nil
+}
+
+// reload re-reads the files that changed since they were last loaded.
+func (r *certReloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.caFile != "" {
+		mod, err := modTime(r.caFile)
+		if err != nil {
+			return fmt.Errorf("--nsqd.tls.ca-file: %v", err)
+		}
+		if !mod.Equal(r.caMod) {
+			pem, err := os.ReadFile(r.caFile)
+			if err != nil {
+				return fmt.Errorf("failed to read CA file: %v", err)
+			}
+			roots := x509.NewCertPool()
+			if !roots.AppendCertsFromPEM(pem) {
+				return fmt.Errorf("no certificates found in CA file %s", r.caFile)
+			}
+			r.roots, r.caMod = roots, mod
+		}
+	}
+
+	if r.certFile != "" {
+		certMod, err := modTime(r.certFile)
+		if err != nil {
+			return fmt.Errorf("--nsqd.tls.cert-file: %v", err)
+		}
+		keyMod, err := modTime(r.keyFile)
+		if err != nil {
+			return fmt.Errorf("--nsqd.tls.key-file: %v", err)
+		}
+		if keyMod.After(certMod) {
+			certMod = keyMod
+		}
+		if !certMod.Equal(r.certMod) {
+			cert, err := loadKeyPair(r.certFile, r.keyFile)
+			if err != nil {
+				return fmt.Errorf("failed to load client certificate: %v", err)
+			}
+			r.cert, r.certMod = &cert, certMod
+		}
+	}
+	return nil
+}
+
+func modTime(path string) (time.Time, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadKeyPair(t *testing.T) {
+	for _, tt := range []struct {
+		key        string
+		passphrase string
+		err        string
+	}{
+		{key: "testdata/client.key"},
+		{key: "testdata/client.key", passphrase: "secret"},
+		{key: "testdata/client-pkcs8.key", passphrase: "secret"},
+		{key: "testdata/client-pkcs8-sha1.key", passphrase: "secret"},
+		{key: "testdata/client-legacy.key", passphrase: "secret"},
+		{key: "testdata/client-pkcs8.key", passphrase: "wrong", err: "password incorrect"},
+		{key: "testdata/client-legacy.key", passphrase: "wrong", err: "password incorrect"},
+	} {
+		setFlag(t, "nsqd.tls.key-passphrase", tt.passphrase)
+		cert, err := loadKeyPair("testdata/client.crt", tt.key)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s with passphrase %q: err = %v, want an error containing %q", tt.key, tt.passphrase, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s with passphrase %q: %v", tt.key, tt.passphrase, err)
+			continue
+		}
+		if cert.PrivateKey == nil {
+			t.Errorf("%s with passphrase %q: no private key", tt.key, tt.passphrase)
+		}
+	}
+}
+
+func TestLoadKeyPairWithoutPassphrase(t *testing.T) {
+	for _, key := range []string{"testdata/client-pkcs8.key", "testdata/client-legacy.key"} {
+		if _, err := loadKeyPair("testdata/client.crt", key); err == nil || !strings.Contains(err.Error(), "--nsqd.tls.key-passphrase") {
+			t.Errorf("%s without a passphrase: err = %v, want one asking for the passphrase", key, err)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"time"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	tracingURL         = flag.String("tracing.otlp.url", "", "URL of the OpenTelemetry collector the traces of scrapes are sent to over OTLP, e.g. http://otel-collector:4317 for gRPC or http://otel-collector:4318/v1/traces for HTTP. Disabled if empty.")
+	tracingProtocol    = flag.String("tracing.otlp.protocol", "grpc", "Protocol used to send traces over OTLP. One of: [grpc, http]")
+	tracingSampleRatio = flag.Float64("tracing.sample-ratio", 1, "Fraction of the scrapes traced, unless the scrape request carries a sampling decision.")
+)
+
+// tracerProvider is the provider of the tracer passed to the collector, nil
+// unless tracing is enabled.
+var tracerProvider *sdktrace.TracerProvider
+
+// checkTracingFlags validates the --tracing.* flags.
+func checkTracingFlags() error {
+	switch *tracingProtocol {
+	case "grpc", "http":
+	default:
+		return fmt.Errorf("invalid --tracing.otlp.protocol %q, must be grpc or http", *tracingProtocol)
+	}
+	if *tracingSampleRatio < 0 || *tracingSampleRatio > 1 {
+		return errors.New("--tracing.sample-ratio must be between 0 and 1")
+	}
+	if *tracingURL != "" {
+		if u, err := url.Parse(*tracingURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid --tracing.otlp.url %q", *tracingURL)
+		}
+	}
+	return nil
+}
+
+// newTracer returns the tracer of the collector, nil if tracing is
+// disabled.
+func newTracer() (trace.Tracer, error) {
+	if *tracingURL == "" {
+		return nil, nil
+	}
+	var (
+		exporter sdktrace.SpanExporter
+		err      error
+	)
+	ctx := context.Background()
+	switch *tracingProtocol {
+	case "grpc":
+		exporter, err = otlptracegrpc.New(ctx, otlptracegrpc.WithEndpointURL(*tracingURL))
+	case "http":
+		exporter, err = otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(*tracingURL))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP trace exporter: %v", err)
+	}
+	tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(*tracingSampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("nsq_exporter"))),
+	)
+	return tracerProvider.Tracer("github.com/amartorelli/nsq_exporter"), nil
+}
+
+// shutdownTracing sends the spans still buffered.
+func shutdownTracing() error {
+	if tracerProvider == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return tracerProvider.Shutdown(ctx)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+var (
+	webUI        = flag.Bool("web.ui", false, "Serve a live table of the topics and channels under /ui, from the stats last fetched from every nsqd node.")
+	webUIRefresh = flag.Duration("web.ui.refresh-interval", 5*time.Second, "How often the page of --web.ui refreshes its table.")
+)
+
+// checkUIFlags validates the --web.ui.* flags.
+func checkUIFlags() error {
+	if *webUIRefresh < time.Second {
+		return fmt.Errorf("invalid --web.ui.refresh-interval %s, must be at least 1s", *webUIRefresh)
+	}
+	return nil
+}
+
+var uiTemplate = template.Must(template.New("ui").Parse(`<html>
+<head>
+<title>NSQ Exporter - Topics</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; }
+th { cursor: pointer; background: #eee; }
+td.num { text-align: right; }
+tr.paused { color: #999; }
+#error { color: #c00; }
+</style>
+</head>
+<body>
+<h1>NSQ Exporter - Topics</h1>
+<p><a href="/">Home</a> | <a href="/status">Status</a> | <a href="/api/v1/topics">JSON</a></p>
+{{if .TokenRequired}}<p><label>Metrics token <input type="password" id="token"></label></p>
+{{end}}<p>Updated <span id="updated">never</span> <span id="error"></span></p>
+<table>
+<thead><tr>
+<th data-key="topic">Topic</th>
+<th data-key="channel">Channel</th>
+<th data-key="depth">Depth</th>
+<th data-key="in_flight_count">In flight</th>
+<th data-key="client_count">Clients</th>
+<th data-key="paused">Paused</th>
+<th data-key="nodes">Nodes</th>
+</tr></thead>
+<tbody id="rows"></tbody>
+</table>
+<script>
+var rows = [], sortKey = "depth", sortDesc = true;
+var token = document.getElementById("token");
+if (token) {
+  token.value = sessionStorage.getItem("nsq_exporter_token") || "";
+  token.onchange = function() {
+    sessionStorage.setItem("nsq_exporter_token", token.value);
+    refresh();
+  };
+}
+
+function render() {
+  rows.sort(function(a, b) {
+    var x = a[sortKey], y = b[sortKey], c = x < y ? -1 : x > y ? 1 : 0;
+    if (c === 0) c = a.topic < b.topic ? -1 : a.topic > b.topic ? 1 : a.channel < b.channel ? -1 : 1;
+    return sortDesc ? -c : c;
+  });
+  var body = document.getElementById("rows");
+  body.textContent = "";
+  rows.forEach(function(r) {
+    var tr = body.insertRow();
+    if (r.paused) tr.className = "paused";
+    [r.topic, r.channel, r.depth, r.in_flight_count, r.client_count, r.paused ? "yes" : "", r.nodes].forEach(function(v, i) {
+      var td = tr.insertCell();
+      td.textContent = v;
+      if (i >= 2 && i <= 4) td.className = "num";
+    });
+  });
+}
+
+function refresh() {
+  var headers = {};
+  if (token && token.value) headers.Authorization = "Bearer " + token.value;
+  fetch("/api/v1/topics", {headers: headers}).then(function(resp) {
+    if (!resp.ok) throw new Error(resp.status + " " + resp.statusText);
+    return resp.json();
+  }).then(function(data) {
+    rows = [];
+    data.topics.forEach(function(t) {
+      var nodes = t.nodes.join(", ");
+      if (t.channels.length === 0) {
+        rows.push({topic: t.topic, channel: "", depth: t.depth, in_flight_count: 0, client_count: 0, paused: t.paused, nodes: nodes});
+      }
+      t.channels.forEach(function(c) {
+        rows.push({topic: t.topic, channel: c.channel, depth: c.depth, in_flight_count: c.in_flight_count,
+          client_count: c.client_count, paused: t.paused || c.paused, nodes: nodes});
+      });
+    });
+    render();
+    document.getElementById("updated").textContent = new Date().toLocaleTimeString();
+    document.getElementById("error").textContent = "";
+  }).catch(function(err) {
+    document.getElementById("error").textContent = "(" + err.message + ")";
+  });
+}
+
+document.querySelectorAll("th").forEach(function(th) {
+  th.onclick = function() {
+    var key = th.getAttribute("data-key");
+    sortDesc = key === sortKey ? !sortDesc : false;
+    sortKey = key;
+    render();
+  };
+});
+refresh();
+setInterval(refresh, {{.RefreshMillis}});
+</script>
+</body>
+</html>
+`))
+
+// uiHandler serves a page showing the topics and channels of
+// /api/v1/topics in a table, sortable by every column and refreshed every
+// --web.ui.refresh-interval. nsqd isn't contacted by the page. The page
+// holds no data, so it is served without --web.metrics-token, which it
+// asks for and sends along when fetching the topics.
+func uiHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data := struct {
+			RefreshMillis int64
+			TokenRequired bool
+		}{RefreshMillis: webUIRefresh.Milliseconds(), TokenRequired: webMetricsToken.isSet()}
+		if err := uiTemplate.Execute(w, data); err != nil {
+			slog.Error("Error rendering UI", "err", err)
+		}
+	})
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// ViewConfig is a subset of the topics served at <web.path>/view/<name>,
+// e.g. those of a team sharing the NSQ cluster, optionally protected by
+// its own credentials.
+type ViewConfig struct {
+	Name string `yaml:"name"`
+	// Topics are the path.Match patterns of the topics of the view, e.g.
+	// "payments-*".
+	Topics      []string   `yaml:"topics"`
+	BasicAuth   *BasicAuth `yaml:"basic_auth,omitempty"`
+	BearerToken string     `yaml:"bearer_token,omitempty"`
+}
+
+// BasicAuth are the credentials of a view.
+type BasicAuth struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// validateViews reports every invalid setting of views.
+func validateViews(views []ViewConfig) []error {
+	var errs []error
+	names := make(map[string]bool, len(views))
+	for i, v := range views {
+		switch {
+		case v.Name == "":
+			errs = append(errs, fmt.Errorf("views[%d]: missing name", i))
+		case strings.Contains(v.Name, "/"):
+			errs = append(errs, fmt.Errorf("views[%d]: name %q must not contain /", i, v.Name))
+		case names[v.Name]:
+			errs = append(errs, fmt.Errorf("views[%d]: duplicate name %q", i, v.Name))
+		}
+		names[v.Name] = true
+		if len(v.Topics) == 0 {
+			errs = append(errs, fmt.Errorf("views[%d]: missing topics", i))
+		}
+		for _, p := range v.Topics {
+			if _, err := path.Match(p, ""); err != nil {
+				errs = append(errs, fmt.Errorf("views[%d]: invalid pattern %q: %v", i, p, err))
+			}
+		}
+		if v.BasicAuth != nil && v.BearerToken != "" {
+			errs = append(errs, fmt.Errorf("views[%d]: basic_auth and bearer_token are mutually exclusive", i))
+		}
+		if v.BasicAuth != nil && v.BasicAuth.Username == "" {
+			errs = append(errs, fmt.Errorf("views[%d]: basic_auth: missing username", i))
+		}
+	}
+	return errs
+}
+
+// findView returns the view name of the configuration, nil if there is
+// none.
+func findView(name string) *ViewConfig {
+	cfg := loadedConfig.Load()
+	if cfg == nil {
+		return nil
+	}
+	for i := range cfg.Views {
+		if cfg.Views[i].Name == name {
+			return &cfg.Views[i]
+		}
+	}
+	return nil
+}
+
+// matches reports whether topic belongs to the view.
+func (v *ViewConfig) matches(topic string) bool {
+	for _, p := range v.Topics {
+		if ok, _ := path.Match(p, topic); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// authorized reports whether r carries the credentials of the view, if it
+// has any.
+func (v *ViewConfig) authorized(r *http.Request) bool {
+	switch {
+	case v.BasicAuth != nil:
+		user, password, ok := r.BasicAuth()
+		return ok && equal(user, v.BasicAuth.Username) && equal(password, v.BasicAuth.Password)
+	case v.BearerToken != "":
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		return ok && equal(token, v.BearerToken)
+	}
+	return true
+}
+
+// challenge is the WWW-Authenticate header of the responses to requests
+// lacking the credentials of the view.
+func (v *ViewConfig) challenge() string {
+	if v.BasicAuth != nil {
+		return fmt.Sprintf("Basic realm=%q", v.Name)
+	}
+	return fmt.Sprintf("Bearer realm=%q", v.Name)
+}
+
+// equal compares credentials in constant time.
+func equal(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// redactedViews returns views with their credentials redacted.
+func redactedViews(views []ViewConfig) []ViewConfig {
+	var out []ViewConfig
+	for _, v := range views {
+		if v.BasicAuth != nil {
+			v.BasicAuth = &BasicAuth{Username: v.BasicAuth.Username, Password: redacted}
+		}
+		if v.BearerToken != "" {
+			v.BearerToken = redacted
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
+// viewGatherer only keeps the series of a gatherer labelled with a topic of
+// the view.
+type viewGatherer struct {
+	prometheus.Gatherer
+	view *ViewConfig
+}
+
+func (g viewGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+	kept := mfs[:0]
+	for _, mf := range mfs {
+		metrics := mf.Metric[:0]
+		for _, m := range mf.Metric {
+			for _, lp := range m.Label {
+				if lp.GetName() == "topic" && g.view.matches(lp.GetValue()) {
+					metrics = append(metrics, m)
+					break
+				}
+			}
+		}
+		if mf.Metric = metrics; len(metrics) > 0 {
+			kept = append(kept, mf)
+		}
+	}
+	return kept, err
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/amartorelli/nsq_exporter/pkg/collector"
+	"github.com/prometheus/common/version"
+)
+
+var (
+	alertsWebhookURL     = flag.String("alerts.webhook-url", "", "URL alerts are POSTed to as JSON when a channel exceeds the thresholds of the alerts section of the configuration file, evaluated after every poll. Requires --scrape.mode=poll.")
+	alertsWebhookTimeout = flag.Duration("alerts.webhook-timeout", 10*time.Second, "Timeout of the requests to --alerts.webhook-url.")
+)
+
+// checkWebhookFlags validates the --alerts.webhook-* flags.
+func checkWebhookFlags() error {
+	if *alertsWebhookURL == "" {
+		return nil
+	}
+	if u, err := url.Parse(*alertsWebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid --alerts.webhook-url %q", *alertsWebhookURL)
+	}
+	if *scrapeMode != "poll" {
+		return fmt.Errorf("--alerts.webhook-url requires --scrape.mode=poll")
+	}
+	if *alertsWebhookTimeout <= 0 {
+		return fmt.Errorf("--alerts.webhook-timeout must be positive, got %s", *alertsWebhookTimeout)
+	}
+	return nil
+}
+
+// webhookAlert is a state change of an alert, sent to the webhook.
+type webhookAlert struct {
+	Status   string     `json:"status"`
+	Alert    string     `json:"alert"`
+	Node     string     `json:"node"`
+	Topic    string     `json:"topic"`
+	Channel  string     `json:"channel"`
+	Depth    int64      `json:"depth"`
+	Summary  string     `json:"summary"`
+	StartsAt time.Time  `json:"starts_at"`
+	EndsAt   *time.Time `json:"ends_at,omitempty"`
+}
+
+type alertKey struct {
+	alert, node, topic, channel string
+}
+
+// alertState is a condition being met since a time, firing once it was met
+// for the duration of its alert.
+type alertState struct {
+	since  time.Time
+	firing bool
+}
+
+// alerter evaluates the thresholds of the alerts configuration against the
+// stats of the targets, the way the rules of the rules command do.
+type alerter struct {
+	states map[alertKey]*alertState
+}
+
+// evaluate returns the alerts that started or stopped firing at now.
+func (a *alerter) evaluate(cfg AlertsConfig, targets []*collector.Target, now time.Time) []webhookAlert {
+	var changes []webhookAlert
+	met := make(map[alertKey]bool)
+	check := func(key alertKey, cond bool, hold time.Duration, depth int64, summary string) {
+		if !cond {
+			return
+		}
+		met[key] = true
+		s, ok := a.states[key]
+		if !ok {
+			s = &alertState{since: now}
+			a.states[key] = s
+		}
+		if !s.firing && now.Sub(s.since) >= hold {
+			s.firing = true
+			changes = append(changes, webhookAlert{
+				Status: "firing", Alert: key.alert, Node: key.node, Topic: key.topic, Channel: key.channel,
+				Depth: depth, Summary: summary, StartsAt: s.since,
+			})
+		}
+	}
+	for _, t := range targets {
+		stats, _ := t.LastStats()
+		if stats == nil {
+			continue
+		}
+		node := t.Endpoint().Node
+		for _, topic := range stats.Topics {
+			for _, ch := range topic.Channels {
+				where := fmt.Sprintf("Channel %s/%s on %s", topic.TopicName, ch.ChannelName, node)
+				check(alertKey{"NSQChannelDepthHigh", node, topic.TopicName, ch.ChannelName},
+					ch.Depth > int64(cfg.DepthThreshold), time.Duration(cfg.DepthFor), ch.Depth,
+					fmt.Sprintf("%s holds more than %d messages", where, cfg.DepthThreshold))
+				check(alertKey{"NSQChannelNoConsumers", node, topic.TopicName, ch.ChannelName},
+					ch.ClientCount == 0 && ch.Depth > 0, time.Duration(cfg.NoConsumersFor), ch.Depth,
+					where+" has messages but no consumers")
+			}
+		}
+	}
+	for key, s := range a.states {
+		if met[key] {
+			continue
+		}
+		if s.firing {
+			end := now
+			changes = append(changes, webhookAlert{
+				Status: "resolved", Alert: key.alert, Node: key.node, Topic: key.topic, Channel: key.channel,
+				StartsAt: s.since, EndsAt: &end,
+			})
+		}
+		delete(a.states, key)
+	}
+	return changes
+}
+
+// alertLoop evaluates the alerts after every poll of c and sends the
+// alerts that started or stopped firing to --alerts.webhook-url, until
+// stop is closed.
+func alertLoop(logger *slog.Logger, c *collector.Collector, stop <-chan struct{}) {
+	a := &alerter{states: make(map[alertKey]*alertState)}
+	client := &http.Client{}
+	for {
+		select {
+		case <-c.Polled():
+		case <-stop:
+			return
+		}
+		cfg := &Config{}
+		if loaded := loadedConfig.Load(); loaded != nil {
+			cfg = loaded
+		}
+		alerts := a.evaluate(cfg.Alerts.withDefaults(), c.Targets(), time.Now())
+		if len(alerts) == 0 {
+			continue
+		}
+		if err := sendAlerts(client, alerts); err != nil {
+			logger.Error("Error sending alerts to the webhook", "alerts", len(alerts), "err", err)
+		}
+	}
+}
+
+// sendAlerts POSTs alerts to the webhook as {"alerts": [...]}.
+func sendAlerts(client *http.Client, alerts []webhookAlert) error {
+	body, err := json.Marshal(struct {
+		Alerts []webhookAlert `json:"alerts"`
+	}{alerts})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *alertsWebhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, *alertsWebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create webhook request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "nsq_exporter/"+version.Version)
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send alerts: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("webhook returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}